@@ -0,0 +1,86 @@
+package lampshade
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// ackShardDepth is how many acks each shard buffers
+	ackShardDepth = 16
+)
+
+// ackShards spreads the acks of a session's streams across several buffered
+// channels so that, on sessions with many streams, receive buffers don't all
+// contend for the single channel that the session's sendLoop reads from.
+// Streams are assigned to shards by id. Like the scheduler, ackShards is
+// passive: after queueing an ack, a receive buffer signals ready and the
+// sendLoop then pulls pending acks with next.
+type ackShards struct {
+	shards   []chan []byte
+	ready    chan struct{}
+	signaled int32
+	nextIdx  int // only accessed from the sendLoop
+}
+
+// newAckShards returns ackShards with the given number of shards, or nil if
+// numShards <= 1, in which case acks go through the session's out channel.
+func newAckShards(numShards int) *ackShards {
+	if numShards <= 1 {
+		return nil
+	}
+	as := &ackShards{
+		shards: make([]chan []byte, numShards),
+		ready:  make(chan struct{}, 1),
+	}
+	for i := range as.shards {
+		as.shards[i] = make(chan []byte, ackShardDepth)
+	}
+	return as
+}
+
+// shardFor returns the channel to which the stream with the given id should
+// send its acks.
+func (as *ackShards) shardFor(id uint16) chan []byte {
+	return as.shards[int(id)%len(as.shards)]
+}
+
+// readyCh returns the channel that's signaled when acks are pending. It's nil
+// if sharding is disabled, so that selecting on it blocks forever.
+func (as *ackShards) readyCh() <-chan struct{} {
+	if as == nil {
+		return nil
+	}
+	return as.ready
+}
+
+// signal notifies the sendLoop that acks are pending. Only the first signal
+// since the sendLoop last looked touches the ready channel.
+func (as *ackShards) signal() {
+	if atomic.CompareAndSwapInt32(&as.signaled, 0, 1) {
+		select {
+		case as.ready <- struct{}{}:
+		default:
+			// already signaled
+		}
+	}
+}
+
+// next returns the next pending ack, visiting shards in round-robin order, or
+// nil if no acks are pending.
+func (as *ackShards) next() []byte {
+	// clear before looking so that acks queued after we've looked at their
+	// shard signal again
+	atomic.StoreInt32(&as.signaled, 0)
+	for i := 0; i < len(as.shards); i++ {
+		shard := as.shards[as.nextIdx]
+		as.nextIdx = (as.nextIdx + 1) % len(as.shards)
+		select {
+		case frame := <-shard:
+			// there may be more
+			as.signal()
+			return frame
+		default:
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package lampshade
+
+import (
+	"errors"
+	"hash/crc32"
+)
+
+const (
+	// checksumSize is the size of the checksum at the end of each session
+	// frame's Frames when checksums are enabled, see "Checksums" in the package
+	// docs
+	checksumSize = 4
+
+	// flagChecksums is the bit in the client init message's Flags that enables
+	// checksums
+	flagChecksums = 1 << 0
+
+	// knownFlags are all of the Flags that we understand
+	knownFlags = flagChecksums | flagAcceptPush
+)
+
+var (
+	checksumFailures int64
+
+	checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errChecksumMismatch = errors.New("session frame checksum mismatch")
+)
+
+// appendChecksum appends the checksum of framesData to it. There's always room
+// for it, since the checksum is accounted for in the session's cipherOverhead.
+func appendChecksum(framesData []byte) []byte {
+	n := len(framesData)
+	framesData = framesData[:n+checksumSize]
+	binaryEncoding.PutUint32(framesData[n:], crc32.Checksum(framesData[:n], checksumTable))
+	return framesData
+}
+
+// verifyChecksum checks the checksum at the end of a received session frame's
+// Frames and strips it.
+func verifyChecksum(framesData []byte) ([]byte, error) {
+	if len(framesData) < checksumSize {
+		return nil, errChecksumMismatch
+	}
+	framesData, checksum := consume(framesData, len(framesData)-checksumSize)
+	if binaryEncoding.Uint32(checksum) != crc32.Checksum(framesData, checksumTable) {
+		return nil, errChecksumMismatch
+	}
+	return framesData, nil
+}
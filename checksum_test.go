@@ -0,0 +1,110 @@
+package lampshade
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// corruptingConn flips a bit in the last byte of Frames of each session frame
+// that's written while corrupt is set. That's right in front of the checksum,
+// since NoEncryption doesn't add a MAC.
+type corruptingConn struct {
+	net.Conn
+	corrupt int32
+}
+
+func (conn *corruptingConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&conn.corrupt) == 1 && len(b) > lenSize+checksumSize {
+		corrupted := append([]byte(nil), b...)
+		corrupted[len(corrupted)-checksumSize-1] ^= 1
+		b = corrupted
+	}
+	return conn.Conn.Write(b)
+}
+
+func TestChecksums(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.Cipher = NoEncryption
+		opts.ProtocolVersion = checksumVersion
+		opts.Checksums = true
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	var wrapped *corruptingConn
+	conn, err := d.Dial(func() (net.Conn, error) {
+		conn, dialErr := dial()
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		wrapped = &corruptingConn{Conn: conn}
+		return wrapped, nil
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	data := make([]byte, 2*testWindowSize*MaxDataLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go conn.Write(data)
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(conn, received)
+	require.NoError(t, err)
+	assert.Equal(t, data, received, "checksummed frames should get through in both directions")
+
+	// without the checksum, the server would happily pass along the corrupted
+	// data
+	before := ReadGlobalStats().ChecksumFailures
+	atomic.StoreInt32(&wrapped.corrupt, 1)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	assert.Error(t, err, "server should have closed the session instead of echoing corrupted data")
+	assert.Equal(t, int64(1), ReadGlobalStats().ChecksumFailures-before)
+}
+
+func TestVerifyChecksum(t *testing.T) {
+	b := make([]byte, 5, 5+checksumSize)
+	copy(b, "hello")
+	checksummed := appendChecksum(b)
+	require.Len(t, checksummed, 5+checksumSize)
+
+	verified, err := verifyChecksum(checksummed)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(verified))
+
+	checksummed[1] ^= 1
+	_, err = verifyChecksum(checksummed)
+	assert.Equal(t, errChecksumMismatch, err)
+	_, err = verifyChecksum(checksummed[:checksumSize-1])
+	assert.Equal(t, errChecksumMismatch, err, "frames too short to even have a checksum")
+}
+
+func TestClientInitMsgFlags(t *testing.T) {
+	pk := testPrivateKey(t)
+	cs, err := newCryptoSpec(NoEncryption)
+	require.NoError(t, err)
+	paddings := []InitMsgPadding{PaddingOAEPSHA256}
+
+	msg, err := buildClientInitMsg(&pk.PublicKey, PaddingOAEPSHA256, checksumVersion, 1000, 32, flagChecksums, cs, time.Time{})
+	require.NoError(t, err)
+	_, _, flags, _, _, _, err := decodeClientInitMsg(pk, paddings, msg)
+	require.NoError(t, err)
+	assert.Equal(t, byte(flagChecksums), flags)
+
+	_, err = buildClientInitMsg(&pk.PublicKey, PaddingOAEPSHA256, rekeyVersion, 1000, 32, flagChecksums, cs, time.Time{})
+	assert.Error(t, err, "versions before Flags can't carry any")
+
+	msg, err = buildClientInitMsg(&pk.PublicKey, PaddingOAEPSHA256, checksumVersion, 1000, 32, 1<<7, cs, time.Time{})
+	require.NoError(t, err)
+	_, _, _, _, _, _, err = decodeClientInitMsg(pk, paddings, msg)
+	assert.Error(t, err, "unknown flags should be rejected")
+}
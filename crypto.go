@@ -5,8 +5,11 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"time"
 
 	"github.com/aead/chacha20"
@@ -14,6 +17,10 @@ import (
 	"golang.org/x/crypto/chacha20poly1305"
 )
 
+// ErrUnsupportedVersion indicates that a client init message uses a newer
+// protocol version than this server supports.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
 var newSecret = _newSecret
 
 // Cipher specifies a stream cipher
@@ -70,6 +77,54 @@ func (c Cipher) String() string {
 	}
 }
 
+// InitMsgPadding specifies the RSA padding scheme used for encrypting the
+// client init message.
+type InitMsgPadding byte
+
+func (p InitMsgPadding) hash() hash.Hash {
+	switch p {
+	case PaddingOAEPSHA1:
+		return sha1.New()
+	default:
+		return sha256.New()
+	}
+}
+
+func (p InitMsgPadding) encrypt(pub *rsa.PublicKey, msg []byte) ([]byte, error) {
+	switch p {
+	case PaddingOAEPSHA256, PaddingOAEPSHA1:
+		return rsa.EncryptOAEP(p.hash(), rand.Reader, pub, msg, nil)
+	case PaddingPKCS1v15:
+		return rsa.EncryptPKCS1v15(rand.Reader, pub, msg)
+	default:
+		return nil, fmt.Errorf("Unknown init msg padding: %d", p)
+	}
+}
+
+func (p InitMsgPadding) decrypt(priv *rsa.PrivateKey, msg []byte) ([]byte, error) {
+	switch p {
+	case PaddingOAEPSHA256, PaddingOAEPSHA1:
+		return rsa.DecryptOAEP(p.hash(), rand.Reader, priv, msg, nil)
+	case PaddingPKCS1v15:
+		return rsa.DecryptPKCS1v15(rand.Reader, priv, msg)
+	default:
+		return nil, fmt.Errorf("Unknown init msg padding: %d", p)
+	}
+}
+
+func (p InitMsgPadding) String() string {
+	switch p {
+	case PaddingOAEPSHA256:
+		return "OAEP_SHA256"
+	case PaddingOAEPSHA1:
+		return "OAEP_SHA1"
+	case PaddingPKCS1v15:
+		return "PKCS1v15"
+	default:
+		return "unknown"
+	}
+}
+
 // cryptoSpec encodes all the crypto configuration for a session.
 type cryptoSpec struct {
 	cipherCode Cipher
@@ -271,13 +326,27 @@ func nonceGenerator(iv []byte) func() []byte {
 	}
 }
 
-func buildClientInitMsg(serverPublicKey *rsa.PublicKey, windowSize int, maxPadding int, cs *cryptoSpec, ts time.Time) ([]byte, error) {
+func buildClientInitMsg(serverPublicKey *rsa.PublicKey, padding InitMsgPadding, version int, windowSize int, maxPadding int, flags byte, cs *cryptoSpec, ts time.Time) ([]byte, error) {
+	if version < 0 || version > protocolVersion {
+		return nil, fmt.Errorf("%v: %d", ErrUnsupportedVersion, version)
+	}
+	if windowSize > maxInitWindowSize {
+		return nil, fmt.Errorf("Window size %d exceeds maximum of %d", windowSize, maxInitWindowSize)
+	}
+	if flags != 0 && version < checksumVersion {
+		return nil, fmt.Errorf("Flags require version %d, not %d", checksumVersion, version)
+	}
 	var plainText []byte
 	_windowSize := make([]byte, winSize)
 	binaryEncoding.PutUint32(_windowSize, uint32(windowSize))
+	// the version takes the place of the unused most significant byte
+	_windowSize[0] = byte(version)
 	plainText = append(plainText, _windowSize...)
 	plainText = append(plainText, byte(maxPadding))
 	plainText = append(plainText, byte(cs.cipherCode))
+	if version >= checksumVersion {
+		plainText = append(plainText, flags)
+	}
 	plainText = append(plainText, cs.secret...)
 	plainText = append(plainText, cs.metaSendIV...)
 	plainText = append(plainText, cs.dataSendIV...)
@@ -288,27 +357,47 @@ func buildClientInitMsg(serverPublicKey *rsa.PublicKey, windowSize int, maxPaddi
 		binaryEncoding.PutUint64(_ts, uint64(ts.Unix()))
 		plainText = append(plainText, _ts...)
 	}
-	cipherText, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, serverPublicKey, plainText, nil)
+	cipherText, err := padding.encrypt(serverPublicKey, plainText)
 	if err != nil {
 		return nil, fmt.Errorf("Unable to encrypt init msg: %v", err)
 	}
 	return cipherText, nil
 }
 
-func decodeClientInitMsg(serverPrivateKey *rsa.PrivateKey, msg []byte) (windowSize int, maxPadding int, cs *cryptoSpec, ts time.Time, err error) {
-	pt, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, serverPrivateKey, msg, nil)
+// decodeClientInitMsg decodes the client init message, trying each of the
+// accepted paddings in order.
+func decodeClientInitMsg(serverPrivateKey *rsa.PrivateKey, paddings []InitMsgPadding, msg []byte) (windowSize int, maxPadding int, flags byte, cs *cryptoSpec, ts time.Time, version int, err error) {
+	var pt []byte
+	for _, padding := range paddings {
+		pt, err = padding.decrypt(serverPrivateKey, msg)
+		if err == nil {
+			break
+		}
+	}
 	if err != nil {
-		return 0, 0, nil, time.Time{}, fmt.Errorf("Unable to decrypt init message: %v", err)
+		return 0, 0, 0, nil, time.Time{}, 0, fmt.Errorf("Unable to decrypt init message: %v", err)
 	}
 	_windowSize, pt := consume(pt, winSize)
-	windowSize = int(binaryEncoding.Uint32(_windowSize))
+	version = int(_windowSize[0])
+	if version > protocolVersion {
+		return 0, 0, 0, nil, time.Time{}, 0, fmt.Errorf("%v: %d", ErrUnsupportedVersion, version)
+	}
+	windowSize = int(binaryEncoding.Uint32(_windowSize) & maxInitWindowSize)
 	_maxPadding, pt := consume(pt, 1)
 	maxPadding = int(_maxPadding[0])
 	_cipherCode, pt := consume(pt, 1)
 	cs = &cryptoSpec{}
 	cs.cipherCode = Cipher(_cipherCode[0])
 	if !cs.cipherCode.valid() {
-		return 0, 0, nil, time.Time{}, fmt.Errorf("Unknown cipher code: %d", cs.cipherCode)
+		return 0, 0, 0, nil, time.Time{}, 0, fmt.Errorf("Unknown cipher code: %d", cs.cipherCode)
+	}
+	if version >= checksumVersion {
+		var _flags []byte
+		_flags, pt = consume(pt, 1)
+		flags = _flags[0]
+		if flags&^knownFlags != 0 {
+			return 0, 0, 0, nil, time.Time{}, 0, fmt.Errorf("Unknown flags: %d", flags)
+		}
 	}
 	ivSize := cs.cipherCode.ivSize()
 	cs.secret, pt = consume(pt, maxSecretSize)
@@ -0,0 +1,44 @@
+package lampshade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientInitMsgVersion(t *testing.T) {
+	pk := testPrivateKey(t)
+	cs, err := newCryptoSpec(AES128GCM)
+	require.NoError(t, err)
+	paddings := []InitMsgPadding{PaddingOAEPSHA256}
+
+	msg, err := buildClientInitMsg(&pk.PublicKey, PaddingOAEPSHA256, protocolVersion, 1000, 32, 0, cs, time.Time{})
+	require.NoError(t, err)
+	windowSize, maxPadding, _, decoded, _, version, err := decodeClientInitMsg(pk, paddings, msg)
+	require.NoError(t, err)
+	assert.Equal(t, 1000, windowSize)
+	assert.Equal(t, 32, maxPadding)
+	assert.Equal(t, cs.secret, decoded.secret)
+	assert.Equal(t, protocolVersion, version)
+
+	// older versions are still accepted
+	msg, err = buildClientInitMsg(&pk.PublicKey, PaddingOAEPSHA256, 0, 1000, 32, 0, cs, time.Time{})
+	require.NoError(t, err)
+	windowSize, _, _, _, _, version, err = decodeClientInitMsg(pk, paddings, msg)
+	require.NoError(t, err)
+	assert.Equal(t, 1000, windowSize)
+	assert.Equal(t, 0, version)
+
+	_, err = buildClientInitMsg(&pk.PublicKey, PaddingOAEPSHA256, protocolVersion, maxInitWindowSize+1, 32, 0, cs, time.Time{})
+	assert.Error(t, err, "window size shouldn't overflow into the version")
+
+	// a message from a client speaking a future version
+	plainText := make([]byte, 128)
+	plainText[0] = protocolVersion + 1
+	msg, err = InitMsgPadding(PaddingOAEPSHA256).encrypt(&pk.PublicKey, plainText)
+	require.NoError(t, err)
+	_, _, _, _, _, _, err = decodeClientInitMsg(pk, paddings, msg)
+	assert.Contains(t, err.Error(), ErrUnsupportedVersion.Error())
+}
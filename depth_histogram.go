@@ -0,0 +1,106 @@
+package lampshade
+
+import (
+	"math"
+	"sync/atomic"
+)
+
+// numDepthBuckets is the number of buckets in a DepthHistogram, including the
+// unbounded last one
+const numDepthBuckets = 14
+
+var (
+	// DepthBucketBounds are the inclusive upper bounds of the buckets of a
+	// DepthHistogram, in frames. A last bucket without a bound holds everything
+	// larger.
+	DepthBucketBounds = [numDepthBuckets - 1]int{0, 1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024, 2048}
+
+	depthHistograms    int32
+	sendQueueDepths    depthHistogram
+	receiveQueueDepths depthHistogram
+)
+
+// SetDepthHistograms enables or disables recording the depths of Streams'
+// send and receive queues into the histograms in GlobalStats. Send queues are
+// sampled whenever a Write queues a frame, counting the frames that are queued
+// but haven't been handed to the Session yet. Receive queues are sampled
+// whenever a frame arrives, counting the frames that are waiting to be read.
+// Each sample costs a few atomic operations, so this is disabled by default.
+// Whatever was recorded is kept when disabling.
+func SetDepthHistograms(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+	}
+	atomic.StoreInt32(&depthHistograms, v)
+}
+
+// DepthHistogram is a snapshot of how the depth of a kind of queue was
+// distributed over all of the samples taken, see SetDepthHistograms.
+type DepthHistogram struct {
+	// Counts holds the number of samples in each bucket, see
+	// DepthBucketBounds. It has one more entry than DepthBucketBounds.
+	Counts []int64
+
+	// Sum is the sum of all of the sampled depths.
+	Sum int64
+}
+
+// Count returns the total number of samples.
+func (h DepthHistogram) Count() int64 {
+	var count int64
+	for _, c := range h.Counts {
+		count += c
+	}
+	return count
+}
+
+// Quantile returns the upper bound of the bucket that contains the q-quantile
+// (0 <= q <= 1) of the samples, for example 0.99 for p99. It returns 0 if
+// there are no samples and math.MaxInt32 if the quantile falls into the last,
+// unbounded bucket.
+func (h DepthHistogram) Quantile(q float64) int {
+	count := h.Count()
+	if count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(count)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.Counts[:len(DepthBucketBounds)] {
+		seen += c
+		if seen >= rank {
+			return DepthBucketBounds[i]
+		}
+	}
+	return math.MaxInt32
+}
+
+// depthHistogram accumulates samples for a DepthHistogram.
+type depthHistogram struct {
+	counts [numDepthBuckets]int64
+	sum    int64
+}
+
+// record adds a sample of the given depth, if histograms are enabled.
+func (h *depthHistogram) record(depth int) {
+	if atomic.LoadInt32(&depthHistograms) == 0 {
+		return
+	}
+	i := 0
+	for i < len(DepthBucketBounds) && depth > DepthBucketBounds[i] {
+		i++
+	}
+	atomic.AddInt64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, int64(depth))
+}
+
+func (h *depthHistogram) snapshot() DepthHistogram {
+	counts := make([]int64, len(h.counts))
+	for i := range h.counts {
+		counts[i] = atomic.LoadInt64(&h.counts[i])
+	}
+	return DepthHistogram{Counts: counts, Sum: atomic.LoadInt64(&h.sum)}
+}
@@ -0,0 +1,30 @@
+package lampshade
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDepthHistogram(t *testing.T) {
+	var h depthHistogram
+	h.record(5)
+	assert.Zero(t, h.snapshot().Count(), "shouldn't record while disabled")
+
+	SetDepthHistograms(true)
+	defer SetDepthHistograms(false)
+	for depth := 0; depth < 100; depth++ {
+		h.record(depth)
+	}
+	h.record(5000)
+	snapshot := h.snapshot()
+	assert.EqualValues(t, 101, snapshot.Count())
+	assert.EqualValues(t, 99*100/2+5000, snapshot.Sum)
+	assert.EqualValues(t, 1, snapshot.Counts[0], "only 0 should be in the first bucket")
+	assert.EqualValues(t, 2, snapshot.Counts[3], "3 through 4 should be in the 4 bucket")
+	assert.Equal(t, 64, snapshot.Quantile(0.5))
+	assert.Equal(t, 128, snapshot.Quantile(0.99))
+	assert.Equal(t, math.MaxInt32, snapshot.Quantile(1))
+	assert.Zero(t, DepthHistogram{}.Quantile(0.5))
+}
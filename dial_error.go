@@ -0,0 +1,56 @@
+package lampshade
+
+import (
+	"fmt"
+)
+
+// DialError is returned by Dialers with DialerOpts.DetailedDialErrors when a
+// dial fails for lack of a session. It describes the state of the Dialer at
+// the time of the failure. Unwrap returns the underlying cause, so errors.Is
+// and errors.As see through it, for example to ErrSessionRateLimited or
+// ErrDialTimeout.
+type DialError struct {
+	// Err is the reason why the dial failed.
+	Err error
+
+	// OpenSessions is the number of Sessions that were open, including ones
+	// that have been retired but still have Streams.
+	OpenSessions int
+
+	// PendingSessions is the number of Sessions that were being established.
+	PendingSessions int
+
+	// ConsecutiveFailures is the number of attempts to start a Session that
+	// failed in a row, 0 if the most recent attempt succeeded.
+	ConsecutiveFailures int
+
+	// LastSessionError is the error from the most recent attempt to start a
+	// Session, or nil if it succeeded. It can differ from Err, for example when
+	// the dial's context expired while waiting for a Session.
+	LastSessionError error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("%v (open sessions: %d, pending sessions: %d, consecutive session failures: %d)",
+		e.Err, e.OpenSessions, e.PendingSessions, e.ConsecutiveFailures)
+}
+
+func (e *DialError) Unwrap() error {
+	return e.Err
+}
+
+// dialError wraps err in a DialError if DetailedDialErrors is enabled.
+func (d *dialer) dialError(err error) error {
+	if !d.detailedDialErrors {
+		return err
+	}
+	d.muNumLivePending.Lock()
+	defer d.muNumLivePending.Unlock()
+	return &DialError{
+		Err:                 err,
+		OpenSessions:        d.numOpen,
+		PendingSessions:     d.numPending,
+		ConsecutiveFailures: d.sessionFailures,
+		LastSessionError:    d.lastSessionErr,
+	}
+}
@@ -0,0 +1,64 @@
+package lampshade
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// DialGroup dials Streams that are all pinned to the same Session, so that
+// related Streams share fate: if the Session dies, all of the group's Streams
+// die with it.
+//
+// Dials within a group ignore MaxStreamsPerConn and IdleInterval, so the
+// group keeps using its Session even after the Dialer has rotated to a new
+// one for regular dials. A Session that's been retired stays open for as long
+// as it has open Streams, so the group can keep dialing while any of its
+// Streams remain open. Once the Session has closed or run out of stream IDs,
+// dials fail with ErrConnectionClosed and the caller needs to start a new
+// group.
+type DialGroup interface {
+	// Dial creates a new Stream on the group's Session.
+	Dial() (net.Conn, error)
+
+	// DialWithHeaders is like Dial but attaches the given headers to the new
+	// Stream.
+	DialWithHeaders(headers map[string]string) (net.Conn, error)
+}
+
+type dialGroup struct {
+	session sessionIntf
+	mx      sync.Mutex
+}
+
+func (d *dialer) DialGroup(ctx context.Context, dial DialFN) (DialGroup, error) {
+	s, err := d.getOrCreateSession(ctx, dial)
+	if err != nil {
+		return nil, err
+	}
+	d.returnSession(s)
+	return &dialGroup{session: s}, nil
+}
+
+func (g *dialGroup) Dial() (net.Conn, error) {
+	return g.DialWithHeaders(nil)
+}
+
+func (g *dialGroup) DialWithHeaders(headers map[string]string) (net.Conn, error) {
+	if encodedHeadersSize(headers) > MaxHeadersSize {
+		return nil, ErrHeadersTooLarge
+	}
+	// hold the lock so that concurrent dials can't exhaust the stream IDs
+	// between checking and creating
+	g.mx.Lock()
+	if !g.session.AllowNewStream(maxClientStreams, 0) {
+		g.mx.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	c, err := g.session.dialStream()
+	g.mx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return withHeaders(c, headers)
+}
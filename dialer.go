@@ -7,23 +7,115 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/l2dy/plampshade/ema"
+	"github.com/l2dy/plampshade/ops"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	minLiveConns = 1
+
+	// minCipherRetryBackoff is how long we wait before trying the primary
+	// cipher again after falling back from it. The backoff doubles with each
+	// consecutive failure up to maxCipherRetryBackoff.
+	minCipherRetryBackoff = 1 * time.Minute
+	maxCipherRetryBackoff = 1 * time.Hour
+
+	// lameDuckRetireInterval is the minimum time between replacing one lame
+	// duck session and the next, see retireLameDuck.
+	lameDuckRetireInterval = 30 * time.Second
 )
 
 var initTS = time.Now
 
+var dialerCount int64
+
 // DialerOpts configures options for creating Dialers
 type DialerOpts struct {
+	// Name - label for this dialer, included in the context of the ops it
+	// creates (as "dialer") and prefixed to its log lines. Useful when a process
+	// uses dialers for several upstreams. Defaults to "dialer-<n>" where n counts
+	// the dialers created by this process.
+	Name string
+
 	// WindowSize - transmit window size in # of frames. If <= 0, defaults to 1250.
 	WindowSize int
 
+	// ReceiveBufferDepth - how many received frames to buffer per stream. This
+	// can be larger than WindowSize to smooth out scheduling, but if it's
+	// smaller, the session stops reading from the physical connection whenever
+	// one stream's buffer is full. If <= 0, defaults to WindowSize.
+	ReceiveBufferDepth int
+
+	// MaxReceiveBufferBytes - if > 0, also limits received frames buffered per
+	// stream by their size in bytes. Once that many bytes are queued, the
+	// stream holds back acks until the reader catches up, so the sender stops
+	// once its window is used up even if fewer than ReceiveBufferDepth frames
+	// are buffered. This bounds memory when frames are large. It's a soft
+	// limit, frames that were acked before it was hit may still push the
+	// buffer past it. If <= 0, only the number of frames is limited.
+	MaxReceiveBufferBytes int
+
+	// UnlimitedWindow - if true, streams never wait for acks before sending,
+	// which avoids ack round trips on loopback or trusted high-bandwidth links
+	// where the receiver keeps up. The only bound is then the receiver's
+	// buffer of WindowSize frames per stream. Once that's full, the receiver
+	// stops reading from the physical connection until it drains, which stalls
+	// all of the session's streams rather than just the slow one.
+	UnlimitedWindow bool
+
+	// SlowStartWindow - if > 0, streams start out with a transmit window of
+	// this many frames instead of the full WindowSize, and the window grows
+	// exponentially as acks arrive until it reaches WindowSize, like TCP slow
+	// start. This avoids overshooting slow links with a burst of WindowSize
+	// frames when a stream starts. The initial window is never less than a
+	// tenth of WindowSize, since that's how often the peer acks. Defaults to 0
+	// (start with the full window). Ignored if UnlimitedWindow is set.
+	SlowStartWindow int
+
+	// InitialBurst - if > 0, the number of frames that a new stream sends
+	// before it waits for the first ack, like TCP's initial window. Unlike
+	// with SlowStartWindow, the window opens up to the full WindowSize as
+	// soon as the first ack arrives. A small burst avoids loss when a stream
+	// starts, a large one gets short transfers done in fewer round trips. The
+	// burst is never less than a tenth of WindowSize, since that's how often
+	// the peer acks. Defaults to 0 (start with the full window). Ignored if
+	// UnlimitedWindow or SlowStartWindow is set.
+	InitialBurst int
+
+	// WindowPolicy - if set, the WindowPolicy that new sessions start out
+	// with, taking precedence over UnlimitedWindow, SlowStartWindow and
+	// InitialBurst, which correspond to UnlimitedWindowPolicy,
+	// SlowStartWindowPolicy and InitialBurstWindowPolicy. The
+	// policy can be changed later on for each session with
+	// Session.SetWindowPolicy. Defaults to FixedWindowPolicy.
+	WindowPolicy WindowPolicy
+
+	// MaxQueuedFrames - if > 0, caps how many frames each stream queues for
+	// sending, after which Write fails with ErrSendBufferFull instead of
+	// blocking until the peer acks. This suits latency-sensitive callers that
+	// would rather drop or redirect data than wait. A stream holds at most
+	// WindowSize + 2 frames of up to MaxDataLen bytes (plus framing) at a time,
+	// so values above WindowSize + 1 have no effect. Defaults to 0 (Write
+	// blocks).
+	MaxQueuedFrames int
+
+	// MaxUnackedBytes - if > 0, each stream stops sending once this many bytes
+	// of data that it sent haven't been acked by the peer yet, on top of the
+	// frame-based transmit window. Since the peer only acks what its
+	// application has read, this bounds how much a stalled reader on the other
+	// end has to buffer in bytes rather than frames, which matters when frame
+	// sizes vary. Since the peer only acks once it has read a tenth of the
+	// window, values below ceil(WindowSize / 10) * MaxDataLen are raised to
+	// that, so that a stream can't end up waiting for an ack that never comes.
+	// It only limits what we send, so the server needs
+	// ListenerOpts.MaxUnackedBytes to protect us in turn. Defaults to 0 (only
+	// the window applies).
+	MaxUnackedBytes int
+
 	// MaxPadding - maximum random padding to use when necessary.
 	MaxPadding int
 
@@ -31,30 +123,298 @@ type DialerOpts struct {
 	// new streams can be created. If <=0, defaults to 1.
 	MaxLiveConns int
 
+	// SessionPool - if set, the Dialer uses the sessions of this pool, which
+	// it shares with every other Dialer created with the same pool, rather
+	// than managing sessions of its own. All other options, including Name,
+	// are ignored in favor of the ones that the pool was created with, and
+	// NewDialer logs an error if any of them are set. Defaults to nil (the
+	// Dialer has sessions of its own).
+	SessionPool *SessionPool
+
+	// SessionPolicy - how new streams are assigned to the live physical
+	// connections when MaxLiveConns > 1, see SpreadSessions and FillSessions
+	// for the tradeoffs. Defaults to SpreadSessions.
+	SessionPolicy SessionPolicy
+
+	// SoftStreamsPerConn - with FillSessions, the number of open streams at
+	// which a physical connection counts as full, so that new streams spill
+	// over onto the next one. Unlike MaxStreamsPerConn, this counts streams
+	// that are currently open and the connection keeps getting used as long
+	// as there's nothing better. If <= 0, defaults to 100.
+	SoftStreamsPerConn int
+
 	// MaxStreamsPerConn - limits the number of streams per physical connection.
-	//                     If <=0, defaults to max uint16.
+	//                     Once a session has had this many streams, the next
+	//                     dial retires it and opens a new one, see
+	//                     FailOnRotation. If <=0 or > 32768, defaults to
+	//                     32768, the number of stream IDs available to the
+	//                     client (see "Stream IDs").
 	MaxStreamsPerConn uint16
 
 	// IdleInterval - If we haven't dialed any new connections within this
 	//                interval, open a new physical connection on the next dial.
 	IdleInterval time.Duration
 
+	// ValidateSession - optional check that's run on a live session before
+	// opening a new stream on it, for catching sessions that have gone stale
+	// without the dialer noticing, for example because the network silently
+	// dropped the physical connection. If it returns false, the session is
+	// retired like one that reached MaxStreamsPerConn, so its existing streams
+	// can finish, and the dial waits for a new session. It's called on every
+	// dial that reuses a session, so it should be cheap, for example checking
+	// Session.LastActivity. Defaults to nil (no validation).
+	ValidateSession func(s Session) bool
+
+	// MaxSessions - hard cap on the number of physical connections that may be
+	// open at the same time, including ones that have been retired but are
+	// still draining their streams. Once the cap is reached, sessions keep
+	// getting used past MaxStreamsPerConn and IdleInterval for as long as they
+	// can, and otherwise dials wait for a session to close. If <= 0, there's no
+	// cap.
+	MaxSessions int
+
+	// MaxPendingSessions - if > 0, limits how many sessions may be in the
+	// process of being established at the same time. Concurrent dials that
+	// need a new session always share the ones that are pending, but with
+	// MaxLiveConns > 1, dials that keep waiting start additional sessions every
+	// RedialSessionInterval, which can add up to a burst of physical
+	// connections while handshakes are slow. Setting this to 1 makes all of
+	// them wait for a single handshake instead. Defaults to 0 (only limited by
+	// MaxLiveConns).
+	MaxPendingSessions int
+
+	// MaxSessionRate - if > 0, caps how many new physical connections the dialer
+	// opens per second, no matter whether they succeed, to protect servers from
+	// connection storms like many clients reconnecting at once. Up to
+	// SessionBurst connections may be opened back to back, after which new
+	// connections are spaced out to the rate. Unlike backing off after
+	// failures, this applies even when dialing succeeds. Dials that need a new
+	// session wait for the rate to allow one, unless FailOnSessionRate is set.
+	// Defaults to 0 (no limit).
+	MaxSessionRate float64
+
+	// SessionBurst - how many new physical connections may be opened at once
+	// before MaxSessionRate applies. Defaults to 1.
+	SessionBurst int
+
+	// FailOnSessionRate - if true, dials that need a new session while
+	// MaxSessionRate is exceeded fail immediately with ErrSessionRateLimited
+	// instead of waiting. Dials that can use an existing session aren't
+	// affected.
+	FailOnSessionRate bool
+
+	// FailOnRotation - if true, a dial that finds that the current session has
+	// reached MaxStreamsPerConn fails with ErrSessionRotated once it has
+	// retired that session and started its replacement, rather than waiting
+	// for the replacement. This tells callers that a rotation happened, for
+	// example to count rotations or to reestablish affinity to a connection.
+	// Subsequent dials use the new session. Defaults to false (rotate
+	// silently).
+	FailOnRotation bool
+
+	// OnSessionRotated - optional callback that's invoked whenever a dial
+	// retires a session because it reached MaxStreamsPerConn, for example to
+	// count rotations or to drop assumptions about connection affinity.
+	// Sessions that are retired for other reasons, like IdleInterval,
+	// ValidateSession or lame duck mode, aren't reported. It's called from the
+	// dial that noticed, before that dial continues on another session, so it
+	// should be quick. Unlike FailOnRotation, it doesn't affect the dial.
+	// Defaults to nil.
+	OnSessionRotated func(s Session)
+
+	// SessionFactory - optional factory for the sessions that dials open
+	// streams on, for plugging in custom or mock sessions for experimentation
+	// and testing. Sessions from a SessionFactory don't count towards
+	// MaxSessions and don't show up in Dump, and options that need the
+	// built-in session, like ValidateSession, OnSessionRotated, lame duck
+	// handling and headers, don't apply to them. HealthCheck always uses the
+	// built-in session. Defaults to nil, which uses the built-in session.
+	SessionFactory SessionFactory
+
+	// DetailedDialErrors - if true, dials that fail because no session could
+	// be established return a *DialError that describes the state of the
+	// Dialer, such as how many sessions are open and how many attempts to start
+	// one have failed in a row. It unwraps to the underlying error. Defaults to
+	// false (return the underlying error as is).
+	DetailedDialErrors bool
+
 	// PingInterval - how frequently to ping to calculate RTT, set to 0 to disable
 	PingInterval time.Duration
 
+	// KeepAliveInterval - if > 0, an empty frame is sent whenever nothing else
+	// has been sent on a session for this long, to keep middleboxes like NATs
+	// from dropping idle connections. Peers ignore these frames. Defaults to 0
+	// (disabled).
+	KeepAliveInterval time.Duration
+
+	// WriteStallTimeout - if > 0, a session whose physical connection doesn't
+	// finish writing a session frame within this long is considered stuck. The
+	// physical connection is closed to unblock the write and reads and writes
+	// on all of the session's streams fail with ErrSessionStalled, rather than
+	// waiting for the write indefinitely. Should be generous enough to allow
+	// for a full session frame on the slowest link that's expected. Defaults to
+	// 0 (wait as long as the physical connection does).
+	WriteStallTimeout time.Duration
+
+	// StreamIdleTimeout - if > 0, streams on which no data has been sent or
+	// received for this long are reset, which frees their buffers on sessions
+	// with many abandoned streams. Reads and writes on a reset stream fail with
+	// ErrStreamIdle. Streams are checked every half of this, so a stream may be
+	// idle for up to one and a half times this long before it's reset. Streams
+	// that have been paused with Stream.Pause are left alone. Defaults to 0
+	// (streams may stay idle indefinitely).
+	StreamIdleTimeout time.Duration
+
+	// MaxSessionFrameSize - if > 0, no session frame that we send is larger
+	// than this many bytes, counting Len, padding, the MAC and the checksum.
+	// Set it to what fits into a datagram on the path (for example the path
+	// MTU minus IP and UDP headers) for transports that would otherwise
+	// fragment. Writes are split into correspondingly smaller frames and fewer
+	// frames get coalesced, which costs some efficiency. Headers that don't fit
+	// make dials fail with ErrHeadersTooLarge. The client init message that
+	// precedes the first session frame isn't counted. Values below 256 are
+	// raised to 256. Only limits what we send, the peer has its own setting.
+	// Defaults to 0 (session frames of up to 64KB).
+	MaxSessionFrameSize int
+
+	// AckJitter - if > 0, acks are delayed by a random duration up to this
+	// value to avoid bursts of acks when many streams ack at the same time.
+	// Defaults to 0 (no jitter).
+	AckJitter time.Duration
+
+	// AckShards - if > 1, acks from a session's streams are spread across this
+	// many channels instead of all going through the one channel that feeds
+	// the session's writer, which reduces contention on sessions with
+	// thousands of busy streams. Defaults to 0 (a single channel).
+	AckShards int
+
+	// FramePriority - the order in which the session's writer picks frames when
+	// frames of several classes are waiting to be sent, highest priority first.
+	// The priority is strict, so a steady supply of higher priority frames
+	// holds back lower priority ones. Classes that are left out are appended in
+	// their order in DefaultFramePriority. Defaults to DefaultFramePriority
+	// (control, then acks, then data).
+	FramePriority []FrameClass
+
+	// AdaptiveAcks - if true, streams adapt how often they ack to how quickly
+	// the application reads from them. Readers that keep up ack as often as
+	// every quarter of the regular interval (a tenth of the window), which
+	// keeps the sender's window open, while readers that fall behind ack at
+	// the regular interval to save overhead. Defaults to false (always ack at
+	// the regular interval).
+	AdaptiveAcks bool
+
+	// RekeyBytes - if > 0, sessions switch to a new key for sending after
+	// sending this many bytes with the current one, see "Rekeying" in the
+	// package docs. This keeps very long-lived sessions from encrypting
+	// unbounded amounts of data with the same key. Requires ProtocolVersion 3
+	// or later and a cipher other than NoEncryption. Defaults to 0 (never rekey
+	// based on volume).
+	RekeyBytes int64
+
+	// RekeyInterval - if > 0, sessions switch to a new key for sending once
+	// they've been sending with the current one for this long. Like RekeyBytes,
+	// this requires ProtocolVersion 3 or later. Sessions only rekey when they
+	// send something, so idle sessions keep their key. Defaults to 0 (never
+	// rekey based on time).
+	RekeyInterval time.Duration
+
+	// Checksums - if true, every session frame in either direction carries a
+	// CRC-32C checksum that's verified on receipt, see "Checksums" in the
+	// package docs. This catches corruption that the transport or a
+	// FrameInterceptor introduces, which matters most with NoEncryption since
+	// the AEAD ciphers already authenticate everything. Requires
+	// ProtocolVersion 4 or later. Defaults to false, since reliable transports
+	// don't need the overhead.
+	Checksums bool
+
+	// AcceptPushedStreams - if true, the server may open streams to us on our
+	// sessions, which we pick up with Session.AcceptStream, see "Pushed
+	// Streams" in the package docs. Requires ProtocolVersion 5 or later.
+	// Defaults to false, in which case the server can't push streams and any
+	// that it tries to push anyway are rejected.
+	AcceptPushedStreams bool
+
+	// DialTimeout - if > 0, the dialer gives up on a DialFN that hasn't returned
+	// a physical connection within this long and fails with ErrDialTimeout,
+	// regardless of whether the DialFN honors any timeouts of its own. A
+	// connection that the DialFN returns after that is closed. Defaults to 0
+	// (wait for the DialFN however long it takes).
+	DialTimeout time.Duration
+
 	// RedialSessionInterval - how frequently to redial a new session when
 	// there's no live session, for faster recovery after network failures.
 	// Defaults to 5 seconds.
 	RedialSessionInterval time.Duration
 
+	// FrameInterceptor - optional hook for observing and modifying frames, for
+	// testing and diagnostics only.
+	FrameInterceptor FrameInterceptor
+
+	// OnFrameDropped - optional callback for diagnosing data loss, invoked
+	// whenever a frame for the given stream is dropped rather than delivered or
+	// sent, see FrameDropReason for the reasons. It's called from the
+	// session's goroutines, so it must be quick and must not block. Defaults to
+	// nil, in which case drops are only counted in GlobalStats where noted.
+	OnFrameDropped func(streamID uint16, reason FrameDropReason)
+
+	// StreamLogLevel - if set, every stream that's opened or closed is logged
+	// at this level with structured fields for audit trails: session_id (the
+	// same as SessionDump.ID) and stream_id to correlate the two, remote_addr,
+	// name (if Name is set) and, on close, bytes_read, bytes_written,
+	// duration_seconds and close_reason. The reason is "closed" if the stream
+	// was closed locally, "closed by peer", "session closed", or the error from
+	// ResetAll, WriteStallTimeout or StreamIdleTimeout. Defaults to
+	// logrus.PanicLevel, the zero value, which disables the logging so that
+	// busy sessions don't pay for it.
+	StreamLogLevel log.Level
+
+	// Hooks - optional callbacks for observing sessions and streams as they
+	// open and close, for example for tracing. Defaults to nil.
+	Hooks *LifecycleHooks
+
 	// Pool - BufferPool to use (required)
 	Pool BufferPool
 
-	// Cipher - which cipher to use, 1 = AES128 in CTR mode, 2 = ChaCha20
+	// Cipher - which AEAD cipher to use for authenticating and encrypting
+	// frames, AES128GCM or ChaCha20Poly1305. Frames that fail authentication
+	// cause the session to be reset. NoEncryption disables encryption and
+	// authentication, which is only appropriate for trusted links. Defaults to
+	// AES128GCM.
 	Cipher Cipher
 
+	// FallbackCiphers - opt-in list of ciphers to fall back to, in order, on
+	// networks that interfere with the handshake. Whenever the server closes a
+	// session that used the current cipher after streams were opened on it but
+	// without ever having responded, the dialer moves on to the next cipher for
+	// subsequent sessions and logs the downgrade. After falling back from
+	// Cipher, it periodically tries Cipher again for a single session, backing
+	// off from 1 minute up to 1 hour while that keeps failing, and moves back
+	// to Cipher as soon as a session using it gets a response.
+	// Including NoEncryption here allows downgrading to plaintext, which
+	// exposes all traffic to the network, so only do that if that's
+	// acceptable.
+	FallbackCiphers []Cipher
+
 	// ServerPublicKey - if provided, this dialer will use encryption.
 	ServerPublicKey *rsa.PublicKey
+
+	// InitMsgPadding - RSA padding scheme for encrypting the client init
+	// message. Defaults to PaddingOAEPSHA256. Servers must be configured to
+	// accept whichever padding is used here.
+	InitMsgPadding InitMsgPadding
+
+	// ProtocolVersion - version of the protocol to speak, see "Protocol
+	// Versions" in the package docs. Servers reject versions that are newer
+	// than what they support, so this defaults to 0, which all servers
+	// support. Version 1 lets servers in lame duck mode tell us to dial new
+	// sessions for new streams. Version 2 adds out-of-band data, see
+	// Stream.WriteOOB. Version 3 adds rekeying, see RekeyBytes. Version 4 adds
+	// checksums, see Checksums. Version 5 adds pushed streams, see
+	// AcceptPushedStreams. Version 6 adds ack requests, see Stream.Sync.
+	// Version 7 adds half-closing streams, see Stream.CloseWrite. Version 8
+	// adds headers, see DialWithHeaders.
+	ProtocolVersion int
 }
 
 // NewDialer wraps the given dial function with support for lampshade. The
@@ -66,60 +426,175 @@ type DialerOpts struct {
 //
 // If a new physical connection is needed but can't be established, the dialer
 // returns the underlying dial error.
+//
+// If opts.SessionPool is set, the Dialer shares the pool's sessions and
+// options instead, see SessionPool.
 func NewDialer(opts *DialerOpts) Dialer {
+	if opts.SessionPool != nil {
+		return opts.SessionPool.newDialer(opts)
+	}
+	return newDialer(opts)
+}
+
+func newDialer(opts *DialerOpts) *dialer {
 	if opts.WindowSize <= 0 {
 		opts.WindowSize = defaultWindowSize
 	}
 	if opts.MaxLiveConns <= 0 {
 		opts.MaxLiveConns = 1
 	}
-	if opts.MaxStreamsPerConn <= 0 || opts.MaxStreamsPerConn > maxID {
-		opts.MaxStreamsPerConn = maxID
+	if opts.MaxStreamsPerConn <= 0 || opts.MaxStreamsPerConn > maxClientStreams {
+		opts.MaxStreamsPerConn = maxClientStreams
+	}
+
+	if opts.SoftStreamsPerConn <= 0 {
+		opts.SoftStreamsPerConn = defaultSoftStreamsPerConn
 	}
 
 	if opts.RedialSessionInterval <= 0 {
 		opts.RedialSessionInterval = 5 * time.Second
 	}
-	log.Debugf("Initializing Dialer with   windowSize: %v   maxPadding: %v   maxLiveConns: %v  maxStreamsPerConn: %v   pingInterval: %v   cipher: %v",
+	if opts.Cipher == 0 {
+		opts.Cipher = AES128GCM
+	}
+	if opts.Name == "" {
+		opts.Name = fmt.Sprintf("dialer-%d", atomic.AddInt64(&dialerCount, 1))
+	}
+	log.Debugf("%v: Initializing Dialer with   windowSize: %v   maxPadding: %v   maxLiveConns: %v  maxStreamsPerConn: %v   pingInterval: %v   cipher: %v   initMsgPadding: %v",
+		opts.Name,
 		opts.WindowSize,
 		opts.MaxPadding,
 		opts.MaxLiveConns,
 		opts.MaxStreamsPerConn,
 		opts.PingInterval,
-		opts.Cipher)
+		opts.Cipher,
+		opts.InitMsgPadding)
 	liveSessions := make(chan sessionIntf, opts.MaxLiveConns)
 	liveSessions <- nullSession{}
-	return &dialer{
+	d := &dialer{
+		name:                  opts.Name,
 		windowSize:            opts.WindowSize,
+		windowPolicy:          windowPolicyFor(opts.WindowPolicy, opts.UnlimitedWindow, opts.SlowStartWindow, opts.InitialBurst),
+		maxQueuedFrames:       opts.MaxQueuedFrames,
+		maxUnackedBytes:       opts.MaxUnackedBytes,
+		receiveBufferDepth:    opts.ReceiveBufferDepth,
+		maxReceiveBufferBytes: opts.MaxReceiveBufferBytes,
 		maxPadding:            opts.MaxPadding,
 		maxStreamsPerConn:     opts.MaxStreamsPerConn,
 		maxLiveConns:          opts.MaxLiveConns,
+		sessionPolicy:         opts.SessionPolicy,
+		softStreamsPerConn:    opts.SoftStreamsPerConn,
+		maxSessions:           opts.MaxSessions,
+		maxPendingSessions:    opts.MaxPendingSessions,
+		failOnSessionRate:     opts.FailOnSessionRate,
+		failOnRotation:        opts.FailOnRotation,
+		onSessionRotated:      opts.OnSessionRotated,
+		sessionFactory:        opts.SessionFactory,
+		detailedDialErrors:    opts.DetailedDialErrors,
 		idleInterval:          opts.IdleInterval,
+		validateSession:       opts.ValidateSession,
 		pingInterval:          opts.PingInterval,
+		keepAliveInterval:     opts.KeepAliveInterval,
+		writeStallTimeout:     opts.WriteStallTimeout,
+		streamIdleTimeout:     opts.StreamIdleTimeout,
+		maxSessionFrameSize:   opts.MaxSessionFrameSize,
+		ackJitter:             opts.AckJitter,
+		ackShards:             opts.AckShards,
+		framePriority:         opts.FramePriority,
+		adaptiveAcks:          opts.AdaptiveAcks,
+		rekeyBytes:            opts.RekeyBytes,
+		rekeyInterval:         opts.RekeyInterval,
+		checksums:             opts.Checksums && opts.ProtocolVersion >= checksumVersion,
+		acceptPush:            opts.AcceptPushedStreams && opts.ProtocolVersion >= pushVersion,
+		frameInterceptor:      opts.FrameInterceptor,
+		onFrameDropped:        opts.OnFrameDropped,
+		streamLogLevel:        opts.StreamLogLevel,
+		hooks:                 opts.Hooks,
+		dialTimeout:           opts.DialTimeout,
 		redialSessionInterval: opts.RedialSessionInterval,
 		pool:                  opts.Pool,
-		cipherCode:            opts.Cipher,
+		ciphers:               append([]Cipher{opts.Cipher}, opts.FallbackCiphers...),
 		serverPublicKey:       opts.ServerPublicKey,
+		initMsgPadding:        opts.InitMsgPadding,
+		protocolVersion:       opts.ProtocolVersion,
 		liveSessions:          liveSessions,
 		numLive:               1, // the nullSession
+		sessions:              make(map[*session]bool),
+		idle:                  make(map[*session]bool),
+		sessionClosed:         make(chan struct{}, 1),
 		emaRTT:                ema.NewDuration(0, 0.5),
+		firstResponseTime:     ema.NewDuration(0, 0.5),
+	}
+	if opts.MaxSessionRate > 0 {
+		d.sessionRate = newTokenBucket(opts.MaxSessionRate, opts.SessionBurst)
 	}
+	return d
 }
 
 type dialer struct {
+	// 64 bit fields first so that they're aligned for atomic access
+	handshakeFailures     [numHandshakeFailures]int64
+	firstResponseTime     *ema.EMA
+	name                  string
 	windowSize            int
+	windowPolicy          WindowPolicy
+	maxQueuedFrames       int
+	maxUnackedBytes       int
+	receiveBufferDepth    int
+	maxReceiveBufferBytes int
 	maxPadding            int
 	maxLiveConns          int
+	sessionPolicy         SessionPolicy
+	softStreamsPerConn    int
+	maxSessions           int
+	maxPendingSessions    int
+	sessionRate           *tokenBucket // nil unless MaxSessionRate is set
+	failOnSessionRate     bool
+	failOnRotation        bool
+	onSessionRotated      func(s Session)
+	sessionFactory        SessionFactory
+	detailedDialErrors    bool
 	maxStreamsPerConn     uint16
 	idleInterval          time.Duration
+	validateSession       func(s Session) bool
 	pingInterval          time.Duration
+	keepAliveInterval     time.Duration
+	writeStallTimeout     time.Duration
+	streamIdleTimeout     time.Duration
+	maxSessionFrameSize   int
+	ackJitter             time.Duration
+	ackShards             int
+	framePriority         []FrameClass
+	adaptiveAcks          bool
+	rekeyBytes            int64
+	rekeyInterval         time.Duration
+	frameInterceptor      FrameInterceptor
+	onFrameDropped        func(streamID uint16, reason FrameDropReason)
+	streamLogLevel        log.Level
+	hooks                 *LifecycleHooks
+	dialTimeout           time.Duration
 	redialSessionInterval time.Duration
 	pool                  BufferPool
-	cipherCode            Cipher
+	ciphers               []Cipher
+	cipherIdx             int32
+	muCipher              sync.Mutex
+	primaryFailures       int       // consecutive failures of ciphers[0] since falling back from it
+	retryPrimaryAt        time.Time // when to try ciphers[0] again after falling back, see nextCipherIdx
 	serverPublicKey       *rsa.PublicKey
+	initMsgPadding        InitMsgPadding
+	protocolVersion       int
+	checksums             bool
+	acceptPush            bool
 	muNumLivePending      sync.Mutex
 	numLive               int
 	numPending            int
+	numOpen               int
+	sessions              map[*session]bool // open sessions, for Dump
+	idle                  map[*session]bool // sessions waiting in liveSessions, see putLive
+	lastSessionErr        error             // from the most recent attempt to start a session
+	lastLameDuckRetired   time.Time         // see retireLameDuck
+	sessionFailures       int               // consecutive failed attempts to start a session
+	sessionClosed         chan struct{}
 	liveSessions          chan sessionIntf
 	emaRTT                *ema.EMA
 }
@@ -129,13 +604,27 @@ func (d *dialer) Dial(dial DialFN) (net.Conn, error) {
 }
 
 func (d *dialer) DialContext(ctx context.Context, dial DialFN) (net.Conn, error) {
+	return d.DialWithHeaders(ctx, dial, nil)
+}
+
+func (d *dialer) DialWithHeaders(ctx context.Context, dial DialFN, headers map[string]string) (net.Conn, error) {
+	if encodedHeadersSize(headers) > MaxHeadersSize {
+		return nil, ErrHeadersTooLarge
+	}
+	if len(headers) > 0 && d.protocolVersion < headersVersion {
+		// don't bother with a session, sendHeaders would refuse anyway
+		return nil, ErrHeadersUnsupported
+	}
 	s, err := d.getOrCreateSession(ctx, dial)
 	if err != nil {
-		return nil, err
+		return nil, d.dialError(err)
 	}
-	c := s.CreateStream()
+	c, err := s.dialStream()
 	d.returnSession(s)
-	return c, nil
+	if err != nil {
+		return nil, err
+	}
+	return withHeaders(c, headers)
 }
 
 func (d *dialer) getNumLivePending() int {
@@ -146,61 +635,235 @@ func (d *dialer) getNumLivePending() int {
 }
 
 func (d *dialer) getOrCreateSession(ctx context.Context, dial DialFN) (sessionIntf, error) {
-	newSession := func(cap int) {
+	// newSession starts establishing a new session in the background if we're
+	// below cap. It only fails if the session rate is exceeded and there's no
+	// live or pending session that could serve this dial instead.
+	newSession := func(cap int) error {
 		d.muNumLivePending.Lock()
-		if d.numLive+d.numPending >= cap {
+		if d.numLive+d.numPending >= cap || d.atSessionCap() || d.atPendingCap() {
 			d.muNumLivePending.Unlock()
-			return
+			return nil
+		}
+		var wait time.Duration
+		if d.sessionRate != nil {
+			if !d.failOnSessionRate {
+				wait = d.sessionRate.reserve()
+			} else if !d.sessionRate.tryTake() {
+				stranded := d.numLive+d.numPending == 0
+				if stranded {
+					// put back the placeholder used before the first session so
+					// that the next dial tries again right away rather than at
+					// the next redial
+					d.numLive++
+				}
+				d.muNumLivePending.Unlock()
+				if stranded {
+					d.liveSessions <- nullSession{}
+					return ErrSessionRateLimited
+				}
+				return nil
+			}
 		}
 		d.numPending++
 		d.muNumLivePending.Unlock()
 		go func() {
-			s, err := d.startSession(dial)
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+			s, err := d.newSession(dial)
 			d.muNumLivePending.Lock()
 			d.numPending--
+			d.lastSessionErr = err
 			if err != nil {
+				d.sessionFailures++
 				d.muNumLivePending.Unlock()
 				return
 			}
+			d.sessionFailures = 0
 			d.numLive++
 			d.muNumLivePending.Unlock()
-			d.liveSessions <- s
+			atomic.AddInt64(&sessionsDialed, 1)
+			d.putLive(s)
 		}()
+		return nil
 	}
 	for {
 		select {
 		case s := <-d.liveSessions:
-			if s.AllowNewStream(d.maxStreamsPerConn, d.idleInterval) {
+			d.takeLive(s)
+			allowed := s.AllowNewStream(d.maxStreamsPerConn, d.idleInterval)
+			if sess, ok := s.(*session); ok && !allowed && sess.LameDuck() && !d.retireLameDuck() {
+				allowed = sess.allowNewStreamWhileLameDuck(d.maxStreamsPerConn, d.idleInterval)
+			}
+			if !allowed {
+				d.muNumLivePending.Lock()
+				atSessionCap := d.atSessionCap()
+				d.muNumLivePending.Unlock()
+				// if we can't replace this session, keep using it for as long as
+				// possible
+				allowed = atSessionCap && s.AllowNewStream(maxClientStreams, 0)
+			}
+			if allowed && d.sessionValid(s) {
+				if d.sessionPolicy == FillSessions {
+					var full bool
+					if s, full = d.fillSession(s); full {
+						if err := newSession(d.maxLiveConns); err != nil {
+							d.returnSession(s)
+							return nil, err
+						}
+					}
+				}
 				return s, nil
 			}
 			d.muNumLivePending.Lock()
 			d.numLive--
 			d.muNumLivePending.Unlock()
 			s.MarkDefunct()
-			newSession(minLiveConns)
+			rotated := false
+			if sess, ok := s.(*session); ok && sess.streamsExhausted(d.maxStreamsPerConn) {
+				rotated = true
+				if d.onSessionRotated != nil {
+					d.onSessionRotated(sess)
+				}
+			}
+			if err := newSession(minLiveConns); err != nil {
+				return nil, err
+			}
+			if rotated && d.failOnRotation {
+				return nil, ErrSessionRotated
+			}
+		case <-d.sessionClosed:
+			// we may have been at the session cap
+			if err := newSession(minLiveConns); err != nil {
+				return nil, err
+			}
 		case <-time.After(d.redialSessionInterval):
-			newSession(d.maxLiveConns)
+			if err := newSession(d.maxLiveConns); err != nil {
+				return nil, err
+			}
 		case <-ctx.Done():
+			d.muNumLivePending.Lock()
+			err := d.lastSessionErr
+			d.muNumLivePending.Unlock()
+			if err != nil {
+				// the most recent attempt to start a session explains why
+				return nil, err
+			}
 			return nil, errors.New("No session available")
 		}
 	}
 }
 
+// retireLameDuck indicates whether a lame duck session may be replaced now,
+// which is at most once per lameDuckRetireInterval. If every server that dial
+// reaches is draining, each replacement turns out to be lame duck too, and
+// without the limit we'd start a new session for nearly every stream.
+func (d *dialer) retireLameDuck() bool {
+	d.muNumLivePending.Lock()
+	defer d.muNumLivePending.Unlock()
+	now := time.Now()
+	if now.Sub(d.lastLameDuckRetired) < lameDuckRetireInterval {
+		return false
+	}
+	d.lastLameDuckRetired = now
+	return true
+}
+
+// sessionValid runs the ValidateSession hook, if any, on the given live
+// session.
+func (d *dialer) sessionValid(s sessionIntf) bool {
+	if d.validateSession == nil {
+		return true
+	}
+	sess, ok := s.(*session)
+	if !ok {
+		return true
+	}
+	if !d.validateSession(sess) {
+		log.Debugf("%vSession failed validation, will start new session", sess.logPrefix)
+		return false
+	}
+	return true
+}
+
+// atPendingCap indicates whether pending sessions have reached
+// maxPendingSessions. Must be called while holding muNumLivePending.
+func (d *dialer) atPendingCap() bool {
+	return d.maxPendingSessions > 0 && d.numPending >= d.maxPendingSessions
+}
+
+// atSessionCap indicates whether open and pending sessions have reached
+// maxSessions. Must be called while holding muNumLivePending.
+func (d *dialer) atSessionCap() bool {
+	return d.maxSessions > 0 && d.numOpen+d.numPending >= d.maxSessions
+}
+
+// onSessionClosed keeps track of open sessions for enforcing maxSessions.
+func (d *dialer) onSessionClosed(s *session) {
+	d.muNumLivePending.Lock()
+	d.numOpen--
+	delete(d.sessions, s)
+	d.muNumLivePending.Unlock()
+	select {
+	case d.sessionClosed <- struct{}{}:
+	default:
+		// already signaled
+	}
+}
+
 func (d *dialer) returnSession(s sessionIntf) {
 	addBack := true
 	d.muNumLivePending.Lock()
-	if d.numLive > minLiveConns {
+	if d.numLive > minLiveConns && d.sessionPolicy != FillSessions {
 		d.numLive--
 		addBack = false
 	}
 	d.muNumLivePending.Unlock()
 	if addBack {
-		d.liveSessions <- s
+		d.putLive(s)
 	} else {
 		s.MarkDefunct()
 	}
 }
 
+// CanDialWithoutNewConn reports whether any of the currently idle live
+// sessions would accept a new stream, using the same criteria as Dial. Sessions
+// that are temporarily in use by concurrent dials aren't considered.
+func (d *dialer) CanDialWithoutNewConn() bool {
+	d.muNumLivePending.Lock()
+	defer d.muNumLivePending.Unlock()
+	keepLameDuck := time.Since(d.lastLameDuckRetired) < lameDuckRetireInterval
+	for s := range d.idle {
+		if s.AllowNewStream(d.maxStreamsPerConn, d.idleInterval) {
+			return true
+		}
+		if keepLameDuck && s.LameDuck() && s.allowNewStreamWhileLameDuck(d.maxStreamsPerConn, d.idleInterval) {
+			return true
+		}
+	}
+	return false
+}
+
+// putLive puts s into liveSessions, where it's idle until a dial takes it
+// again with takeLive.
+func (d *dialer) putLive(s sessionIntf) {
+	if sess, ok := s.(*session); ok {
+		d.muNumLivePending.Lock()
+		d.idle[sess] = true
+		d.muNumLivePending.Unlock()
+	}
+	d.liveSessions <- s
+}
+
+// takeLive records that s was taken from liveSessions.
+func (d *dialer) takeLive(s sessionIntf) {
+	if sess, ok := s.(*session); ok {
+		d.muNumLivePending.Lock()
+		delete(d.idle, sess)
+		d.muNumLivePending.Unlock()
+	}
+}
+
 func (d *dialer) EMARTT() time.Duration {
 	return d.emaRTT.GetDuration()
 }
@@ -209,24 +872,261 @@ func (d *dialer) BoundTo(dial DialFN) BoundDialer {
 	return &boundDialer{d, dial}
 }
 
+// HealthCheck dials a dedicated session that's not shared with regular
+// streams and does a ping round trip on it.
+func (d *dialer) HealthCheck(ctx context.Context, dial DialFN) error {
+	// Use a separate RTT tracker so that health checks don't skew EMARTT
+	s, err := d.dialSession(dial, ema.NewDuration(0, 0.5), atomic.LoadInt32(&d.cipherIdx), nil, true)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	_, err = s.ping(ctx)
+	return err
+}
+
+// startSession starts a new session using the given DialFN and tracks it.
 func (d *dialer) startSession(dial DialFN) (*session, error) {
-	conn, err := dial()
+	// reserve the slot up front so that the session counts towards maxSessions
+	// from the start, even if it closes before we get to track it below
+	d.muNumLivePending.Lock()
+	d.numOpen++
+	d.muNumLivePending.Unlock()
+	cipherIdx := d.nextCipherIdx()
+	s, err := d.doStartSession(dial, d.emaRTT, cipherIdx, func(s *session) {
+		d.onSessionClosed(s)
+		if s.handshakeFailed() {
+			d.handshakeFailed(s.handshakeStart, HandshakeFailureRejected, errHandshakeRejected)
+			d.fallBack(cipherIdx)
+		}
+	})
+	if err != nil {
+		// beforeClose only runs for started sessions, so release the slot here
+		d.muNumLivePending.Lock()
+		d.numOpen--
+		d.muNumLivePending.Unlock()
+		return nil, err
+	}
+	d.muNumLivePending.Lock()
+	if !s.isClosed() {
+		// otherwise onSessionClosed may already have run
+		d.sessions[s] = true
+	}
+	d.muNumLivePending.Unlock()
+	return s, nil
+}
+
+// nextCipherIdx returns the index of the cipher to use for a new session.
+// That's the current cipher, except that once we've fallen back, the primary
+// cipher is tried again for a single session each time retryPrimaryAt passes.
+func (d *dialer) nextCipherIdx() int32 {
+	idx := atomic.LoadInt32(&d.cipherIdx)
+	if idx == 0 {
+		return 0
+	}
+	d.muCipher.Lock()
+	defer d.muCipher.Unlock()
+	now := time.Now()
+	if now.Before(d.retryPrimaryAt) {
+		return idx
+	}
+	// keep concurrent sessions on the fallback cipher while this one tries
+	d.retryPrimaryAt = now.Add(cipherRetryBackoff(d.primaryFailures))
+	return 0
+}
+
+// fallBack switches from the cipher at the given index to the next fallback
+// cipher, if there is one and we haven't switched already. If the primary
+// cipher failed again while retrying it, we stay where we are and back off
+// further before the next retry.
+func (d *dialer) fallBack(fromIdx int32) {
+	d.muCipher.Lock()
+	defer d.muCipher.Unlock()
+	current := atomic.LoadInt32(&d.cipherIdx)
+	if fromIdx == 0 && current > 0 {
+		d.primaryFailures++
+		backoff := cipherRetryBackoff(d.primaryFailures)
+		d.retryPrimaryAt = time.Now().Add(backoff)
+		log.Debugf("%v: Server still doesn't respond to sessions using %v, trying again in %v", d.name, d.ciphers[0], backoff)
+		return
+	}
+	if fromIdx != current || int(fromIdx)+1 >= len(d.ciphers) {
+		return
+	}
+	atomic.StoreInt32(&d.cipherIdx, fromIdx+1)
+	if fromIdx == 0 {
+		d.primaryFailures = 1
+		d.retryPrimaryAt = time.Now().Add(cipherRetryBackoff(d.primaryFailures))
+	}
+	log.Errorf("%v: Server closed session using %v without responding, falling back to %v", d.name, d.ciphers[fromIdx], d.ciphers[fromIdx+1])
+}
+
+// cipherWorked moves back to the primary cipher if a session using it got a
+// response after we had fallen back from it.
+func (d *dialer) cipherWorked(idx int32) {
+	if idx != 0 || atomic.LoadInt32(&d.cipherIdx) == 0 {
+		return
+	}
+	d.muCipher.Lock()
+	defer d.muCipher.Unlock()
+	if atomic.LoadInt32(&d.cipherIdx) == 0 {
+		return
+	}
+	atomic.StoreInt32(&d.cipherIdx, 0)
+	d.primaryFailures = 0
+	d.retryPrimaryAt = time.Time{}
+	log.Debugf("%v: Server responded to session using %v again, no longer falling back", d.name, d.ciphers[0])
+}
+
+// cipherRetryBackoff is how long to wait before trying the primary cipher
+// again after it failed the given number of consecutive times.
+func cipherRetryBackoff(failures int) time.Duration {
+	backoff := maxCipherRetryBackoff
+	if shift := uint(failures - 1); shift < 6 {
+		backoff = minCipherRetryBackoff << shift
+	}
+	if backoff > maxCipherRetryBackoff {
+		backoff = maxCipherRetryBackoff
+	}
+	return backoff
+}
+
+// dialWithTimeout calls dial, giving up with ErrDialTimeout if it doesn't
+// return within dialTimeout. A conn that dial returns after we've given up is
+// closed.
+func (d *dialer) dialWithTimeout(dial DialFN) (net.Conn, error) {
+	if d.dialTimeout <= 0 {
+		return dial()
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	resultCh := make(chan result)
+	abandoned := make(chan struct{})
+	ops.Go(func() {
+		conn, err := dial()
+		select {
+		case resultCh <- result{conn, err}:
+		case <-abandoned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	})
+
+	timer := time.NewTimer(d.dialTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-resultCh:
+		return r.conn, r.err
+	case <-timer.C:
+		close(abandoned)
+		return nil, ErrDialTimeout
+	}
+}
+
+func (d *dialer) doStartSession(dial DialFN, emaRTT *ema.EMA, cipherIdx int32, beforeClose func(*session)) (*session, error) {
+	// the session's goroutines inherit this op's context
+	op := ops.Begin("lampshade_start_session").Set("dialer", d.name)
+	defer op.End()
+	s, err := d.dialSession(dial, emaRTT, cipherIdx, beforeClose, false)
+	return s, op.FailIf(err)
+}
+
+// dialSession dials and starts a session using the cipher at cipherIdx. A
+// probe session, see HealthCheck, leaves no trace in the dialer's handshake
+// stats, the cipher fallback or GlobalStats.
+func (d *dialer) dialSession(dial DialFN, emaRTT *ema.EMA, cipherIdx int32, beforeClose func(*session), probe bool) (*session, error) {
+	start := time.Now()
+	handshakeFailed := func(failure HandshakeFailure, err error) {
+		if !probe {
+			d.handshakeFailed(start, failure, err)
+		}
+	}
+	conn, err := d.dialWithTimeout(dial)
 	if err != nil {
+		failure := HandshakeFailureDial
+		if err == ErrDialTimeout {
+			failure = HandshakeFailureTimeout
+		}
+		handshakeFailed(failure, err)
 		return nil, err
 	}
 
-	cs, err := newCryptoSpec(d.cipherCode)
+	cipherCode := d.ciphers[cipherIdx]
+	cs, err := newCryptoSpec(cipherCode)
 	if err != nil {
-		return nil, fmt.Errorf("Unable to create crypto spec for %v: %v", d.cipherCode, err)
+		err = fmt.Errorf("Unable to create crypto spec for %v: %v", cipherCode, err)
+		handshakeFailed(HandshakeFailureCrypto, err)
+		return nil, err
 	}
 
 	// Generate the client init message
-	clientInitMsg, err := buildClientInitMsg(d.serverPublicKey, d.windowSize, d.maxPadding, cs, initTS())
+	var flags byte
+	if d.checksums {
+		flags |= flagChecksums
+	}
+	if d.acceptPush {
+		flags |= flagAcceptPush
+	}
+	clientInitMsg, err := buildClientInitMsg(d.serverPublicKey, d.initMsgPadding, d.protocolVersion, d.windowSize, d.maxPadding, flags, cs, initTS())
 	if err != nil {
-		return nil, fmt.Errorf("Unable to generate client init message: %v", err)
+		err = fmt.Errorf("Unable to generate client init message: %v", err)
+		handshakeFailed(HandshakeFailureCrypto, err)
+		return nil, err
 	}
 
-	return startSession(conn, d.windowSize, d.maxPadding, false, d.pingInterval, cs, clientInitMsg, d.pool, d.emaRTT, nil, nil)
+	onFirstResponse := func() {
+		d.firstResponseReceived(start)
+		d.cipherWorked(cipherIdx)
+	}
+	hooks := d.hooks
+	if probe {
+		onFirstResponse = nil
+		hooks = nil
+	}
+	opts := &sessionOpts{
+		name:                d.name,
+		handshakeStart:      start,
+		onFirstResponse:     onFirstResponse,
+		version:             d.protocolVersion,
+		windowSize:          d.windowSize,
+		windowPolicy:        d.windowPolicy,
+		maxQueuedFrames:     d.maxQueuedFrames,
+		maxUnackedBytes:     d.maxUnackedBytes,
+		receiveBufferDepth:  d.receiveBufferDepth,
+		maxReceiveBytes:     d.maxReceiveBufferBytes,
+		maxPadding:          d.maxPadding,
+		ackJitter:           d.ackJitter,
+		ackShards:           d.ackShards,
+		framePriority:       d.framePriority,
+		adaptiveAcks:        d.adaptiveAcks,
+		pingInterval:        d.pingInterval,
+		keepAliveInterval:   d.keepAliveInterval,
+		writeStallTimeout:   d.writeStallTimeout,
+		streamIdleTimeout:   d.streamIdleTimeout,
+		maxSessionFrameSize: d.maxSessionFrameSize,
+		rekeyBytes:          d.rekeyBytes,
+		rekeyInterval:       d.rekeyInterval,
+		frameInterceptor:    d.frameInterceptor,
+		onFrameDropped:      d.onFrameDropped,
+		streamLogLevel:      d.streamLogLevel,
+		hooks:               hooks,
+		checksums:           d.checksums,
+		pushEnabled:         d.acceptPush,
+		probe:               probe,
+	}
+	s, err := startSession(conn, opts, cs, clientInitMsg, d.pool, emaRTT, nil, beforeClose)
+	if err != nil {
+		failure := HandshakeFailureCrypto
+		if _, ok := err.(*handshakeWriteError); ok {
+			failure = HandshakeFailureWrite
+		}
+		handshakeFailed(failure, err)
+	}
+	return s, err
 }
 
 type boundDialer struct {
@@ -242,3 +1142,15 @@ func (bd *boundDialer) Dial() (net.Conn, error) {
 func (bd *boundDialer) DialContext(ctx context.Context) (net.Conn, error) {
 	return bd.Dialer.DialContext(ctx, bd.dial)
 }
+
+func (bd *boundDialer) HealthCheck(ctx context.Context) error {
+	return bd.Dialer.HealthCheck(ctx, bd.dial)
+}
+
+func (bd *boundDialer) DialWithHeaders(ctx context.Context, headers map[string]string) (net.Conn, error) {
+	return bd.Dialer.DialWithHeaders(ctx, bd.dial, headers)
+}
+
+func (bd *boundDialer) DialGroup(ctx context.Context) (DialGroup, error) {
+	return bd.Dialer.DialGroup(ctx, bd.dial)
+}
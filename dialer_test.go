@@ -0,0 +1,829 @@
+package lampshade
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/l2dy/plampshade/ops"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaxSessions(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxStreamsPerConn = 1
+		opts.MaxSessions = 1
+	})
+	defer l.Close()
+
+	first, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer first.Close()
+
+	// the first session would normally be retired after one stream, but since
+	// we can't open another one, it keeps getting used
+	second, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer second.Close()
+	assert.True(t, first.(Stream).Session() == second.(Stream).Session(), "should have reused session")
+}
+
+func TestMaxSessionsReservesSlot(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxSessions = 1
+	})
+	defer l.Close()
+	dd := d.(*dialer)
+	numOpen := func() int {
+		dd.muNumLivePending.Lock()
+		defer dd.muNumLivePending.Unlock()
+		return dd.numOpen
+	}
+
+	dialing := make(chan struct{})
+	proceed := make(chan error)
+	blockingDial := func() (net.Conn, error) {
+		close(dialing)
+		if err := <-proceed; err != nil {
+			return nil, err
+		}
+		return dial()
+	}
+
+	errCh := make(chan error)
+	go func() {
+		_, err := dd.startSession(blockingDial)
+		errCh <- err
+	}()
+	<-dialing
+	assert.Equal(t, 1, numOpen(), "slot should be reserved while the session is starting")
+	proceed <- errors.New("unable to dial")
+	assert.Error(t, <-errCh)
+	assert.Zero(t, numOpen(), "slot should be released when the session fails to start")
+
+	s, err := dd.startSession(dial)
+	require.NoError(t, err)
+	assert.Equal(t, 1, numOpen())
+	s.Close()
+	assert.Zero(t, numOpen())
+}
+
+func TestMaxStreamsPerConn(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxStreamsPerConn = 2
+	})
+	defer l.Close()
+
+	var sessions []Session
+	for i := 0; i < 5; i++ {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		defer conn.Close()
+		sessions = append(sessions, conn.(Stream).Session())
+	}
+	assert.True(t, sessions[0] == sessions[1], "first session should have taken two streams")
+	assert.True(t, sessions[1] != sessions[2], "first session should have been retired after two streams")
+	assert.True(t, sessions[2] == sessions[3], "second session should have taken two streams")
+	assert.True(t, sessions[3] != sessions[4], "second session should have been retired after two streams")
+}
+
+func TestFillSessions(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxLiveConns = 3
+		opts.SessionPolicy = FillSessions
+		opts.SoftStreamsPerConn = 2
+	})
+	defer l.Close()
+
+	dialSession := func() (net.Conn, Session) {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		return conn, conn.(Stream).Session()
+	}
+	conn1, first := dialSession()
+	defer conn1.Close()
+	conn2, s := dialSession()
+	defer conn2.Close()
+	assert.True(t, first == s, "should have packed streams onto the first session")
+	conn3, s := dialSession()
+	defer conn3.Close()
+	assert.True(t, first == s, "should keep using the full session while the next one is started")
+
+	var second Session
+	for i := 0; i < 100 && (second == nil || second == first); i++ {
+		time.Sleep(10 * time.Millisecond)
+		var conn net.Conn
+		conn, second = dialSession()
+		if second == first {
+			conn.Close()
+		} else {
+			defer conn.Close()
+		}
+	}
+	assert.True(t, second != first, "should have spilled over onto a second session")
+
+	conn1.Close()
+	conn2.Close()
+	conn3.Close()
+	time.Sleep(50 * time.Millisecond)
+	conn, s := dialSession()
+	defer conn.Close()
+	assert.True(t, second == s, "should prefer the busiest session that isn't full")
+	select {
+	case <-first.(*session).closeCh:
+	case <-time.After(time.Second):
+		t.Fatal("empty session should have been retired")
+	}
+}
+
+func TestStreamIDsAcrossRotation(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxStreamsPerConn = 3
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	var physicalDials int32
+	countingDial := func() (net.Conn, error) {
+		atomic.AddInt32(&physicalDials, 1)
+		return dial()
+	}
+
+	var conns []net.Conn
+	for i := 0; i < 4; i++ {
+		conn, err := d.Dial(countingDial)
+		require.NoError(t, err)
+		defer conn.Close()
+		conns = append(conns, conn)
+		if i < 3 {
+			assert.EqualValues(t, 1, atomic.LoadInt32(&physicalDials), "first three streams should share one physical connection")
+		}
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&physicalDials), "fourth stream should have needed a new physical connection")
+
+	var ids []uint16
+	for _, conn := range conns {
+		_, id := frameTypeAndID(conn.(*stream).sb.defaultHeader)
+		ids = append(ids, id)
+	}
+	assert.Equal(t, []uint16{0, 2, 4, 0}, ids, "client stream IDs should be even and start over on the new session")
+
+	// the streams that are still open on the first session don't get mixed up
+	// with the one that reuses ID 0 on the second session
+	for i, conn := range conns {
+		_, err := conn.Write([]byte{byte(i)})
+		require.NoError(t, err)
+	}
+	for i, conn := range conns {
+		b := make([]byte, 1)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := io.ReadFull(conn, b)
+		require.NoError(t, err)
+		assert.Equal(t, byte(i), b[0])
+	}
+}
+
+func TestFailOnRotation(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxStreamsPerConn = 1
+		opts.FailOnRotation = true
+	})
+	defer l.Close()
+
+	first, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer first.Close()
+	_, err = d.Dial(dial)
+	assert.Equal(t, ErrSessionRotated, err)
+	assert.True(t, err.(net.Error).Temporary())
+
+	second, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer second.Close()
+	assert.True(t, first.(Stream).Session() != second.(Stream).Session(), "should have dialed on the replacement session")
+}
+
+func TestOnSessionRotated(t *testing.T) {
+	var mx sync.Mutex
+	var rotated []Session
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxStreamsPerConn = 1
+		opts.OnSessionRotated = func(s Session) {
+			mx.Lock()
+			rotated = append(rotated, s)
+			mx.Unlock()
+		}
+	})
+	defer l.Close()
+
+	first, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := d.Dial(dial)
+	require.NoError(t, err, "rotation should stay transparent to the dial")
+	defer second.Close()
+
+	mx.Lock()
+	defer mx.Unlock()
+	if assert.Len(t, rotated, 1) {
+		assert.True(t, rotated[0] == first.(Stream).Session(), "should have reported the exhausted session")
+	}
+}
+
+func TestValidateSession(t *testing.T) {
+	var mx sync.Mutex
+	var stale Session
+	var validated int32
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ValidateSession = func(s Session) bool {
+			atomic.AddInt32(&validated, 1)
+			mx.Lock()
+			defer mx.Unlock()
+			return s != stale
+		}
+	})
+	defer l.Close()
+
+	first, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer second.Close()
+	session := first.(Stream).Session()
+	assert.True(t, session == second.(Stream).Session(), "valid session should have been reused")
+	assert.True(t, atomic.LoadInt32(&validated) > 0, "should have validated session before reusing it")
+
+	mx.Lock()
+	stale = session
+	mx.Unlock()
+	third, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer third.Close()
+	assert.True(t, session != third.(Stream).Session(), "invalid session shouldn't have been reused")
+	_, err = first.Write([]byte("hello"))
+	assert.NoError(t, err, "existing streams on invalid session should keep working")
+}
+
+func TestMaxSessionRate(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		// every other dial needs a new session
+		opts.MaxStreamsPerConn = 2
+		opts.MaxSessionRate = 10
+	})
+	defer l.Close()
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+	assert.True(t, time.Since(start) >= 200*time.Millisecond, "should have spaced out the second and third session")
+}
+
+func TestFailOnSessionRate(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxStreamsPerConn = 2
+		opts.MaxSessionRate = 1
+		opts.FailOnSessionRate = true
+	})
+	defer l.Close()
+
+	for i := 0; i < 2; i++ {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		defer conn.Close()
+	}
+	start := time.Now()
+	_, err := d.Dial(dial)
+	assert.Equal(t, ErrSessionRateLimited, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "should have failed right away")
+
+	time.Sleep(time.Second)
+	conn, err := d.Dial(dial)
+	require.NoError(t, err, "rate should allow a new session again")
+	conn.Close()
+}
+
+func TestDialGroup(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxStreamsPerConn = 1
+	})
+	defer l.Close()
+
+	group, err := d.DialGroup(context.Background(), dial)
+	require.NoError(t, err)
+
+	// no need to close the group's streams, closing the session takes care of
+	// that
+	first, err := group.Dial()
+	require.NoError(t, err)
+	second, err := group.Dial()
+	require.NoError(t, err)
+	session := first.(Stream).Session()
+	assert.True(t, session == second.(Stream).Session(), "streams in a group should share a session")
+
+	ungrouped, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer ungrouped.Close()
+	assert.True(t, session != ungrouped.(Stream).Session(), "regular dials should have rotated to a new session")
+
+	session.Close()
+	_, err = group.Dial()
+	assert.Equal(t, ErrConnectionClosed, err, "group shouldn't move to a different session")
+}
+
+func TestConcurrentDialsDuringSlowConnect(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	var physicalDials int32
+	slowDial := func() (net.Conn, error) {
+		atomic.AddInt32(&physicalDials, 1)
+		time.Sleep(250 * time.Millisecond)
+		return dial()
+	}
+
+	const dialers = 10
+	var wg sync.WaitGroup
+	wg.Add(dialers)
+	for i := 0; i < dialers; i++ {
+		go func() {
+			defer wg.Done()
+			conn, err := d.Dial(slowDial)
+			if assert.NoError(t, err) {
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&physicalDials), "concurrent dials should share a single new session")
+}
+
+func TestDialRecoversFromFailedConnect(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.RedialSessionInterval = 50 * time.Millisecond
+	})
+	defer l.Close()
+
+	var physicalDials int32
+	flakyDial := func() (net.Conn, error) {
+		if atomic.AddInt32(&physicalDials, 1) == 1 {
+			time.Sleep(50 * time.Millisecond)
+			return nil, errors.New("first dial fails")
+		}
+		return dial()
+	}
+
+	const dialers = 5
+	var wg sync.WaitGroup
+	wg.Add(dialers)
+	for i := 0; i < dialers; i++ {
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := d.DialContext(ctx, flakyDial)
+			if assert.NoError(t, err) {
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 1, d.Stats().HandshakeFailures[HandshakeFailureDial])
+}
+
+// halfWritingConn only writes the first half of the first Write, either
+// failing or reporting a short write without an error.
+type halfWritingConn struct {
+	net.Conn
+	fail   bool
+	closed int32
+}
+
+func (conn *halfWritingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b[:len(b)/2])
+	if err == nil && conn.fail {
+		err = errors.New("connection reset mid-write")
+	}
+	return n, err
+}
+
+func (conn *halfWritingConn) Close() error {
+	atomic.StoreInt32(&conn.closed, 1)
+	return conn.Conn.Close()
+}
+
+func TestPartialHandshakeWrite(t *testing.T) {
+	for _, fail := range []bool{true, false} {
+		l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+			opts.RedialSessionInterval = 50 * time.Millisecond
+		})
+		defer l.Close()
+
+		var conns []*halfWritingConn
+		var mx sync.Mutex
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		_, err := d.DialContext(ctx, func() (net.Conn, error) {
+			conn, dialErr := dial()
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			halfWriting := &halfWritingConn{Conn: conn, fail: fail}
+			mx.Lock()
+			conns = append(conns, halfWriting)
+			mx.Unlock()
+			return halfWriting, nil
+		})
+		cancel()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "Unable to write client init message")
+		if !fail {
+			assert.True(t, errors.Is(err, io.ErrShortWrite), "short writes without an error should be detected")
+		}
+		assert.True(t, d.Stats().HandshakeFailures[HandshakeFailureWrite] > 0)
+		// the most recent attempt may still be in progress
+		time.Sleep(100 * time.Millisecond)
+		mx.Lock()
+		for _, conn := range conns {
+			assert.EqualValues(t, 1, atomic.LoadInt32(&conn.closed), "connection with a partial handshake should have been closed")
+		}
+		mx.Unlock()
+	}
+}
+
+func TestFallbackCiphers(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.FallbackCiphers = []Cipher{ChaCha20Poly1305}
+	})
+	defer l.Close()
+	go echoAll(l)
+	dd := d.(*dialer)
+
+	// endpoints that never respond, one that just sits there and one that
+	// closes the connection, like a network that kills the handshake
+	listen := func(reject bool) DialFN {
+		wrapped, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { wrapped.Close() })
+		go func() {
+			for {
+				conn, err := wrapped.Accept()
+				if err != nil {
+					return
+				}
+				if reject {
+					go func() {
+						conn.Read(make([]byte, 1))
+						// give the dial time to open its stream, sessions
+						// that fail before they carry any stream don't count
+						// as rejected handshakes
+						time.Sleep(50 * time.Millisecond)
+						conn.Close()
+					}()
+				}
+			}
+		}()
+		return func() (net.Conn, error) {
+			return net.Dial("tcp", wrapped.Addr().String())
+		}
+	}
+	silent, rejecting := listen(false), listen(true)
+
+	dialAndWrite := func(dial DialFN) net.Conn {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		return conn
+	}
+	dialRejected := func() {
+		conn := dialAndWrite(rejecting)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 5))
+		require.Error(t, err)
+		require.NotEqual(t, ErrTimeout, err, "server should have closed the session")
+	}
+	dialWorking := func(expected Cipher) {
+		conn := dialAndWrite(dial)
+		_, err := io.ReadFull(conn, make([]byte, 5))
+		require.NoError(t, err)
+		assert.Equal(t, expected, conn.(Stream).Session().Params().Cipher)
+		conn.(Stream).Session().Close()
+	}
+	retryPrimaryNow := func() {
+		dd.muCipher.Lock()
+		dd.retryPrimaryAt = time.Now()
+		dd.muCipher.Unlock()
+	}
+
+	conn := dialAndWrite(silent)
+	conn.(Stream).Session().Close()
+	assert.Zero(t, atomic.LoadInt32(&dd.cipherIdx), "closing a session ourselves before the server responded shouldn't cause fallback")
+	assert.Zero(t, d.Stats().HandshakeFailures[HandshakeFailureRejected])
+
+	dialRejected()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dd.cipherIdx), "should have fallen back after server closed session without responding")
+	assert.EqualValues(t, 1, d.Stats().HandshakeFailures[HandshakeFailureRejected])
+	assert.Zero(t, d.Stats().FirstResponseTime)
+
+	dialWorking(ChaCha20Poly1305)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dd.cipherIdx), "should stay on the fallback cipher until it's time to retry")
+	assert.EqualValues(t, 1, d.Stats().HandshakeFailures[HandshakeFailureRejected], "working session shouldn't count as rejected")
+	assert.True(t, d.Stats().FirstResponseTime > 0, "first response should have been timed")
+
+	retryPrimaryNow()
+	dialRejected()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dd.cipherIdx), "failed retry of the primary cipher should stay on the fallback cipher")
+	dd.muCipher.Lock()
+	assert.True(t, time.Until(dd.retryPrimaryAt) > minCipherRetryBackoff, "should back off further after the retry failed")
+	dd.muCipher.Unlock()
+	dialWorking(ChaCha20Poly1305)
+
+	retryPrimaryNow()
+	dialWorking(AES128GCM)
+	assert.Zero(t, atomic.LoadInt32(&dd.cipherIdx), "should have moved back to the primary cipher once it worked again")
+	dialWorking(AES128GCM)
+}
+
+func TestDialTimeout(t *testing.T) {
+	l, d, _ := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.DialTimeout = 50 * time.Millisecond
+	})
+	defer l.Close()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	lateConns := make(chan net.Conn, 10)
+	hangingDial := func() (net.Conn, error) {
+		<-unblock
+		conn, peer := net.Pipe()
+		lateConns <- peer
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 250*time.Millisecond)
+	defer cancel()
+	_, err := d.DialContext(ctx, hangingDial)
+	assert.Equal(t, ErrDialTimeout, err)
+	assert.True(t, err.(net.Error).Timeout())
+	assert.EqualValues(t, 1, d.Stats().HandshakeFailures[HandshakeFailureTimeout])
+	assert.Zero(t, d.Stats().HandshakeFailures[HandshakeFailureDial])
+
+	// conns that show up after the timeout get closed
+	unblock <- struct{}{}
+	peer := <-lateConns
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = peer.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestLameDuck(t *testing.T) {
+	for _, version := range []int{0, lameDuckVersion} {
+		l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+			opts.ProtocolVersion = version
+		})
+		l.(LameDuckListener).EnterLameDuck()
+
+		first, err := d.Dial(dial)
+		require.NoError(t, err)
+		_, err = first.Write([]byte("hello"))
+		require.NoError(t, err)
+		serverConn, err := l.Accept()
+		require.NoError(t, err)
+		_, err = io.ReadFull(serverConn, make([]byte, 5))
+		require.NoError(t, err)
+
+		session := first.(Stream).Session()
+		if version < lameDuckVersion {
+			// give the server a chance to send anything it might send
+			time.Sleep(100 * time.Millisecond)
+			assert.False(t, session.LameDuck(), "older clients shouldn't be told about lame duck mode")
+			second, err := d.Dial(dial)
+			require.NoError(t, err)
+			assert.True(t, session == second.(Stream).Session(), "older clients should keep using the session")
+		} else {
+			deadline := time.Now().Add(5 * time.Second)
+			for !session.LameDuck() && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			require.True(t, session.LameDuck(), "client should have been told about lame duck mode")
+			second, err := d.Dial(dial)
+			require.NoError(t, err)
+			assert.True(t, session != second.(Stream).Session(), "new streams should go to a new session")
+		}
+
+		// existing streams are still served
+		_, err = serverConn.Write([]byte("world"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(first, make([]byte, 5))
+		require.NoError(t, err)
+		l.Close()
+	}
+}
+
+func TestLameDuckSingleServer(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = lameDuckVersion
+	})
+	defer l.Close()
+	go echoAll(l)
+	l.(LameDuckListener).EnterLameDuck()
+	var dialed int32
+	countingDial := func() (net.Conn, error) {
+		atomic.AddInt32(&dialed, 1)
+		return dial()
+	}
+
+	// every session that the only server hands out is lame duck
+	for i := 0; i < 10; i++ {
+		conn, err := d.Dial(countingDial)
+		require.NoError(t, err)
+		defer conn.Close()
+		session := conn.(Stream).Session()
+		deadline := time.Now().Add(5 * time.Second)
+		for !session.LameDuck() && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		require.True(t, session.LameDuck(), "client should have been told about lame duck mode")
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&dialed), "should have replaced the lame duck session only once rather than dialing for every stream")
+}
+
+func TestHealthCheck(t *testing.T) {
+	const name = "health-check"
+	var reported int32
+	ops.RegisterReporter(func(failure error, ctx map[string]interface{}) {
+		if ctx["dialer"] == name {
+			atomic.AddInt32(&reported, 1)
+		}
+	})
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.Name = name
+		opts.FallbackCiphers = []Cipher{ChaCha20Poly1305}
+	})
+	defer l.Close()
+
+	require.NoError(t, d.HealthCheck(context.Background(), dial))
+	err := d.HealthCheck(context.Background(), func() (net.Conn, error) {
+		return nil, errors.New("unreachable")
+	})
+	require.Error(t, err)
+	assert.Zero(t, d.Stats().FirstResponseTime, "health checks shouldn't be timed")
+	for failure, count := range d.Stats().HandshakeFailures {
+		assert.Zero(t, count, "health checks shouldn't count as %v failures", failure)
+	}
+	assert.Zero(t, atomic.LoadInt32(&reported), "health checks shouldn't be reported to ops")
+	assert.Zero(t, atomic.LoadInt32(&d.(*dialer).cipherIdx))
+
+	// GlobalStats also count the server's end and everything else that's
+	// running in this process, so look at the probe session directly
+	var stat int64
+	(&session{probe: true}).addStat(&stat, 1)
+	assert.Zero(t, stat, "probe sessions shouldn't count towards GlobalStats")
+}
+
+func TestCanDialWithoutNewConn(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		// stream IDs 0 and 2
+		opts.MaxStreamsPerConn = 2
+	})
+	defer l.Close()
+	dd := d.(*dialer)
+
+	assert.False(t, d.CanDialWithoutNewConn(), "there's no session yet")
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.True(t, d.CanDialWithoutNewConn(), "session has room for another stream")
+	assert.Len(t, dd.liveSessions, 1, "checking shouldn't take the session out of liveSessions")
+
+	conn, err = d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.False(t, d.CanDialWithoutNewConn(), "session has used up its stream IDs")
+	assert.Len(t, dd.liveSessions, 1)
+}
+
+func TestDump(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.Name = "dump"
+		// stream IDs 0 and 2
+		opts.MaxStreamsPerConn = 2
+	})
+	defer l.Close()
+
+	var streams []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		defer conn.Close()
+		streams = append(streams, conn)
+	}
+	_, err := streams[0].Write([]byte("hello"))
+	require.NoError(t, err)
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	_, err = io.ReadFull(serverConn, make([]byte, 5))
+	require.NoError(t, err)
+	_, err = serverConn.Write([]byte("hi"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(streams[0], make([]byte, 2))
+	require.NoError(t, err)
+
+	dump := d.Dump()
+	assert.Equal(t, "dump", dump.Name)
+	assert.Equal(t, Cipher(AES128GCM), dump.Cipher)
+	assert.Empty(t, dump.LastSessionError)
+	assert.True(t, dump.PooledBuffers >= 0)
+	require.Len(t, dump.Sessions, 2, "the first session should have been retired after two streams")
+	first, second := dump.Sessions[0], dump.Sessions[1]
+	assert.True(t, first.ID < second.ID)
+	assert.True(t, first.Retired)
+	assert.False(t, second.Retired)
+	require.Len(t, first.Streams, 2)
+	require.Len(t, second.Streams, 1)
+	stream := first.Streams[0]
+	assert.Equal(t, uint16(0), stream.ID)
+	assert.Equal(t, int64(5), stream.BytesWritten)
+	assert.Equal(t, int64(2), stream.BytesRead)
+	assert.Equal(t, 0, stream.QueuedFrames)
+	assert.Equal(t, testWindowSize-1, stream.TransmitWindow, "the frame that was written shouldn't have been acked yet")
+	assert.Equal(t, 1, stream.UnackedFrames)
+
+	// closed sessions drop out of the dump
+	streams[2].(Stream).Session().Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.Dump().Sessions) > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Len(t, d.Dump().Sessions, 1)
+}
+
+func TestDetailedDialErrors(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.RedialSessionInterval = 10 * time.Millisecond
+		opts.DetailedDialErrors = true
+	})
+	defer l.Close()
+
+	errDown := errors.New("down")
+	failingDial := func() (net.Conn, error) {
+		return nil, errDown
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := d.DialContext(ctx, failingDial)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, errDown), "should unwrap to the underlying error")
+	var dialErr *DialError
+	require.True(t, errors.As(err, &dialErr))
+	assert.Equal(t, errDown, dialErr.LastSessionError)
+	assert.Zero(t, dialErr.OpenSessions)
+	assert.True(t, dialErr.ConsecutiveFailures > 1, "should have kept trying to start a session")
+	assert.Contains(t, err.Error(), "down (open sessions: 0")
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	conn.Close()
+	assert.Zero(t, d.(*dialer).dialError(errDown).(*DialError).ConsecutiveFailures, "a successful session should reset the failure count")
+}
+
+func TestMaxPendingSessions(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxLiveConns = 10
+		opts.MaxPendingSessions = 1
+		opts.RedialSessionInterval = 10 * time.Millisecond
+	})
+	defer l.Close()
+
+	var physicalDials int32
+	slowDial := func() (net.Conn, error) {
+		atomic.AddInt32(&physicalDials, 1)
+		time.Sleep(250 * time.Millisecond)
+		return dial()
+	}
+
+	const dialers = 50
+	var wg sync.WaitGroup
+	wg.Add(dialers)
+	for i := 0; i < dialers; i++ {
+		go func() {
+			defer wg.Done()
+			conn, err := d.Dial(slowDial)
+			if assert.NoError(t, err) {
+				conn.Close()
+			}
+		}()
+	}
+	time.Sleep(200 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&physicalDials), "dials redialing while the first handshake is pending shouldn't open more connections")
+	wg.Wait()
+}
@@ -0,0 +1,162 @@
+package lampshade
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+var sessionIDs uint64
+
+// DialerDump is a point in time snapshot of a Dialer's state for diagnostics,
+// see Dialer.Dump.
+type DialerDump struct {
+	// Name is the Dialer's name, see DialerOpts.Name.
+	Name string
+
+	// Sessions lists the Dialer's open Sessions, including ones that have been
+	// retired but still have Streams, ordered by SessionDump.ID.
+	Sessions []SessionDump
+
+	// PendingSessions is the number of Sessions currently being established.
+	PendingSessions int
+
+	// LastSessionError is the error from the most recent attempt to start a
+	// Session, or "" if that attempt succeeded.
+	LastSessionError string
+
+	// Cipher is the cipher used for new Sessions, which differs from
+	// DialerOpts.Cipher once the Dialer has fallen back to one of the
+	// FallbackCiphers.
+	Cipher Cipher
+
+	// PooledBuffers is the number of buffers currently held by the Dialer's
+	// BufferPool, or -1 if the pool doesn't keep count.
+	PooledBuffers int
+}
+
+// SessionDump is a point in time snapshot of a Session's state, see
+// Dialer.Dump.
+type SessionDump struct {
+	// ID identifies the Session within this process.
+	ID uint64
+
+	CreatedAt    time.Time
+	LastActivity time.Time
+
+	// Retired indicates that no new Streams will be opened on this Session and
+	// that it will close once its Streams have.
+	Retired bool
+
+	// LameDuck indicates that the server asked us to move elsewhere, see
+	// Session.LameDuck.
+	LameDuck bool
+
+	// InFlightBytes is the same as SessionStats.InFlightBytes.
+	InFlightBytes int64
+
+	// Streams lists the Session's open Streams, ordered by StreamDump.ID.
+	Streams []StreamDump
+}
+
+// StreamDump is a point in time snapshot of a Stream's state, see Dialer.Dump.
+type StreamDump struct {
+	// ID is the Stream's ID within its Session.
+	ID uint16
+
+	// BytesWritten and BytesRead count the data written to and read from the
+	// Stream by the application.
+	BytesWritten int64
+	BytesRead    int64
+
+	// TransmitWindow is the number of frames that may still be sent before
+	// waiting for an ack. It's negative while a frame is waiting for the
+	// window to open, and always 0 with UnlimitedWindowPolicy.
+	TransmitWindow int
+
+	// UnackedFrames is the number of frames written to the Stream that the
+	// peer hasn't acked yet, including ones that haven't been sent.
+	UnackedFrames int
+
+	// QueuedFrames is the number of frames written to the Stream that haven't
+	// been handed to the Session for sending yet.
+	QueuedFrames int
+
+	// RTT is the same as Stream.RTT.
+	RTT time.Duration
+}
+
+// Dump collects a snapshot of the dialer's state. It only takes each lock
+// long enough to copy what it needs, so it doesn't hold up the data path, but
+// that also means that the snapshots of different Sessions and Streams are
+// taken at slightly different times.
+func (d *dialer) Dump() DialerDump {
+	d.muNumLivePending.Lock()
+	dump := DialerDump{
+		Name:            d.name,
+		PendingSessions: d.numPending,
+	}
+	if d.lastSessionErr != nil {
+		dump.LastSessionError = d.lastSessionErr.Error()
+	}
+	sessions := make([]*session, 0, len(d.sessions))
+	for s := range d.sessions {
+		sessions = append(sessions, s)
+	}
+	d.muNumLivePending.Unlock()
+
+	dump.Cipher = d.ciphers[atomic.LoadInt32(&d.cipherIdx)]
+	dump.PooledBuffers = -1
+	if pool, ok := d.pool.(*bufferPool); ok {
+		dump.PooledBuffers = pool.pool.NumPooled()
+	}
+	for _, s := range sessions {
+		dump.Sessions = append(dump.Sessions, s.dump())
+	}
+	sort.Slice(dump.Sessions, func(i, j int) bool {
+		return dump.Sessions[i].ID < dump.Sessions[j].ID
+	})
+	return dump
+}
+
+func (s *session) dump() SessionDump {
+	s.mx.RLock()
+	retired := s.defunct
+	streams := make([]*stream, 0, len(s.streams))
+	for _, c := range s.streams {
+		streams = append(streams, c)
+	}
+	s.mx.RUnlock()
+
+	dump := SessionDump{
+		ID:            s.id,
+		CreatedAt:     s.CreatedAt(),
+		LastActivity:  s.LastActivity(),
+		Retired:       retired,
+		LameDuck:      s.LameDuck(),
+		InFlightBytes: s.Stats().InFlightBytes,
+	}
+	for _, c := range streams {
+		dump.Streams = append(dump.Streams, c.dump())
+	}
+	sort.Slice(dump.Streams, func(i, j int) bool {
+		return dump.Streams[i].ID < dump.Streams[j].ID
+	})
+	return dump
+}
+
+func (c *stream) dump() StreamDump {
+	_, id := frameTypeAndID(c.sb.defaultHeader)
+	c.sb.muInFlight.Lock()
+	unacked := c.sb.unacked
+	c.sb.muInFlight.Unlock()
+	return StreamDump{
+		ID:             id,
+		BytesWritten:   atomic.LoadInt64(&c.bytesWritten),
+		BytesRead:      atomic.LoadInt64(&c.bytesRead),
+		TransmitWindow: c.sb.window.available(),
+		UnackedFrames:  unacked,
+		QueuedFrames:   int(atomic.LoadInt32(&c.sb.queued)),
+		RTT:            c.RTT(),
+	}
+}
@@ -0,0 +1,54 @@
+package lampshade
+
+// FrameDropReason explains why a frame was dropped, see
+// DialerOpts.OnFrameDropped.
+type FrameDropReason int
+
+const (
+	// FrameDropClosed means that a frame arrived for a Stream that had already
+	// been closed for reading, or that data queued for sending was discarded
+	// because the Session closed.
+	FrameDropClosed FrameDropReason = iota
+
+	// FrameDropOverflow means that an out-of-band frame arrived while the
+	// Stream already had as many waiting as it buffers, because the application
+	// isn't keeping up with ReadOOB.
+	FrameDropOverflow
+
+	// FrameDropTimeout means that data queued for sending was discarded because
+	// the Stream didn't finish flushing within its linger time, see
+	// Stream.SetLinger, for example because the peer stopped acking.
+	FrameDropTimeout
+)
+
+func (r FrameDropReason) String() string {
+	switch r {
+	case FrameDropClosed:
+		return "closed"
+	case FrameDropOverflow:
+		return "overflow"
+	case FrameDropTimeout:
+		return "timeout"
+	default:
+		return "unknown"
+	}
+}
+
+// frameDropped reports a dropped frame for the given stream to the
+// onFrameDropped callback, if any.
+func (s *session) frameDropped(id uint16, reason FrameDropReason) {
+	if s.onFrameDropped != nil {
+		s.onFrameDropped(id, reason)
+	}
+}
+
+// onFrameDroppedFor returns a callback that reports dropped frames for the
+// given stream, or nil if the session doesn't report them.
+func (s *session) onFrameDroppedFor(id uint16) func(FrameDropReason) {
+	if s.onFrameDropped == nil {
+		return nil
+	}
+	return func(reason FrameDropReason) {
+		s.onFrameDropped(id, reason)
+	}
+}
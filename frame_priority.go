@@ -0,0 +1,97 @@
+package lampshade
+
+// FrameClass is a class of frames that a Session's writer merges onto the
+// underlying connection, see DialerOpts.FramePriority.
+type FrameClass int
+
+const (
+	// FrameClassControl covers headers, out-of-band data, lame duck
+	// notifications, pings and echos.
+	FrameClassControl FrameClass = iota
+
+	// FrameClassAck covers acks, which open the peer's transmit windows.
+	FrameClassAck
+
+	// FrameClassData covers data frames from Streams, along with the RST frames
+	// that follow them when Streams are closed.
+	FrameClassData
+
+	numFrameClasses = iota
+)
+
+// DefaultFramePriority is the order in which frame classes are written when
+// no FramePriority is configured. Control frames go first since they're small
+// and often latency sensitive, acks go next so that the peer can keep sending,
+// and data goes last.
+var DefaultFramePriority = []FrameClass{FrameClassControl, FrameClassAck, FrameClassData}
+
+func (c FrameClass) String() string {
+	switch c {
+	case FrameClassControl:
+		return "control"
+	case FrameClassAck:
+		return "ack"
+	case FrameClassData:
+		return "data"
+	default:
+		return "unknown"
+	}
+}
+
+// normalizeFramePriority returns priority with unknown and duplicate classes
+// removed and any classes it's missing appended in their default order.
+func normalizeFramePriority(priority []FrameClass) []FrameClass {
+	result := make([]FrameClass, 0, numFrameClasses)
+	seen := make(map[FrameClass]bool, numFrameClasses)
+	for _, classes := range [][]FrameClass{priority, DefaultFramePriority} {
+		for _, class := range classes {
+			if class < 0 || class >= numFrameClasses || seen[class] {
+				continue
+			}
+			seen[class] = true
+			result = append(result, class)
+		}
+	}
+	return result
+}
+
+// pollFrame returns the next frame of the given class, or nil if none is
+// immediately available.
+func (s *session) pollFrame(class FrameClass) []byte {
+	switch class {
+	case FrameClassControl:
+		select {
+		case frame := <-s.out:
+			return frame
+		case frame := <-s.echoOut:
+			return frame
+		default:
+		}
+	case FrameClassAck:
+		select {
+		case frame := <-s.ackOut:
+			return frame
+		case <-s.acks.readyCh():
+			return s.acks.next()
+		default:
+		}
+	case FrameClassData:
+		select {
+		case <-s.sched.ready:
+			return s.sched.next()
+		default:
+		}
+	}
+	return nil
+}
+
+// pollFrames returns the next frame of the highest priority class that has one
+// immediately available, or nil if none do.
+func (s *session) pollFrames() []byte {
+	for _, class := range s.framePriority {
+		if frame := s.pollFrame(class); frame != nil {
+			return frame
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package lampshade
+
+import (
+	"crypto/rand"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollFramesByPriority(t *testing.T) {
+	control := newHeader(frameTypeLameDuck, 0)
+	ack := ackWithFrames(newHeader(frameTypeData, 1), 1)
+	data := withDataHeader(make([]byte, 0, maxFrameSize), newHeader(frameTypeData, 1))
+
+	for _, priority := range [][]FrameClass{
+		nil,
+		{FrameClassData, FrameClassAck, FrameClassControl},
+		{FrameClassAck},
+	} {
+		s := &session{
+			out:           make(chan []byte, 1),
+			echoOut:       make(chan []byte),
+			ackOut:        make(chan []byte, 1),
+			sched:         newScheduler(),
+			framePriority: normalizeFramePriority(priority),
+		}
+		s.out <- control
+		s.ackOut <- ack
+		s.sched.submit(data)
+
+		frames := map[FrameClass][]byte{FrameClassControl: control, FrameClassAck: ack, FrameClassData: data}
+		for _, class := range s.framePriority {
+			assert.Equal(t, frames[class], s.pollFrames(), "%v frame should be next with priority %v", class, s.framePriority)
+		}
+		assert.Nil(t, s.pollFrames())
+	}
+}
+
+func TestNormalizeFramePriority(t *testing.T) {
+	assert.Equal(t, DefaultFramePriority, normalizeFramePriority(nil))
+	assert.Equal(t, []FrameClass{FrameClassData, FrameClassControl, FrameClassAck},
+		normalizeFramePriority([]FrameClass{FrameClassData, FrameClassData, FrameClass(7)}))
+}
+
+func TestDataFirstFramePriority(t *testing.T) {
+	l, d, dial := newTestPair(t, &ListenerOpts{
+		FramePriority: []FrameClass{FrameClassData, FrameClassAck, FrameClassControl},
+	}, func(opts *DialerOpts) {
+		opts.FramePriority = []FrameClass{FrameClassData, FrameClassAck, FrameClassControl}
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// enough to need acks in both directions
+	data := make([]byte, MaxDataLen*testWindowSize*3)
+	rand.Read(data)
+	go conn.Write(data)
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(conn, received)
+	require.NoError(t, err)
+	assert.Equal(t, data, received)
+}
@@ -0,0 +1,55 @@
+package lampshade
+
+const (
+	// minMaxSessionFrameSize is the smallest allowed MaxSessionFrameSize, which
+	// leaves room for some data alongside the framing of the largest cipher
+	// overhead and ensures that out-of-band and rekey frames always fit
+	minMaxSessionFrameSize = 256
+)
+
+// limitSessionFrameSize applies the given MaxSessionFrameSize to the session.
+// Must be called once the session's cipherOverhead is final.
+func (s *session) limitSessionFrameSize(maxSessionFrameSize int) {
+	s.maxDataLen = MaxDataLen
+	if maxSessionFrameSize <= 0 {
+		return
+	}
+	if maxSessionFrameSize < minMaxSessionFrameSize {
+		maxSessionFrameSize = minMaxSessionFrameSize
+	}
+	s.maxSessionFrameSize = maxSessionFrameSize
+	if maxDataLen := maxSessionFrameSize - lenSize - s.cipherOverhead - dataHeaderSize; maxDataLen < s.maxDataLen {
+		s.maxDataLen = maxDataLen
+	}
+}
+
+// coalescedSize returns how many bytes the given frame takes up once it's
+// coalesced into a session frame, see sender.bufferFrame.
+func coalescedSize(frame []byte) int {
+	frameType, _ := frameTypeAndID(frame[len(frame)-headerSize:])
+	switch frameType {
+	case frameTypeRST, frameTypeLameDuck:
+		return headerSize
+	case frameTypeACK, frameTypePing, frameTypeEcho:
+		return len(frame)
+	default:
+		return len(frame) + lenSize
+	}
+}
+
+// bufferFrameIfFits buffers the given frame if that keeps the session frame
+// within maxSessionFrameSize. Otherwise, it holds on to the frame so that it
+// goes first in the next session frame.
+func (snd *sender) bufferFrameIfFits(frame []byte) bool {
+	if !snd.fits(frame) {
+		snd.pendingFrame = frame
+		return false
+	}
+	snd.bufferFrame(frame)
+	return true
+}
+
+func (snd *sender) fits(frame []byte) bool {
+	return snd.maxSessionFrameSize <= 0 ||
+		snd.startOfData+snd.coalescedBytes+coalescedSize(frame)+snd.cipherOverhead <= snd.maxSessionFrameSize
+}
@@ -0,0 +1,95 @@
+package lampshade
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sizeRecordingConn records the size of every write after the first, which
+// also contains the client init message.
+type sizeRecordingConn struct {
+	net.Conn
+	writes int
+	sizes  []int
+	mx     sync.Mutex
+}
+
+func (conn *sizeRecordingConn) Write(b []byte) (int, error) {
+	conn.mx.Lock()
+	conn.writes++
+	if conn.writes > 1 {
+		conn.sizes = append(conn.sizes, len(b))
+	}
+	conn.mx.Unlock()
+	return conn.Conn.Write(b)
+}
+
+func TestMaxSessionFrameSize(t *testing.T) {
+	maxSize := 300
+	l, d, dial := newTestPair(t, &ListenerOpts{MaxSessionFrameSize: maxSize}, func(opts *DialerOpts) {
+		opts.MaxSessionFrameSize = maxSize
+		opts.MaxPadding = 255
+		opts.PingInterval = time.Millisecond
+		opts.ProtocolVersion = headersVersion
+		opts.Checksums = true
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	var recording *sizeRecordingConn
+	recordingDial := func() (net.Conn, error) {
+		conn, dialErr := dial()
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		recording = &sizeRecordingConn{Conn: conn}
+		return recording, nil
+	}
+	conn, err := d.Dial(recordingDial)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	data := make([]byte, 2*testWindowSize*MaxDataLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go conn.Write(data)
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(conn, received)
+	require.NoError(t, err)
+	assert.Equal(t, data, received)
+	for i := 0; i < 10; i++ {
+		// small writes get padded
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, received[:5])
+		require.NoError(t, err)
+	}
+
+	recording.mx.Lock()
+	defer recording.mx.Unlock()
+	require.NotEmpty(t, recording.sizes)
+	for _, size := range recording.sizes {
+		assert.True(t, size <= maxSize, "session frame of %d bytes exceeds %d", size, maxSize)
+	}
+
+	_, err = d.DialWithHeaders(context.Background(), recordingDial, map[string]string{"big": strings.Repeat("x", maxSize)})
+	assert.Equal(t, ErrHeadersTooLarge, err, "headers that don't fit into a session frame should be refused")
+}
+
+func TestCoalescedSize(t *testing.T) {
+	header := newHeader(frameTypeData, 1)
+	assert.Equal(t, headerSize+lenSize+5, coalescedSize(append([]byte("hello"), header...)))
+	assert.Equal(t, headerSize, coalescedSize(newHeader(frameTypeRST, 1)))
+	assert.Equal(t, ackFrameSize, coalescedSize(ackWithFrames(header, 5)))
+	assert.Equal(t, pingFrameSize, coalescedSize(ping()))
+}
@@ -0,0 +1,121 @@
+package lampshade
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/l2dy/plampshade/ops"
+)
+
+// HandshakeFailure classifies why a Dialer failed to establish a session.
+type HandshakeFailure int
+
+const (
+	// HandshakeFailureDial means that the DialFN returned an error.
+	HandshakeFailureDial HandshakeFailure = iota
+
+	// HandshakeFailureTimeout means that the DialFN didn't return within
+	// DialerOpts.DialTimeout.
+	HandshakeFailureTimeout
+
+	// HandshakeFailureCrypto means that we couldn't set up encryption for the
+	// session, for example because the client init message couldn't be built.
+	HandshakeFailureCrypto
+
+	// HandshakeFailureRejected means that the connection was closed or reset
+	// before the server sent anything back even though we opened streams on
+	// it, which is how a server rejects a client init message that it can't
+	// handle. Sessions that we close ourselves before the server responds
+	// don't count.
+	HandshakeFailureRejected
+
+	// HandshakeFailureWrite means that the client init message couldn't be
+	// written to the physical connection in full, in which case the
+	// connection is closed rather than leaving the server with a partial
+	// message that it can't parse.
+	HandshakeFailureWrite
+
+	numHandshakeFailures = iota
+)
+
+var errHandshakeRejected = errors.New("server closed session without responding")
+
+// handshakeWriteError indicates that writing the client init message failed,
+// see HandshakeFailureWrite.
+type handshakeWriteError struct {
+	err error
+}
+
+func (e *handshakeWriteError) Error() string {
+	return "Unable to write client init message: " + e.err.Error()
+}
+
+func (e *handshakeWriteError) Unwrap() error {
+	return e.err
+}
+
+func (f HandshakeFailure) String() string {
+	switch f {
+	case HandshakeFailureDial:
+		return "dial"
+	case HandshakeFailureTimeout:
+		return "timeout"
+	case HandshakeFailureCrypto:
+		return "crypto"
+	case HandshakeFailureRejected:
+		return "rejected"
+	case HandshakeFailureWrite:
+		return "write"
+	default:
+		return "unknown"
+	}
+}
+
+// DialerStats is a point in time snapshot of a Dialer's statistics.
+type DialerStats struct {
+	// FirstResponseTime is a moving average of the time from starting to dial
+	// the physical connection until the first frame from the server arrived.
+	// Servers don't acknowledge the client init message, they only send
+	// frames once they have something to say about a stream, like data or an
+	// ack, so this includes however long the server took to respond to the
+	// first stream rather than just the time to set up the session.
+	FirstResponseTime time.Duration
+
+	// HandshakeFailures counts failed handshakes by why they failed.
+	HandshakeFailures map[HandshakeFailure]int64
+}
+
+func (d *dialer) Stats() DialerStats {
+	stats := DialerStats{
+		FirstResponseTime: d.firstResponseTime.GetDuration(),
+		HandshakeFailures: make(map[HandshakeFailure]int64, numHandshakeFailures),
+	}
+	for i := range d.handshakeFailures {
+		stats.HandshakeFailures[HandshakeFailure(i)] = atomic.LoadInt64(&d.handshakeFailures[i])
+	}
+	return stats
+}
+
+// firstResponseReceived records the first frame from the server on a session
+// whose handshake started at start, see DialerStats.FirstResponseTime.
+func (d *dialer) firstResponseReceived(start time.Time) {
+	elapsed := time.Since(start)
+	d.firstResponseTime.UpdateDuration(elapsed)
+	op := ops.Begin("lampshade_handshake").Set("dialer", d.name).Set("first_response_seconds", elapsed.Seconds())
+	op.End()
+}
+
+// handshakeFailed records a handshake that started at start and failed with
+// err. The duration is reported too, so that handshakes that are slow to fail
+// show up.
+func (d *dialer) handshakeFailed(start time.Time, failure HandshakeFailure, err error) {
+	elapsed := time.Since(start)
+	atomic.AddInt64(&d.handshakeFailures[failure], 1)
+	op := ops.Begin("lampshade_handshake").
+		Set("dialer", d.name).
+		Set("handshake_seconds", elapsed.Seconds()).
+		Set("handshake_failure", failure.String())
+	op.FailIf(err)
+	op.End()
+}
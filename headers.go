@@ -0,0 +1,91 @@
+package lampshade
+
+import (
+	"errors"
+	"sort"
+)
+
+const (
+	headerFieldLenSize = 2
+
+	// MaxHeadersSize is the maximum encoded size of the headers that can be
+	// attached to a new stream. Each key and value is encoded with a 2 byte
+	// length prefix, so the usable space is somewhat smaller than this.
+	MaxHeadersSize = MaxDataLen
+)
+
+var (
+	// ErrHeadersTooLarge indicates that the headers passed to DialWithHeaders
+	// don't fit within MaxHeadersSize.
+	ErrHeadersTooLarge = errors.New("headers too large")
+
+	// ErrHeadersUnsupported indicates that headers were passed to
+	// DialWithHeaders or PushStream on a Session whose protocol version doesn't
+	// support headers frames.
+	ErrHeadersUnsupported = errors.New("headers not supported by protocol version")
+
+	errMalformedHeaders = errors.New("malformed headers frame")
+)
+
+// encodedHeadersSize returns the number of bytes needed to encode the given
+// headers.
+func encodedHeadersSize(headers map[string]string) int {
+	size := 0
+	for key, value := range headers {
+		size += headerFieldLenSize + len(key) + headerFieldLenSize + len(value)
+	}
+	return size
+}
+
+// encodeHeaders encodes the given headers into b, which must be large enough
+// to hold encodedHeadersSize(headers) bytes. Keys are encoded in sorted order.
+func encodeHeaders(b []byte, headers map[string]string) []byte {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	b = b[:0]
+	for _, key := range keys {
+		b = appendHeaderField(b, key)
+		b = appendHeaderField(b, headers[key])
+	}
+	return b
+}
+
+func appendHeaderField(b []byte, field string) []byte {
+	l := len(b)
+	b = b[:l+headerFieldLenSize]
+	binaryEncoding.PutUint16(b[l:], uint16(len(field)))
+	return append(b, field...)
+}
+
+func decodeHeaders(b []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	for len(b) > 0 {
+		key, rest, err := consumeHeaderField(b)
+		if err != nil {
+			return nil, err
+		}
+		value, rest, err := consumeHeaderField(rest)
+		if err != nil {
+			return nil, err
+		}
+		headers[key] = value
+		b = rest
+	}
+	return headers, nil
+}
+
+func consumeHeaderField(b []byte) (string, []byte, error) {
+	if len(b) < headerFieldLenSize {
+		return "", nil, errMalformedHeaders
+	}
+	l := int(binaryEncoding.Uint16(b))
+	b = b[headerFieldLenSize:]
+	if len(b) < l {
+		return "", nil, errMalformedHeaders
+	}
+	return string(b[:l]), b[l:], nil
+}
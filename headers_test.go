@@ -0,0 +1,111 @@
+package lampshade
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncodeDecodeHeaders(t *testing.T) {
+	headers := map[string]string{"target": "example.com:443", "empty": "", "": "no key"}
+	b := encodeHeaders(make([]byte, 0, MaxHeadersSize), headers)
+	assert.Len(t, b, encodedHeadersSize(headers))
+	decoded, err := decodeHeaders(b)
+	require.NoError(t, err)
+	assert.Equal(t, headers, decoded)
+
+	decoded, err = decodeHeaders(nil)
+	require.NoError(t, err)
+	assert.Empty(t, decoded)
+
+	_, err = decodeHeaders(b[:len(b)-1])
+	assert.Equal(t, errMalformedHeaders, err, "truncated value")
+	_, err = decodeHeaders(b[:1])
+	assert.Equal(t, errMalformedHeaders, err, "truncated length")
+}
+
+func TestDialWithHeaders(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion
+	})
+	defer l.Close()
+
+	headers := map[string]string{"target": "example.com:443", "kind": "bulk"}
+	conn, err := d.DialWithHeaders(context.Background(), dial, headers)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	assert.Equal(t, headers, serverConn.(Stream).Headers())
+	b := make([]byte, 5)
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(serverConn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b), "data should follow the headers")
+}
+
+func TestHeadersUnsupported(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion - 1
+	})
+	defer l.Close()
+
+	_, err := d.DialWithHeaders(context.Background(), dial, map[string]string{"target": "a"})
+	assert.Equal(t, ErrHeadersUnsupported, err)
+	conn, err := d.DialWithHeaders(context.Background(), dial, nil)
+	require.NoError(t, err, "dials without headers should still work")
+	conn.Close()
+}
+
+func TestLateHeaders(t *testing.T) {
+	// whether to inject a headers frame in front of the next data frame from
+	// the client
+	var inject int32
+	l, d, dial := newTestPair(t, &ListenerOpts{
+		FrameInterceptor: func(outbound bool, frame []byte) []byte {
+			if outbound || len(frame) < dataHeaderSize || frame[0] != frameTypeData || !atomic.CompareAndSwapInt32(&inject, 1, 0) {
+				return frame
+			}
+			headers := encodeHeaders(make([]byte, 0, MaxHeadersSize), map[string]string{"late": "true"})
+			late := make([]byte, dataHeaderSize, dataHeaderSize+len(headers))
+			setFrameTypeAndID(late, frameTypeHeaders, binaryEncoding.Uint16(frame[1:]))
+			binaryEncoding.PutUint16(late[headerSize:], uint16(len(headers)))
+			late = append(late, headers...)
+			return append(late, frame...)
+		},
+	}, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion
+	})
+	defer l.Close()
+
+	conn, err := d.DialWithHeaders(context.Background(), dial, map[string]string{"late": "false"})
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("a"))
+	require.NoError(t, err)
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1)
+	_, err = io.ReadFull(serverConn, b)
+	require.NoError(t, err)
+
+	atomic.StoreInt32(&inject, 1)
+	_, err = conn.Write([]byte("b"))
+	require.NoError(t, err)
+	for err == nil {
+		_, err = serverConn.Read(b)
+	}
+	assert.Equal(t, ErrLateHeaders, err, "headers for an open stream should reset it")
+	assert.Equal(t, map[string]string{"late": "false"}, serverConn.(Stream).Headers(), "original headers should be kept")
+}
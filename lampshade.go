@@ -66,14 +66,22 @@
 //
 //   256 bytes, always combined with first data message to vary size.
 //
-//   To initialize a session, the client sends the below, encrypted using
-//   RSA OAEP using the server's PK:
+//   To initialize a session, the client sends the below, encrypted with the
+//   server's PK using RSA OAEP with SHA-256 (the default), RSA OAEP with SHA-1
+//   or RSA PKCS #1 v1.5. The padding scheme isn't communicated explicitly, to
+//   avoid leaking a fingerprint; the server instead tries each scheme that it's
+//   configured to accept. Servers only accept OAEP with SHA-256 by default, so
+//   clients using a different scheme need servers configured to accept it.
+//   PKCS #1 v1.5 is only there for interop with older deployments and should
+//   be avoided otherwise.
 //
-//     +-----+---------+--------+--------+----------+----------+----------+----------+----+
-//     | Win | Max Pad | Cipher | Secret | Send IV1 | Send IV2 | Recv IV1 | Recv IV2 | TS |
-//     +-----+---------+--------+--------+----------+----------+----------+----------+----+
-//     |  4  |    1    |    1   |   32   |    12    |    12    |    12    |    12    |  8 |
-//     +-----+---------+--------+--------+----------+----------+----------+----------+----+
+//     +-----+-----+---------+--------+--------+----------+----------+----------+----------+----+
+//     | Ver | Win | Max Pad | Cipher | Secret | Send IV1 | Send IV2 | Recv IV1 | Recv IV2 | TS |
+//     +-----+-----+---------+--------+--------+----------+----------+----------+----------+----+
+//     |  1  |  3  |    1    |    1   |   32   |    12    |    12    |    12    |    12    |  8 |
+//     +-----+-----+---------+--------+--------+----------+----------+----------+----------+----+
+//
+//       Ver        - protocol version, see "Protocol Versions" below
 //
 //       Win        - transmit window size in # of frames
 //
@@ -98,6 +106,78 @@
 //       TS         - Optional, this is the timestamp of the client init message
 //                    in seconds since epoch.
 //
+//   From version 4 on, Cipher is followed by a 1 byte Flags field, a bit set of
+//   optional features for the session:
+//
+//       1 = checksums (see "Checksums" below)
+//       2 = accepts pushed streams (version 5 or later, see "Pushed Streams"
+//           below)
+//
+//   Servers treat flags that they don't know like any other bad init message.
+//
+// Protocol Versions:
+//
+//   Ver and Win used to make up a single 4 byte Win field, so init messages
+//   from clients that predate versioning are version 0 messages, as long as
+//   their window size fits into 3 bytes, which all practical window sizes do.
+//
+//     0 - the original protocol
+//
+//     1 - like version 0, but the server may send lame duck frames (see
+//         "Lame Duck" below)
+//
+//     2 - like version 1, but both ends may send out-of-band frames (see
+//         Stream.WriteOOB)
+//
+//     3 - like version 2, but both ends may send rekey frames (see
+//         "Rekeying" below)
+//
+//     4 - like version 3, but the client init message includes Flags
+//
+//     5 - like version 4, but the client may accept streams pushed by the
+//         server (see "Pushed Streams" below)
+//
+//     6 - like version 5, but ack frames may request an ack in return (see
+//         "Frames" under "Stream Framing" above)
+//
+//     7 - like version 6, but both ends may send fin frames to close their
+//         side of a stream (see "Closing Streams" below)
+//
+//     8 - like version 7, but both ends may send headers frames (see "Data"
+//         under "Stream Framing" above)
+//
+//   Because the server never responds to a client init message that it can't
+//   handle (to avoid giving probes anything to go on), versions are selected
+//   by the client rather than negotiated interactively:
+//
+//     - a client sends the version it wants to speak, which determines the
+//       layout of the rest of the init message and of everything that follows
+//
+//     - a server accepts any version up to the newest one it knows and speaks
+//       that version for the rest of the session
+//
+//     - a server treats a newer version than it knows like any other bad init
+//       message, reporting the unsupported version to ListenerOpts.OnError and
+//       consuming input until InitMsgTimeout
+//
+//   New versions may only change what follows Ver, so that any server can
+//   always tell which version a client is speaking. Clients that need to talk
+//   to older servers must stick to a version that those servers support.
+//
+// Lame Duck:
+//
+//   A server that's about to shut down can enter lame duck mode, in which it
+//   keeps serving existing sessions but asks clients to move new streams
+//   elsewhere. It does so by sending a lame duck frame as the first frame on
+//   every new session with a client that speaks version 1 or later. Older
+//   clients don't get the frame, since they'd mistake it for data, and simply
+//   keep using the session. A client that receives a lame duck frame stops
+//   opening new streams on the session and dials a new one for subsequent
+//   streams, while the session's existing streams carry on. In case the new
+//   session is lame duck too, as happens when there's only one server, a
+//   Dialer replaces at most one lame duck session every 30 seconds and keeps
+//   opening streams on lame duck sessions in between.
+//
 // Session Framing:
 //
 //   Where possible, lampshade coalesces multiple stream-level frames into a
@@ -128,6 +208,53 @@
 //   XOR'ed with a frame sequence number, similar AES128_GCM in TLS 1.3
 //   (see https://blog.cloudflare.com/tls-nonce-nse/).
 //
+//   Both ends keep their own 64-bit sequence numbers, which start at 0 and
+//   increase by one with each session frame. Because sessions run over a
+//   reliable, ordered connection, the replay window is zero: the receiver only
+//   accepts the very next sequence number. A replayed, reordered or dropped
+//   session frame therefore fails authentication, which resets the session.
+//
+// Rekeying:
+//
+//   Each end can switch the key and IV that it uses for encrypting the Frames
+//   of its session frames (see DialerOpts.RekeyBytes and RekeyInterval), which
+//   keeps long-lived sessions from encrypting unbounded amounts of data under
+//   the same key. The two directions are rekeyed independently of each other.
+//
+//     - the sender generates a new random secret and data IV and sends them in
+//       a rekey frame, which is the only frame in its session frame and is
+//       still encrypted with the old key
+//
+//     - the sender encrypts every subsequent session frame with the new key,
+//       with a sequence number that starts over at 0
+//
+//     - the receiver decrypts every session frame after the one containing the
+//       rekey frame with the new key
+//
+//   Since session frames arrive in order, both ends always agree on which key
+//   applies to which frame. The Len field keeps being encrypted with the
+//   original stream cipher. Sessions that don't use encryption never rekey,
+//   and receiving a rekey frame on a session that's older than version 3 is
+//   an error.
+//
+// Checksums:
+//
+//   If the client sets the checksums flag (see DialerOpts.Checksums), both
+//   ends append a 4 byte CRC-32C (Castagnoli) checksum of Frames to Frames
+//   before encrypting it, and verify and strip it after decrypting.
+//
+//     +-----+---------+----------+------+
+//     | Len |  Frames | Checksum |  MAC |
+//     +-----+---------+----------+------+
+//     |  2  | <=65514 |     4    |  16  |
+//     +-----+---------+----------+------+
+//
+//   A session frame whose checksum doesn't match closes the session, since
+//   corrupted data can't be attributed to any one stream and nothing read
+//   after it can be trusted to be framed correctly. The AEAD ciphers already
+//   detect corruption on their own, so checksums mostly make sense with
+//   NoEncryption over transports that don't guarantee integrity.
+//
 // Padding:
 //
 //   - used only when there weren't enough pending writes to coalesce
@@ -152,24 +279,109 @@
 //
 //                      0 = padding
 //                      1 = data
+//                  2-246 = extensions (see "Extension Frames" below)
+//                    247 = fin (see "Closing Streams" below)
+//                    248 = rekey (stream ID 0, see "Rekeying" above)
+//                    249 = out-of-band data
+//                    250 = lame duck (sent once by the server, stream ID 0)
+//                    251 = headers (sent once when opening a stream, version
+//                          8 or later)
 //                    252 = ping
 //                    253 = echo
 //                    254 = ack
 //                    255 = rst (close connection)
 //
-//     Stream ID  - unique identifier for stream. (last field for ack and rst)
+//     Stream ID  - unique identifier for stream, see "Stream IDs" below. (last
+//                  field for ack and rst)
+//
+//     Data Len   - length of data (for type "data", "out-of-band data",
+//                  "headers" or "padding")
 //
-//     Data Len   - length of data (for type "data" or "padding")
+//     Frames     - number of frames being ACK'd (for type ACK). From version 6
+//                  on, the high bit is the ack request bit, with which the
+//                  sender asks the peer to ack everything that it has
+//                  consumed, see Stream.Sync. The remaining bits still count
+//                  acked frames. An ack without the bit that acks 0 frames
+//                  means nothing, servers send those with
+//                  ListenerOpts.AckOnFirst.
 //
-//     Frames     - number of frames being ACK'd (for type ACK)
+//     Secret/IV  - for type "rekey", in place of Data Len and Data, the 32 byte
+//                  secret followed by the 12 byte data IV to use from the next
+//                  session frame on
 //
 //     Data       - data (for type "data" or "padding")
 //
+//                  for type "headers", a sequence of key/value pairs, each
+//                  encoded as a 2 byte length followed by the key or value.
+//                  The headers frame is not subject to flow control and is
+//                  always sent before any data on the stream. A receiver
+//                  resets a stream whose headers arrive after the stream was
+//                  opened (see ErrLateHeaders).
+//
 //     TS         - time at which ping packet was sent as 64-bit uint. This is
 //                  a passthrough value, so the client implementation can put
 //                  whatever it wants in here in order to calculate its RTT.
 //                  (for type "ping" and "echo")
 //
+// Extension Frames:
+//
+//   Frame types 2 through 247 are reserved for future extensions of the
+//   protocol. Extension frames follow the layout of data frames, with a Data
+//   Len followed by that much data, so that receivers which don't know an
+//   extension can still skip over it. The high bit of the frame type (128) is
+//   the must-understand bit:
+//
+//     2-127   - a receiver that doesn't know the frame type ignores the frame,
+//               for extensions that are merely an optimization or a hint
+//
+//     128-247 - a receiver that doesn't know the frame type resets the stream
+//               that the frame belongs to (see ErrUnknownFrame), for
+//               extensions that change the meaning of the stream's data
+//
+//   Extension frames don't count towards the transmit window. A sender should
+//   only send them once it knows that the peer speaks a version of the
+//   protocol that defines them, the bit only keeps older peers from
+//   misinterpreting them.
+//
+//   The fin frame (247) was carved out of this range in version 7. It has the
+//   layout of an extension frame with a Data Len of 0 and the must-understand
+//   bit set, so that older peers reset the stream rather than miss the end of
+//   its data, but unlike extension frames, it counts towards the transmit
+//   window and gets acked like a data frame.
+//
+// Stream IDs:
+//
+//   Stream IDs are scoped to a session and never reused within it. To leave
+//   room for streams opened by either end, the ID space is split by parity:
+//
+//     even IDs (0, 2, 4, ...) - streams opened by the client
+//
+//     odd IDs (1, 3, 5, ...)  - streams opened by the server, see "Pushed
+//                               Streams" below
+//
+//   Clients follow this convention regardless of protocol version. A client
+//   can therefore open at most 32768 streams on one session, after which it
+//   dials a new session (see DialerOpts.MaxStreamsPerConn). Clients that
+//   predate this convention allocate consecutive IDs, which servers still
+//   accept, so servers can't rely on odd IDs being free on their sessions.
+//
+// Pushed Streams:
+//
+//   Besides accepting the client's streams, a server can open streams to the
+//   client with Session.PushStream, which the client picks up with
+//   Session.AcceptStream. Pushed streams use odd IDs and otherwise work like
+//   any other stream. Since older clients use odd IDs themselves, a server
+//   only pushes streams on sessions with clients that speak version 5 or
+//   later and set the accepts pushed streams flag, see
+//   DialerOpts.AcceptPushedStreams. On other sessions, PushStream fails with
+//   ErrPushUnsupported.
+//
+//   Like a dialed stream, a pushed stream becomes known to the peer when the
+//   first frame for it arrives, which is its headers frame if it has headers.
+//   A client that hasn't opted in rejects any stream with an odd ID by
+//   responding with an rst, so the server's end of the stream closes cleanly
+//   rather than sending into the void.
+//
 // Flow Control:
 //
 //   Stream-level flow control is managed using windows similarly to HTTP/2.
@@ -188,6 +400,46 @@
 //     - if the client requests a window larger than what the server is willing
 //       to buffer, the server can adjust the window by sending an ACK with a
 //       negative value
+//     - a sender that wants to know when everything it sent has been consumed
+//       (see Stream.Sync) sends an ACK with the ack request bit set in its
+//       Frames field. The receiver responds by acking whatever it has
+//       consumed so far and acking again once it has consumed everything
+//       that's buffered. Ack requests need protocol version 6, on older
+//       Sessions Sync fails with ErrSyncUnsupported
+//
+// Closing Streams:
+//
+//   Closing a Stream flushes the data that's buffered for sending before the
+//   Stream is reset, see Stream.SetLinger. While that's going on, writes are
+//   handled as follows:
+//
+//     - data from Writes that returned before Close was called is flushed
+//     - a Write that's blocked when Close is called, for example because the
+//       transmit window is closed, fails with ErrStreamClosing unless its data
+//       was accepted into the send buffer before the flush began, in which
+//       case it's flushed like everything else. For Writes spanning several
+//       frames, the returned count tells how much was accepted.
+//     - Writes that start after Close was called fail with ErrStreamClosing
+//       while the flush is in progress and with ErrConnectionClosed once the
+//       Stream is closed. Nothing from these Writes is sent.
+//     - once the Stream has been reset, Writes fail with a *ResetError if it
+//       was reset by Stream.Reset, Stream.ResetAfterFlush (ErrStreamReset) or
+//       Session.ResetAll, for being idle longer than
+//       DialerOpts.StreamIdleTimeout (ErrStreamIdle), because of an unknown
+//       extension frame (ErrUnknownFrame) or because of headers that arrived
+//       after it was opened (ErrLateHeaders), with ErrSessionStalled if
+//       its Session was closed because of DialerOpts.WriteStallTimeout,
+//       otherwise with ErrConnectionClosed
+//
+//   From version 7 on, either end can also close just its sending side with
+//   Stream.CloseWrite, like a TCP half-close. This queues a fin frame behind
+//   the data that's buffered for sending, and Writes fail with ErrWriteClosed
+//   from then on. Once the peer has read everything that came before the fin,
+//   its Reads return io.EOF, while it can still write to the Stream. The peer
+//   counts the fin as consumed as soon as it arrives, so that an ack covering
+//   everything up to and including the fin means that the peer has consumed
+//   all of the data (see Stream.CloseWriteSync). The Stream is only torn down
+//   once Close is called, which still sends an RST as usual.
 //
 // Ping Protocol:
 //
@@ -203,6 +455,7 @@ package lampshade
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/binary"
 	"net"
 	"time"
@@ -218,6 +471,34 @@ const (
 	tsSize         = 8
 	maxSecretSize  = 32
 	metaIVSize     = 12
+	versionSize    = 1
+
+	// protocolVersion is the newest version of the protocol that we speak, see
+	// "Protocol Versions" above
+	protocolVersion = 8
+	// lameDuckVersion is the first version in which servers send lame duck
+	// frames
+	lameDuckVersion = 1
+	// oobVersion is the first version that supports out-of-band frames
+	oobVersion = 2
+	// rekeyVersion is the first version that supports rekey frames
+	rekeyVersion = 3
+	// checksumVersion is the first version that has Flags in the client init
+	// message, which can enable checksums
+	checksumVersion = 4
+	// pushVersion is the first version in which the client only opens streams
+	// with even IDs and may accept streams pushed by the server
+	pushVersion = 5
+	// ackRequestVersion is the first version in which ack frames may carry
+	// the ack request bit
+	ackRequestVersion = 6
+	// halfCloseVersion is the first version that supports fin frames
+	halfCloseVersion = 7
+	// headersVersion is the first version that supports headers frames
+	headersVersion = 8
+	// maxInitWindowSize is the largest window size that fits into the client
+	// init message alongside the version
+	maxInitWindowSize = 1<<((winSize-versionSize)*8) - 1
 
 	// NoEncryption is no encryption
 	NoEncryption = 1
@@ -226,6 +507,14 @@ const (
 	// ChaCha20Poly1305 is 256-bit ChaCha20Poly1305 with a 96-bit Nonce
 	ChaCha20Poly1305 = 3
 
+	// PaddingOAEPSHA256 is RSA OAEP with SHA-256 (the default)
+	PaddingOAEPSHA256 = 0
+	// PaddingOAEPSHA1 is RSA OAEP with SHA-1
+	PaddingOAEPSHA1 = 1
+	// PaddingPKCS1v15 is RSA PKCS #1 v1.5, only use this for interop with older
+	// servers
+	PaddingPKCS1v15 = 2
+
 	// framing
 	headerSize     = 3
 	lenSize        = 2
@@ -242,16 +531,30 @@ const (
 	maxSessionFrameSize = (2 << 15) - 1
 
 	// frame types
-	frameTypePadding = 0
-	frameTypeData    = 1
-	frameTypePing    = 252
-	frameTypeEcho    = 253
-	frameTypeACK     = 254
-	frameTypeRST     = 255
+	frameTypePadding  = 0
+	frameTypeData     = 1
+	frameTypeFin      = 247
+	frameTypeRekey    = 248
+	frameTypeOOB      = 249
+	frameTypeLameDuck = 250
+	frameTypeHeaders  = 251
+	frameTypePing     = 252
+	frameTypeEcho     = 253
+	frameTypeACK      = 254
+	frameTypeRST      = 255
+
+	// frameTypeMustUnderstand marks extension frame types that receivers which
+	// don't know them must not ignore, see "Extension Frames"
+	frameTypeMustUnderstand = 0x80
+
+	// ackRequestBit is set in the Frames field of ack frames that request an
+	// ack in return, see "Frames" above
+	ackRequestBit = 1 << 31
 
 	ackRatio          = 10 // ack every 1/10 of window
 	defaultWindowSize = 2 * 1024 * 1024 / MaxDataLen
 	maxID             = (2 << 15) - 1
+	maxClientStreams  = maxID/2 + 1 // the number of even stream IDs, see "Stream IDs"
 )
 
 var (
@@ -263,6 +566,50 @@ var (
 	// ErrListenerClosed indicates that an Accept was attempted on a closed
 	// listener.
 	ErrListenerClosed = &netError{"listener closed", false, false}
+	// ErrDialTimeout indicates that the DialFN didn't return a physical
+	// connection within DialerOpts.DialTimeout.
+	ErrDialTimeout = &netError{"dial timeout", true, true}
+	// ErrSendBufferFull indicates that a Write was refused because the Stream
+	// already had MaxQueuedFrames frames queued for sending.
+	ErrSendBufferFull = &netError{"send buffer full", false, true}
+	// ErrStreamClosing indicates that a Write was refused because the Stream
+	// is closing. Data written before the Stream started closing is still
+	// being flushed, see "Closing Streams" above.
+	ErrStreamClosing = &netError{"stream closing", false, false}
+	// ErrSessionRateLimited indicates that a dial needed a new session but
+	// DialerOpts.MaxSessionRate didn't allow opening one yet.
+	ErrSessionRateLimited = &netError{"session rate limited", false, true}
+	// ErrSessionRotated indicates that a dial found that the current session
+	// had reached DialerOpts.MaxStreamsPerConn and started replacing it, see
+	// DialerOpts.FailOnRotation.
+	ErrSessionRotated = &netError{"session rotated", false, true}
+	// ErrSessionStalled indicates that a Stream's Session was closed because
+	// writing to its physical connection made no progress for
+	// DialerOpts.WriteStallTimeout.
+	ErrSessionStalled = &netError{"session stalled", true, false}
+	// ErrStreamIdle indicates that a Stream was reset because no data was sent
+	// or received on it for DialerOpts.StreamIdleTimeout.
+	ErrStreamIdle = &ResetError{"idle timeout"}
+	// ErrUnknownFrame indicates that a Stream was reset because the peer sent a
+	// frame for it with a type that we don't know and that has the
+	// must-understand bit set, see "Extension Frames" above.
+	ErrUnknownFrame = &ResetError{"unknown frame type"}
+	// ErrLateHeaders indicates that a Stream was reset because the peer sent
+	// headers for it after it had already been opened.
+	ErrLateHeaders = &ResetError{"headers after stream opened"}
+	// ErrStreamReset indicates that a Stream was reset on this end with
+	// Stream.Reset or Stream.ResetAfterFlush.
+	ErrStreamReset = &ResetError{"reset locally"}
+	// ErrSyncUnsupported indicates that Sync was called on a Stream whose
+	// Session's protocol version doesn't support ack requests.
+	ErrSyncUnsupported = &netError{"sync not supported by protocol version", false, false}
+	// ErrCloseWriteUnsupported indicates that CloseWrite or CloseWriteSync was
+	// called on a Stream whose Session's protocol version doesn't support fin
+	// frames.
+	ErrCloseWriteUnsupported = &netError{"close write not supported by protocol version", false, false}
+	// ErrWriteClosed indicates that a Write was attempted after the Stream's
+	// sending side was closed with CloseWrite.
+	ErrWriteClosed = &netError{"write side closed", false, false}
 
 	binaryEncoding = binary.BigEndian
 
@@ -288,7 +635,23 @@ type StatsTracking interface {
 	EMARTT() time.Duration
 }
 
-// DialFN is a function that dials the server
+// FrameInterceptor is a hook that sees every session frame (a sequence of
+// coalesced stream frames) in plaintext, right before it's encrypted and sent
+// (outbound) or right after it's been received and decrypted (inbound). It
+// returns the frame to use in place of the original, which may be the
+// original itself, a modified copy, or nil to drop the frame entirely. The
+// only exception is the padding frame that's sent along with the client init
+// message, which the interceptor never sees.
+//
+// FrameInterceptor is meant for testing, fuzzing and protocol diagnostics. It
+// runs on the hot path of every session frame, so it should not be configured
+// in production.
+type FrameInterceptor func(outbound bool, frame []byte) []byte
+
+// DialFN is a function that dials the server. The Dialer leaves dialing the
+// physical connection entirely to the DialFN, so that's where to configure
+// things like the local address that new sessions should originate from, for
+// example with a net.Dialer's LocalAddr or with MultiDialWith.
 type DialFN func() (net.Conn, error)
 
 // Dialer provides an interface for opening new lampshade connections.
@@ -302,9 +665,41 @@ type Dialer interface {
 	// DialContext is the same as Dial but with the specific context.
 	DialContext(ctx context.Context, dial DialFN) (net.Conn, error)
 
+	// DialWithHeaders is like DialContext but attaches the given headers to the
+	// new stream. The headers are delivered to the server before any data and
+	// are available there via Stream.Headers(). If the encoded headers exceed
+	// MaxHeadersSize, this returns ErrHeadersTooLarge. Headers require
+	// protocol version 8 or later, otherwise this returns
+	// ErrHeadersUnsupported.
+	DialWithHeaders(ctx context.Context, dial DialFN, headers map[string]string) (net.Conn, error)
+
+	// HealthCheck checks whether the lampshade server is reachable and
+	// responsive by dialing a dedicated session and doing a ping round trip on
+	// it, bounded by ctx. The dedicated session is closed afterwards and
+	// doesn't affect the sessions used for regular streams, EMARTT, Stats,
+	// cipher fallback (see DialerOpts.FallbackCiphers) or GlobalStats, other
+	// than SessionGoroutines while it runs, and it isn't reported to ops.
+	HealthCheck(ctx context.Context, dial DialFN) error
+
 	// BoundTo returns a BoundDialer that uses the given DialFN to connect to the
 	// lampshade server.
 	BoundTo(dial DialFN) BoundDialer
+
+	// CanDialWithoutNewConn reports whether the next Dial can be served by an
+	// existing session without opening a new physical connection. This is
+	// useful for schedulers balancing across multiple Dialers.
+	CanDialWithoutNewConn() bool
+
+	// DialGroup returns a DialGroup whose Streams are all opened on the same
+	// Session, using the given DialFN if a new Session is needed.
+	DialGroup(ctx context.Context, dial DialFN) (DialGroup, error)
+
+	// Stats returns a snapshot of the Dialer's handshake statistics.
+	Stats() DialerStats
+
+	// Dump returns a snapshot of the Dialer's Sessions and Streams for
+	// diagnostics, for example to expose on a debug HTTP endpoint.
+	Dump() DialerDump
 }
 
 // BoundDialer is a Dialer bound to a specific DialFN for connecting to the
@@ -317,6 +712,16 @@ type BoundDialer interface {
 
 	// DialContext is the same as Dial but with the specific context.
 	DialContext(ctx context.Context) (net.Conn, error)
+
+	// DialWithHeaders is like DialContext but attaches the given headers to the
+	// new stream.
+	DialWithHeaders(ctx context.Context, headers map[string]string) (net.Conn, error)
+
+	// HealthCheck is like Dialer.HealthCheck using the bound DialFN.
+	HealthCheck(ctx context.Context) error
+
+	// DialGroup is like Dialer.DialGroup using the bound DialFN.
+	DialGroup(ctx context.Context) (DialGroup, error)
 }
 
 // Session is a wrapper around a net.Conn that supports multiplexing.
@@ -325,6 +730,85 @@ type Session interface {
 
 	// Wrapped() exposes access to the net.Conn that's wrapped by this Session.
 	Wrapped() net.Conn
+
+	// Stats() returns a snapshot of this Session's statistics.
+	Stats() SessionStats
+
+	// CreatedAt() returns the time at which this Session was established.
+	CreatedAt() time.Time
+
+	// LastActivity() returns the time at which this Session last sent or
+	// received data.
+	LastActivity() time.Time
+
+	// TLSConnectionState() returns the state of the TLS connection underlying
+	// this Session, looking through any wrapping conns. The bool is false if
+	// the physical connection isn't TLS.
+	TLSConnectionState() (*tls.ConnectionState, bool)
+
+	// ResetAll() aborts every open Stream on this Session and then closes the
+	// Session, for example when taking a server down for maintenance. Unlike a
+	// regular Close(), it doesn't wait for buffered data to be flushed. Each
+	// Stream is reset with an RST, and reads and writes on this end, including
+	// ones that are currently blocked, fail promptly with a *ResetError that
+	// carries the given reason. The reason isn't sent to the peer, whose
+	// Streams see an ordinary RST.
+	ResetAll(reason string) error
+
+	// Params() returns the parameters that this Session ended up with after
+	// the handshake, for example to reproduce a problem with
+	// StartTestSession.
+	Params() SessionParams
+
+	// LameDuck() indicates whether the server has told us that it's draining,
+	// in which case no new Streams are created on this Session. Only ever true
+	// on the dialing side, see "Lame Duck" above.
+	LameDuck() bool
+
+	// WindowPolicy() returns the WindowPolicy that this Session's Streams
+	// currently follow.
+	WindowPolicy() WindowPolicy
+
+	// SetWindowPolicy() switches this Session to a different WindowPolicy
+	// without reconnecting. It applies to new Streams as well as to the ones
+	// that are already open, see the built-in policies for how they treat
+	// windows that were opened under a different policy. Only the sending
+	// side is affected, the peer doesn't need to know.
+	SetWindowPolicy(policy WindowPolicy)
+
+	// PushStream() opens a new Stream from the server to the client, attaching
+	// the given headers if there are any, see "Pushed Streams" above. It's only
+	// supported on the listening side and only if the client accepts pushed
+	// streams, otherwise it returns ErrPushUnsupported. Headers also require
+	// protocol version 8 or later, otherwise it returns ErrHeadersUnsupported.
+	PushStream(headers map[string]string) (Stream, error)
+
+	// AcceptStream() waits for the server to push a Stream and returns it, or
+	// returns ErrConnectionClosed once the Session is closed. Up to 16 pushed
+	// Streams are buffered, beyond which the Session stops processing incoming
+	// frames until the application catches up. It's only supported on the
+	// dialing side with DialerOpts.AcceptPushedStreams, otherwise it returns
+	// ErrPushUnsupported.
+	AcceptStream() (Stream, error)
+}
+
+// LameDuckListener is implemented by the net.Listener returned by
+// WrapListener.
+type LameDuckListener interface {
+	net.Listener
+
+	// EnterLameDuck() puts the listener into lame duck mode, see "Lame Duck"
+	// above. Connections continue to be accepted and served, but clients that
+	// support it are told to open new streams elsewhere. There's no way back,
+	// lame duck mode lasts until the listener is closed.
+	EnterLameDuck()
+}
+
+// SessionStats is a point in time snapshot of a Session's statistics.
+type SessionStats struct {
+	// InFlightBytes is the number of bytes written across all of the Session's
+	// streams that have been sent but not yet acked by the peer.
+	InFlightBytes int64
 }
 
 // Stream is a net.Conn that also exposes access to the underlying Session
@@ -337,6 +821,171 @@ type Stream interface {
 	// Wrapped() exposes the wrapped connection (same thing as Session(), but
 	// implements netx.WrappedConn interface)
 	Wrapped() net.Conn
+
+	// ReadContext() is like Read() but also returns ctx.Err() if ctx is done
+	// before any data becomes available, which allows unblocking a waiting
+	// reader from another goroutine. Canceling doesn't consume any data, so the
+	// Stream can still be read from afterwards. The read deadline still
+	// applies.
+	ReadContext(ctx context.Context, b []byte) (int, error)
+
+	// ReadFull() is like Read() but waits until b is completely filled, for
+	// callers that read fixed-size records. It behaves like io.ReadFull on the
+	// Stream, except that the read deadline applies to the call as a whole. If
+	// the deadline passes first, ReadFull returns what it has read along with
+	// ErrTimeout. If the Stream ends partway through, it returns
+	// io.ErrUnexpectedEOF.
+	ReadFull(b []byte) (int, error)
+
+	// ReadFrame() is a lower-level alternative to Read() that returns the data
+	// of the next received frame without copying it. The returned release
+	// function must be called once the caller is done with the data, after
+	// which the data must not be used anymore. Releasing returns the underlying
+	// buffer to the pool and allows the frame to be acked. Don't mix calls to
+	// ReadFrame() and Read() from different goroutines.
+	ReadFrame() ([]byte, func(), error)
+
+	// ReadFrames() is for advanced high-throughput use. It copies the data of
+	// as many received frames as are already queued into bufs, one frame per
+	// slot, and returns the number of slots filled. Each filled slot is
+	// resliced to the length of its frame's data, so slots should have a
+	// capacity of at least MaxDataLen, otherwise frames get split across
+	// slots. If nothing is queued, ReadFrames waits for the first frame like
+	// Read() does, but it never waits to fill the remaining slots. All frames
+	// that are delivered get acked as usual.
+	ReadFrames(bufs [][]byte) (int, error)
+
+	// SetLinger() controls what happens to buffered data when the Stream is
+	// closed, analogous to net.TCPConn.SetLinger. If sec < 0 (the default),
+	// Close waits up to 30 seconds for buffered data to be flushed before the
+	// Stream is reset. If sec == 0, buffered data is discarded and the
+	// Stream is reset immediately. If sec > 0, buffered data is flushed for up
+	// to sec seconds before the Stream is reset.
+	SetLinger(sec int) error
+
+	// Reset() aborts the Stream right away, like Close() after SetLinger(0):
+	// buffered data is discarded, an RST is sent to the peer, and reads and
+	// writes on this end, including ones that are currently blocked, fail
+	// with ErrStreamReset. Data that's already on its way may still reach the
+	// peer, anything after it won't.
+	Reset()
+
+	// ResetAfterFlush() resets the Stream like Reset(), but only after
+	// everything that was written so far has been sent, so the peer reads all
+	// of it before it sees the RST. It blocks until the data has been sent or
+	// the flush timed out, like Close() does, except that SetLinger(0) is
+	// ignored since flushing is the point. A linger > 0 still limits how long
+	// it flushes. Reads and writes on this end fail with ErrStreamReset from
+	// the start, writes that are blocked when it's called fail too unless
+	// their data was already accepted into the send buffer.
+	ResetAfterFlush()
+
+	// SetWaterMarks() registers callbacks for application-driven backpressure.
+	// onHigh is called when the number of frames written to the Stream but not
+	// yet acked by the peer reaches high, and onLow is called when it
+	// subsequently drops back to low, so that the application can pause and
+	// resume producing data. Like WindowSize, the marks are counted in frames
+	// of up to MaxDataLen bytes. The callbacks run synchronously on the
+	// goroutine that crossed the mark, which may be the session's receive loop,
+	// so they must not block or call back into the Stream. high <= 0 disables
+	// the callbacks. Returns ErrInvalidWaterMarks unless 0 <= low < high.
+	SetWaterMarks(high, low int, onHigh, onLow func()) error
+
+	// WriteOOB() sends a small piece of urgent data, up to MaxOOBLen bytes,
+	// that the peer receives from ReadOOB() rather than Read(). Out-of-band
+	// data skips the Stream's send buffer and transmit window, so it overtakes
+	// any data written before it that's still waiting to be sent, and it
+	// arrives while the peer's reader is blocked or busy with regular data. It
+	// isn't ordered with respect to regular data in any other way, but
+	// out-of-band frames are delivered in the order in which they were
+	// written. Returns ErrOOBUnsupported unless the Session speaks protocol
+	// version 2 or later, see DialerOpts.ProtocolVersion.
+	WriteOOB(b []byte) error
+
+	// ReadOOB() returns a channel from which to receive out-of-band data sent
+	// by the peer with WriteOOB(). Up to 16 frames are buffered, beyond which
+	// out-of-band data is dropped until the application catches up. The
+	// channel is closed once the Stream is closed.
+	ReadOOB() <-chan []byte
+
+	// RTT() returns a moving average of the time between sending a frame on
+	// this Stream and receiving the peer's ack for it, or 0 if no frame has
+	// been acked yet. Unlike Dialer.EMARTT, this includes the time that frames
+	// spend queued behind the Stream's other frames and the time until the
+	// peer's application reads them, since that's when they get acked. Only
+	// one frame at a time is timed, so this is cheap but only updates about
+	// once per round trip.
+	RTT() time.Duration
+
+	// Headers() returns the headers that the dialing side attached when opening
+	// this Stream, or nil if there weren't any.
+	Headers() map[string]string
+
+	// SetUserData() associates arbitrary application data with this Stream,
+	// replacing whatever was set before, and UserData() returns it, or nil if
+	// nothing was set. This saves callers that keep track of many Streams from
+	// maintaining a separate map. Both are safe to call concurrently with each
+	// other and with any other method, but the Stream only holds on to the
+	// value, synchronizing access to whatever it points to is up to the
+	// caller. The value isn't sent to the peer and is kept after the Stream is
+	// closed.
+	SetUserData(data interface{})
+	UserData() interface{}
+
+	// Pause() stops acking the data that's read from this Stream, so that the
+	// peer stops sending once its transmit window is used up, without closing
+	// the Stream. Reads carry on with whatever has already arrived, which is at
+	// most a window's worth. Resume() acks everything that was read in the
+	// meantime, which lets the peer continue. This allows a proxy whose
+	// downstream is blocked to stop pulling data from upstream without
+	// buffering it. Nothing times out because of a pause, the Session keeps
+	// running as usual and the peer's Writes block rather than fail unless
+	// they have a deadline. Pausing and resuming more than once is harmless.
+	Pause()
+	Resume()
+
+	// ReadDeadline() and WriteDeadline() return the deadlines most recently set
+	// with SetDeadline(), SetReadDeadline() or SetWriteDeadline(), or the zero
+	// time if no deadline is set, so that callers can save and restore them.
+	ReadDeadline() time.Time
+	WriteDeadline() time.Time
+
+	// Sync() blocks until everything written to the Stream so far has been
+	// acked by the peer, meaning that the peer has consumed it. The wait is
+	// bounded by the write deadline, after which Sync returns ErrTimeout.
+	// Returns ErrSyncUnsupported unless the Session speaks protocol version 6
+	// or later.
+	// Calling Sync() before Close() confirms that a request was delivered in
+	// full before the Stream is torn down.
+	Sync() error
+
+	// CloseWrite() closes the sending side of the Stream, after which the peer
+	// reads io.EOF once it has read everything written before, and subsequent
+	// Writes fail with ErrWriteClosed. Reading carries on as usual. It waits
+	// for the fin frame to be queued behind the buffered data for up to the
+	// write deadline, but not for it to be sent. Close() still needs to be
+	// called once the Stream is done. Returns ErrCloseWriteUnsupported unless
+	// the Session speaks protocol version 7 or later, see "Closing Streams"
+	// above.
+	CloseWrite() error
+
+	// CloseWriteSync() is CloseWrite() followed by Sync(), so it only returns
+	// once the peer has consumed everything written to the Stream and received
+	// the fin. This is how a client confirms that a request was delivered in
+	// full before it waits for the response.
+	CloseWriteSync() error
+
+	// WriteMessage() and ReadMessage() provide a message mode on top of the
+	// Stream. Ordinarily, a Stream is a byte stream like TCP, so the boundaries
+	// of Writes aren't visible to the reader and may not line up with frames.
+	// In message mode, each message is length-prefixed so that ReadMessage()
+	// returns exactly the messages passed to WriteMessage() on the other end.
+	// Messages are limited to MaxMessageSize. Message mode and regular
+	// Reads/Writes shouldn't be mixed in the same direction. If a deadline
+	// expires partway through a message, the boundaries can no longer be
+	// relied upon and the Stream should be closed.
+	WriteMessage(b []byte) error
+	ReadMessage() ([]byte, error)
 }
 
 // BufferPool is a pool of reusable buffers
@@ -415,6 +1064,16 @@ func ackWithFrames(header []byte, frames int32) []byte {
 	return ack
 }
 
+// ackRequest returns an ack frame for the stream with the given header that
+// acks nothing and requests an ack in return.
+func ackRequest(header []byte) []byte {
+	ack := make([]byte, ackFrameSize)
+	copy(ack[winSize:], header)
+	ack[winSize] = frameTypeACK
+	binaryEncoding.PutUint32(ack, ackRequestBit)
+	return ack
+}
+
 func ping() []byte {
 	// note - header and ts field are reversed to match the usual format for
 	// data frames
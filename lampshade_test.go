@@ -0,0 +1,58 @@
+package lampshade
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testWindowSize = 25
+)
+
+var (
+	testPool       = NewBufferPool(10 * 1024 * 1024)
+	testKey        *rsa.PrivateKey
+	generateKeyErr error
+	generateKey    sync.Once
+)
+
+func testPrivateKey(t testing.TB) *rsa.PrivateKey {
+	generateKey.Do(func() {
+		testKey, generateKeyErr = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	require.NoError(t, generateKeyErr)
+	return testKey
+}
+
+// newTestPair starts a lampshade listener on a local port and returns it
+// together with a Dialer and DialFN for connecting to it. If configure is
+// provided, it can customize the DialerOpts before the Dialer is built.
+func newTestPair(t testing.TB, listenerOpts *ListenerOpts, configure func(opts *DialerOpts)) (net.Listener, Dialer, DialFN) {
+	pk := testPrivateKey(t)
+	wrapped, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	if listenerOpts == nil {
+		listenerOpts = &ListenerOpts{}
+	}
+	l := WrapListener(wrapped, testPool, pk, listenerOpts)
+
+	opts := &DialerOpts{
+		WindowSize:      testWindowSize,
+		Pool:            testPool,
+		Cipher:          AES128GCM,
+		ServerPublicKey: &pk.PublicKey,
+	}
+	if configure != nil {
+		configure(opts)
+	}
+	d := NewDialer(opts)
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", wrapped.Addr().String())
+	}
+	return l, d, dial
+}
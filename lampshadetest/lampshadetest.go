@@ -0,0 +1,128 @@
+// Package lampshadetest provides helpers for testing code built on top of
+// lampshade without using real network connections.
+//
+// Usage:
+//
+//	l, d, err := lampshadetest.NewPair(nil, nil)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer l.Close()
+//	go serve(l)
+//	conn, err := d.Dial()
+package lampshadetest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/l2dy/plampshade"
+)
+
+const (
+	// poolSize is the size of the BufferPool used when the DialerOpts don't
+	// specify one
+	poolSize = 10 * 1024 * 1024
+)
+
+var (
+	// errClosed is returned by the pipe listener's Accept and by the DialFN
+	// once the listener has been closed
+	errClosed = errors.New("pipe listener closed")
+
+	generateKeyOnce sync.Once
+	key             *rsa.PrivateKey
+	generateKeyErr  error
+)
+
+// NewPair returns a lampshade Listener and a Dialer bound to it that are
+// connected in memory. Every physical connection the Dialer opens is one end of
+// a net.Pipe, whose other end the Listener accepts and performs the lampshade
+// handshake on, so everything except the network behaves as in production.
+// Once the Listener is closed, the Dialer can't establish new sessions anymore,
+// like with a server that went away.
+//
+// Either opts may be nil. Unless the DialerOpts specify otherwise, the pair
+// shares a BufferPool and uses an RSA key that's generated once per process.
+// The given DialerOpts are copied rather than modified.
+func NewPair(listenerOpts *lampshade.ListenerOpts, dialerOpts *lampshade.DialerOpts) (net.Listener, lampshade.BoundDialer, error) {
+	generateKeyOnce.Do(func() {
+		key, generateKeyErr = rsa.GenerateKey(rand.Reader, 2048)
+	})
+	if generateKeyErr != nil {
+		return nil, nil, generateKeyErr
+	}
+
+	if listenerOpts == nil {
+		listenerOpts = &lampshade.ListenerOpts{}
+	}
+	opts := &lampshade.DialerOpts{}
+	if dialerOpts != nil {
+		*opts = *dialerOpts
+	}
+	if opts.Pool == nil {
+		opts.Pool = lampshade.NewBufferPool(poolSize)
+	}
+	if opts.ServerPublicKey == nil {
+		opts.ServerPublicKey = &key.PublicKey
+	}
+
+	pl := newPipeListener()
+	l := lampshade.WrapListener(pl, opts.Pool, key, listenerOpts)
+	return l, lampshade.NewDialer(opts).BoundTo(pl.dial), nil
+}
+
+// pipeListener is a net.Listener that accepts the server ends of net.Pipes
+// created by dial.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (pl *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case pl.conns <- server:
+		return client, nil
+	case <-pl.closed:
+		client.Close()
+		server.Close()
+		return nil, errClosed
+	}
+}
+
+func (pl *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-pl.conns:
+		return conn, nil
+	case <-pl.closed:
+		return nil, errClosed
+	}
+}
+
+func (pl *pipeListener) Close() error {
+	pl.closeOnce.Do(func() {
+		close(pl.closed)
+	})
+	return nil
+}
+
+func (pl *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,41 @@
+package lampshadetest
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewPair(t *testing.T) {
+	l, d, err := NewPair(nil, nil)
+	require.NoError(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		conn, err := d.Dial()
+		require.NoError(t, err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		b := make([]byte, 5)
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+		conn.Close()
+	}
+
+	l.Close()
+	_, err = l.Accept()
+	assert.Error(t, err)
+}
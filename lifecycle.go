@@ -0,0 +1,86 @@
+package lampshade
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LifecycleHooks are optional callbacks for observing sessions and streams as
+// they open and close, for example to record them as spans in a distributed
+// tracing system. Integrations with such systems can live in their own modules
+// and just set these, so that lampshade itself doesn't depend on them. Any of
+// the hooks may be nil. They're called from the session's goroutines, so they
+// must be quick and must not block. Probe sessions, see Dialer.HealthCheck,
+// don't trigger any hooks.
+type LifecycleHooks struct {
+	// OnSessionStarted is called when a session starts. On the client, that's
+	// once the client init message has been sent, before the server responds.
+	OnSessionStarted func(s Session)
+
+	// OnHandshakeComplete is called on the client when the first frame from
+	// the server arrives, which completes the handshake that began at
+	// handshakeStart, when dialing started.
+	OnHandshakeComplete func(s Session, handshakeStart time.Time)
+
+	// OnSessionClosed is called when a session starts closing. Streams that
+	// are still open close right after, with the reason "session closed".
+	OnSessionClosed func(s Session)
+
+	// OnStreamOpened is called when a stream is opened, by either end.
+	OnStreamOpened func(c Stream)
+
+	// OnStreamClosed is called when a stream closes.
+	OnStreamClosed func(c Stream, info StreamCloseInfo)
+}
+
+// StreamCloseInfo describes a stream that closed, see
+// LifecycleHooks.OnStreamClosed.
+type StreamCloseInfo struct {
+	// Reason is why the stream closed, as in the close_reason field logged with
+	// DialerOpts.StreamLogLevel.
+	Reason string
+
+	BytesRead    int64
+	BytesWritten int64
+	Duration     time.Duration
+}
+
+func (s *session) onStarted() {
+	if s.hooks != nil && s.hooks.OnSessionStarted != nil {
+		s.hooks.OnSessionStarted(s)
+	}
+}
+
+func (s *session) onHandshakeComplete() {
+	if s.hooks != nil && s.hooks.OnHandshakeComplete != nil {
+		s.hooks.OnHandshakeComplete(s, s.handshakeStart)
+	}
+}
+
+func (s *session) onClosed() {
+	if s.hooks != nil && s.hooks.OnSessionClosed != nil {
+		s.hooks.OnSessionClosed(s)
+	}
+}
+
+// onOpened logs and reports that the stream was opened.
+func (c *stream) onOpened() {
+	c.logOpened()
+	if hooks := c.session.hooks; hooks != nil && hooks.OnStreamOpened != nil {
+		hooks.OnStreamOpened(c)
+	}
+}
+
+// onClosed reports that the stream closed for the given reason. Unlike
+// logClosed, it must be called without holding c.mx, since the hook may use
+// the stream.
+func (c *stream) onClosed(reason string) {
+	if hooks := c.session.hooks; hooks != nil && hooks.OnStreamClosed != nil {
+		hooks.OnStreamClosed(c, StreamCloseInfo{
+			Reason:       reason,
+			BytesRead:    atomic.LoadInt64(&c.bytesRead),
+			BytesWritten: atomic.LoadInt64(&c.bytesWritten),
+			Duration:     time.Since(c.openedAt),
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package lampshade
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hookRecorder records the events reported through its LifecycleHooks.
+type hookRecorder struct {
+	events     []string
+	closeInfos []StreamCloseInfo
+	mx         sync.Mutex
+}
+
+func (r *hookRecorder) record(event string) {
+	r.mx.Lock()
+	r.events = append(r.events, event)
+	r.mx.Unlock()
+}
+
+func (r *hookRecorder) hooks() *LifecycleHooks {
+	return &LifecycleHooks{
+		OnSessionStarted: func(s Session) {
+			r.record("session started")
+		},
+		OnHandshakeComplete: func(s Session, handshakeStart time.Time) {
+			r.record(fmt.Sprintf("handshake complete %v", !handshakeStart.IsZero() && time.Since(handshakeStart) > 0))
+		},
+		OnSessionClosed: func(s Session) {
+			r.record("session closed")
+		},
+		OnStreamOpened: func(c Stream) {
+			r.record("stream opened")
+		},
+		OnStreamClosed: func(c Stream, info StreamCloseInfo) {
+			r.mx.Lock()
+			r.closeInfos = append(r.closeInfos, info)
+			r.mx.Unlock()
+			r.record("stream closed")
+		},
+	}
+}
+
+// waitFor waits until n events have been recorded and returns them.
+func (r *hookRecorder) waitFor(t *testing.T, n int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mx.Lock()
+		events := append([]string(nil), r.events...)
+		r.mx.Unlock()
+		if len(events) >= n || time.Now().After(deadline) {
+			return events
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	var client, server hookRecorder
+	l, d, dial := newTestPair(t, &ListenerOpts{Hooks: server.hooks()}, func(opts *DialerOpts) {
+		opts.Hooks = client.hooks()
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	_, err = io.ReadFull(serverConn, make([]byte, 5))
+	require.NoError(t, err)
+	_, err = serverConn.Write([]byte("hi"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 2))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	// otherwise the server may see the session close before the stream
+	server.waitFor(t, 3)
+	require.NoError(t, conn.(Stream).Session().Close())
+
+	// the handshake may complete before or after the stream opens
+	events := client.waitFor(t, 5)
+	assert.ElementsMatch(t, []string{"session started", "stream opened", "handshake complete true", "stream closed", "session closed"}, events)
+	assert.Equal(t, "session started", events[0])
+	assert.Equal(t, "session closed", events[len(events)-1])
+	assert.Equal(t, []string{"session started", "stream opened", "stream closed", "session closed"}, server.waitFor(t, 4))
+	client.mx.Lock()
+	assert.Equal(t, StreamCloseInfo{Reason: closeReasonLocal, BytesRead: 2, BytesWritten: 5}, withoutDuration(client.closeInfos[0]))
+	client.mx.Unlock()
+	server.mx.Lock()
+	assert.Equal(t, StreamCloseInfo{Reason: closeReasonPeer, BytesRead: 5, BytesWritten: 2}, withoutDuration(server.closeInfos[0]))
+	server.mx.Unlock()
+
+	// health checks don't trigger hooks
+	var probed hookRecorder
+	l, d, dial = newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.Hooks = probed.hooks()
+	})
+	defer l.Close()
+	require.NoError(t, d.HealthCheck(context.Background(), dial))
+	time.Sleep(100 * time.Millisecond)
+	assert.Empty(t, probed.waitFor(t, 0))
+}
+
+func withoutDuration(info StreamCloseInfo) StreamCloseInfo {
+	info.Duration = 0
+	return info
+}
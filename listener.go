@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"math"
 	"net"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -23,6 +24,22 @@ type ListenerOpts struct {
 	// AckOnFirst forces an immediate ACK after receiving the first frame, which could help defeat timing attacks
 	AckOnFirst bool
 
+	// AckJitter, if > 0, delays acks by a random duration up to this value to
+	// avoid bursts of acks when many streams ack at the same time.
+	AckJitter time.Duration
+
+	// AckShards, if > 1, spreads acks across this many channels to reduce
+	// contention, see DialerOpts.AckShards.
+	AckShards int
+
+	// FramePriority, if set, is the order in which the session's writer picks
+	// frames of different classes, see DialerOpts.FramePriority.
+	FramePriority []FrameClass
+
+	// AdaptiveAcks, if true, adapts how often streams ack to how quickly the
+	// application reads from them, see DialerOpts.AdaptiveAcks.
+	AdaptiveAcks bool
+
 	// InitMsgTimeout controls how long the listener will wait before responding to bad client init
 	// messages. This applies in 3 situations:
 	//   1. The client has sent some, but not all of the init message. This situation is salvagable
@@ -49,6 +66,87 @@ type ListenerOpts struct {
 	// against replay attacks.
 	MaxClientInitAge time.Duration
 
+	// ReceiveBufferDepth controls how many received frames are buffered per
+	// stream, see DialerOpts.ReceiveBufferDepth. If <= 0, defaults to the
+	// window size requested by the client.
+	ReceiveBufferDepth int
+
+	// MaxReceiveBufferBytes, if > 0, also limits received frames buffered per
+	// stream by their size in bytes, see DialerOpts.MaxReceiveBufferBytes.
+	MaxReceiveBufferBytes int
+
+	// UnlimitedWindow, if true, lets streams send without waiting for acks, see
+	// DialerOpts.UnlimitedWindow for the tradeoffs.
+	UnlimitedWindow bool
+
+	// SlowStartWindow, if > 0, starts streams with a smaller transmit window
+	// that grows as acks arrive, see DialerOpts.SlowStartWindow.
+	SlowStartWindow int
+
+	// InitialBurst, if > 0, limits how many frames a new stream sends before
+	// the first ack, see DialerOpts.InitialBurst.
+	InitialBurst int
+
+	// WindowPolicy, if set, is the initial window policy of new sessions, see
+	// DialerOpts.WindowPolicy. Takes precedence over UnlimitedWindow,
+	// SlowStartWindow and InitialBurst.
+	WindowPolicy WindowPolicy
+
+	// MaxQueuedFrames, if > 0, makes Writes fail with ErrSendBufferFull rather
+	// than block once a stream has this many frames queued for sending, see
+	// DialerOpts.MaxQueuedFrames.
+	MaxQueuedFrames int
+
+	// MaxUnackedBytes, if > 0, makes streams stop sending once this many bytes
+	// haven't been acked by the client yet, see DialerOpts.MaxUnackedBytes.
+	MaxUnackedBytes int
+
+	// KeepAliveInterval, if > 0, sends an empty frame whenever nothing else has
+	// been sent on a session for this long, to keep middleboxes like NATs from
+	// dropping idle connections. Defaults to 0 (disabled).
+	KeepAliveInterval time.Duration
+
+	// WriteStallTimeout, if > 0, closes sessions whose physical connection
+	// doesn't finish writing a session frame within this long, see
+	// DialerOpts.WriteStallTimeout.
+	WriteStallTimeout time.Duration
+
+	// StreamIdleTimeout, if > 0, resets streams on which no data has been sent
+	// or received for this long, see DialerOpts.StreamIdleTimeout.
+	StreamIdleTimeout time.Duration
+
+	// MaxSessionFrameSize, if > 0, limits the size of the session frames that
+	// we send, see DialerOpts.MaxSessionFrameSize.
+	MaxSessionFrameSize int
+
+	// RekeyBytes and RekeyInterval, if > 0, make sessions switch to a new key
+	// for sending after sending that many bytes or for that long with the
+	// current one, see DialerOpts.RekeyBytes. Only applies to sessions with
+	// clients that speak protocol version 3 or later.
+	RekeyBytes    int64
+	RekeyInterval time.Duration
+
+	// InitMsgPaddings lists the RSA padding schemes accepted for client init
+	// messages, which are tried in order. Defaults to only PaddingOAEPSHA256.
+	// Accepting PaddingPKCS1v15 allows older clients to connect but is weaker.
+	InitMsgPaddings []InitMsgPadding
+
+	// FrameInterceptor is an optional hook for observing and modifying frames,
+	// for testing and diagnostics only.
+	FrameInterceptor FrameInterceptor
+
+	// OnFrameDropped is an optional callback that's invoked whenever a frame
+	// is dropped, see DialerOpts.OnFrameDropped.
+	OnFrameDropped func(streamID uint16, reason FrameDropReason)
+
+	// StreamLogLevel, if set, logs every stream that's opened or closed at this
+	// level, see DialerOpts.StreamLogLevel.
+	StreamLogLevel log.Level
+
+	// Hooks are optional callbacks for observing sessions and streams as they
+	// open and close, see DialerOpts.Hooks.
+	Hooks *LifecycleHooks
+
 	// Optional callback for errors that arise when accepting connectinos
 	OnError func(net.Conn, error)
 }
@@ -66,6 +164,10 @@ func (opts *ListenerOpts) withDefaults() *ListenerOpts {
 		out.MaxClientInitAge = forever
 	}
 
+	if len(out.InitMsgPaddings) == 0 {
+		out.InitMsgPaddings = []InitMsgPadding{PaddingOAEPSHA256}
+	}
+
 	if out.OnError == nil {
 		out.OnError = func(net.Conn, error) {}
 	}
@@ -82,6 +184,7 @@ type listener struct {
 	keyCache *lru.Cache
 	errCh    chan error
 	connCh   chan net.Conn
+	lameDuck int32
 }
 
 // WrapListener wraps the given listener with support for multiplexing. Only
@@ -136,6 +239,10 @@ func (l *listener) Addr() net.Addr {
 	return l.wrapped.Addr()
 }
 
+func (l *listener) EnterLameDuck() {
+	atomic.StoreInt32(&l.lameDuck, 1)
+}
+
 func (l *listener) Close() error {
 	ops.Go(func() {
 		l.errCh <- ErrListenerClosed
@@ -223,7 +330,7 @@ func (l *listener) doOnConn(conn net.Conn) error {
 		return consumeInboundTillDeadlineThenFail(fullErr)
 	}
 
-	windowSize, maxPadding, cs, ts, err := decodeClientInitMsg(l.serverPrivateKey, initMsg)
+	windowSize, maxPadding, flags, cs, ts, version, err := decodeClientInitMsg(l.serverPrivateKey, l.opts.InitMsgPaddings, initMsg)
 	var fullErr error
 	if err != nil {
 		fullErr = fmt.Errorf("Unable to decode client init msg from %v: %v", conn.RemoteAddr(), err)
@@ -244,6 +351,36 @@ func (l *listener) doOnConn(conn net.Conn) error {
 
 	clearReadDeadline(conn)
 	unpauseIdleTiming()
-	startSession(conn, windowSize, maxPadding, l.opts.AckOnFirst, 0, cs.reversed(), nil, l.pool, nil, l.connCh, nil)
+	opts := &sessionOpts{
+		version:             version,
+		windowSize:          windowSize,
+		windowPolicy:        windowPolicyFor(l.opts.WindowPolicy, l.opts.UnlimitedWindow, l.opts.SlowStartWindow, l.opts.InitialBurst),
+		maxQueuedFrames:     l.opts.MaxQueuedFrames,
+		maxUnackedBytes:     l.opts.MaxUnackedBytes,
+		receiveBufferDepth:  l.opts.ReceiveBufferDepth,
+		maxReceiveBytes:     l.opts.MaxReceiveBufferBytes,
+		maxPadding:          maxPadding,
+		ackOnFirst:          l.opts.AckOnFirst,
+		ackJitter:           l.opts.AckJitter,
+		ackShards:           l.opts.AckShards,
+		framePriority:       l.opts.FramePriority,
+		adaptiveAcks:        l.opts.AdaptiveAcks,
+		keepAliveInterval:   l.opts.KeepAliveInterval,
+		writeStallTimeout:   l.opts.WriteStallTimeout,
+		streamIdleTimeout:   l.opts.StreamIdleTimeout,
+		maxSessionFrameSize: l.opts.MaxSessionFrameSize,
+		rekeyBytes:          l.opts.RekeyBytes,
+		rekeyInterval:       l.opts.RekeyInterval,
+		frameInterceptor:    l.opts.FrameInterceptor,
+		onFrameDropped:      l.opts.OnFrameDropped,
+		streamLogLevel:      l.opts.StreamLogLevel,
+		hooks:               l.opts.Hooks,
+		checksums:           flags&flagChecksums != 0,
+		pushEnabled:         version >= pushVersion && flags&flagAcceptPush != 0,
+	}
+	s, err := startSession(conn, opts, cs.reversed(), nil, l.pool, nil, l.connCh, nil)
+	if err == nil && version >= lameDuckVersion && atomic.LoadInt32(&l.lameDuck) == 1 {
+		s.sendLameDuck()
+	}
 	return nil
 }
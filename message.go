@@ -0,0 +1,53 @@
+package lampshade
+
+import (
+	"errors"
+	"io"
+)
+
+const (
+	messageLenSize = 4
+
+	// MaxMessageSize is the largest message that can be sent with WriteMessage.
+	MaxMessageSize = 16 * 1024 * 1024
+)
+
+var (
+	// ErrMessageTooLarge indicates that a message exceeds MaxMessageSize, either
+	// when writing it or when reading a message announced by the peer.
+	ErrMessageTooLarge = errors.New("message too large")
+)
+
+// WriteMessage writes b as a single message, prefixed by its length. Messages
+// written this way don't get interleaved with concurrent calls to Write or
+// WriteMessage.
+func (c *stream) WriteMessage(b []byte) error {
+	if len(b) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	msg := make([]byte, messageLenSize+len(b))
+	binaryEncoding.PutUint32(msg, uint32(len(b)))
+	copy(msg[messageLenSize:], b)
+	_, err := c.Write(msg)
+	return err
+}
+
+// ReadMessage reads the next message written by the peer with WriteMessage.
+func (c *stream) ReadMessage() ([]byte, error) {
+	lenBuf := make([]byte, messageLenSize)
+	_, err := io.ReadFull(c, lenBuf)
+	if err != nil {
+		return nil, err
+	}
+	msgLen := binaryEncoding.Uint32(lenBuf)
+	if msgLen > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	msg := make([]byte, msgLen)
+	_, err = io.ReadFull(c, msg)
+	if err == io.EOF {
+		// stream ended in the middle of the message
+		err = io.ErrUnexpectedEOF
+	}
+	return msg, err
+}
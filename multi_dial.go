@@ -0,0 +1,215 @@
+package lampshade
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/l2dy/plampshade/ema"
+)
+
+const (
+	// minAddrBackoff is how long MultiDial avoids an address after it first
+	// fails to dial. The backoff doubles with each consecutive failure up to
+	// maxAddrBackoff.
+	minAddrBackoff = 1 * time.Second
+	maxAddrBackoff = 1 * time.Minute
+)
+
+var errNoAddrs = errors.New("no addresses to dial")
+
+// DialCandidate describes one of the addresses that a DialStrategy can choose
+// from.
+type DialCandidate struct {
+	// Addr is the address to dial.
+	Addr string
+
+	// ConnectTime is a moving average of how long successful dials to Addr
+	// took, or 0 if Addr hasn't been dialed successfully yet.
+	ConnectTime time.Duration
+
+	// Failures is the number of consecutive failed dials to Addr.
+	Failures int
+}
+
+// DialStrategy decides which address MultiDial dials next.
+type DialStrategy interface {
+	// Pick returns the index of the candidate to dial. candidates is never
+	// empty. Pick may be called concurrently.
+	Pick(candidates []DialCandidate) int
+}
+
+// DialStrategyFunc adapts a function to a DialStrategy.
+type DialStrategyFunc func(candidates []DialCandidate) int
+
+func (fn DialStrategyFunc) Pick(candidates []DialCandidate) int {
+	return fn(candidates)
+}
+
+// RoundRobin returns a DialStrategy that cycles through the candidates.
+func RoundRobin() DialStrategy {
+	var next uint64
+	return DialStrategyFunc(func(candidates []DialCandidate) int {
+		return int((atomic.AddUint64(&next, 1) - 1) % uint64(len(candidates)))
+	})
+}
+
+// Random returns a DialStrategy that picks a candidate at random.
+func Random() DialStrategy {
+	return DialStrategyFunc(func(candidates []DialCandidate) int {
+		return rand.Intn(len(candidates))
+	})
+}
+
+// LowestLatency returns a DialStrategy that picks the candidate with the
+// lowest ConnectTime. Candidates that haven't been dialed successfully yet are
+// tried first so that every address gets measured.
+func LowestLatency() DialStrategy {
+	return DialStrategyFunc(func(candidates []DialCandidate) int {
+		best := 0
+		for i, candidate := range candidates {
+			if candidate.ConnectTime == 0 {
+				return i
+			}
+			if candidate.ConnectTime < candidates[best].ConnectTime {
+				best = i
+			}
+		}
+		return best
+	})
+}
+
+// MultiDial returns a DialFN that dials one of the given TCP addresses, chosen
+// by strategy. If strategy is nil, it defaults to RoundRobin.
+//
+// MultiDial keeps track of failures per address. After an address fails to
+// dial, it's left out of the candidates for a backoff period that starts at
+// one second and doubles with each consecutive failure, up to a minute. If a
+// dial fails, the DialFN tries the remaining candidates before giving up and
+// returning the last error. If every address is backing off, all of them are
+// candidates again so that dials don't fail outright.
+func MultiDial(addrs []string, strategy DialStrategy) DialFN {
+	return MultiDialWith(&net.Dialer{}, addrs, strategy)
+}
+
+// MultiDialWith is like MultiDial but dials with the given net.Dialer, which
+// allows configuring things like timeouts or the local address to dial from.
+// On multi-homed hosts, setting the net.Dialer's LocalAddr to a *net.TCPAddr
+// makes new sessions originate from that IPv4 or IPv6 address. Leave its Port
+// at 0 to use an ephemeral port. Addresses of the other IP version than
+// LocalAddr can't be dialed and count as failed dials.
+func MultiDialWith(dialer *net.Dialer, addrs []string, strategy DialStrategy) DialFN {
+	return newMultiDialer(addrs, strategy, func(addr string) (net.Conn, error) {
+		return dialer.Dial("tcp", addr)
+	}).Dial
+}
+
+func newMultiDialer(addrs []string, strategy DialStrategy, dial func(addr string) (net.Conn, error)) *multiDialer {
+	if strategy == nil {
+		strategy = RoundRobin()
+	}
+	md := &multiDialer{strategy: strategy, dial: dial}
+	for _, addr := range addrs {
+		md.addrs = append(md.addrs, &dialAddr{addr: addr, connectTime: ema.NewDuration(0, 0.5)})
+	}
+	return md
+}
+
+type multiDialer struct {
+	addrs    []*dialAddr
+	strategy DialStrategy
+	dial     func(addr string) (net.Conn, error)
+}
+
+type dialAddr struct {
+	addr         string
+	connectTime  *ema.EMA
+	failures     int
+	backoffUntil time.Time
+	mx           sync.Mutex
+}
+
+func (md *multiDialer) Dial() (net.Conn, error) {
+	err := errNoAddrs
+	tried := make(map[*dialAddr]bool, len(md.addrs))
+	for len(tried) < len(md.addrs) {
+		addrs, candidates := md.candidates(tried)
+		addr := addrs[md.strategy.Pick(candidates)]
+		tried[addr] = true
+		var conn net.Conn
+		start := time.Now()
+		conn, err = md.dial(addr.addr)
+		addr.record(time.Since(start), err)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// candidates returns the addresses that haven't been tried yet and aren't
+// backing off, together with their DialCandidates. If all untried addresses
+// are backing off, it returns all of them.
+func (md *multiDialer) candidates(tried map[*dialAddr]bool) ([]*dialAddr, []DialCandidate) {
+	now := time.Now()
+	var untried, available []*dialAddr
+	for _, addr := range md.addrs {
+		if tried[addr] {
+			continue
+		}
+		untried = append(untried, addr)
+		if !addr.backingOff(now) {
+			available = append(available, addr)
+		}
+	}
+	if len(available) == 0 {
+		available = untried
+	}
+	candidates := make([]DialCandidate, 0, len(available))
+	for _, addr := range available {
+		candidates = append(candidates, addr.candidate())
+	}
+	return available, candidates
+}
+
+func (addr *dialAddr) backingOff(now time.Time) bool {
+	addr.mx.Lock()
+	defer addr.mx.Unlock()
+	return now.Before(addr.backoffUntil)
+}
+
+func (addr *dialAddr) candidate() DialCandidate {
+	addr.mx.Lock()
+	failures := addr.failures
+	addr.mx.Unlock()
+	return DialCandidate{
+		Addr:        addr.addr,
+		ConnectTime: addr.connectTime.GetDuration(),
+		Failures:    failures,
+	}
+}
+
+func (addr *dialAddr) record(elapsed time.Duration, err error) {
+	if err == nil {
+		addr.connectTime.UpdateDuration(elapsed)
+	}
+	addr.mx.Lock()
+	defer addr.mx.Unlock()
+	if err == nil {
+		addr.failures = 0
+		addr.backoffUntil = time.Time{}
+		return
+	}
+	addr.failures++
+	backoff := maxAddrBackoff
+	if shift := uint(addr.failures - 1); shift < 6 {
+		backoff = minAddrBackoff << shift
+	}
+	if backoff > maxAddrBackoff {
+		backoff = maxAddrBackoff
+	}
+	addr.backoffUntil = time.Now().Add(backoff)
+}
@@ -0,0 +1,87 @@
+package lampshade
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiDial(t *testing.T) {
+	dialed := make(map[string]int)
+	down := map[string]bool{"b": true}
+	md := newMultiDialer([]string{"a", "b", "c"}, RoundRobin(), func(addr string) (net.Conn, error) {
+		dialed[addr]++
+		if down[addr] {
+			return nil, errors.New("down")
+		}
+		client, server := net.Pipe()
+		server.Close()
+		return client, nil
+	})
+
+	for i := 0; i < 6; i++ {
+		conn, err := md.Dial()
+		require.NoError(t, err)
+		conn.Close()
+	}
+	assert.Equal(t, 1, dialed["b"], "failed address should have been skipped while backing off")
+	assert.Equal(t, 6, dialed["a"]+dialed["c"], "every dial should have succeeded on one of the remaining addresses")
+	assert.True(t, dialed["a"] >= 2 && dialed["c"] >= 2, "dials should have been spread across the remaining addresses: %v", dialed)
+
+	// when everything is down, all addresses get tried and the last error is
+	// returned
+	down["a"], down["c"] = true, true
+	_, err := md.Dial()
+	assert.EqualError(t, err, "down")
+	_, err = md.Dial()
+	assert.EqualError(t, err, "down", "should keep trying addresses that are backing off rather than fail outright")
+}
+
+func TestMultiDialWithLocalAddr(t *testing.T) {
+	for _, ips := range []struct{ listen, local string }{
+		// on Linux, the whole 127.0.0.0/8 is bound to loopback, which lets us
+		// check that we're not just getting the default local address
+		{"127.0.0.1", "127.0.0.2"},
+		{"::1", "::1"},
+	} {
+		t.Run(ips.local, func(t *testing.T) {
+			l, err := net.Listen("tcp", net.JoinHostPort(ips.listen, "0"))
+			if err != nil {
+				t.Skipf("%v not available: %v", ips.listen, err)
+			}
+			defer l.Close()
+
+			localAddr := &net.TCPAddr{IP: net.ParseIP(ips.local)}
+			dial := MultiDialWith(&net.Dialer{LocalAddr: localAddr}, []string{l.Addr().String()}, nil)
+			conn, err := dial()
+			if err != nil {
+				t.Skipf("unable to dial from %v: %v", ips.local, err)
+			}
+			defer conn.Close()
+			assert.True(t, localAddr.IP.Equal(conn.LocalAddr().(*net.TCPAddr).IP), "should have dialed from %v, not %v", ips.local, conn.LocalAddr())
+
+			serverConn, err := l.Accept()
+			require.NoError(t, err)
+			defer serverConn.Close()
+			assert.Equal(t, conn.LocalAddr().String(), serverConn.RemoteAddr().String())
+		})
+	}
+}
+
+func TestLowestLatency(t *testing.T) {
+	strategy := LowestLatency()
+	assert.Equal(t, 1, strategy.Pick([]DialCandidate{
+		{Addr: "a", ConnectTime: 5 * time.Millisecond},
+		{Addr: "b", ConnectTime: 2 * time.Millisecond},
+		{Addr: "c", ConnectTime: 3 * time.Millisecond},
+	}))
+	assert.Equal(t, 2, strategy.Pick([]DialCandidate{
+		{Addr: "a", ConnectTime: 5 * time.Millisecond},
+		{Addr: "b", ConnectTime: 2 * time.Millisecond},
+		{Addr: "c"},
+	}), "should try unmeasured addresses first")
+}
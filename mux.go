@@ -0,0 +1,99 @@
+package lampshade
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// StreamHandler handles a Stream dispatched by a StreamMux. The handler owns
+// the Stream and is responsible for closing it.
+type StreamHandler func(stream Stream)
+
+// StreamMux dispatches Streams accepted from a lampshade Listener to handlers
+// based on the target that the dialing side specified in the TargetHeader
+// when opening the Stream, similar to an http.ServeMux.
+//
+// A pattern either matches a target exactly or, if it ends in "*", matches
+// every target that starts with what precedes the "*". Exact matches take
+// precedence over prefix matches and longer prefixes take precedence over
+// shorter ones. Streams that don't match any pattern go to the default
+// handler, or are closed if there is none.
+type StreamMux struct {
+	exact          map[string]StreamHandler
+	prefixes       map[string]StreamHandler
+	defaultHandler StreamHandler
+	mx             sync.RWMutex
+}
+
+// NewStreamMux creates a new StreamMux without any handlers.
+func NewStreamMux() *StreamMux {
+	return &StreamMux{
+		exact:    make(map[string]StreamHandler),
+		prefixes: make(map[string]StreamHandler),
+	}
+}
+
+// Handle registers the handler for the given pattern, replacing any handler
+// previously registered for the same pattern.
+func (mux *StreamMux) Handle(pattern string, handler StreamHandler) {
+	mux.mx.Lock()
+	defer mux.mx.Unlock()
+	if strings.HasSuffix(pattern, "*") {
+		mux.prefixes[strings.TrimSuffix(pattern, "*")] = handler
+	} else {
+		mux.exact[pattern] = handler
+	}
+}
+
+// HandleDefault registers the handler for Streams that don't match any
+// pattern.
+func (mux *StreamMux) HandleDefault(handler StreamHandler) {
+	mux.mx.Lock()
+	mux.defaultHandler = handler
+	mux.mx.Unlock()
+}
+
+// handlerFor returns the handler for the given target, or nil if there is
+// none.
+func (mux *StreamMux) handlerFor(target string) StreamHandler {
+	mux.mx.RLock()
+	defer mux.mx.RUnlock()
+	if handler := mux.exact[target]; handler != nil {
+		return handler
+	}
+	var handler StreamHandler
+	longest := -1
+	for prefix, candidate := range mux.prefixes {
+		if len(prefix) > longest && strings.HasPrefix(target, prefix) {
+			handler, longest = candidate, len(prefix)
+		}
+	}
+	if handler != nil {
+		return handler
+	}
+	return mux.defaultHandler
+}
+
+// ServeStream dispatches the given Stream to the matching handler. It blocks
+// until the handler returns.
+func (mux *StreamMux) ServeStream(stream Stream) {
+	handler := mux.handlerFor(stream.Headers()[TargetHeader])
+	if handler == nil {
+		stream.Close()
+		return
+	}
+	handler(stream)
+}
+
+// Serve accepts Streams from the given lampshade Listener and serves each one
+// on its own goroutine until Accept fails, returning the error from Accept.
+func (mux *StreamMux) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go mux.ServeStream(conn.(Stream))
+	}
+}
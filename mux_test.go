@@ -0,0 +1,60 @@
+package lampshade
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamMux(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion
+	})
+	defer l.Close()
+
+	respondWith := func(response string) StreamHandler {
+		return func(stream Stream) {
+			defer stream.Close()
+			stream.Write([]byte(response))
+		}
+	}
+	mux := NewStreamMux()
+	mux.Handle("echo", respondWith("exact"))
+	mux.Handle("echo/*", respondWith("short prefix"))
+	mux.Handle("echo/v2/*", respondWith("long prefix"))
+	go mux.Serve(l)
+
+	dialTarget := func(target string) (string, error) {
+		conn, err := d.DialWithHeaders(context.Background(), dial, map[string]string{TargetHeader: target})
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 20)
+		n, err := io.ReadAtLeast(conn, b, 1)
+		return string(b[:n]), err
+	}
+	for target, expected := range map[string]string{
+		"echo":       "exact",
+		"echo/v1":    "short prefix",
+		"echo/v2/x":  "long prefix",
+		"echo/v2/":   "long prefix",
+		"echo/other": "short prefix",
+	} {
+		response, err := dialTarget(target)
+		if assert.NoError(t, err, target) {
+			assert.Equal(t, expected, response, target)
+		}
+	}
+
+	_, err := dialTarget("unknown")
+	assert.Equal(t, io.EOF, err, "unmatched stream should be closed without a default handler")
+
+	mux.HandleDefault(respondWith("default"))
+	response, err := dialTarget("unknown")
+	require.NoError(t, err)
+	assert.Equal(t, "default", response)
+}
@@ -0,0 +1,87 @@
+package lampshade
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxOOBLen is the maximum length of the data in an out-of-band frame, see
+	// Stream.WriteOOB.
+	MaxOOBLen = 128
+
+	// oobQueueDepth is how many received out-of-band frames are buffered per
+	// stream until the application picks them up from ReadOOB
+	oobQueueDepth = 16
+)
+
+var (
+	// ErrOOBTooLarge indicates that the data passed to WriteOOB exceeds
+	// MaxOOBLen.
+	ErrOOBTooLarge = errors.New("out-of-band data too large")
+
+	// ErrOOBUnsupported indicates that WriteOOB was called on a Session whose
+	// protocol version doesn't support out-of-band data.
+	ErrOOBUnsupported = errors.New("out-of-band data not supported by protocol version")
+)
+
+func (c *stream) WriteOOB(b []byte) error {
+	if len(b) > MaxOOBLen {
+		return ErrOOBTooLarge
+	}
+	if c.session.version < oobVersion {
+		return ErrOOBUnsupported
+	}
+	c.mx.RLock()
+	finalWriteErr := c.finalWriteErr
+	c.mx.RUnlock()
+	if finalWriteErr != nil {
+		return finalWriteErr
+	}
+
+	// bypass the send buffer and the window by going straight to the session,
+	// like acks do
+	frame := c.pool.getForFrame()[:len(b)]
+	copy(frame, b)
+	frame = withDataHeader(frame, withFrameType(c.sb.defaultHeader, frameTypeOOB))
+	select {
+	case c.session.out <- frame:
+		return nil
+	case <-c.session.closeCh:
+		c.pool.Put(frame[:maxFrameSize])
+		return ErrConnectionClosed
+	}
+}
+
+func (c *stream) ReadOOB() <-chan []byte {
+	return c.oob
+}
+
+// onOOB delivers out-of-band data received from the peer. It never blocks the
+// session's receive loop, if the application isn't keeping up with ReadOOB the
+// data is dropped.
+func (c *stream) onOOB(data []byte) {
+	c.muOOB.Lock()
+	defer c.muOOB.Unlock()
+	_, id := frameTypeAndID(c.sb.defaultHeader)
+	if c.oobClosed {
+		c.session.frameDropped(id, FrameDropClosed)
+		return
+	}
+	select {
+	case c.oob <- data:
+	default:
+		log.Debugf("%vDropping out-of-band data for stream, %d frames already waiting", c.session.logPrefix, oobQueueDepth)
+		c.session.frameDropped(id, FrameDropOverflow)
+	}
+}
+
+func (c *stream) closeOOB() {
+	c.muOOB.Lock()
+	if !c.oobClosed {
+		c.oobClosed = true
+		close(c.oob)
+	}
+	c.muOOB.Unlock()
+}
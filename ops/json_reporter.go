@@ -0,0 +1,70 @@
+package ops
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// JSONReporter returns a Reporter that writes each reported Op to w as a JSON
+// object on its own line. The object contains the Op's context plus a
+// "success" field. Context values that can't be serialized to JSON are
+// replaced by their string representation or, failing that, their type. If
+// writing to w fails, the error is passed to onError, or logged if onError is
+// nil. It's safe to use the same JSONReporter from multiple goroutines.
+// Register it with RegisterReporter.
+func JSONReporter(w io.Writer, onError func(err error)) Reporter {
+	if onError == nil {
+		onError = func(err error) {
+			log.Errorf("Unable to report op as JSON: %v", err)
+		}
+	}
+	var mx sync.Mutex
+	return func(failure error, ctx map[string]interface{}) {
+		obj := make(map[string]interface{}, len(ctx)+1)
+		for key, value := range ctx {
+			obj[key] = jsonValue(value)
+		}
+		obj["success"] = failure == nil
+		b, err := json.Marshal(obj)
+		if err != nil {
+			// shouldn't happen since every value has already been checked
+			onError(err)
+			return
+		}
+		b = append(b, '\n')
+		mx.Lock()
+		_, err = w.Write(b)
+		mx.Unlock()
+		if err != nil {
+			onError(err)
+		}
+	}
+}
+
+// jsonValue returns value if it can be serialized to JSON, otherwise a string
+// describing it.
+func jsonValue(value interface{}) (result interface{}) {
+	defer func() {
+		if recover() != nil {
+			// some custom MarshalJSON or String method panicked
+			result = fmt.Sprintf("%T", value)
+		}
+	}()
+
+	if _, err := json.Marshal(value); err == nil {
+		return value
+	}
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		// don't use %v, which can recurse forever on cyclic values
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,49 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestJSONReporter(t *testing.T) {
+	var buf bytes.Buffer
+	var errs []error
+	report := JSONReporter(&buf, func(err error) {
+		errs = append(errs, err)
+	})
+	report(nil, map[string]interface{}{"op": "json_success", "n": 1})
+	report(errors.New("boom"), map[string]interface{}{"op": "json_failure", "ch": make(chan int)})
+	assert.Empty(t, errs)
+
+	dec := json.NewDecoder(&buf)
+	var success, failure map[string]interface{}
+	require.NoError(t, dec.Decode(&success))
+	require.NoError(t, dec.Decode(&failure))
+	assert.Equal(t, map[string]interface{}{"op": "json_success", "n": 1.0, "success": true}, success)
+	assert.Equal(t, map[string]interface{}{"op": "json_failure", "ch": "chan int", "success": false}, failure)
+}
+
+func TestJSONReporterWriteError(t *testing.T) {
+	var errs []error
+	report := JSONReporter(failingWriter{}, func(err error) {
+		errs = append(errs, err)
+	})
+	report(nil, map[string]interface{}{"op": "json_write_error"})
+	if assert.Len(t, errs, 1) {
+		assert.EqualError(t, errs[0], "disk full")
+	}
+
+	// without onError, the error is only logged
+	JSONReporter(failingWriter{}, nil)(nil, map[string]interface{}{"op": "json_write_error"})
+}
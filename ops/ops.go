@@ -6,22 +6,73 @@
 package ops
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	mrand "math/rand"
 	"sync"
 	"sync/atomic"
 
 	"github.com/l2dy/plampshade/context"
+	log "github.com/sirupsen/logrus"
 )
 
+// DefaultMaxKeysPerOp is the default limit on the number of distinct keys per
+// Op, see SetMaxKeysPerOp.
+const DefaultMaxKeysPerOp = 256
+
+// maxDroppedOpNames bounds the number of op names that DroppedKeysByOp tracks.
+const maxDroppedOpNames = 1000
+
 var (
 	cm             = context.NewManager()
 	reporters      []Reporter
 	reportersMutex sync.RWMutex
+
+	// randRead is where span IDs come from, replaceable for testing
+	randRead = rand.Read
+
+	maxKeysPerOp = int64(DefaultMaxKeysPerOp)
+	droppedKeys  int64
+	droppedByOp  = make(map[string]int64)
+	muDropped    sync.Mutex
 )
 
 // Reporter is a function that reports the success or failure of an Op. If
-// failure is nil, the Op can be considered successful.
+// failure is nil, the Op can be considered successful. Otherwise, ctx includes
+// the failure's Severity as "severity".
 type Reporter func(failure error, ctx map[string]interface{})
 
+// Severity classifies failures so that reporters can route them or alert on
+// them differently, for example to page on a protocol violation but only count
+// transient timeouts.
+type Severity int
+
+const (
+	// SeverityWarning is for failures that are expected to happen now and then
+	// and resolve themselves, like timeouts.
+	SeverityWarning Severity = iota + 1
+	// SeverityError is for regular failures. It's the severity of failures
+	// reported with FailIf.
+	SeverityError
+	// SeverityCritical is for failures that indicate that something is broken,
+	// like a peer violating the protocol.
+	SeverityCritical
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	case SeverityCritical:
+		return "critical"
+	default:
+		return "unknown"
+	}
+}
+
 // Op represents an operation that's being performed. It mimics the API of
 // context.Context.
 type Op interface {
@@ -48,14 +99,39 @@ type Op interface {
 
 	// FailIf marks this Op as failed if the given err is not nil. If FailIf is
 	// called multiple times, the latest error will be reported as the failure.
-	// Returns the original error for convenient chaining.
+	// Returns the original error for convenient chaining. The failure is
+	// reported with SeverityError.
 	FailIf(err error) error
+
+	// Fail is like FailIf but reports the failure with the given severity.
+	Fail(err error, severity Severity) error
+
+	// WithTrace tags this Op with the given trace and span IDs for correlating
+	// reports with distributed traces. The IDs are included in the reported
+	// context as "trace_id" and "span_id". Child Ops started with Begin inherit
+	// the trace ID and get their own span ID, with this Op's span ID recorded as
+	// "parent_span_id".
+	WithTrace(traceID string, spanID string) Op
 }
 
 type op struct {
+	name     string
+	parent   *op
 	ctx      context.Context
 	canceled bool
-	failure  atomic.Value
+	failure  atomic.Value // opFailure
+	muTrace  sync.RWMutex
+	traceID  string
+	spanID   string
+	muKeys   sync.Mutex
+	keys     map[string]bool
+	// inheritedKeys is the number of keys the parent had when this op began
+	inheritedKeys int
+}
+
+type opFailure struct {
+	err      error
+	severity Severity
 }
 
 // RegisterReporter registers the given reporter.
@@ -67,11 +143,115 @@ func RegisterReporter(reporter Reporter) {
 
 // Begin marks the beginning of a new Op.
 func Begin(name string) Op {
-	return &op{ctx: cm.Enter().Put("op", name).PutIfAbsent("root_op", name)}
+	return newOp(name, nil, cm.Enter())
 }
 
 func (o *op) Begin(name string) Op {
-	return &op{ctx: o.ctx.Enter().Put("op", name).PutIfAbsent("root_op", name)}
+	child := newOp(name, o, o.ctx.Enter())
+	o.muTrace.RLock()
+	traceID, spanID := o.traceID, o.spanID
+	o.muTrace.RUnlock()
+	if traceID != "" {
+		child.WithTrace(traceID, newSpanID())
+		child.ctx.Put("parent_span_id", spanID)
+	}
+	return child
+}
+
+func newOp(name string, parent *op, ctx context.Context) *op {
+	o := &op{
+		name:   name,
+		parent: parent,
+		ctx:    ctx.Put("op", name).PutIfAbsent("root_op", name),
+	}
+	if parent != nil && capKeys() {
+		o.inheritedKeys = parent.numKeys()
+	}
+	return o
+}
+
+func (o *op) WithTrace(traceID string, spanID string) Op {
+	o.muTrace.Lock()
+	o.traceID = traceID
+	o.spanID = spanID
+	o.ctx.Put("trace_id", traceID).Put("span_id", spanID)
+	o.muTrace.Unlock()
+	return o
+}
+
+func capKeys() bool {
+	return atomic.LoadInt64(&maxKeysPerOp) > 0
+}
+
+func (o *op) numKeys() int {
+	o.muKeys.Lock()
+	defer o.muKeys.Unlock()
+	return o.inheritedKeys + len(o.keys)
+}
+
+func (o *op) hasKey(key string) bool {
+	for ; o != nil; o = o.parent {
+		o.muKeys.Lock()
+		has := o.keys[key]
+		o.muKeys.Unlock()
+		if has {
+			return true
+		}
+	}
+	return false
+}
+
+// admit checks whether key may be set on this op. Keys that this op or one of
+// its parents already has can always be updated, new keys are dropped once the
+// op has reached the limit set with SetMaxKeysPerOp.
+func (o *op) admit(key string) bool {
+	max := int(atomic.LoadInt64(&maxKeysPerOp))
+	if max <= 0 {
+		// don't pay for tracking keys
+		return true
+	}
+	if o.parent.hasKey(key) {
+		return true
+	}
+	o.muKeys.Lock()
+	if o.keys[key] {
+		o.muKeys.Unlock()
+		return true
+	}
+	numKeys := o.inheritedKeys + len(o.keys)
+	if numKeys < max {
+		if o.keys == nil {
+			o.keys = make(map[string]bool)
+		}
+		o.keys[key] = true
+		o.muKeys.Unlock()
+		return true
+	}
+	o.muKeys.Unlock()
+
+	atomic.AddInt64(&droppedKeys, 1)
+	muDropped.Lock()
+	dropped, tracked := droppedByOp[o.name]
+	if tracked || len(droppedByOp) < maxDroppedOpNames {
+		droppedByOp[o.name] = dropped + 1
+	}
+	first := !tracked && droppedByOp[o.name] == 1
+	muDropped.Unlock()
+	if first {
+		log.Errorf("Dropping key %v on op %v, which already has %d keys, further drops on this op are only counted, see ops.DroppedKeysByOp", key, o.name, numKeys)
+	}
+	return false
+}
+
+// newSpanID generates a random 64-bit span ID in the hex format used by
+// OpenTelemetry. Span IDs only need to be unique, not unpredictable, so if the
+// system's secure random source fails, it falls back to math/rand.
+func newSpanID() string {
+	b := make([]byte, 8)
+	if _, err := randRead(b); err != nil {
+		binary.BigEndian.PutUint64(b, mrand.Uint64())
+	}
+	return hex.EncodeToString(b)
 }
 
 func (o *op) Go(fn func()) {
@@ -102,14 +282,20 @@ func (o *op) End() {
 
 	if len(reportersCopy) > 0 {
 		var failure error
-		_failure := o.failure.Load()
-		ctx := o.ctx.AsMap(_failure, true)
-		if _failure != nil {
-			failure = _failure.(error)
+		_failure, failed := o.failure.Load().(opFailure)
+		if failed {
+			failure = _failure.err
+		}
+		ctx := o.ctx.AsMap(failure, true)
+		if failed {
 			_, errorSet := ctx["error"]
 			if !errorSet {
 				ctx["error"] = failure.Error()
 			}
+			_, severitySet := ctx["severity"]
+			if !severitySet {
+				ctx["severity"] = _failure.severity.String()
+			}
 		}
 		for _, reporter := range reportersCopy {
 			reporter(failure, ctx)
@@ -120,10 +306,45 @@ func (o *op) End() {
 }
 
 func (o *op) Set(key string, value interface{}) Op {
-	o.ctx.Put(key, value)
+	if o.admit(key) {
+		o.ctx.Put(key, value)
+	}
 	return o
 }
 
+// SetMaxKeysPerOp limits the number of distinct keys that each Op reports,
+// protecting reporters from cardinality explosions when callers set high
+// cardinality keys. Keys set with Set and SetDynamic count towards the limit,
+// including those inherited from parent Ops. Global keys and the keys that
+// this package sets itself, like "op" and "trace_id", don't. New keys set
+// beyond the limit are dropped, the first drop on each Op name is logged. If
+// max <= 0, there's no limit and keys aren't tracked at all, so keys set while
+// there's no limit don't count if a limit is set later. Defaults to
+// DefaultMaxKeysPerOp.
+func SetMaxKeysPerOp(max int) {
+	atomic.StoreInt64(&maxKeysPerOp, int64(max))
+}
+
+// DroppedKeys returns the number of keys that have been dropped because of the
+// limit set with SetMaxKeysPerOp.
+func DroppedKeys() int64 {
+	return atomic.LoadInt64(&droppedKeys)
+}
+
+// DroppedKeysByOp is like DroppedKeys but broken down by the name of the Op on
+// which the keys were dropped. Op names are expected to be low cardinality, so
+// only the first 1000 names with drops are tracked, drops on further names are
+// only counted in DroppedKeys.
+func DroppedKeysByOp() map[string]int64 {
+	muDropped.Lock()
+	defer muDropped.Unlock()
+	result := make(map[string]int64, len(droppedByOp))
+	for name, dropped := range droppedByOp {
+		result[name] = dropped
+	}
+	return result
+}
+
 // SetGlobal puts a key->value pair into the global context, which is inherited
 // by all Ops.
 func SetGlobal(key string, value interface{}) {
@@ -131,7 +352,9 @@ func SetGlobal(key string, value interface{}) {
 }
 
 func (o *op) SetDynamic(key string, valueFN func() interface{}) Op {
-	o.ctx.PutDynamic(key, valueFN)
+	if o.admit(key) {
+		o.ctx.PutDynamic(key, valueFN)
+	}
 	return o
 }
 
@@ -147,8 +370,12 @@ func AsMap(obj interface{}, includeGlobals bool) context.Map {
 }
 
 func (o *op) FailIf(err error) error {
+	return o.Fail(err, SeverityError)
+}
+
+func (o *op) Fail(err error, severity Severity) error {
 	if err != nil {
-		o.failure.Store(err)
+		o.failure.Store(opFailure{err, severity})
 	}
 	return err
 }
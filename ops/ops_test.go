@@ -0,0 +1,184 @@
+package ops
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	reported     = make(map[string]map[string]interface{})
+	reportedMx   sync.Mutex
+	registerOnce sync.Once
+)
+
+// reportFor returns the context most recently reported for the Op with the
+// given name.
+func reportFor(t *testing.T, name string) map[string]interface{} {
+	reportedMx.Lock()
+	defer reportedMx.Unlock()
+	ctx := reported[name]
+	require.NotNil(t, ctx, "%v not reported", name)
+	return ctx
+}
+
+func recordReports() {
+	registerOnce.Do(func() {
+		RegisterReporter(func(failure error, ctx map[string]interface{}) {
+			reportedMx.Lock()
+			reported[ctx["op"].(string)] = ctx
+			reportedMx.Unlock()
+		})
+	})
+}
+
+var spanIDPattern = regexp.MustCompile("^[0-9a-f]{16}$")
+
+func TestWithTrace(t *testing.T) {
+	recordReports()
+	parent := Begin("trace_parent").WithTrace("trace", "parent_span")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// retagging while children are started must be safe
+			parent.WithTrace("trace", "parent_span")
+			parent.Begin("trace_sibling").End()
+		}()
+	}
+	wg.Wait()
+
+	child := parent.Begin("trace_child")
+	child.End()
+	parent.End()
+
+	ctx := reportFor(t, "trace_child")
+	assert.Equal(t, "trace", ctx["trace_id"])
+	assert.Equal(t, "parent_span", ctx["parent_span_id"])
+	assert.Regexp(t, spanIDPattern, ctx["span_id"])
+	assert.Equal(t, "parent_span", reportFor(t, "trace_parent")["span_id"])
+}
+
+func TestSpanIDWithoutSecureRandom(t *testing.T) {
+	origRandRead := randRead
+	randRead = func(b []byte) (int, error) {
+		return 0, errors.New("no randomness")
+	}
+	defer func() {
+		randRead = origRandRead
+	}()
+	first, second := newSpanID(), newSpanID()
+	assert.Regexp(t, spanIDPattern, first)
+	assert.NotEqual(t, first, second)
+}
+
+func TestMaxKeysPerOp(t *testing.T) {
+	recordReports()
+	SetMaxKeysPerOp(2)
+	defer SetMaxKeysPerOp(DefaultMaxKeysPerOp)
+	dropped, droppedBefore := DroppedKeys(), DroppedKeysByOp()
+
+	// op and root_op don't count towards the limit
+	parent := Begin("keys_parent").Set("a", 1).Set("b", 2).Set("c", 3)
+	parent.Set("a", 10)
+	child := parent.Begin("keys_child")
+	// keys inherited from the parent count towards the child's limit, but can
+	// still be updated
+	child.Set("b", 20).Set("d", 4)
+	child.End()
+	parent.End()
+
+	ctx := reportFor(t, "keys_parent")
+	assert.Equal(t, 10, ctx["a"])
+	assert.Equal(t, 2, ctx["b"])
+	assert.NotContains(t, ctx, "c")
+	ctx = reportFor(t, "keys_child")
+	assert.Equal(t, 20, ctx["b"])
+	assert.NotContains(t, ctx, "d")
+
+	assert.EqualValues(t, 2, DroppedKeys()-dropped)
+	byOp := DroppedKeysByOp()
+	assert.EqualValues(t, 1, byOp["keys_parent"]-droppedBefore["keys_parent"])
+	assert.EqualValues(t, 1, byOp["keys_child"]-droppedBefore["keys_child"])
+
+	// keys on sibling Ops don't count towards each other's limit
+	for i := 0; i < 2; i++ {
+		Begin("keys_sibling").Set("a", i).Set("b", i).End()
+	}
+	assert.Equal(t, 1, reportFor(t, "keys_sibling")["b"])
+	assert.Zero(t, DroppedKeysByOp()["keys_sibling"])
+}
+
+func TestSeverity(t *testing.T) {
+	recordReports()
+	Begin("severity_success").End()
+	op := Begin("severity_fail_if")
+	op.FailIf(errors.New("failed"))
+	op.End()
+	op = Begin("severity_warning")
+	op.Fail(errors.New("timed out"), SeverityWarning)
+	op.End()
+	op = Begin("severity_critical")
+	op.Fail(errors.New("protocol violation"), SeverityCritical)
+	op.End()
+	op = Begin("severity_nil")
+	assert.NoError(t, op.Fail(nil, SeverityCritical))
+	op.End()
+
+	assert.NotContains(t, reportFor(t, "severity_success"), "severity")
+	assert.NotContains(t, reportFor(t, "severity_nil"), "severity", "nil errors shouldn't fail the op")
+	assert.Equal(t, "error", reportFor(t, "severity_fail_if")["severity"])
+	assert.Equal(t, "warning", reportFor(t, "severity_warning")["severity"])
+	assert.Equal(t, "critical", reportFor(t, "severity_critical")["severity"])
+	assert.Equal(t, "protocol violation", reportFor(t, "severity_critical")["error"])
+}
+
+func TestMaxKeysPerOpDisabled(t *testing.T) {
+	SetMaxKeysPerOp(0)
+	defer SetMaxKeysPerOp(DefaultMaxKeysPerOp)
+	dropped := DroppedKeys()
+
+	parent := Begin("keys_disabled")
+	child := parent.Begin("keys_disabled_child")
+	for i := 0; i < 2*DefaultMaxKeysPerOp; i++ {
+		child.Set(fmt.Sprintf("key%d", i), i)
+	}
+	assert.Nil(t, child.(*op).keys, "keys shouldn't be tracked without a limit")
+	assert.Equal(t, dropped, DroppedKeys())
+	child.End()
+	parent.End()
+}
+
+func TestDroppedKeysByOpBounded(t *testing.T) {
+	SetMaxKeysPerOp(1)
+	defer SetMaxKeysPerOp(DefaultMaxKeysPerOp)
+	// don't log every first drop
+	level := log.GetLevel()
+	log.SetLevel(log.FatalLevel)
+	defer log.SetLevel(level)
+	dropped := DroppedKeys()
+	// leave room for the names of other tests
+	muDropped.Lock()
+	origDroppedByOp := droppedByOp
+	droppedByOp = make(map[string]int64)
+	muDropped.Unlock()
+	defer func() {
+		muDropped.Lock()
+		droppedByOp = origDroppedByOp
+		muDropped.Unlock()
+	}()
+
+	for i := 0; i < maxDroppedOpNames+10; i++ {
+		Begin(fmt.Sprintf("keys_bounded%d", i)).Set("a", 1).Set("b", 2).End()
+	}
+	assert.Len(t, DroppedKeysByOp(), maxDroppedOpNames)
+	assert.EqualValues(t, maxDroppedOpNames+10, DroppedKeys()-dropped, "drops beyond the tracked names should still be counted")
+}
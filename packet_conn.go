@@ -0,0 +1,243 @@
+package lampshade
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// TargetHeader is the header that identifies which logical target a Stream is
+// for. PacketConn sets it and StreamMux routes on it. To open a Stream for a
+// particular target, include it in the headers passed to DialWithHeaders.
+const TargetHeader = "target"
+
+// PacketAddr is the logical address of a target reached through a PacketConn.
+type PacketAddr string
+
+func (addr PacketAddr) Network() string {
+	return "lampshade"
+}
+
+func (addr PacketAddr) String() string {
+	return string(addr)
+}
+
+type packet struct {
+	data []byte
+	addr net.Addr
+}
+
+// packetConn adapts lampshade Streams to net.PacketConn, see NewPacketConn.
+type packetConn struct {
+	dialer        BoundDialer
+	streams       map[string]Stream
+	dialing       map[string]*pendingStream
+	incoming      chan packet
+	closeCh       chan struct{}
+	closeOnce     sync.Once
+	readDeadline  time.Time
+	writeDeadline time.Time
+	mx            sync.Mutex
+}
+
+// NewPacketConn returns a net.PacketConn that sends and receives packets over
+// Streams dialed with the given BoundDialer.
+//
+// Lampshade is fundamentally stream oriented, so the semantics differ from
+// UDP. The first packet written to an address opens a new Stream for that
+// address, identified to the server with TargetHeader, and all later packets
+// to and from that address travel on that Stream in message mode (see
+// Stream.WriteMessage). Delivery is therefore reliable and ordered per
+// address, and packets can be up to MaxMessageSize. Packets are only received
+// from addresses that have been written to. As with UDP, if a packet is larger
+// than the buffer passed to ReadFrom, the excess is discarded.
+func NewPacketConn(dialer BoundDialer) net.PacketConn {
+	return &packetConn{
+		dialer:   dialer,
+		streams:  make(map[string]Stream),
+		dialing:  make(map[string]*pendingStream),
+		incoming: make(chan packet),
+		closeCh:  make(chan struct{}),
+	}
+}
+
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	pc.mx.Lock()
+	deadline := pc.readDeadline
+	pc.mx.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p := <-pc.incoming:
+		return copy(b, p.data), p.addr, nil
+	case <-timeout:
+		return 0, nil, ErrTimeout
+	case <-pc.closeCh:
+		return 0, nil, ErrConnectionClosed
+	}
+}
+
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if len(b) > MaxMessageSize {
+		// don't bother dialing, and keep the stream for the packets that fit
+		return 0, ErrMessageTooLarge
+	}
+	stream, err := pc.streamFor(addr)
+	if err != nil {
+		return 0, err
+	}
+	err = stream.WriteMessage(b)
+	if err != nil {
+		// the stream is either dead or, after a timeout, may have sent part of
+		// the message, which would throw off the peer's framing of the next one
+		pc.forget(addr.String(), stream)
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// pendingStream is a Stream that's still being dialed. done is closed once
+// stream and err are set.
+type pendingStream struct {
+	done   chan struct{}
+	stream Stream
+	err    error
+}
+
+// streamFor returns the Stream for the given address, dialing a new one if
+// necessary. Dials happen outside of pc.mx so that a slow dial to one address
+// doesn't hold up writes to others, and concurrent writes to the same address
+// share a single dial.
+func (pc *packetConn) streamFor(addr net.Addr) (Stream, error) {
+	target := addr.String()
+	pc.mx.Lock()
+	select {
+	case <-pc.closeCh:
+		pc.mx.Unlock()
+		return nil, ErrConnectionClosed
+	default:
+	}
+	stream := pc.streams[target]
+	if stream != nil {
+		pc.mx.Unlock()
+		return stream, nil
+	}
+	pending := pc.dialing[target]
+	if pending != nil {
+		pc.mx.Unlock()
+		<-pending.done
+		return pending.stream, pending.err
+	}
+	pending = &pendingStream{done: make(chan struct{})}
+	pc.dialing[target] = pending
+	writeDeadline := pc.writeDeadline
+	pc.mx.Unlock()
+
+	pending.stream, pending.err = pc.dial(target, writeDeadline)
+
+	pc.mx.Lock()
+	delete(pc.dialing, target)
+	if pending.err == nil {
+		select {
+		case <-pc.closeCh:
+			pending.stream.Close()
+			pending.stream, pending.err = nil, ErrConnectionClosed
+		default:
+			// pick up any deadline set while we were dialing
+			pending.stream.SetWriteDeadline(pc.writeDeadline)
+			pc.streams[target] = pending.stream
+			go pc.readFrom(pending.stream, PacketAddr(target))
+		}
+	}
+	pc.mx.Unlock()
+	close(pending.done)
+	return pending.stream, pending.err
+}
+
+func (pc *packetConn) dial(target string, writeDeadline time.Time) (Stream, error) {
+	ctx := context.Background()
+	if !writeDeadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, writeDeadline)
+		defer cancel()
+	}
+	conn, err := pc.dialer.DialWithHeaders(ctx, map[string]string{TargetHeader: target})
+	if err != nil {
+		return nil, err
+	}
+	return conn.(Stream), nil
+}
+
+// readFrom reads packets from the given Stream until it fails.
+func (pc *packetConn) readFrom(stream Stream, addr PacketAddr) {
+	defer pc.forget(addr.String(), stream)
+	for {
+		msg, err := stream.ReadMessage()
+		if err != nil {
+			return
+		}
+		select {
+		case pc.incoming <- packet{msg, addr}:
+		case <-pc.closeCh:
+			return
+		}
+	}
+}
+
+// forget closes the given Stream and removes it so that the next write to its
+// address dials a new one.
+func (pc *packetConn) forget(target string, stream Stream) {
+	pc.mx.Lock()
+	if pc.streams[target] == stream {
+		delete(pc.streams, target)
+	}
+	pc.mx.Unlock()
+	stream.Close()
+}
+
+func (pc *packetConn) Close() error {
+	pc.closeOnce.Do(func() {
+		pc.mx.Lock()
+		close(pc.closeCh)
+		streams := pc.streams
+		pc.streams = make(map[string]Stream)
+		pc.mx.Unlock()
+		for _, stream := range streams {
+			go stream.Close()
+		}
+	})
+	return nil
+}
+
+func (pc *packetConn) LocalAddr() net.Addr {
+	return PacketAddr("")
+}
+
+func (pc *packetConn) SetDeadline(t time.Time) error {
+	pc.SetReadDeadline(t)
+	return pc.SetWriteDeadline(t)
+}
+
+func (pc *packetConn) SetReadDeadline(t time.Time) error {
+	pc.mx.Lock()
+	pc.readDeadline = t
+	pc.mx.Unlock()
+	return nil
+}
+
+// SetWriteDeadline applies to dialing new Streams as well as writing.
+func (pc *packetConn) SetWriteDeadline(t time.Time) error {
+	pc.mx.Lock()
+	pc.writeDeadline = t
+	for _, stream := range pc.streams {
+		stream.SetWriteDeadline(t)
+	}
+	pc.mx.Unlock()
+	return nil
+}
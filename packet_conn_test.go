@@ -0,0 +1,160 @@
+package lampshade
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacketConn(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion
+	})
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				stream := conn.(Stream)
+				prefix := []byte(stream.Headers()[TargetHeader] + ":")
+				for {
+					msg, err := stream.ReadMessage()
+					if err != nil {
+						return
+					}
+					if stream.WriteMessage(append(prefix, msg...)) != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	pc := NewPacketConn(d.BoundTo(dial))
+	defer pc.Close()
+
+	for _, target := range []string{"a", "b", "a"} {
+		_, err := pc.WriteTo([]byte("hello"), PacketAddr(target))
+		require.NoError(t, err)
+	}
+	received := make(map[string]int)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 3; i++ {
+		b := make([]byte, 100)
+		n, addr, err := pc.ReadFrom(b)
+		require.NoError(t, err)
+		assert.Equal(t, addr.String()+":hello", string(b[:n]))
+		received[addr.String()]++
+	}
+	assert.Equal(t, map[string]int{"a": 2, "b": 1}, received)
+
+	// packets larger than the buffer are truncated
+	_, err := pc.WriteTo([]byte("hello"), PacketAddr("b"))
+	require.NoError(t, err)
+	b := make([]byte, 3)
+	n, _, err := pc.ReadFrom(b)
+	require.NoError(t, err)
+	assert.Equal(t, "b:h", string(b[:n]))
+
+	pc.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = pc.ReadFrom(b)
+	assert.Equal(t, ErrTimeout, err)
+}
+
+func TestPacketConnMessageTooLarge(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	bd := &blockingDialer{BoundDialer: d.BoundTo(dial)}
+	pc := NewPacketConn(bd)
+	defer pc.Close()
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	tooLarge := make([]byte, MaxMessageSize+1)
+	_, err := pc.WriteTo(tooLarge, PacketAddr("a"))
+	assert.Equal(t, ErrMessageTooLarge, err)
+	assert.Zero(t, atomic.LoadInt32(&bd.dials), "oversized packet shouldn't have dialed")
+
+	_, err = pc.WriteTo([]byte("hello"), PacketAddr("a"))
+	require.NoError(t, err)
+	// the echo is on its way back while we write the oversized packet
+	_, err = pc.WriteTo(tooLarge, PacketAddr("a"))
+	assert.Equal(t, ErrMessageTooLarge, err)
+	b := make([]byte, 100)
+	n, _, err := pc.ReadFrom(b)
+	require.NoError(t, err, "inbound packets should survive an oversized write")
+	assert.Equal(t, "hello", string(b[:n]))
+
+	_, err = pc.WriteTo([]byte("world"), PacketAddr("a"))
+	require.NoError(t, err)
+	n, _, err = pc.ReadFrom(b)
+	require.NoError(t, err)
+	assert.Equal(t, "world", string(b[:n]))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&bd.dials), "oversized packet shouldn't have torn down the stream")
+}
+
+// blockingDialer blocks dials to the "slow" target until unblock is closed.
+type blockingDialer struct {
+	BoundDialer
+	unblock chan struct{}
+	dials   int32
+}
+
+func (d *blockingDialer) DialWithHeaders(ctx context.Context, headers map[string]string) (net.Conn, error) {
+	atomic.AddInt32(&d.dials, 1)
+	if headers[TargetHeader] == "slow" {
+		<-d.unblock
+	}
+	return d.BoundDialer.DialWithHeaders(ctx, headers)
+}
+
+func TestPacketConnDialOutsideLock(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	bd := &blockingDialer{BoundDialer: d.BoundTo(dial), unblock: make(chan struct{})}
+	pc := NewPacketConn(bd)
+	defer pc.Close()
+
+	slowDone := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := pc.WriteTo([]byte("hello"), PacketAddr("slow"))
+			slowDone <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	fastDone := make(chan error, 1)
+	go func() {
+		_, err := pc.WriteTo([]byte("hello"), PacketAddr("fast"))
+		fastDone <- err
+	}()
+	select {
+	case err := <-fastDone:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("write to fast target blocked by dial to slow target")
+	}
+
+	close(bd.unblock)
+	for i := 0; i < 2; i++ {
+		require.NoError(t, <-slowDone)
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&bd.dials), "concurrent writes to the same address should share a dial")
+}
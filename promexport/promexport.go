@@ -0,0 +1,126 @@
+// Package promexport exposes lampshade's process-wide statistics in the
+// Prometheus text exposition format, ready to be scraped. It doesn't depend on
+// the Prometheus client library, so it can be used without pulling that into
+// the build.
+//
+// Usage:
+//
+//	http.Handle("/metrics", promexport.Handler())
+package promexport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/l2dy/plampshade"
+	log "github.com/sirupsen/logrus"
+)
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type metric struct {
+	name  string
+	kind  string
+	help  string
+	value func(stats lampshade.GlobalStats) int64
+}
+
+var metrics = []metric{
+	{"lampshade_sessions_open", "gauge", "Number of currently open sessions.",
+		func(stats lampshade.GlobalStats) int64 { return stats.OpenSessions }},
+	{"lampshade_sessions_closed_total", "counter", "Total number of sessions that have been closed.",
+		func(stats lampshade.GlobalStats) int64 { return stats.ClosedSessions }},
+	{"lampshade_sessions_dialed_total", "counter", "Total number of physical connections dialed by Dialers.",
+		func(stats lampshade.GlobalStats) int64 { return stats.SessionsDialed }},
+	{"lampshade_streams_open", "gauge", "Number of currently open streams.",
+		func(stats lampshade.GlobalStats) int64 { return stats.OpenStreams }},
+	{"lampshade_streams_closed_total", "counter", "Total number of streams that have been closed.",
+		func(stats lampshade.GlobalStats) int64 { return stats.ClosedStreams }},
+	{"lampshade_sent_bytes_total", "counter", "Total bytes written to physical connections.",
+		func(stats lampshade.GlobalStats) int64 { return stats.BytesSent }},
+	{"lampshade_received_bytes_total", "counter", "Total bytes read from physical connections.",
+		func(stats lampshade.GlobalStats) int64 { return stats.BytesReceived }},
+	{"lampshade_window_stalls_total", "counter", "Total number of times a stream waited for its transmit window.",
+		func(stats lampshade.GlobalStats) int64 { return stats.WindowStalls }},
+	{"lampshade_session_goroutines", "gauge", "Number of goroutines running on behalf of sessions and their streams.",
+		func(stats lampshade.GlobalStats) int64 { return stats.SessionGoroutines }},
+	{"lampshade_frames_dropped_after_close_total", "counter", "Total number of data frames discarded because their stream was already closed.",
+		func(stats lampshade.GlobalStats) int64 { return stats.FramesDroppedAfterClose }},
+	{"lampshade_session_rekeys_total", "counter", "Total number of times a session switched to a new key for sending.",
+		func(stats lampshade.GlobalStats) int64 { return stats.SessionRekeys }},
+	{"lampshade_checksum_failures_total", "counter", "Total number of sessions closed because a session frame failed its checksum.",
+		func(stats lampshade.GlobalStats) int64 { return stats.ChecksumFailures }},
+}
+
+type histogram struct {
+	name  string
+	help  string
+	value func(stats lampshade.GlobalStats) lampshade.DepthHistogram
+}
+
+// histograms stay empty unless enabled with lampshade.SetDepthHistograms
+var histograms = []histogram{
+	{"lampshade_send_queue_depth_frames", "Depth of streams' send queues whenever a frame is queued.",
+		func(stats lampshade.GlobalStats) lampshade.DepthHistogram { return stats.SendQueueDepths }},
+	{"lampshade_receive_queue_depth_frames", "Depth of streams' receive queues whenever a frame arrives.",
+		func(stats lampshade.GlobalStats) lampshade.DepthHistogram { return stats.ReceiveQueueDepths }},
+}
+
+// WriteMetrics writes the current statistics to w in the Prometheus text
+// exposition format.
+func WriteMetrics(w io.Writer) error {
+	stats := lampshade.ReadGlobalStats()
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n%v %d\n", m.name, m.help, m.name, m.kind, m.name, m.value(stats))
+		if err != nil {
+			return err
+		}
+	}
+	for _, h := range histograms {
+		if err := writeHistogram(w, h, h.value(stats)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHistogram(w io.Writer, h histogram, value lampshade.DepthHistogram) error {
+	_, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name)
+	if err != nil {
+		return err
+	}
+	var cumulative int64
+	for i, count := range value.Counts {
+		cumulative += count
+		le := "+Inf"
+		if i < len(lampshade.DepthBucketBounds) {
+			le = fmt.Sprint(lampshade.DepthBucketBounds[i])
+		}
+		_, err = fmt.Fprintf(w, "%v_bucket{le=\"%v\"} %d\n", h.name, le, cumulative)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "%v_sum %d\n%v_count %d\n", h.name, value.Sum, h.name, cumulative)
+	return err
+}
+
+// Handler returns an http.Handler that serves the current statistics for
+// scraping by Prometheus. The metrics are rendered in full before anything is
+// sent, so that a failure results in a 500 rather than a truncated scrape.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var buf bytes.Buffer
+		if err := WriteMetrics(&buf); err != nil {
+			log.Errorf("Unable to write metrics: %v", err)
+			http.Error(resp, "unable to write metrics", http.StatusInternalServerError)
+			return
+		}
+		resp.Header().Set("Content-Type", contentType)
+		if _, err := resp.Write(buf.Bytes()); err != nil {
+			log.Debugf("Unable to send metrics to %v: %v", req.RemoteAddr, err)
+		}
+	})
+}
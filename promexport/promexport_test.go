@@ -0,0 +1,115 @@
+package promexport
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/l2dy/plampshade"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sample is a single sample line of the exposition format.
+type sample struct {
+	name   string
+	labels string
+	value  float64
+}
+
+// parse parses the exposition format, failing the test on anything that's
+// malformed. It returns the declared type of each metric and the samples in
+// order.
+func parse(t *testing.T, body string) (map[string]string, []sample) {
+	types := make(map[string]string)
+	helped := make(map[string]bool)
+	var samples []sample
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "# HELP "):
+			fields := strings.SplitN(strings.TrimPrefix(line, "# HELP "), " ", 2)
+			require.Len(t, fields, 2, "HELP without text: %v", line)
+			helped[fields[0]] = true
+		case strings.HasPrefix(line, "# TYPE "):
+			fields := strings.Fields(strings.TrimPrefix(line, "# TYPE "))
+			require.Len(t, fields, 2, "malformed TYPE: %v", line)
+			require.True(t, helped[fields[0]], "TYPE before HELP: %v", line)
+			require.Contains(t, []string{"counter", "gauge", "histogram"}, fields[1])
+			types[fields[0]] = fields[1]
+		default:
+			fields := strings.Fields(line)
+			require.Len(t, fields, 2, "malformed sample: %v", line)
+			value, err := strconv.ParseFloat(fields[1], 64)
+			require.NoError(t, err, "malformed value: %v", line)
+			s := sample{name: fields[0], value: value}
+			if i := strings.IndexByte(s.name, '{'); i >= 0 {
+				require.True(t, strings.HasSuffix(s.name, "}"), "malformed labels: %v", line)
+				s.name, s.labels = s.name[:i], s.name[i+1:len(s.name)-1]
+			}
+			samples = append(samples, s)
+		}
+	}
+	require.NoError(t, scanner.Err())
+	return types, samples
+}
+
+func TestHandler(t *testing.T) {
+	lampshade.SetDepthHistograms(true)
+	defer lampshade.SetDepthHistograms(false)
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, contentType, rec.Header().Get("Content-Type"))
+
+	types, samples := parse(t, rec.Body.String())
+	for _, m := range metrics {
+		assert.Equal(t, m.kind, types[m.name], m.name)
+	}
+	for _, h := range histograms {
+		assert.Equal(t, "histogram", types[h.name], h.name)
+	}
+
+	buckets := make(map[string][]sample)
+	counts := make(map[string]float64)
+	for _, s := range samples {
+		switch {
+		case strings.HasSuffix(s.name, "_bucket"):
+			name := strings.TrimSuffix(s.name, "_bucket")
+			require.Equal(t, "histogram", types[name], s.name)
+			require.True(t, strings.HasPrefix(s.labels, `le="`), s.labels)
+			buckets[name] = append(buckets[name], s)
+		case strings.HasSuffix(s.name, "_count") && types[strings.TrimSuffix(s.name, "_count")] == "histogram":
+			counts[strings.TrimSuffix(s.name, "_count")] = s.value
+		case strings.HasSuffix(s.name, "_sum") && types[strings.TrimSuffix(s.name, "_sum")] == "histogram":
+		default:
+			require.NotEmpty(t, types[s.name], "sample without TYPE: %v", s.name)
+		}
+	}
+	for _, h := range histograms {
+		bs := buckets[h.name]
+		require.Len(t, bs, len(lampshade.DepthBucketBounds)+1, h.name)
+		for i := 1; i < len(bs); i++ {
+			assert.True(t, bs[i].value >= bs[i-1].value, "buckets of %v should be cumulative", h.name)
+		}
+		last := bs[len(bs)-1]
+		assert.Equal(t, `le="+Inf"`, last.labels)
+		assert.Equal(t, counts[h.name], last.value, "+Inf bucket of %v should match its count", h.name)
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(b []byte) (int, error) {
+	return 0, errors.New("broken")
+}
+
+func TestWriteMetricsError(t *testing.T) {
+	assert.Error(t, WriteMetrics(failingWriter{}))
+}
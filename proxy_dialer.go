@@ -0,0 +1,41 @@
+package lampshade
+
+import (
+	"context"
+	"net"
+)
+
+// ProxyDialer adapts a BoundDialer to the Dialer and ContextDialer interfaces
+// of golang.org/x/net/proxy, so that lampshade can be used wherever those are
+// expected, for example as the forward Dialer of proxy.FromURL or to dial
+// through from an http.Transport.
+//
+// The lampshade server doesn't see the addr passed to Dial directly. Instead,
+// each Stream carries it in its TargetHeader, so a server that wants to act
+// as a SOCKS-like proxy reads Stream.Headers()[TargetHeader] and dials that
+// address itself, or routes on it with a StreamMux. Since Streams are reliable
+// and ordered, only the "tcp", "tcp4" and "tcp6" networks are supported.
+type ProxyDialer struct {
+	dialer BoundDialer
+}
+
+// NewProxyDialer returns a ProxyDialer that dials Streams with the given
+// BoundDialer.
+func NewProxyDialer(dialer BoundDialer) *ProxyDialer {
+	return &ProxyDialer{dialer: dialer}
+}
+
+// Dial opens a Stream to the given addr, see ProxyDialer.
+func (pd *ProxyDialer) Dial(network, addr string) (net.Conn, error) {
+	return pd.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial but with the given context.
+func (pd *ProxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	return pd.dialer.DialWithHeaders(ctx, map[string]string{TargetHeader: addr})
+}
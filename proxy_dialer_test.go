@@ -0,0 +1,43 @@
+package lampshade
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyDialer(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion
+	})
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(conn.(Stream).Headers()[TargetHeader]))
+			conn.Close()
+		}
+	}()
+
+	pd := NewProxyDialer(d.BoundTo(dial))
+	conn, err := pd.Dial("tcp", "example.com:443")
+	require.NoError(t, err)
+	target, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	assert.Equal(t, "example.com:443", string(target), "addr should reach the server in TargetHeader")
+
+	conn, err = pd.DialContext(context.Background(), "tcp6", "[::1]:80")
+	require.NoError(t, err)
+	target, _ = ioutil.ReadAll(conn)
+	conn.Close()
+	assert.Equal(t, "[::1]:80", string(target))
+
+	_, err = pd.Dial("udp", "example.com:53")
+	assert.Error(t, err, "non-stream networks should be rejected")
+}
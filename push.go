@@ -0,0 +1,77 @@
+package lampshade
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+const (
+	// flagAcceptPush is the bit in the client init message's Flags that tells
+	// the server that the client accepts pushed streams
+	flagAcceptPush = 1 << 1
+
+	// pushQueueDepth is how many pushed streams are buffered on the client
+	// until the application picks them up from AcceptStream
+	pushQueueDepth = 16
+
+	// maxPushedStreams is the number of odd stream IDs, see "Stream IDs"
+	maxPushedStreams = maxID/2 + 1
+)
+
+var (
+	// ErrPushUnsupported indicates that PushStream was called on a Session
+	// whose client doesn't accept pushed streams, or that PushStream or
+	// AcceptStream was called on the wrong end of a Session, see "Pushed
+	// Streams" in the package docs.
+	ErrPushUnsupported = errors.New("pushed streams not supported on session")
+
+	// ErrPushIDsExhausted indicates that a Session has already pushed as many
+	// streams as there are odd stream IDs.
+	ErrPushIDsExhausted = errors.New("no stream IDs left for pushed streams")
+)
+
+func (s *session) PushStream(headers map[string]string) (Stream, error) {
+	if s.client || !s.pushEnabled {
+		return nil, ErrPushUnsupported
+	}
+	n := atomic.AddUint32(&s.nextPushID, 1)
+	if n > maxPushedStreams {
+		return nil, ErrPushIDsExhausted
+	}
+	// the server opens streams with odd IDs, see "Stream IDs"
+	id := uint16(2*(n-1) + 1)
+	s.mx.Lock()
+	if s.isClosed() {
+		s.mx.Unlock()
+		return nil, ErrConnectionClosed
+	}
+	c := newStream(s, s.pool, s.windowSize, id)
+	s.streams[id] = c
+	s.mx.Unlock()
+	c.onOpened()
+	if len(headers) > 0 {
+		if err := c.sendHeaders(headers); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (s *session) AcceptStream() (Stream, error) {
+	if !s.client || !s.pushEnabled {
+		return nil, ErrPushUnsupported
+	}
+	select {
+	case c := <-s.pushed:
+		return c, nil
+	case <-s.closeCh:
+		return nil, ErrConnectionClosed
+	}
+}
+
+// isPushed indicates whether the stream with the given ID was opened by the
+// server.
+func (s *session) isPushed(id uint16) bool {
+	return s.client && id%2 == 1
+}
@@ -0,0 +1,127 @@
+package lampshade
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialAndAccept dials a stream and accepts it on the server, returning both
+// ends.
+func dialAndAccept(t *testing.T, l net.Listener, d Dialer, dial DialFN) (Stream, Stream) {
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hi"))
+	require.NoError(t, err)
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	_, err = io.ReadFull(serverConn, make([]byte, 2))
+	require.NoError(t, err)
+	return conn.(Stream), serverConn.(Stream)
+}
+
+func TestPushStream(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion
+		opts.AcceptPushedStreams = true
+	})
+	defer l.Close()
+
+	conn, serverConn := dialAndAccept(t, l, d, dial)
+	defer conn.Close()
+	defer serverConn.Close()
+
+	// enough to need acks in both directions
+	data := make([]byte, 2*testWindowSize*MaxDataLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	pushed, err := serverConn.Session().PushStream(map[string]string{"path": "/push"})
+	require.NoError(t, err)
+	defer pushed.Close()
+	_, id := frameTypeAndID(pushed.(*stream).sb.defaultHeader)
+	assert.Equal(t, uint16(1), id, "pushed streams should have odd IDs")
+	go pushed.Write(data)
+
+	accepted, err := conn.Session().AcceptStream()
+	require.NoError(t, err)
+	defer accepted.Close()
+	assert.Equal(t, map[string]string{"path": "/push"}, accepted.Headers())
+	accepted.SetDeadline(time.Now().Add(10 * time.Second))
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(accepted, received)
+	require.NoError(t, err)
+	assert.Equal(t, data, received)
+
+	_, err = accepted.Write([]byte("thanks"))
+	require.NoError(t, err)
+	reply := make([]byte, 6)
+	_, err = io.ReadFull(pushed, reply)
+	require.NoError(t, err)
+	assert.Equal(t, "thanks", string(reply))
+
+	// the session's regular streams are unaffected
+	_, err = serverConn.Write([]byte("hello"))
+	require.NoError(t, err)
+	hello := make([]byte, 5)
+	_, err = io.ReadFull(conn, hello)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(hello))
+
+	_, err = serverConn.Session().AcceptStream()
+	assert.Equal(t, ErrPushUnsupported, err, "servers can't accept pushed streams")
+	_, err = conn.Session().PushStream(nil)
+	assert.Equal(t, ErrPushUnsupported, err, "clients can't push streams")
+}
+
+func TestPushStreamUnsupported(t *testing.T) {
+	for _, configure := range []func(opts *DialerOpts){
+		func(opts *DialerOpts) {
+			opts.ProtocolVersion = pushVersion
+		},
+		func(opts *DialerOpts) {
+			opts.ProtocolVersion = checksumVersion
+			opts.AcceptPushedStreams = true
+		},
+	} {
+		l, d, dial := newTestPair(t, nil, configure)
+		conn, serverConn := dialAndAccept(t, l, d, dial)
+		_, err := serverConn.Session().PushStream(nil)
+		assert.Equal(t, ErrPushUnsupported, err)
+		_, err = conn.Session().AcceptStream()
+		assert.Equal(t, ErrPushUnsupported, err)
+		conn.Close()
+		l.Close()
+	}
+}
+
+func TestRejectPushedStream(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = pushVersion
+	})
+	defer l.Close()
+
+	conn, serverConn := dialAndAccept(t, l, d, dial)
+	defer conn.Close()
+	defer serverConn.Close()
+
+	// pretend that the client opted in
+	serverConn.Session().(*session).pushEnabled = true
+	pushed, err := serverConn.Session().PushStream(nil)
+	require.NoError(t, err)
+	_, err = pushed.Write([]byte("unwanted"))
+	require.NoError(t, err)
+	pushed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = pushed.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "client should have reset the pushed stream")
+
+	clientSession := conn.Session().(*session)
+	clientSession.mx.RLock()
+	numStreams := len(clientSession.streams)
+	clientSession.mx.RUnlock()
+	assert.Equal(t, 1, numStreams, "client shouldn't have kept the pushed stream")
+}
@@ -1,50 +1,163 @@
 package lampshade
 
 import (
+	"errors"
 	"io"
 	"math"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var errReadCanceled = errors.New("read canceled")
+
 // receiveBuffer buffers incoming frames. It queues up available frames in a
 // channel and makes sure that those are read in order when filling reader's
 // buffers via the read() method. It also makes sure to send an ack whenever a
 // queued frame has been fully read.
 //
-// In order to bound memory usage, the channel holds only <windowSize> frames,
-// after which it starts back-pressuring. The sender knows not to send more
-// than <windowSize> frames so as to prevent this. Once the sender receives an
-// ACK from the receiver, it sends a subsequent frame and so on.
+// In order to bound memory usage, the channel holds only <depth> frames, after
+// which it starts back-pressuring. By default, depth is the same as
+// <windowSize>. The sender knows not to send more than <windowSize> frames so
+// as to prevent this. Once the sender receives an ACK from the receiver, it
+// sends a subsequent frame and so on. Acks are always based on <windowSize>,
+// regardless of depth.
+//
+// Optionally, the channel is also limited by bytes, see limitBytes.
 type receiveBuffer struct {
+	// 64 bit fields first so that they're aligned for atomic access
+	queuedBytes   int64 // bytes of the frames queued on in
+	maxBytes      int64 // if > 0, acks are withheld while more bytes are queued, see limitBytes
 	defaultHeader []byte
 	windowSize    int
 	ackInterval   int
-	unacked       int
+	adaptive      bool  // whether to adapt the ack interval, see adaptAckInterval
+	avgBacklog    int32 // smoothed backlog of queued frames, scaled by backlogScale
+	adaptedAck    int32 // current ack interval when adaptive
+	ackJitter     time.Duration
+	unacked       int32
+	ackRequested  int32
+	paused        int32 // set while acks are withheld, see pause
 	in            chan []byte
-	ack           chan []byte
+	ack           chan []byte           // must never be closed, flushPendingAck may send on it even after close
+	ackPending    int32                 // consumed frames whose ack couldn't be queued yet, see doSendACK
+	flushingAck   int32                 // set while flushPendingAck is running
+	ackQueued     func()                // called after each ack is queued on ack
+	spawn         func(func())          // used to start flushPendingAck
+	onDropped     func(FrameDropReason) // if set, called for each dropped frame
 	pool          BufferPool
 	poolable      []byte
 	current       []byte
+	uncounted     bool // whether current still has to be counted towards the next ack
+	finished      bool // whether in was closed because of a fin, see finish
 	muClosing     sync.RWMutex
 	closed        chan interface{}
 }
 
-func newReceiveBuffer(defaultHeader []byte, ack chan []byte, pool BufferPool, windowSize int) *receiveBuffer {
-	ackInterval := int(math.Ceil(float64(windowSize) / 10))
+func newReceiveBuffer(defaultHeader []byte, ack chan []byte, pool BufferPool, windowSize int, depth int, ackJitter time.Duration) *receiveBuffer {
+	ackInterval := ackIntervalFor(windowSize)
 	return &receiveBuffer{
 		defaultHeader: defaultHeader,
 		windowSize:    windowSize,
 		ackInterval:   ackInterval,
-		in:            make(chan []byte, windowSize),
+		ackJitter:     ackJitter,
+		in:            make(chan []byte, depth),
 		ack:           ack,
+		ackQueued:     func() {},
+		spawn:         func(fn func()) { go fn() },
 		pool:          pool,
 		closed:        make(chan interface{}),
 	}
 }
 
+// ackIntervalFor returns how many frames a receiveBuffer consumes before acking
+// them for the given window size.
+func ackIntervalFor(windowSize int) int {
+	return int(math.Ceil(float64(windowSize) / 10))
+}
+
+const (
+	// backlogScale is the fixed point scale of receiveBuffer.avgBacklog, which
+	// also serves as the inverse of the smoothing factor, like srtt in TCP
+	backlogScale = 8
+)
+
+// enableAdaptiveAcks makes the receiveBuffer adapt its ack interval to how
+// quickly the reader consumes frames, see adaptAckInterval. Must be called
+// before any frames are submitted.
+func (buf *receiveBuffer) enableAdaptiveAcks() {
+	buf.adaptive = true
+	buf.adaptedAck = int32(buf.minAckInterval())
+}
+
+// limitBytes makes the receiveBuffer withhold acks while the frames queued on
+// in add up to maxBytes or more, in addition to the usual limit of depth
+// frames. Since the sender never has more than windowSize frames unacked, it
+// stops once its window is used up, which bounds memory by bytes rather than
+// by frames. Acks resume as soon as the reader brings the queue below the
+// limit. Frames that were acked before the limit was hit can still arrive, so
+// the limit is soft. Must be called before any frames are submitted.
+func (buf *receiveBuffer) limitBytes(maxBytes int) {
+	buf.maxBytes = int64(maxBytes)
+}
+
+// overBytes indicates whether acks are currently withheld because of
+// limitBytes.
+func (buf *receiveBuffer) overBytes() bool {
+	return buf.maxBytes > 0 && atomic.LoadInt64(&buf.queuedBytes) >= buf.maxBytes
+}
+
+// minAckInterval is the smallest interval that adaptAckInterval will use.
+func (buf *receiveBuffer) minAckInterval() int {
+	return int(math.Ceil(float64(buf.ackInterval) / 4))
+}
+
+// adaptAckInterval is called whenever a frame has been consumed and adjusts the
+// ack interval based on how many frames are still queued behind it, smoothed
+// with an exponentially weighted moving average. A reader that keeps up with
+// the sender has no backlog, so the sender is the bottleneck and acking early
+// keeps its window open. A reader that falls behind builds up a backlog, in
+// which case early acks don't speed anything up and we save overhead by acking
+// less often. The interval scales linearly from a quarter of the regular
+// interval with no backlog up to the regular interval once the average backlog
+// reaches it. It never exceeds the regular interval, which peers (e.g. during
+// slow start) rely on.
+func (buf *receiveBuffer) adaptAckInterval() {
+	if !buf.adaptive {
+		return
+	}
+	backlog := int32(len(buf.in)) * backlogScale
+	avg := atomic.LoadInt32(&buf.avgBacklog)
+	avg += (backlog - avg) / backlogScale
+	atomic.StoreInt32(&buf.avgBacklog, avg)
+
+	min, max := buf.minAckInterval(), buf.ackInterval
+	smoothed := int(avg / backlogScale)
+	if smoothed > max {
+		smoothed = max
+	}
+	atomic.StoreInt32(&buf.adaptedAck, int32(min+(max-min)*smoothed/max))
+}
+
+// currentAckInterval returns how many consumed frames to ack at a time.
+func (buf *receiveBuffer) currentAckInterval() int {
+	if buf.adaptive {
+		return int(atomic.LoadInt32(&buf.adaptedAck))
+	}
+	return buf.ackInterval
+}
+
 // submit allows the session to submit a new frame to the receiveBuffer. If the
-// receiveBuffer has been closed, this is a noop.
+// receiveBuffer has been closed, the frame is dropped, returned to the pool,
+// counted in GlobalStats.FramesDroppedAfterClose and reported to onDropped.
+//
+// submit never sends on a closed in channel. doSubmit checks closed and
+// finished and sends on in while holding muClosing's read lock, and close() and
+// finish() only close channels while holding the write lock, so a close can't
+// happen in between.
+// To avoid holding up close() indefinitely while blocked on a full in, doSubmit
+// gives up the lock every getCloseTimeout() and checks again.
 func (buf *receiveBuffer) submit(frame []byte) {
 	for {
 		if buf.doSubmit(frame) {
@@ -59,21 +172,64 @@ func (buf *receiveBuffer) doSubmit(frame []byte) bool {
 
 	select {
 	case <-buf.closed:
-		// already closed, don't bother
+		// already closed, nobody's going to read this
+		buf.dropAfterClose(frame)
 		return true
 	default:
-		closeTimer := time.NewTimer(getCloseTimeout())
-		defer closeTimer.Stop()
+	}
+	if buf.finished {
+		// the peer shouldn't send anything after its fin
+		buf.dropAfterClose(frame)
+		return true
+	}
 
-		select {
-		case buf.in <- frame:
-			// okay
-			return true
-		case <-closeTimer.C:
-			// don't block forever on writing to buf.in. This gives us a chance to see whether we've closed in the meantime
-			return false
-		}
+	closeTimer := time.NewTimer(getCloseTimeout())
+	defer closeTimer.Stop()
+
+	select {
+	case buf.in <- frame:
+		// the reader may take the frame before we count it, in which case
+		// queuedBytes is briefly negative, which is harmless
+		atomic.AddInt64(&buf.queuedBytes, int64(len(frame)))
+		receiveQueueDepths.record(len(buf.in))
+		return true
+	case <-closeTimer.C:
+		// don't block forever on writing to buf.in. This gives us a chance to see whether we've closed in the meantime
+		return false
+	}
+}
+
+func (buf *receiveBuffer) dropAfterClose(frame []byte) {
+	buf.pool.Put(frame[:maxFrameSize])
+	atomic.AddInt64(&framesDroppedAfterClose, 1)
+	if buf.onDropped != nil {
+		buf.onDropped(FrameDropClosed)
+	}
+}
+
+// finish handles a fin from the peer. Frames that have already been submitted
+// can still be read, after which reads return io.EOF, and subsequent frames are
+// dropped. The fin itself counts as a consumed frame right away, so that it
+// gets acked along with the data that the reader consumes. Like
+// submit, it must only be called from the session's recvLoop.
+func (buf *receiveBuffer) finish() {
+	buf.muClosing.Lock()
+	select {
+	case <-buf.closed:
+		buf.muClosing.Unlock()
+		return
+	default:
+	}
+	if buf.finished {
+		buf.muClosing.Unlock()
+		return
 	}
+	buf.finished = true
+	close(buf.in)
+	buf.muClosing.Unlock()
+
+	atomic.AddInt32(&buf.unacked, 1)
+	buf.ackIf(len(buf.in) == 0)
 }
 
 // reads available data into the given buffer. If no data is queued, read will
@@ -82,10 +238,34 @@ func (buf *receiveBuffer) doSubmit(frame []byte) bool {
 //
 // As long as some data was already queued, read will not wait for more data
 // even if b has not yet been filled.
-func (buf *receiveBuffer) read(b []byte, deadline time.Time) (totalN int, err error) {
+func (buf *receiveBuffer) read(b []byte, deadline time.Time) (int, error) {
+	return buf.readCancelable(b, deadline, nil)
+}
+
+// readCancelable is like read, but also stops waiting for data and returns
+// errReadCanceled once cancel is closed. Nothing gets consumed in that case,
+// so subsequent reads pick up where this one left off.
+func (buf *receiveBuffer) readCancelable(b []byte, deadline time.Time, cancel <-chan struct{}) (totalN int, err error) {
+	return buf.doRead(b, deadline, cancel, false)
+}
+
+// readFull is like read, but keeps waiting for data until b is full. If the
+// deadline passes first, it returns what it read along with ErrTimeout. If the
+// stream ends partway through, it returns io.ErrUnexpectedEOF like
+// io.ReadFull.
+func (buf *receiveBuffer) readFull(b []byte, deadline time.Time) (int, error) {
+	n, err := buf.doRead(b, deadline, nil, true)
+	if err == io.EOF && n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (buf *receiveBuffer) doRead(b []byte, deadline time.Time, cancel <-chan struct{}, full bool) (totalN int, err error) {
 	for {
 		n := copy(b, buf.current)
 		buf.current = buf.current[n:]
+		buf.countIfConsumed()
 		totalN += n
 		if n == len(b) {
 			// nothing more to copy
@@ -109,13 +289,18 @@ func (buf *receiveBuffer) read(b []byte, deadline time.Time) (totalN int, err er
 			continue
 		default:
 			// nothing immediately available
-			if totalN > 0 {
+			if totalN > 0 && !full {
 				// we've read something, return what we have
 				buf.ackIfNecessary()
 				return
 			}
+			if full {
+				// let the sender know about what we've consumed so far, since it
+				// may be waiting for that before sending the rest
+				buf.ackIfNecessary()
+			}
 
-			// We haven't ready anything, wait up till deadline to read
+			// Wait up till deadline to read
 			now := time.Now()
 			if deadline.IsZero() {
 				// Default deadline to something really large so that we effectively
@@ -123,6 +308,9 @@ func (buf *receiveBuffer) read(b []byte, deadline time.Time) (totalN int, err er
 				deadline = largeDeadline
 			} else if deadline.Before(now) {
 				// Deadline already past, don't bother doing anything
+				if full {
+					err = ErrTimeout
+				}
 				buf.ackIfNecessary()
 				return
 			}
@@ -134,6 +322,11 @@ func (buf *receiveBuffer) read(b []byte, deadline time.Time) (totalN int, err er
 				err = ErrTimeout
 				buf.ackIfNecessary()
 				return
+			case <-cancel:
+				readTimer.Stop()
+				err = errReadCanceled
+				buf.ackIfNecessary()
+				return
 			case frame, open := <-buf.in:
 				// Read next frame, continue loop
 				readTimer.Stop()
@@ -150,41 +343,284 @@ func (buf *receiveBuffer) read(b []byte, deadline time.Time) (totalN int, err er
 	}
 }
 
-// ackIfNecessary acks every buf.ackInterval
+// readFrame returns the data of the next available frame without copying it
+// out of the pooled buffer. If a previous read only partially consumed a frame,
+// the remainder of that frame is returned. If no data is queued, readFrame
+// waits up to deadline like read does.
+//
+// The caller must call the returned release function once it's done with the
+// data and must not retain the data after that. Releasing returns the buffer to
+// the pool and counts the frame towards the next ack. Releasing more than once
+// is a noop.
+func (buf *receiveBuffer) readFrame(deadline time.Time) ([]byte, func(), error) {
+	if len(buf.current) == 0 {
+		frame, err := buf.waitForFrame(deadline)
+		if err != nil {
+			buf.ackIfNecessary()
+			return nil, nil, err
+		}
+		buf.onFrame(frame)
+	}
+
+	// the frame gets counted towards the next ack once it's released
+	data, poolable, counted := buf.current, buf.poolable, !buf.uncounted
+	buf.current, buf.poolable, buf.uncounted = nil, nil, false
+	var released int32
+	release := func() {
+		if !atomic.CompareAndSwapInt32(&released, 0, 1) {
+			// already released
+			return
+		}
+		buf.pool.Put(poolable[:maxFrameSize])
+		if !counted {
+			atomic.AddInt32(&buf.unacked, 1)
+			buf.adaptAckInterval()
+		}
+		// the reader may still be working on other frames, so only look at
+		// what's queued
+		buf.ackIf(len(buf.in) == 0)
+	}
+	return data, release, nil
+}
+
+// readFrames copies the data of queued frames into bufs, one frame per slot,
+// and reslices each filled slot to the length of its data. It waits up to
+// deadline for the first frame like read does, but after that only takes
+// frames that are immediately available, returning the number of slots filled.
+// A frame that doesn't fit into the capacity of its slot continues in the next
+// slot. All consumed frames are counted towards acks as usual.
+func (buf *receiveBuffer) readFrames(bufs [][]byte, deadline time.Time) (n int, err error) {
+	defer buf.ackIfNecessary()
+	for n < len(bufs) {
+		if len(buf.current) == 0 {
+			if n == 0 {
+				frame, err := buf.waitForFrame(deadline)
+				if err != nil {
+					return 0, err
+				}
+				buf.onFrame(frame)
+			} else {
+				select {
+				case frame, open := <-buf.in:
+					if !open {
+						// the next call will return io.EOF
+						return n, nil
+					}
+					buf.onFrame(frame)
+				default:
+					// nothing immediately available
+					return n, nil
+				}
+			}
+		}
+		b := bufs[n][:cap(bufs[n])]
+		copied := copy(b, buf.current)
+		buf.current = buf.current[copied:]
+		buf.countIfConsumed()
+		bufs[n] = b[:copied]
+		n++
+	}
+	return n, nil
+}
+
+// waitForFrame waits up to deadline for the next frame to become available. If
+// deadline is Zero, it waits indefinitely.
+func (buf *receiveBuffer) waitForFrame(deadline time.Time) ([]byte, error) {
+	select {
+	case frame, open := <-buf.in:
+		if !open {
+			return nil, io.EOF
+		}
+		return frame, nil
+	default:
+		// nothing immediately available
+	}
+
+	now := time.Now()
+	if deadline.IsZero() {
+		deadline = largeDeadline
+	} else if deadline.Before(now) {
+		return nil, ErrTimeout
+	}
+
+	readTimer := time.NewTimer(deadline.Sub(now))
+	defer readTimer.Stop()
+	select {
+	case <-readTimer.C:
+		return nil, ErrTimeout
+	case frame, open := <-buf.in:
+		if !open {
+			return nil, io.EOF
+		}
+		return frame, nil
+	}
+}
+
+// ackIfNecessary acks every currentAckInterval() frames, or as soon as the reader has
+// consumed everything if the peer requested an ack (see onAckRequested). If an
+// ackJitter is configured, the ack is delayed by a random duration up to
+// ackJitter so that acks from many streams don't all go out at the same time.
+//
+// Reads only call it once they're done with the frames they consume (or before
+// they wait for more), and each ack carries the full count of unacked frames,
+// so a read that crosses several ack intervals still sends a single ack.
 func (buf *receiveBuffer) ackIfNecessary() {
-	if buf.unacked >= buf.ackInterval {
-		buf.doSendACK(buf.unacked)
-		buf.unacked = 0
+	buf.ackIf(len(buf.current) == 0 && len(buf.in) == 0)
+}
+
+func (buf *receiveBuffer) ackIf(drained bool) {
+	if atomic.LoadInt32(&buf.paused) == 1 {
+		// consumed frames keep accumulating until resume
+		return
+	}
+	if buf.overBytes() {
+		// consumed frames keep accumulating until the reader catches up
+		return
+	}
+	unacked := int(atomic.LoadInt32(&buf.unacked))
+	if unacked == 0 {
+		return
+	}
+	requested := drained && atomic.CompareAndSwapInt32(&buf.ackRequested, 1, 0)
+	if unacked >= buf.currentAckInterval() || requested {
+		if unacked := atomic.SwapInt32(&buf.unacked, 0); unacked > 0 {
+			if buf.ackJitter <= 0 {
+				buf.doSendACK(int(unacked))
+				return
+			}
+			time.AfterFunc(time.Duration(rand.Int63n(int64(buf.ackJitter))), func() {
+				buf.doSendACK(int(unacked))
+			})
+		}
+	}
+}
+
+// onAckRequested handles an ack request from the peer, which it sends when it
+// wants to know that everything it sent has been consumed. We immediately ack
+// the frames that the reader has already taken and remember to ack again once
+// the reader has consumed whatever is still buffered.
+func (buf *receiveBuffer) onAckRequested() {
+	atomic.StoreInt32(&buf.ackRequested, 1)
+	if atomic.LoadInt32(&buf.paused) == 1 || buf.overBytes() {
+		// resume or the reader catching up takes care of it
+		return
+	}
+	if unacked := atomic.SwapInt32(&buf.unacked, 0); unacked > 0 {
+		buf.doSendACK(int(unacked))
 	}
 }
 
+// pause stops acking consumed frames, which halts the sender once its window
+// is used up. Reading carries on with whatever has already been received.
+func (buf *receiveBuffer) pause() {
+	atomic.StoreInt32(&buf.paused, 1)
+}
+
+// resume acks everything that was consumed while paused and goes back to
+// acking as usual.
+func (buf *receiveBuffer) resume() {
+	if !atomic.CompareAndSwapInt32(&buf.paused, 1, 0) {
+		// not paused
+		return
+	}
+	if buf.overBytes() {
+		// the reader catching up takes care of it
+		return
+	}
+	if unacked := atomic.SwapInt32(&buf.unacked, 0); unacked > 0 {
+		buf.doSendACK(int(unacked))
+	}
+}
+
+// doSendACK queues an ack for the given number of frames without blocking the
+// reader. If the session isn't taking acks right now, the count is added to
+// ackPending and flushPendingAck queues it in the background, coalesced with
+// whatever else gets consumed in the meantime, so acks are delayed but never
+// lost.
 func (buf *receiveBuffer) doSendACK(unacked int) {
+	if atomic.LoadInt32(&buf.flushingAck) == 0 {
+		select {
+		case <-buf.closed:
+			return
+		case buf.ack <- ackWithFrames(buf.defaultHeader, int32(unacked)):
+			buf.ackQueued()
+			return
+		default:
+			// ack channel is full
+		}
+	}
+	atomic.AddInt32(&buf.ackPending, int32(unacked))
+	if atomic.CompareAndSwapInt32(&buf.flushingAck, 0, 1) {
+		buf.spawn(buf.flushPendingAck)
+	}
+}
+
+// sendEmptyACK queues an ack for 0 frames, see ListenerOpts.AckOnFirst. Unlike
+// doSendACK, it waits for the session to take the ack, since there's no count
+// that could carry it over to a later ack.
+func (buf *receiveBuffer) sendEmptyACK() {
 	select {
 	case <-buf.closed:
-		return
-	case buf.ack <- ackWithFrames(buf.defaultHeader, int32(unacked)):
-		// okay
+	case buf.ack <- ackWithFrames(buf.defaultHeader, 0):
+		buf.ackQueued()
+	}
+}
+
+// flushPendingAck queues acks for ackPending until there's nothing left to ack
+// or the receiveBuffer is closed. Only one runs at a time per receiveBuffer.
+func (buf *receiveBuffer) flushPendingAck() {
+	for {
+		if pending := atomic.SwapInt32(&buf.ackPending, 0); pending > 0 {
+			select {
+			case <-buf.closed:
+				return
+			case buf.ack <- ackWithFrames(buf.defaultHeader, pending):
+				buf.ackQueued()
+			}
+		}
+		atomic.StoreInt32(&buf.flushingAck, 0)
+		// doSendACK may have added to ackPending after we swapped it but before
+		// it could see that we were done
+		if atomic.LoadInt32(&buf.ackPending) == 0 || !atomic.CompareAndSwapInt32(&buf.flushingAck, 0, 1) {
+			return
+		}
 	}
 }
 
 func (buf *receiveBuffer) onFrame(frame []byte) {
+	atomic.AddInt64(&buf.queuedBytes, -int64(len(frame)))
 	if buf.poolable != nil {
 		// Return previous frame to pool
 		buf.pool.Put(buf.poolable[:maxFrameSize])
 	}
 	buf.poolable = frame
 	buf.current = frame[dataHeaderSize:]
-	buf.unacked++
+	buf.uncounted = true
+}
+
+// countIfConsumed counts the current frame towards the next ack once it has
+// been fully read, so that partially read frames don't get acked early.
+func (buf *receiveBuffer) countIfConsumed() {
+	if buf.uncounted && len(buf.current) == 0 {
+		buf.uncounted = false
+		atomic.AddInt32(&buf.unacked, 1)
+		buf.adaptAckInterval()
+	}
 }
 
+// close closes the receiveBuffer. Frames that have already been submitted can
+// still be read, after which reads return io.EOF. It's safe to call close more
+// than once and concurrently with submit.
 func (buf *receiveBuffer) close() {
+	buf.muClosing.Lock()
+	defer buf.muClosing.Unlock()
 	select {
 	case <-buf.closed:
-		return
+		// already closed
 	default:
-		buf.muClosing.Lock()
 		close(buf.closed)
-		close(buf.in)
-		buf.muClosing.Unlock()
+		if !buf.finished {
+			close(buf.in)
+		}
 	}
 }
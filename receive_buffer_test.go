@@ -0,0 +1,490 @@
+package lampshade
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestReceiveBuffer(windowSize int) (*receiveBuffer, chan []byte) {
+	ack := make(chan []byte, windowSize)
+	return newReceiveBuffer(newHeader(frameTypeData, 0), ack, testPool, windowSize, windowSize, 0), ack
+}
+
+func testFrame(data []byte) []byte {
+	frame := testPool.getForFrame()[:dataHeaderSize+len(data)]
+	copy(frame[dataHeaderSize:], data)
+	return frame
+}
+
+func BenchmarkReadWithinFrame(b *testing.B) {
+	const readsPerFrame = 10
+	buf, ack := newTestReceiveBuffer(testWindowSize)
+	go func() {
+		for range ack {
+		}
+	}()
+	p := make([]byte, MaxDataLen/readsPerFrame)
+	data := make([]byte, len(p)*readsPerFrame)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%readsPerFrame == 0 {
+			b.StopTimer()
+			buf.submit(testFrame(data))
+			b.StartTimer()
+		}
+		buf.read(p, time.Time{})
+	}
+}
+
+func TestReadPartialFrameAcrossDeadlines(t *testing.T) {
+	// window of 1 means that every frame gets acked individually
+	buf, ack := newTestReceiveBuffer(1)
+	data := []byte("0123456789")
+	buf.submit(testFrame(data))
+
+	assertNoAck := func(msg string) {
+		select {
+		case <-ack:
+			t.Fatal(msg)
+		default:
+		}
+	}
+
+	var received []byte
+	p := make([]byte, 4)
+	n, err := buf.read(p, time.Now().Add(50*time.Millisecond))
+	require.NoError(t, err)
+	received = append(received, p[:n]...)
+	assertNoAck("partially read frame should not be acked")
+
+	// even with the deadline already expired, the remainder of the current
+	// frame is still available
+	n, err = buf.read(p, time.Now().Add(-1*time.Second))
+	require.NoError(t, err)
+	received = append(received, p[:n]...)
+	assertNoAck("partially read frame should not be acked")
+
+	n, err = buf.read(p, time.Now().Add(50*time.Millisecond))
+	require.NoError(t, err)
+	received = append(received, p[:n]...)
+	assert.Equal(t, data, received, "no data should have been dropped")
+	select {
+	case frame := <-ack:
+		assert.EqualValues(t, 1, binaryEncoding.Uint32(frame), "fully read frame should be acked once")
+	default:
+		t.Fatal("fully read frame should have been acked")
+	}
+
+	n, err = buf.read(p, time.Now().Add(50*time.Millisecond))
+	assert.Equal(t, ErrTimeout, err)
+	assert.Zero(t, n)
+	assertNoAck("frame should not be acked twice")
+}
+
+func TestReceiveBufferDepth(t *testing.T) {
+	const windowSize = 10
+	ack := make(chan []byte, 2*windowSize)
+	buf := newReceiveBuffer(newHeader(frameTypeData, 0), ack, testPool, windowSize, 2*windowSize, 0)
+	assert.Equal(t, 2*windowSize, cap(buf.in), "channel should be sized by depth")
+
+	for i := 0; i < 2*windowSize; i++ {
+		buf.submit(testFrame([]byte{byte(i)}))
+	}
+	p := make([]byte, 1)
+	for i := 0; i < buf.ackInterval; i++ {
+		_, err := buf.read(p, time.Time{})
+		require.NoError(t, err)
+	}
+	select {
+	case frame := <-ack:
+		assert.EqualValues(t, windowSize/10, binaryEncoding.Uint32(frame), "acks should still be based on the window")
+	default:
+		t.Fatal("should have acked after reading ackInterval frames")
+	}
+}
+
+func TestReadBurstAcksOnce(t *testing.T) {
+	const windowSize = 100
+	const burst = 50
+	ack := make(chan []byte, windowSize)
+	buf := newReceiveBuffer(newHeader(frameTypeData, 0), ack, testPool, windowSize, windowSize, 0)
+	countAcks := func() (acks int, frames uint32) {
+		for {
+			select {
+			case frame := <-ack:
+				acks++
+				frames += binaryEncoding.Uint32(frame)
+			default:
+				return
+			}
+		}
+	}
+
+	for i := 0; i < burst; i++ {
+		buf.submit(testFrame([]byte{byte(i)}))
+	}
+	n, err := buf.read(make([]byte, burst), time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, burst, n)
+	acks, frames := countAcks()
+	assert.Equal(t, 1, acks, "a read crossing several ack intervals should ack once")
+	assert.EqualValues(t, burst, frames, "the ack should cover every consumed frame")
+
+	for i := 0; i < burst; i++ {
+		buf.submit(testFrame([]byte{byte(i)}))
+	}
+	bufs := make([][]byte, burst)
+	for i := range bufs {
+		bufs[i] = make([]byte, 1)
+	}
+	n, err = buf.readFrames(bufs, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, burst, n)
+	acks, frames = countAcks()
+	assert.Equal(t, 1, acks, "readFrames should ack once too")
+	assert.EqualValues(t, burst, frames)
+}
+
+func TestReadDoesNotBlockOnFullAckChannel(t *testing.T) {
+	// nobody is taking acks until we say so
+	ack := make(chan []byte)
+	buf := newReceiveBuffer(newHeader(frameTypeData, 0), ack, testPool, 1, 3, 0)
+	defer buf.close()
+
+	for i := 0; i < 3; i++ {
+		buf.submit(testFrame([]byte{byte(i)}))
+	}
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		p := make([]byte, 1)
+		for i := 0; i < 3; i++ {
+			_, err := buf.read(p, time.Time{})
+			assert.NoError(t, err)
+		}
+	}()
+	select {
+	case <-readDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("reads should not block while the ack channel is full")
+	}
+
+	var acked uint32
+	for acked < 3 {
+		select {
+		case frame := <-ack:
+			acked += binaryEncoding.Uint32(frame)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("deferred acks should be delivered eventually, only got %d", acked)
+		}
+	}
+	assert.EqualValues(t, 3, acked, "no acks should be lost or duplicated")
+}
+
+func TestSendEmptyACK(t *testing.T) {
+	// the session isn't taking acks yet
+	ack := make(chan []byte)
+	buf := newReceiveBuffer(newHeader(frameTypeData, 0), ack, testPool, 1, 1, 0)
+	defer buf.close()
+
+	go buf.sendEmptyACK()
+	select {
+	case frame := <-ack:
+		assert.Zero(t, binaryEncoding.Uint32(frame))
+	case <-time.After(5 * time.Second):
+		t.Fatal("empty ack should be delivered once the session takes it")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	// small window means that every frame gets acked individually
+	buf, ack := newTestReceiveBuffer(2)
+	assertNoAck := func(msg string) {
+		select {
+		case <-ack:
+			t.Fatal(msg)
+		default:
+		}
+	}
+
+	buf.pause()
+	buf.submit(testFrame([]byte("a")))
+	buf.submit(testFrame([]byte("b")))
+	p := make([]byte, 1)
+	for _, expected := range []string{"a", "b"} {
+		n, err := buf.read(p, time.Now().Add(50*time.Millisecond))
+		require.NoError(t, err)
+		assert.Equal(t, expected, string(p[:n]), "buffered data should still be readable while paused")
+	}
+	assertNoAck("consumed frames should not be acked while paused")
+	buf.onAckRequested()
+	assertNoAck("ack requests should not be answered while paused")
+
+	buf.resume()
+	select {
+	case frame := <-ack:
+		assert.EqualValues(t, 2, binaryEncoding.Uint32(frame), "resuming should ack everything consumed while paused")
+	default:
+		t.Fatal("resuming should have acked")
+	}
+	buf.resume()
+	assertNoAck("resuming twice should not ack again")
+
+	buf.submit(testFrame([]byte("c")))
+	_, err := buf.read(p, time.Now().Add(50*time.Millisecond))
+	require.NoError(t, err)
+	select {
+	case frame := <-ack:
+		assert.EqualValues(t, 1, binaryEncoding.Uint32(frame), "should go back to acking as usual")
+	default:
+		t.Fatal("should ack again after resuming")
+	}
+}
+
+func TestReceiveBufferByteLimit(t *testing.T) {
+	// small window means that every frame gets acked individually
+	buf, ack := newTestReceiveBuffer(4)
+	frameSize := dataHeaderSize + 10
+	buf.limitBytes(2 * frameSize)
+
+	for i := 0; i < 3; i++ {
+		buf.submit(testFrame(make([]byte, 10)))
+	}
+	p := make([]byte, 10)
+	_, err := buf.read(p, time.Now().Add(50*time.Millisecond))
+	require.NoError(t, err)
+	select {
+	case <-ack:
+		t.Fatal("consumed frames should not be acked while the byte limit is reached")
+	default:
+	}
+	buf.onAckRequested()
+	select {
+	case <-ack:
+		t.Fatal("ack requests should not be answered while the byte limit is reached")
+	default:
+	}
+
+	_, err = buf.read(p, time.Now().Add(50*time.Millisecond))
+	require.NoError(t, err)
+	select {
+	case frame := <-ack:
+		assert.EqualValues(t, 2, binaryEncoding.Uint32(frame), "dropping below the byte limit should ack everything consumed")
+	default:
+		t.Fatal("should ack once below the byte limit")
+	}
+}
+
+func TestAdaptiveAckInterval(t *testing.T) {
+	const windowSize = 100
+	ack := make(chan []byte, windowSize)
+	buf := newReceiveBuffer(newHeader(frameTypeData, 0), ack, testPool, windowSize, windowSize, 0)
+	buf.enableAdaptiveAcks()
+	p := make([]byte, 1)
+	read := func() {
+		_, err := buf.read(p, time.Time{})
+		require.NoError(t, err)
+	}
+
+	// a reader that keeps up acks early
+	for i := 0; i < 3; i++ {
+		buf.submit(testFrame([]byte{byte(i)}))
+		read()
+	}
+	select {
+	case frame := <-ack:
+		assert.EqualValues(t, 3, binaryEncoding.Uint32(frame))
+	default:
+		t.Fatal("reader that keeps up should ack after a quarter of the interval")
+	}
+
+	// a reader that falls behind acks at the regular interval
+	for i := 0; i < 50; i++ {
+		buf.submit(testFrame([]byte{byte(i)}))
+	}
+	for i := 0; i < 10; i++ {
+		read()
+	}
+	assert.Equal(t, buf.ackInterval, buf.currentAckInterval())
+
+	// and goes back to acking early once it has caught up
+	for i := 0; i < 40; i++ {
+		read()
+	}
+	for i := 0; i < 50; i++ {
+		buf.submit(testFrame([]byte{byte(i)}))
+		read()
+	}
+	assert.Equal(t, buf.minAckInterval(), buf.currentAckInterval())
+}
+
+func TestReceiveBufferDropAfterClose(t *testing.T) {
+	buf, _ := newTestReceiveBuffer(testWindowSize)
+	var reasons []FrameDropReason
+	buf.onDropped = func(reason FrameDropReason) {
+		reasons = append(reasons, reason)
+	}
+	buf.submit(testFrame([]byte("a")))
+	buf.close()
+	buf.submit(testFrame([]byte("b")))
+	assert.Equal(t, []FrameDropReason{FrameDropClosed}, reasons, "only frames submitted after closing should be dropped")
+}
+
+func TestSubmitRacingWithClose(t *testing.T) {
+	before := ReadGlobalStats().FramesDroppedAfterClose
+	const (
+		rounds     = 200
+		submitters = 8
+		perRound   = testWindowSize
+	)
+	submitted := 0
+	for i := 0; i < rounds; i++ {
+		buf, ack := newTestReceiveBuffer(testWindowSize)
+		// acks may still be flushed in the background after close, so don't close
+		// the channel, just stop draining it
+		stopDraining := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-ack:
+				case <-stopDraining:
+					return
+				}
+			}
+		}()
+		var wg sync.WaitGroup
+		wg.Add(submitters + 2)
+		for j := 0; j < submitters; j++ {
+			go func() {
+				defer wg.Done()
+				for k := 0; k < perRound; k++ {
+					buf.submit(testFrame([]byte{byte(k)}))
+				}
+			}()
+		}
+		// close from two places at once, like a local close racing with an RST
+		for j := 0; j < 2; j++ {
+			go func() {
+				defer wg.Done()
+				buf.close()
+			}()
+		}
+		// keep reading so that submitters don't just sit on a full buffer
+		read := make(chan int)
+		go func() {
+			n := 0
+			b := make([]byte, 1)
+			for {
+				_, err := buf.read(b, time.Time{})
+				if err != nil {
+					read <- n
+					return
+				}
+				n++
+			}
+		}()
+		wg.Wait()
+		submitted += submitters*perRound - <-read
+		close(stopDraining)
+	}
+	assert.Equal(t, int64(submitted), ReadGlobalStats().FramesDroppedAfterClose-before, "every frame that wasn't read should have been counted as dropped")
+}
+
+func TestFinish(t *testing.T) {
+	buf, ack := newTestReceiveBuffer(testWindowSize)
+	buf.submit(testFrame([]byte("hello")))
+	buf.finish()
+	buf.finish()
+	buf.submit(testFrame([]byte("after fin")))
+
+	b := make([]byte, 100)
+	n, err := buf.read(b, time.Now().Add(5*time.Second))
+	assert.Equal(t, "hello", string(b[:n]))
+	assert.Equal(t, io.EOF, err, "frames after the fin should have been dropped")
+
+	buf.onAckRequested()
+	select {
+	case frame := <-ack:
+		assert.EqualValues(t, 2, binaryEncoding.Uint32(frame), "data and fin should both be acked")
+	case <-time.After(5 * time.Second):
+		t.Fatal("requested ack not sent")
+	}
+	buf.close()
+}
+
+func TestReadFrame(t *testing.T) {
+	// window of 1 means that every frame gets acked individually
+	buf, ack := newTestReceiveBuffer(1)
+	assertAcks := func(expected int, msg string) {
+		acks := 0
+		for {
+			select {
+			case <-ack:
+				acks++
+			default:
+				assert.Equal(t, expected, acks, msg)
+				return
+			}
+		}
+	}
+
+	buf.submit(testFrame([]byte("hello")))
+	data, release, err := buf.readFrame(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	assertAcks(0, "frame should not be acked before it's released")
+	release()
+	assertAcks(1, "released frame should be acked")
+	release()
+	assertAcks(0, "releasing twice should not ack again")
+
+	// after a partial read, ReadFrame returns the remainder of the frame
+	buf.submit(testFrame([]byte("world")))
+	p := make([]byte, 2)
+	_, err = buf.read(p, time.Time{})
+	require.NoError(t, err)
+	data, release, err = buf.readFrame(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, "rld", string(data))
+	release()
+	assertAcks(1, "remainder of frame should be acked once")
+
+	_, release, err = buf.readFrame(time.Now().Add(10 * time.Millisecond))
+	assert.Equal(t, ErrTimeout, err)
+	assert.Nil(t, release)
+}
+
+func TestAckJitter(t *testing.T) {
+	const frames = 5
+	const jitter = 200 * time.Millisecond
+	// window of 1 means that every frame gets acked individually
+	ack := make(chan []byte, frames)
+	buf := newReceiveBuffer(newHeader(frameTypeData, 0), ack, testPool, 1, frames, jitter)
+	for i := 0; i < frames; i++ {
+		buf.submit(testFrame([]byte{byte(i)}))
+	}
+	p := make([]byte, 1)
+	start := time.Now()
+	for i := 0; i < frames; i++ {
+		_, err := buf.read(p, time.Time{})
+		require.NoError(t, err)
+	}
+	assert.True(t, len(ack) < frames, "acks should have been delayed")
+
+	acked := 0
+	for acked < frames {
+		select {
+		case frame := <-ack:
+			acked += int(binaryEncoding.Uint32(frame))
+		case <-time.After(2 * jitter):
+			t.Fatalf("only %d of %d frames acked", acked, frames)
+		}
+	}
+	assert.True(t, time.Since(start) < 2*jitter, "acks should be delayed by no more than the jitter")
+}
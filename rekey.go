@@ -0,0 +1,92 @@
+package lampshade
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// rekeyIVSize is the size of the data IV in a rekey frame, which is the
+	// same for all ciphers that support rekeying
+	rekeyIVSize = 12
+
+	// rekeyDataSize is the size of a rekey frame after its header, the new
+	// secret followed by the new data IV
+	rekeyDataSize = maxSecretSize + rekeyIVSize
+)
+
+var sessionRekeys int64
+
+// rekeyingEnabled indicates whether this end of the session should rekey its
+// send direction, see "Rekeying" in the package docs.
+func (s *session) rekeyingEnabled() bool {
+	return s.version >= rekeyVersion && s.cipherCode != NoEncryption && (s.rekeyBytes > 0 || s.rekeyInterval > 0)
+}
+
+// rekeyDue indicates whether it's time to switch to a new key for sending. Only
+// called from the sendLoop.
+func (s *session) rekeyDue() bool {
+	if !s.rekeyingEnabled() {
+		return false
+	}
+	if s.rekeyBytes > 0 && s.bytesSinceRekey >= s.rekeyBytes {
+		return true
+	}
+	return s.rekeyInterval > 0 && time.Since(s.lastRekey) >= s.rekeyInterval
+}
+
+// rekey generates a new secret and data IV, sends them to the peer in a
+// session frame of their own that's still encrypted with the current key and
+// then switches to them for all subsequent session frames. Only called from the
+// sendLoop, which is what makes the switch atomic with respect to sending.
+func (s *session) rekey() bool {
+	secret, err := newSecret()
+	if err != nil {
+		s.onSessionError(nil, fmt.Errorf("Unable to rekey: %v", err))
+		return false
+	}
+	iv, err := newIV(rekeyIVSize)
+	if err != nil {
+		s.onSessionError(nil, fmt.Errorf("Unable to rekey: %v", err))
+		return false
+	}
+	encrypt, err := newEncrypter(s.cipherCode, secret, iv)
+	if err != nil {
+		s.onSessionError(nil, fmt.Errorf("Unable to rekey: %v", err))
+		return false
+	}
+
+	b := s.sendSessionFrame
+	frameSize := copy(b[lenSize:], newHeader(frameTypeRekey, 0))
+	frameSize += copy(b[lenSize+frameSize:], secret)
+	frameSize += copy(b[lenSize+frameSize:], iv)
+	n, err := s.writeToWire(b, lenSize, frameSize, true)
+	if err != nil {
+		s.onSessionError(nil, err)
+		return false
+	}
+	if n == 0 {
+		// the frame interceptor dropped the rekey frame, so the peer won't know to
+		// switch and neither should we
+		return true
+	}
+	s.dataEncrypt = encrypt
+	s.bytesSinceRekey = 0
+	s.lastRekey = time.Now()
+	atomic.AddInt64(&sessionRekeys, 1)
+	log.Debugf("%vSwitched to new key for sending", s.logPrefix)
+	return true
+}
+
+// decrypterForRekey builds the decrypter for the secret and data IV carried by
+// a rekey frame.
+func (s *session) decrypterForRekey(data []byte) (func([]byte) ([]byte, error), error) {
+	if s.version < rekeyVersion || s.cipherCode == NoEncryption {
+		return nil, fmt.Errorf("Unexpected rekey frame for protocol version %d and cipher %v", s.version, s.cipherCode)
+	}
+	secret, iv := data[:maxSecretSize], data[maxSecretSize:rekeyDataSize]
+	return newDecrypter(s.cipherCode, append([]byte(nil), secret...), append([]byte(nil), iv...))
+}
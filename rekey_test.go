@@ -0,0 +1,101 @@
+package lampshade
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func echoAll(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go io.Copy(conn, conn)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	for _, cipherCode := range []Cipher{AES128GCM, ChaCha20Poly1305} {
+		t.Run(cipherCode.String(), func(t *testing.T) {
+			rekeyBytes := int64(3 * MaxDataLen)
+			l, d, dial := newTestPair(t, &ListenerOpts{RekeyBytes: rekeyBytes}, func(opts *DialerOpts) {
+				opts.Cipher = cipherCode
+				opts.ProtocolVersion = rekeyVersion
+				opts.RekeyBytes = rekeyBytes
+			})
+			defer l.Close()
+			go echoAll(l)
+
+			conn, err := d.Dial(dial)
+			require.NoError(t, err)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+			before := ReadGlobalStats().SessionRekeys
+			data := make([]byte, 4*testWindowSize*MaxDataLen)
+			for i := range data {
+				data[i] = byte(i)
+			}
+			go conn.Write(data)
+			received := make([]byte, len(data))
+			_, err = io.ReadFull(conn, received)
+			require.NoError(t, err)
+			assert.Equal(t, data, received, "data should have survived the key changes in both directions")
+			rekeys := ReadGlobalStats().SessionRekeys - before
+			assert.True(t, rekeys >= 2*int64(len(data))/rekeyBytes-2, "both ends should have rekeyed repeatedly, only rekeyed %d times", rekeys)
+		})
+	}
+}
+
+func TestRekeyInterval(t *testing.T) {
+	l, d, dial := newTestPair(t, &ListenerOpts{RekeyInterval: 10 * time.Millisecond}, func(opts *DialerOpts) {
+		opts.ProtocolVersion = rekeyVersion
+		opts.RekeyInterval = 10 * time.Millisecond
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	before := ReadGlobalStats().SessionRekeys
+	b := make([]byte, 5)
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, b)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	}
+	assert.True(t, ReadGlobalStats().SessionRekeys-before >= 5, "should have rekeyed whenever the interval had passed")
+}
+
+func TestRekeyRequiresVersion(t *testing.T) {
+	l, d, dial := newTestPair(t, &ListenerOpts{RekeyBytes: 1}, func(opts *DialerOpts) {
+		opts.ProtocolVersion = oobVersion
+		opts.RekeyBytes = 1
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	before := ReadGlobalStats().SessionRekeys
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.NoError(t, err)
+	assert.Zero(t, ReadGlobalStats().SessionRekeys-before, "sessions older than version 3 shouldn't rekey")
+}
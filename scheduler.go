@@ -0,0 +1,79 @@
+package lampshade
+
+import (
+	"sync"
+)
+
+// scheduler interleaves data frames from all of a session's streams in
+// round-robin order. Each stream's sendBuffer submits one frame at a time and
+// waits for it to be scheduled before submitting the next, so serving pending
+// frames in FIFO order means that every stream with pending data gets a turn
+// before any stream gets a second one. This keeps a single bulk stream from
+// starving other streams.
+//
+// The scheduler is passive, the session's sendLoop pulls frames from it
+// whenever ready is signaled.
+type scheduler struct {
+	pending []*scheduledFrame
+	ready   chan struct{}
+	mx      sync.Mutex
+}
+
+type scheduledFrame struct {
+	frame    []byte
+	sent     chan struct{}
+	canceled bool
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		ready: make(chan struct{}, 1),
+	}
+}
+
+// submit queues the given frame for sending. The returned scheduledFrame's
+// sent channel is closed once the frame has been handed to the session.
+func (sched *scheduler) submit(frame []byte) *scheduledFrame {
+	sf := &scheduledFrame{frame: frame, sent: make(chan struct{})}
+	sched.mx.Lock()
+	sched.pending = append(sched.pending, sf)
+	sched.mx.Unlock()
+	sched.signal()
+	return sf
+}
+
+// cancel makes sure that the given frame won't be sent if it hasn't been
+// already.
+func (sched *scheduler) cancel(sf *scheduledFrame) {
+	sched.mx.Lock()
+	sf.canceled = true
+	sched.mx.Unlock()
+}
+
+// next returns the next frame to send or nil if nothing is pending.
+func (sched *scheduler) next() []byte {
+	sched.mx.Lock()
+	defer sched.mx.Unlock()
+	for len(sched.pending) > 0 {
+		sf := sched.pending[0]
+		sched.pending[0] = nil
+		sched.pending = sched.pending[1:]
+		if sf.canceled {
+			continue
+		}
+		close(sf.sent)
+		if len(sched.pending) > 0 {
+			sched.signal()
+		}
+		return sf.frame
+	}
+	return nil
+}
+
+func (sched *scheduler) signal() {
+	select {
+	case sched.ready <- struct{}{}:
+	default:
+		// already signaled
+	}
+}
@@ -1,18 +1,24 @@
 package lampshade
 
 import (
+	"math"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/l2dy/plampshade/ops"
+	"github.com/l2dy/plampshade/ema"
 )
 
 var (
 	closeTimeout = uint64(30 * time.Second)
 )
 
+const (
+	// syncRetryInterval is how often sync repeats its request for an ack
+	syncRetryInterval = 250 * time.Millisecond
+)
+
 func getCloseTimeout() time.Duration {
 	return time.Duration(atomic.LoadUint64(&closeTimeout))
 }
@@ -31,30 +37,90 @@ func setCloseTimeout(newTimeout time.Duration) {
 // When closed normally it sends an RST frame to the receiver to indicate that
 // the connection is closed. We handle this from sendBuffer so that we can
 // ensure buffered frames are sent before sending the RST.
+//
+// How long close waits for buffered frames to be sent is controlled by linger,
+// see setLinger.
+//
+// Memory accounting: a frame occupies one pooled buffer of maxFrameSize bytes
+// from the moment Write copies it until the session has written it to the
+// physical connection, after which the session returns the buffer to the pool.
+// Frames that have been sent but not yet acked don't hold on to any memory on
+// our side, they only count against the window. So the frames a stream holds
+// are:
+//
+//   - up to <windowSize> frames in in
+//   - 1 frame that sendLoop has taken from in while it waits for the window to
+//     open and for the scheduler to hand the frame to the session
+//   - 1 frame that a blocked Write has copied but not yet queued (Writes are
+//     serialized, so there's never more than one)
+//
+// for a total of at most (<windowSize> + 2) * maxFrameSize bytes per stream.
+// If maxQueued > 0, frames in in plus the one held by sendLoop are capped at
+// maxQueued and send fails with ErrSendBufferFull instead of blocking, which
+// bounds the stream to (maxQueued + 1) * maxFrameSize bytes. Since in itself
+// only holds <windowSize> frames, a maxQueued above <windowSize> + 1 doesn't
+// change anything, send blocks before reaching it.
 type sendBuffer struct {
-	defaultHeader  []byte
-	window         *window
-	in             chan []byte
-	closeOnce      sync.Once
-	closeRequested chan bool
-	muClosing      sync.RWMutex
-	closing        bool
-	closed         chan interface{}
+	defaultHeader   []byte
+	sessionClosed   <-chan struct{}
+	linger          int64
+	window          *window
+	inFlight        []int     // sizes of sent data frames that haven't been acked yet, oldest first
+	inFlightTotal   int       // sum of inFlight
+	inFlightBytes   *int64    // session-wide count of unacked bytes
+	maxUnackedBytes int       // if > 0, cap on inFlightTotal, see bytesAvailable
+	bytesWaiter     chan bool // closed once bytesNeeded fit, see bytesAvailable
+	bytesNeeded     int
+	unacked         int   // frames accepted by send that haven't been acked yet
+	framesSent      int   // data frames handed to the session so far
+	framesAcked     int   // data frames acked so far
+	rttSample       int   // if > 0, the frame number in framesSent that's being timed
+	maxQueued       int32 // if > 0, cap on queued, see ErrSendBufferFull
+	queued          int32 // frames accepted by send that haven't been handed to the session yet
+	rttSampleStart  time.Time
+	rtt             *ema.EMA
+	allAcked        chan struct{}
+	highWater       int
+	lowWater        int
+	onHighWater     func()
+	onLowWater      func()
+	aboveHighWater  bool
+	muInFlight      sync.Mutex
+	in              chan []byte
+	closeOnce       sync.Once
+	closeRequested  chan bool
+	onDropped       func(FrameDropReason) // if set, called for each discarded data frame
+	abortOnce       sync.Once
+	aborted         chan struct{}
+	muClosing       sync.RWMutex
+	closing         bool
+	closed          chan interface{}
 }
 
-func newSendBuffer(defaultHeader []byte, out chan []byte, windowSize int) *sendBuffer {
+func newSendBuffer(defaultHeader []byte, sched *scheduler, windowSize int, maxQueued int, maxUnackedBytes int, win *window, inFlightBytes *int64, sessionClosed <-chan struct{}, onDropped func(FrameDropReason), spawn func(func())) *sendBuffer {
 	buf := &sendBuffer{
-		defaultHeader:  defaultHeader,
-		window:         newWindow(windowSize),
-		in:             make(chan []byte, windowSize),
-		closeRequested: make(chan bool, 1),
-		closed:         make(chan interface{}),
+		defaultHeader:   defaultHeader,
+		maxQueued:       int32(maxQueued),
+		maxUnackedBytes: maxUnackedBytes,
+		sessionClosed:   sessionClosed,
+		inFlightBytes:   inFlightBytes,
+		allAcked:        make(chan struct{}),
+		rtt:             ema.NewDuration(0, 0.5),
+		window:          win,
+		in:              make(chan []byte, windowSize),
+		linger:          -1,
+		closeRequested:  make(chan bool, 1),
+		onDropped:       onDropped,
+		aborted:         make(chan struct{}),
+		closed:          make(chan interface{}),
 	}
-	ops.Go(func() { buf.sendLoop(out) })
+	// nothing to wait for yet
+	close(buf.allAcked)
+	spawn(func() { buf.sendLoop(sched, spawn) })
 	return buf
 }
 
-func (buf *sendBuffer) sendLoop(out chan []byte) {
+func (buf *sendBuffer) sendLoop(sched *scheduler, spawn func(func())) {
 	sendRST := false
 	rstFrame := withFrameType(buf.defaultHeader, frameTypeRST)
 	closeTimedOut := make(chan interface{})
@@ -62,40 +128,112 @@ func (buf *sendBuffer) sendLoop(out chan []byte) {
 	var signalCloseOnce sync.Once
 	signalClose := func() {
 		signalCloseOnce.Do(func() {
-			go func() {
+			spawn(func() {
 				buf.muClosing.Lock()
 				buf.closing = true
 				close(buf.in)
 				buf.muClosing.Unlock()
-				time.Sleep(getCloseTimeout())
-				close(closeTimedOut)
-			}()
+				flushTimer := time.NewTimer(buf.flushTimeout())
+				defer flushTimer.Stop()
+				select {
+				case <-flushTimer.C:
+					close(closeTimedOut)
+				case <-buf.sessionClosed:
+					// nothing more will be sent, don't wait for it
+					close(closeTimedOut)
+				case <-buf.closed:
+					// finished flushing in time, don't hang around
+				}
+			})
 		})
 	}
 
-	var write func(b []byte)
-	write = func(b []byte) {
+	var waitForSent func(sf *scheduledFrame) bool
+	waitForSent = func(sf *scheduledFrame) bool {
 		select {
-		case out <- b:
-			// okay
+		case <-sf.sent:
+			return true
 		case sendRST = <-buf.closeRequested:
-			// close was requested while we were writing, try again
+			// close was requested while we were writing, keep waiting
 			signalClose()
-			write(b)
+			return waitForSent(sf)
 		case <-closeTimedOut:
 			// closed before frame could be sent, give up
+			sched.cancel(sf)
+			return false
+		}
+	}
+	write := func(b []byte) bool {
+		return waitForSent(sched.submit(b))
+	}
+	writeData := func(frame []byte) {
+		header := buf.defaultHeader
+		if frame == nil {
+			// the fin, see closeWrite
+			header = withFrameType(header, frameTypeFin)
+		}
+		// record size before writing since the session returns the frame to the
+		// pool once it's been sent
+		buf.recordInFlight(len(frame))
+		if !write(withDataHeader(frame, header)) {
+			buf.dropped()
+		}
+		atomic.AddInt32(&buf.queued, -1)
+	}
+
+	// waitToSend waits until available fires, handling a close request in the
+	// meantime. It returns false if closing timed out first.
+	waitToSend := func(available <-chan bool) bool {
+		select {
+		case <-available:
+			return true
+		case sendRST = <-buf.closeRequested:
+			// close requested before window available
+			signalClose()
+			select {
+			case <-available:
+				return true
+			case <-closeTimedOut:
+				// closed before window available
+				return false
+			}
+		case <-closeTimedOut:
+			return false
 		}
 	}
 
 	defer func() {
 		if sendRST {
 			// Send an RST frame with the streamID
-			write(rstFrame)
+			if buf.lingering() {
+				// we stopped flushing because the linger time elapsed, make sure the
+				// RST still goes out
+				buf.writeAfterTimeout(sched, rstFrame)
+			} else {
+				write(rstFrame)
+			}
 		}
+		select {
+		case <-closeTimedOut:
+			// in has been closed, whatever's left in it won't be sent
+			for range buf.in {
+				buf.dropped()
+			}
+		default:
+		}
+		// frames that haven't been acked yet won't be anymore
+		buf.acked(math.MaxInt32, false)
 		close(buf.closed)
 	}()
 
 	for {
+		select {
+		case <-closeTimedOut:
+			// don't send anything else once we've timed out
+			return
+		default:
+		}
+
 		select {
 		case frame, open := <-buf.in:
 			if !open {
@@ -103,22 +241,17 @@ func (buf *sendBuffer) sendLoop(out chan []byte) {
 				return
 			}
 			windowAvailable := buf.window.sub(1)
-			select {
-			case <-windowAvailable:
-				// send allowed
-				write(append(frame, buf.defaultHeader...))
-			case sendRST = <-buf.closeRequested:
-				// close requested before window available
-				signalClose()
-				select {
-				case <-windowAvailable:
-					// send allowed
-					write(append(frame, buf.defaultHeader...))
-				case <-closeTimedOut:
-					// closed before window available
-					return
-				}
+			if windowAvailable != immediate {
+				atomic.AddInt64(&windowStalls, 1)
+			}
+			if !waitToSend(windowAvailable) || !waitToSend(buf.bytesAvailable(len(frame))) {
+				// close was requested while frames were still queued and the
+				// window didn't open before we timed out
+				buf.dropped()
+				return
 			}
+			// send allowed
+			writeData(frame)
 		case sendRST = <-buf.closeRequested:
 			signalClose()
 		case <-closeTimedOut:
@@ -129,21 +262,301 @@ func (buf *sendBuffer) sendLoop(out chan []byte) {
 	}
 }
 
+// withDataHeader writes the given header into the space reserved for it right
+// after the data of a frame. Frames come from BufferPool.getForFrame, which
+// sizes them to hold a full frame including its header, and each frame has its
+// pooled buffer to itself (see stream.writeFrame), so the reserved space never
+// belongs to anything else. Should a frame ever lack that space, it's copied
+// into a new buffer rather than grown with append, which would size the new
+// buffer unpredictably.
+func withDataHeader(frame []byte, header []byte) []byte {
+	n := len(frame)
+	if cap(frame)-n < len(header) {
+		grown := make([]byte, n, maxFrameSize)
+		copy(grown, frame)
+		frame = grown
+	}
+	frame = frame[:n+len(header)]
+	copy(frame[n:], header)
+	return frame
+}
+
+func (buf *sendBuffer) recordInFlight(size int) {
+	buf.muInFlight.Lock()
+	buf.inFlight = append(buf.inFlight, size)
+	buf.inFlightTotal += size
+	buf.framesSent++
+	if buf.rttSample == 0 {
+		// time this frame, see acked
+		buf.rttSample = buf.framesSent
+		buf.rttSampleStart = time.Now()
+	}
+	buf.muInFlight.Unlock()
+	atomic.AddInt64(buf.inFlightBytes, int64(size))
+}
+
+// acked removes the given number of frames from the in-flight accounting. If
+// byPeer is true, the frames were acked by the peer, and if that covers the
+// frame that's being timed, the time since sending it is added to the RTT
+// estimate. Like TCP, we only time one frame at a time, so that sampling
+// doesn't cost more than a clock read per round trip.
+func (buf *sendBuffer) acked(frames int, byPeer bool) {
+	buf.muInFlight.Lock()
+	if frames > len(buf.inFlight) {
+		frames = len(buf.inFlight)
+	}
+	buf.framesAcked += frames
+	if byPeer && buf.rttSample > 0 && buf.framesAcked >= buf.rttSample {
+		buf.rtt.UpdateDuration(time.Since(buf.rttSampleStart))
+		buf.rttSample = 0
+	}
+	ackedBytes := 0
+	for _, size := range buf.inFlight[:frames] {
+		ackedBytes += size
+	}
+	buf.inFlight = buf.inFlight[frames:]
+	buf.inFlightTotal -= ackedBytes
+	if buf.bytesWaiter != nil && buf.fitsUnacked(buf.bytesNeeded) {
+		close(buf.bytesWaiter)
+		buf.bytesWaiter = nil
+	}
+	crossed := buf.addUnacked(-frames)
+	buf.muInFlight.Unlock()
+	if ackedBytes > 0 {
+		atomic.AddInt64(buf.inFlightBytes, -int64(ackedBytes))
+	}
+	notify(crossed)
+}
+
+// bytesAvailable returns a channel that's closed once a data frame of the
+// given size can be sent without exceeding maxUnackedBytes. Only sendLoop
+// calls it, so there's never more than one waiter.
+func (buf *sendBuffer) bytesAvailable(size int) <-chan bool {
+	if buf.maxUnackedBytes <= 0 {
+		return immediate
+	}
+	buf.muInFlight.Lock()
+	defer buf.muInFlight.Unlock()
+	if buf.fitsUnacked(size) {
+		return immediate
+	}
+	buf.bytesWaiter = make(chan bool)
+	buf.bytesNeeded = size
+	return buf.bytesWaiter
+}
+
+// fitsUnacked indicates whether size more unacked bytes stay within
+// maxUnackedBytes. There's always room for one frame when nothing is unacked,
+// so that a cap below the frame size can't stall the stream. Must be called
+// while holding muInFlight.
+func (buf *sendBuffer) fitsUnacked(size int) bool {
+	return buf.inFlightTotal == 0 || buf.inFlightTotal+size <= buf.maxUnackedBytes
+}
+
+// effectiveMaxUnackedBytes raises a positive maxUnackedBytes to at least what
+// the peer's receiveBuffer consumes before it acks, which is
+// ackIntervalFor(windowSize) frames of up to MaxDataLen bytes. With a lower cap,
+// a stream could stop sending before the peer has anything to ack, and neither
+// end would ever make progress again.
+func effectiveMaxUnackedBytes(maxUnackedBytes int, windowSize int) int {
+	if maxUnackedBytes <= 0 {
+		return maxUnackedBytes
+	}
+	if min := ackIntervalFor(windowSize) * MaxDataLen; maxUnackedBytes < min {
+		return min
+	}
+	return maxUnackedBytes
+}
+
+// addUnacked adjusts the number of frames awaiting an ack, replacing allAcked
+// when we start waiting and closing it once everything has been acked. Must be
+// called while holding muInFlight. If this crosses one of the water marks, it
+// returns the corresponding callback, which the caller should pass to notify
+// once it has released muInFlight.
+func (buf *sendBuffer) addUnacked(delta int) func() {
+	wasAllAcked := buf.unacked == 0
+	buf.unacked += delta
+	if wasAllAcked && buf.unacked > 0 {
+		buf.allAcked = make(chan struct{})
+	} else if !wasAllAcked && buf.unacked == 0 {
+		close(buf.allAcked)
+	}
+
+	if buf.highWater <= 0 {
+		return nil
+	}
+	if !buf.aboveHighWater && buf.unacked >= buf.highWater {
+		buf.aboveHighWater = true
+		return buf.onHighWater
+	}
+	if buf.aboveHighWater && buf.unacked <= buf.lowWater {
+		buf.aboveHighWater = false
+		return buf.onLowWater
+	}
+	return nil
+}
+
+func notify(callback func()) {
+	if callback != nil {
+		callback()
+	}
+}
+
+// setWaterMarks configures callbacks for when the number of unacked frames
+// reaches high and when it subsequently drops back to low. A high <= 0
+// disables the callbacks.
+func (buf *sendBuffer) setWaterMarks(high, low int, onHigh, onLow func()) {
+	buf.muInFlight.Lock()
+	buf.highWater = high
+	buf.lowWater = low
+	buf.onHighWater = onHigh
+	buf.onLowWater = onLow
+	buf.aboveHighWater = false
+	buf.muInFlight.Unlock()
+}
+
+// sync waits until every frame accepted by send so far has been acked or until
+// deadline. While waiting, it periodically calls requestAck to prompt the peer
+// to ack frames that it has consumed but not yet acked.
+func (buf *sendBuffer) sync(deadline time.Time, requestAck func()) error {
+	buf.muInFlight.Lock()
+	allAcked := buf.allAcked
+	buf.muInFlight.Unlock()
+
+	select {
+	case <-allAcked:
+		return nil
+	default:
+	}
+
+	if deadline.IsZero() {
+		deadline = largeDeadline
+	}
+	timeout := time.NewTimer(time.Until(deadline))
+	defer timeout.Stop()
+	retry := time.NewTicker(syncRetryInterval)
+	defer retry.Stop()
+
+	for {
+		requestAck()
+		select {
+		case <-allAcked:
+			return nil
+		case <-retry.C:
+			// peer may have consumed more since our last request
+		case <-timeout.C:
+			return ErrTimeout
+		case <-buf.closed:
+			return ErrConnectionClosed
+		}
+	}
+}
+
+// setLinger controls how closing behaves, similarly to net.TCPConn.SetLinger.
+// If sec < 0 (the default), buffered frames are flushed for up to closeTimeout
+// before sending an RST. If sec == 0, buffered frames are discarded and the RST
+// is sent immediately. If sec > 0, buffered frames are flushed for up to sec
+// seconds before sending an RST.
+func (buf *sendBuffer) setLinger(sec int) {
+	linger := int64(-1)
+	if sec >= 0 {
+		linger = int64(time.Duration(sec) * time.Second)
+	}
+	atomic.StoreInt64(&buf.linger, linger)
+}
+
+func (buf *sendBuffer) lingering() bool {
+	return atomic.LoadInt64(&buf.linger) >= 0
+}
+
+// flushTimeout is how long to keep flushing buffered frames after close.
+func (buf *sendBuffer) flushTimeout() time.Duration {
+	linger := atomic.LoadInt64(&buf.linger)
+	if linger < 0 {
+		return getCloseTimeout()
+	}
+	return time.Duration(linger)
+}
+
+// writeAfterTimeout writes the given frame after flushing has already timed
+// out, waiting up to closeTimeout for the session to pick it up.
+func (buf *sendBuffer) writeAfterTimeout(sched *scheduler, b []byte) {
+	sf := sched.submit(b)
+	timer := time.NewTimer(getCloseTimeout())
+	defer timer.Stop()
+	select {
+	case <-sf.sent:
+		// okay
+	case <-timer.C:
+		sched.cancel(sf)
+	case <-buf.sessionClosed:
+		sched.cancel(sf)
+	}
+}
+
+// dropped reports a data frame that's discarded without being sent to
+// onDropped, if set.
+func (buf *sendBuffer) dropped() {
+	if buf.onDropped == nil {
+		return
+	}
+	select {
+	case <-buf.sessionClosed:
+		buf.onDropped(FrameDropClosed)
+	default:
+		buf.onDropped(FrameDropTimeout)
+	}
+}
+
 func (buf *sendBuffer) send(b []byte, writeDeadline time.Time) (int, error) {
+	queued := atomic.AddInt32(&buf.queued, 1)
+	if buf.maxQueued > 0 && queued > buf.maxQueued {
+		atomic.AddInt32(&buf.queued, -1)
+		return 0, ErrSendBufferFull
+	}
+	// count the frame before queueing it so that an ack can't beat us to it
+	buf.muInFlight.Lock()
+	crossed := buf.addUnacked(1)
+	buf.muInFlight.Unlock()
+	notify(crossed)
 	for {
 		processed, n, err := buf.doSend(b, writeDeadline)
 		if processed {
+			if err != nil {
+				atomic.AddInt32(&buf.queued, -1)
+				buf.muInFlight.Lock()
+				crossed = buf.addUnacked(-1)
+				buf.muInFlight.Unlock()
+				notify(crossed)
+			} else {
+				sendQueueDepths.record(int(atomic.LoadInt32(&buf.queued)))
+			}
 			return n, err
 		}
 	}
 }
 
+// closeWrite queues a fin frame behind the frames that are already queued. Like
+// a data frame, it takes up a slot in the window and waits for an ack. The fin
+// is represented by a nil frame in in, which Writes never produce since they
+// always copy into a pooled buffer, even when they're empty. The caller must
+// make sure that nothing else gets sent afterwards.
+func (buf *sendBuffer) closeWrite(writeDeadline time.Time) error {
+	_, err := buf.send(nil, writeDeadline)
+	return err
+}
+
 func (buf *sendBuffer) doSend(b []byte, writeDeadline time.Time) (bool, int, error) {
 	buf.muClosing.RLock()
 	defer buf.muClosing.RUnlock()
 
 	if buf.closing {
+		return true, 0, ErrStreamClosing
+	}
+	select {
+	case <-buf.aborted:
 		return true, 0, syscall.EPIPE
+	default:
 	}
 
 	closeTimer := time.NewTimer(getCloseTimeout())
@@ -154,6 +567,8 @@ func (buf *sendBuffer) doSend(b []byte, writeDeadline time.Time) (bool, int, err
 		select {
 		case buf.in <- b:
 			return true, len(b), nil
+		case <-buf.aborted:
+			return true, 0, syscall.EPIPE
 		case <-closeTimer.C:
 			// don't block forever to give us a chance to close
 			return false, 0, nil
@@ -173,12 +588,22 @@ func (buf *sendBuffer) doSend(b []byte, writeDeadline time.Time) (bool, int, err
 		return true, len(b), nil
 	case <-writeTimer.C:
 		return true, 0, ErrTimeout
+	case <-buf.aborted:
+		return true, 0, syscall.EPIPE
 	case <-closeTimer.C:
 		// don't block forever to give us a chance to close
 		return false, 0, nil
 	}
 }
 
+// abort fails any pending and subsequent sends. Together with a linger of 0,
+// this lets close proceed without waiting for blocked writers.
+func (buf *sendBuffer) abort() {
+	buf.abortOnce.Do(func() {
+		close(buf.aborted)
+	})
+}
+
 func (buf *sendBuffer) close(sendRST bool) {
 	buf.closeOnce.Do(func() {
 		buf.closeRequested <- sendRST
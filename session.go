@@ -2,7 +2,9 @@ package lampshade
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -17,6 +19,7 @@ import (
 	"github.com/l2dy/plampshade/ema"
 	"github.com/l2dy/plampshade/idletiming"
 	"github.com/l2dy/plampshade/mtime"
+	"github.com/l2dy/plampshade/netx"
 	"github.com/l2dy/plampshade/ops"
 
 	log "github.com/sirupsen/logrus"
@@ -27,19 +30,128 @@ var (
 )
 
 var (
-	openSessions          int64
-	closingSessions       int64
-	closedSessions        int64
-	openStreams           int64
-	closingStreams        int64
-	closingReceiveBuffers int64
-	closingSendBuffers    int64
-	closedStreams         int64
-	recvLoops             int64
-	sendLoops             int64
-	trackStatsOnce        sync.Once
+	openSessions            int64
+	closingSessions         int64
+	closedSessions          int64
+	openStreams             int64
+	closingStreams          int64
+	closingReceiveBuffers   int64
+	closingSendBuffers      int64
+	closedStreams           int64
+	recvLoops               int64
+	sendLoops               int64
+	bytesSent               int64
+	bytesReceived           int64
+	windowStalls            int64
+	sessionsDialed          int64
+	sessionGoroutines       int64
+	leakedSessions          int64
+	framesDroppedAfterClose int64
+	leakCheckTimeout        int64
+	trackStatsOnce          sync.Once
 )
 
+const (
+	// leakCheckInterval is how often checkForLeaks looks at whether a closed
+	// session's goroutines have exited
+	leakCheckInterval = 10 * time.Millisecond
+)
+
+// SetLeakCheck enables a debug check that, whenever a Session closes, waits up
+// to timeout for all of the goroutines that the Session started for itself and
+// its Streams to exit. If any are still running after that, it logs an error
+// and counts the Session in GlobalStats.LeakedSessions. A timeout <= 0 (the
+// default) disables the check.
+func SetLeakCheck(timeout time.Duration) {
+	atomic.StoreInt64(&leakCheckTimeout, int64(timeout))
+}
+
+func getLeakCheckTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&leakCheckTimeout))
+}
+
+// GlobalStats is a point in time snapshot of process-wide statistics across all
+// Dialers and Listeners.
+type GlobalStats struct {
+	// OpenSessions is the number of currently open Sessions.
+	OpenSessions int64
+
+	// ClosedSessions is the total number of Sessions that have been closed.
+	ClosedSessions int64
+
+	// OpenStreams is the number of currently open Streams.
+	OpenStreams int64
+
+	// ClosedStreams is the total number of Streams that have been closed.
+	ClosedStreams int64
+
+	// BytesSent is the total number of bytes written to physical connections,
+	// including framing and padding.
+	BytesSent int64
+
+	// BytesReceived is the total number of bytes read from physical
+	// connections, including framing and padding.
+	BytesReceived int64
+
+	// WindowStalls is the number of times a Stream had to wait for its transmit
+	// window to open up before sending.
+	WindowStalls int64
+
+	// SessionsDialed is the number of physical connections established by
+	// Dialers for regular streams.
+	SessionsDialed int64
+
+	// SessionGoroutines is the number of goroutines currently running on
+	// behalf of Sessions and their Streams, including ones that are still
+	// winding down after their Session closed.
+	SessionGoroutines int64
+
+	// LeakedSessions is the number of closed Sessions whose goroutines didn't
+	// all exit in time, if enabled with SetLeakCheck.
+	LeakedSessions int64
+
+	// FramesDroppedAfterClose is the number of data frames that were received
+	// for a Stream after it had been closed for reading and were discarded.
+	FramesDroppedAfterClose int64
+
+	// SessionRekeys is the number of times a Session switched to a new key for
+	// sending, see DialerOpts.RekeyBytes and DialerOpts.RekeyInterval.
+	SessionRekeys int64
+
+	// ChecksumFailures is the number of Sessions that were closed because a
+	// session frame failed its checksum, see DialerOpts.Checksums.
+	ChecksumFailures int64
+
+	// SendQueueDepths and ReceiveQueueDepths are histograms of the depths of
+	// Streams' send and receive queues, if enabled with SetDepthHistograms.
+	// Comparing their upper quantiles to the window size shows whether the
+	// window is too small (send queues back up while receive queues stay
+	// shallow) or bigger than readers need (receive queues back up).
+	SendQueueDepths    DepthHistogram
+	ReceiveQueueDepths DepthHistogram
+}
+
+// ReadGlobalStats returns a snapshot of the process-wide statistics.
+func ReadGlobalStats() GlobalStats {
+	return GlobalStats{
+		OpenSessions:            atomic.LoadInt64(&openSessions),
+		ClosedSessions:          atomic.LoadInt64(&closedSessions),
+		OpenStreams:             atomic.LoadInt64(&openStreams),
+		ClosedStreams:           atomic.LoadInt64(&closedStreams),
+		BytesSent:               atomic.LoadInt64(&bytesSent),
+		BytesReceived:           atomic.LoadInt64(&bytesReceived),
+		WindowStalls:            atomic.LoadInt64(&windowStalls),
+		SessionsDialed:          atomic.LoadInt64(&sessionsDialed),
+		SessionGoroutines:       atomic.LoadInt64(&sessionGoroutines),
+		LeakedSessions:          atomic.LoadInt64(&leakedSessions),
+		FramesDroppedAfterClose: atomic.LoadInt64(&framesDroppedAfterClose),
+		SessionRekeys:           atomic.LoadInt64(&sessionRekeys),
+		ChecksumFailures:        atomic.LoadInt64(&checksumFailures),
+		SendQueueDepths:         sendQueueDepths.snapshot(),
+		ReceiveQueueDepths:      receiveQueueDepths.snapshot(),
+	}
+}
+
 func trackStats() {
 	trackStatsOnce.Do(func() {
 		ops.Go(func() {
@@ -57,36 +169,74 @@ func trackStats() {
 type sessionIntf interface {
 	AllowNewStream(maxStreamPerConn uint16, idleInterval time.Duration) bool
 	MarkDefunct()
-	CreateStream() *stream
+	dialStream() (net.Conn, error)
+	numStreams() int
 }
 type nullSession struct{}
 
 func (s nullSession) AllowNewStream(maxStreamPerConn uint16, idleInterval time.Duration) bool {
 	return false
 }
-func (s nullSession) MarkDefunct()          {}
-func (s nullSession) CreateStream() *stream { panic("should never be called") }
+func (s nullSession) MarkDefunct()                  {}
+func (s nullSession) dialStream() (net.Conn, error) { panic("should never be called") }
+func (s nullSession) numStreams() int               { return 0 }
 
 // session encapsulates the multiplexing of streams onto a single "physical"
 // net.Conn.
 type session struct {
+	// 64 bit fields first so that they're aligned for atomic access
+	goroutines    int64 // number of goroutines started with spawn that are still running
+	lastActivity  int64 // unix nanos
+	inFlightBytes int64 // bytes sent but not yet acked across all streams
 	net.Conn
 	windowSize          int
+	windowPolicy        atomic.Value // windowPolicyValue, see SetWindowPolicy
+	maxQueuedFrames     int
+	maxUnackedBytes     int
+	receiveBufferDepth  int
+	maxReceiveBytes     int
 	maxPadding          *big.Int
 	paddingEnabled      bool
-	cipherOverhead      int
+	cipherOverhead      int  // includes the checksum, if enabled
+	checksums           bool // whether session frames carry checksums
+	cipherCode          Cipher
+	rekeyBytes          int64         // if > 0, rekey after sending this many bytes
+	rekeyInterval       time.Duration // if > 0, rekey after sending for this long
+	bytesSinceRekey     int64         // only accessed from sendLoop
+	lastRekey           time.Time     // only accessed from sendLoop
 	ackOnFirst          bool
+	ackJitter           time.Duration
+	adaptiveAcks        bool
+	frameInterceptor    FrameInterceptor
+	onFrameDropped      func(streamID uint16, reason FrameDropReason)
+	streamLogLevel      log.Level       // PanicLevel disables stream logging
+	hooks               *LifecycleHooks // nil for probe sessions
+	name                string          // see DialerOpts.Name
+	logPrefix           string
 	metaDecrypt         func([]byte) // decrypt in place
 	metaEncrypt         func([]byte) // encrypt in place
 	dataDecrypt         func([]byte) ([]byte, error)
 	dataEncrypt         func(dst []byte, src []byte) []byte
 	pool                BufferPool
 	pingInterval        time.Duration
+	keepAliveInterval   time.Duration
+	writeStallTimeout   time.Duration
+	streamIdleTimeout   time.Duration
+	maxSessionFrameSize int         // if > 0, no session frame on the wire is larger
+	maxDataLen          int         // largest data frame that fits maxSessionFrameSize
+	pendingFrame        []byte      // only accessed from sendLoop, see MaxSessionFrameSize
+	stallTimer          *time.Timer // armed while writing, if writeStallTimeout > 0
+	stalled             int32       // set once a write stalled, see ErrSessionStalled
 	lastPing            time.Time
 	sendSessionFrame    []byte
 	sendLengthBuffer    []byte
 	out                 chan []byte
 	echoOut             chan []byte
+	ackOut              chan []byte // acks, unless they're sharded
+	echoes              chan time.Duration
+	sched               *scheduler
+	acks                *ackShards   // nil unless acks are sharded
+	framePriority       []FrameClass // order in which sendLoop picks frames
 	streams             map[uint16]*stream
 	closed              map[uint16]bool
 	defunct             bool
@@ -98,30 +248,101 @@ type session struct {
 	finishedSendingCh   chan struct{}
 	finishedReceivingCh chan struct{}
 	lastDialed          time.Time
+	createdAt           time.Time
+	receivedAny         int32
+	connFailed          int32 // set if the connection failed before we closed the session ourselves
+	lameDuck            int32 // set once the server has sent a lame duck frame
+	id                  uint64
+	version             int // protocol version spoken on this session
+	handshakeStart      time.Time
+	onFirstResponse     func()
 	nextID              uint32
+	nextPushID          uint32 // server only, see PushStream
+	client              bool   // whether this is the dialing end
+	pushEnabled         bool   // whether the server may push streams, see "Pushed Streams"
+	pushed              chan *stream
+	probe               bool // see sessionOpts.probe
 	mx                  sync.RWMutex
 }
 
+// sessionOpts configures the tunable behavior of a session.
+type sessionOpts struct {
+	name                string // if set, prefixed to log lines
+	version             int    // protocol version, see "Protocol Versions"
+	handshakeStart      time.Time
+	onFirstResponse     func() // if set, called once the first frame from the peer arrives
+	windowSize          int
+	windowPolicy        WindowPolicy // defaults to FixedWindowPolicy
+	maxQueuedFrames     int          // if > 0, streams' Writes fail once this many frames are queued
+	maxUnackedBytes     int          // if > 0, streams stop sending once this many bytes are unacked
+	receiveBufferDepth  int          // defaults to windowSize
+	maxReceiveBytes     int          // if > 0, limits bytes buffered per stream, see receiveBuffer.limitBytes
+	maxPadding          int
+	ackOnFirst          bool
+	ackJitter           time.Duration
+	adaptiveAcks        bool
+	pingInterval        time.Duration
+	keepAliveInterval   time.Duration
+	writeStallTimeout   time.Duration // if > 0, close the session when a write takes longer
+	streamIdleTimeout   time.Duration // if > 0, reset streams that are idle for longer
+	maxSessionFrameSize int           // if > 0, limits the size of session frames on the wire
+	rekeyBytes          int64
+	rekeyInterval       time.Duration
+	frameInterceptor    FrameInterceptor
+	onFrameDropped      func(streamID uint16, reason FrameDropReason) // if set, see DialerOpts.OnFrameDropped
+	streamLogLevel      log.Level
+	hooks               *LifecycleHooks
+	checksums           bool         // whether session frames carry checksums, see "Checksums"
+	ackShards           int          // if > 1, number of channels to spread acks across
+	framePriority       []FrameClass // defaults to DefaultFramePriority
+	pushEnabled         bool         // whether the server may push streams, see "Pushed Streams"
+	client              bool         // whether this is the dialing end, implied by a clientInitMsg
+	probe               bool         // whether this is a health check session, which GlobalStats leave out
+}
+
 // startSession starts a session on the given net.Conn using the given params.
 // If connCh is provided, the session will notify of new streams as they are
 // opened. If beforeClose is provided, the session will use it to notify when
 // it's about to close. If clientInitMsg is provided, this message will be sent
-// with the first frame sent in this session.
-func startSession(conn net.Conn, windowSize int, maxPadding int, ackOnFirst bool, pingInterval time.Duration, cs *cryptoSpec, clientInitMsg []byte, pool BufferPool, emaRTT *ema.EMA, connCh chan net.Conn, beforeClose func(*session)) (*session, error) {
+// with the first frame sent in this session. That happens before the session
+// starts, if it can't be written in full, conn is closed and startSession
+// fails with a *handshakeWriteError.
+func startSession(conn net.Conn, opts *sessionOpts, cs *cryptoSpec, clientInitMsg []byte, pool BufferPool, emaRTT *ema.EMA, connCh chan net.Conn, beforeClose func(*session)) (*session, error) {
 	s := &session{
 		Conn:                conn,
-		windowSize:          windowSize,
-		maxPadding:          big.NewInt(int64(maxPadding)),
-		paddingEnabled:      maxPadding > 0,
-		ackOnFirst:          ackOnFirst,
+		windowSize:          opts.windowSize,
+		maxQueuedFrames:     opts.maxQueuedFrames,
+		maxUnackedBytes:     effectiveMaxUnackedBytes(opts.maxUnackedBytes, opts.windowSize),
+		receiveBufferDepth:  opts.receiveBufferDepth,
+		maxReceiveBytes:     opts.maxReceiveBytes,
+		maxPadding:          big.NewInt(int64(opts.maxPadding)),
+		paddingEnabled:      opts.maxPadding > 0,
+		ackOnFirst:          opts.ackOnFirst,
+		ackJitter:           opts.ackJitter,
+		adaptiveAcks:        opts.adaptiveAcks,
+		frameInterceptor:    opts.frameInterceptor,
+		onFrameDropped:      opts.onFrameDropped,
+		streamLogLevel:      opts.streamLogLevel,
+		hooks:               opts.hooks,
 		cipherOverhead:      cs.cipherCode.overhead(),
+		cipherCode:          cs.cipherCode,
+		rekeyBytes:          opts.rekeyBytes,
+		rekeyInterval:       opts.rekeyInterval,
 		pool:                pool,
-		pingInterval:        pingInterval,
+		pingInterval:        opts.pingInterval,
+		keepAliveInterval:   opts.keepAliveInterval,
+		writeStallTimeout:   opts.writeStallTimeout,
+		streamIdleTimeout:   opts.streamIdleTimeout,
 		lastPing:            time.Now(),
 		sendSessionFrame:    make([]byte, maxSessionFrameSize), // Pre-allocate a sessionFrame for sending
 		sendLengthBuffer:    make([]byte, lenSize),             // pre-allocate buffer for length to avoid extra allocations
 		out:                 make(chan []byte),
 		echoOut:             make(chan []byte),
+		ackOut:              make(chan []byte),
+		framePriority:       normalizeFramePriority(opts.framePriority),
+		echoes:              make(chan time.Duration, 1),
+		sched:               newScheduler(),
+		acks:                newAckShards(opts.ackShards),
 		streams:             make(map[uint16]*stream),
 		closed:              make(map[uint16]bool),
 		emaRTT:              emaRTT,
@@ -131,29 +352,75 @@ func startSession(conn net.Conn, windowSize int, maxPadding int, ackOnFirst bool
 		finishedSendingCh:   make(chan struct{}),
 		finishedReceivingCh: make(chan struct{}),
 		lastDialed:          time.Now(), // to avoid new sessions being marked as idle.
+		id:                  atomic.AddUint64(&sessionIDs, 1),
+		version:             opts.version,
+		handshakeStart:      opts.handshakeStart,
+		onFirstResponse:     opts.onFirstResponse,
+		client:              opts.client || clientInitMsg != nil,
+		pushEnabled:         opts.pushEnabled,
+		probe:               opts.probe,
+	}
+	if s.client && s.pushEnabled {
+		s.pushed = make(chan *stream, pushQueueDepth)
+	}
+	if opts.name != "" {
+		s.name = opts.name
+		s.logPrefix = opts.name + ": "
+	}
+	if s.receiveBufferDepth <= 0 {
+		s.receiveBufferDepth = s.windowSize
 	}
+	if s.writeStallTimeout > 0 {
+		s.stallTimer = time.AfterFunc(s.writeStallTimeout, s.onWriteStalled)
+		s.stallTimer.Stop()
+	}
+	if opts.checksums {
+		s.checksums = true
+		s.cipherOverhead += checksumSize
+	}
+	s.limitSessionFrameSize(opts.maxSessionFrameSize)
+	windowPolicy := opts.windowPolicy
+	if windowPolicy == nil {
+		windowPolicy = FixedWindowPolicy()
+	}
+	s.windowPolicy.Store(windowPolicyValue{windowPolicy})
+	s.createdAt = s.lastDialed
+	s.lastRekey = s.createdAt
+	s.lastActivity = s.createdAt.UnixNano()
 	var err error
 	s.metaEncrypt, s.dataEncrypt, s.metaDecrypt, s.dataDecrypt, err = cs.crypters()
 	if err != nil {
 		return nil, err
 	}
-	atomic.AddInt64(&openSessions, 1)
 	if clientInitMsg != nil {
-		s.sendClientInitMsg(clientInitMsg)
+		if err := s.sendClientInitMsg(clientInitMsg); err != nil {
+			// nothing has been started yet, so there's nothing else to clean up
+			if s.stallTimer != nil {
+				s.stallTimer.Stop()
+			}
+			conn.Close()
+			return nil, &handshakeWriteError{err}
+		}
+	}
+	s.addStat(&openSessions, 1)
+	s.onStarted()
+	s.spawn(s.sendLoop)
+	s.spawn(s.recvLoop)
+	if s.streamIdleTimeout > 0 {
+		s.spawn(s.resetIdleStreams)
 	}
-	ops.Go(s.sendLoop)
-	ops.Go(s.recvLoop)
 	return s, nil
 }
 
-func (s *session) sendClientInitMsg(clientInitMsg []byte) {
+func (s *session) sendClientInitMsg(clientInitMsg []byte) error {
 	// Client init message is already encrypted
 	copy(s.sendSessionFrame, clientInitMsg)
-	// send an empty frame with padding to randomize the size of the packet
-	_, err := s.writeToWire(s.sendSessionFrame, clientInitSize+lenSize, 0, true)
-	if err != nil {
-		s.onSessionError(nil, err)
-	}
+	// send an empty frame with padding to randomize the size of the packet.
+	// The FrameInterceptor doesn't get to see it, since dropping it would
+	// leave the session without a client init message and the server would
+	// never respond.
+	_, err := s.doWriteToWire(s.sendSessionFrame, clientInitSize+lenSize, 0, true, false)
+	return err
 }
 
 func (s *session) recvLoop() {
@@ -171,7 +438,7 @@ func (s *session) recvLoop() {
 				// Closing an idled connection is expected to fail, so don't bother
 				// logging the error.
 			} else {
-				log.Errorf("Unexpected error closing underlying connection: %v", closeErr)
+				log.Errorf("%vUnexpected error closing underlying connection: %v", s.logPrefix, closeErr)
 			}
 		}
 		atomic.AddInt64(&recvLoops, -1)
@@ -197,7 +464,7 @@ func (s *session) recvLoop() {
 				return err
 			}
 			if s.isClosed() {
-				log.Debug("recvLoop detected session closed")
+				log.Debugf("%vrecvLoop detected session closed", s.logPrefix)
 				return io.EOF
 			}
 			b = b[n:]
@@ -208,6 +475,7 @@ func (s *session) recvLoop() {
 		// First read and decrypt length
 		err := readFull(lengthBuffer)
 		if err != nil {
+			s.markConnFailed()
 			if err == io.EOF {
 				s.onSessionError(err, nil)
 				stoppedOnExpectedEOF = true
@@ -226,9 +494,11 @@ func (s *session) recvLoop() {
 		sessionFrame = sessionFrame[:l]
 		err = readFull(sessionFrame)
 		if err != nil {
+			s.markConnFailed()
 			s.onSessionError(fmt.Errorf("Unable to read session frame: %v", err), nil)
 			return
 		}
+		s.addStat(&bytesReceived, int64(lenSize+l))
 
 		// Decrypt session frame
 		sessionFrame, err = s.dataDecrypt(sessionFrame)
@@ -236,9 +506,39 @@ func (s *session) recvLoop() {
 			s.onSessionError(fmt.Errorf("Unable to decrypt session frame: %v", err), nil)
 			return
 		}
+		if s.checksums {
+			sessionFrame, err = verifyChecksum(sessionFrame)
+			if err != nil {
+				s.addStat(&checksumFailures, 1)
+				s.onSessionError(err, nil)
+				return
+			}
+		}
+		s.markActive()
+		if atomic.LoadInt32(&s.receivedAny) == 0 {
+			atomic.StoreInt32(&s.receivedAny, 1)
+			if s.onFirstResponse != nil {
+				s.onFirstResponse()
+			}
+			if s.client {
+				s.onHandshakeComplete()
+			}
+		}
+
+		framesData := sessionFrame
+		if s.frameInterceptor != nil {
+			framesData = s.frameInterceptor(false, framesData)
+			if framesData == nil {
+				// interceptor dropped the frame
+				continue
+			}
+		}
 
-		r := bytes.NewReader(sessionFrame)
+		r := bytes.NewReader(framesData)
 
+		// set if this session frame tells us to switch keys, which happens once
+		// we're done with the session frame
+		var nextDecrypt func([]byte) ([]byte, error)
 		first := true
 		// Read stream frames
 	frameLoop:
@@ -261,6 +561,23 @@ func (s *session) recvLoop() {
 			case frameTypePadding:
 				// Padding is always at the end of a session frame, so stop processing
 				break frameLoop
+			case frameTypeLameDuck:
+				if atomic.CompareAndSwapInt32(&s.lameDuck, 0, 1) {
+					log.Debugf("%vServer is in lame duck mode, won't open new streams on this session", s.logPrefix)
+				}
+				continue
+			case frameTypeRekey:
+				rekeyData := b[headerSize : headerSize+rekeyDataSize]
+				_, err = io.ReadFull(r, rekeyData)
+				if err == nil {
+					nextDecrypt, err = s.decrypterForRekey(rekeyData)
+				}
+				s.pool.Put(b[:maxFrameSize])
+				if err != nil {
+					s.onSessionError(err, nil)
+					return
+				}
+				continue
 			case frameTypeACK:
 				c, open := s.getOrCreateStream(id)
 				if !open {
@@ -273,7 +590,13 @@ func (s *session) recvLoop() {
 					s.onSessionError(err, nil)
 					return
 				}
-				c.ack(int(binaryEncoding.Uint32(ackedFrames)))
+				frames := binaryEncoding.Uint32(ackedFrames)
+				requested := s.version >= ackRequestVersion && frames&ackRequestBit != 0
+				frames &^= ackRequestBit
+				c.ack(int(frames))
+				if requested {
+					c.rb.onAckRequested()
+				}
 				continue
 			case frameTypeRST:
 				// Closing existing connection
@@ -285,7 +608,7 @@ func (s *session) recvLoop() {
 					// Close, but don't send an RST back the other way since the other end is
 					// already closed. Close on goroutine in case stream is blocked on
 					// waiting for ACKs.
-					go c.close(false, nil, nil)
+					go c.close(closeReasonPeer, false, nil, nil)
 				}
 				continue
 			case frameTypePing:
@@ -304,7 +627,15 @@ func (s *session) recvLoop() {
 					return
 				}
 				rtt := mtime.Now().Sub(mtime.Instant(binaryEncoding.Uint64(echoTS)))
-				s.emaRTT.UpdateDuration(rtt)
+				if s.emaRTT != nil {
+					s.emaRTT.UpdateDuration(rtt)
+				}
+				select {
+				case s.echoes <- rtt:
+					// notified pinger
+				default:
+					// nobody waiting for echo
+				}
 				continue
 			}
 
@@ -317,6 +648,12 @@ func (s *session) recvLoop() {
 			}
 
 			dataLength := int(binaryEncoding.Uint16(_dataLength))
+			if dataLength > MaxDataLen {
+				// don't trust the peer, this wouldn't fit into our buffer
+				s.pool.Put(b[:maxFrameSize])
+				s.onSessionError(fmt.Errorf("Frame on stream %d claims %d bytes, more than the maximum of %d", id, dataLength, MaxDataLen), nil)
+				return
+			}
 			// Read frame
 			b = b[:dataHeaderSize+dataLength]
 			_, err = io.ReadFull(r, b[dataHeaderSize:])
@@ -325,25 +662,73 @@ func (s *session) recvLoop() {
 				return
 			}
 
+			if !s.understands(frameType) {
+				s.pool.Put(b[:maxFrameSize])
+				s.onUnknownFrame(frameType, id)
+				continue
+			}
+
+			if frameType == frameTypeFin {
+				s.pool.Put(b[:maxFrameSize])
+				if c, open := s.getOrCreateStream(id); open {
+					c.markActive()
+					c.rb.finish()
+				}
+				continue
+			}
+
+			if frameType == frameTypeOOB {
+				data := append([]byte(nil), b[dataHeaderSize:]...)
+				s.pool.Put(b[:maxFrameSize])
+				if len(data) > MaxOOBLen {
+					s.onSessionError(fmt.Errorf("Out-of-band frame on stream %d has %d bytes, more than the maximum of %d", id, len(data), MaxOOBLen), nil)
+					return
+				}
+				if c, open := s.getOrCreateStream(id); open {
+					c.onOOB(data)
+				}
+				continue
+			}
+
+			if frameType == frameTypeHeaders {
+				headers, decodeErr := decodeHeaders(b[dataHeaderSize:])
+				s.pool.Put(b[:maxFrameSize])
+				if decodeErr != nil {
+					s.onSessionError(fmt.Errorf("Unable to decode headers for stream %d: %v", id, decodeErr), nil)
+					return
+				}
+				s.onHeaders(id, headers)
+				continue
+			}
+
 			c, open := s.getOrCreateStream(id)
 			if !open {
 				if !alreadyLoggedReceiveForClosedStream[id] {
-					log.Debugf("Received data for closed stream %d", id)
+					log.Debugf("%vReceived data for closed stream %d", s.logPrefix, id)
 					alreadyLoggedReceiveForClosedStream[id] = true
 				}
 				// Stream was already closed, ignore
+				s.frameDropped(id, FrameDropClosed)
 				continue
 			}
+			c.markActive()
 			c.rb.submit(b)
 
 			if first {
 				if s.ackOnFirst {
-					// immediately send an empty ack to thwart timing attacks
-					c.rb.doSendACK(0)
+					// immediately send an empty ack to thwart timing attacks,
+					// which without the ack request bit means nothing to the
+					// client
+					c.rb.sendEmptyACK()
 				}
 				first = false
 			}
 		}
+
+		if nextDecrypt != nil {
+			s.dataDecrypt = nextDecrypt
+			log.Debugf("%vSwitched to new key for receiving", s.logPrefix)
+		}
 	}
 }
 
@@ -356,25 +741,79 @@ func (s *session) sendLoop() {
 		atomic.AddInt64(&sendLoops, -1)
 	}()
 
-	for {
-		select {
-		case <-s.closeCh:
-			return
-		case frame := <-s.out:
-			if !s.send(frame) {
-				// closed
-				return
+	var keepAlive <-chan time.Time
+	resetKeepAlive := func() {}
+	if s.keepAliveInterval > 0 {
+		keepAliveTimer := time.NewTimer(s.keepAliveInterval)
+		defer keepAliveTimer.Stop()
+		keepAlive = keepAliveTimer.C
+		resetKeepAlive = func() {
+			if !keepAliveTimer.Stop() {
+				select {
+				case <-keepAliveTimer.C:
+				default:
+				}
 			}
-		case frame := <-s.echoOut:
-			// note - echos get their own channel so they don't queue behind data
-			if !s.send(frame) {
-				// closed
+			keepAliveTimer.Reset(s.keepAliveInterval)
+		}
+	}
+
+	for {
+		var frame []byte
+		if s.pendingFrame != nil {
+			// didn't fit into the previous session frame, see MaxSessionFrameSize
+			frame, s.pendingFrame = s.pendingFrame, nil
+		} else if frame = s.pollFrames(); frame == nil {
+			// nothing available yet, take whatever comes first
+			select {
+			case <-s.closeCh:
 				return
+			case frame = <-s.out:
+			case frame = <-s.echoOut:
+				// note - echos get their own channel so they don't queue behind data
+			case frame = <-s.ackOut:
+			case <-s.acks.readyCh():
+				frame = s.acks.next()
+				if frame == nil {
+					continue
+				}
+			case <-s.sched.ready:
+				frame = s.sched.next()
+				if frame == nil {
+					continue
+				}
+			case <-keepAlive:
+				// nothing sent within keepAliveInterval, send an empty session frame to
+				// keep NAT mappings and the like alive
+				if !s.sendKeepAlive() {
+					return
+				}
+				resetKeepAlive()
+				continue
 			}
 		}
+		if !s.send(frame) {
+			// closed
+			return
+		}
+		if s.rekeyDue() && !s.rekey() {
+			return
+		}
+		resetKeepAlive()
 	}
 }
 
+// sendKeepAlive sends an empty session frame (padded if padding is enabled).
+// Peers ignore such frames since they don't contain any stream frames.
+func (s *session) sendKeepAlive() bool {
+	_, err := s.writeToWire(s.sendSessionFrame, lenSize, 0, true)
+	if err != nil {
+		s.onSessionError(nil, err)
+		return false
+	}
+	return true
+}
+
 func (s *session) send(frame []byte) (open bool) {
 	snd := &sender{
 		session:        s,
@@ -394,9 +833,22 @@ func (s *session) send(frame []byte) (open bool) {
 }
 
 func (s *session) writeToWire(b []byte, startOfFrame, frameSize int, withPadding bool) (int, error) {
+	return s.doWriteToWire(b, startOfFrame, frameSize, withPadding, true)
+}
+
+// doWriteToWire is like writeToWire, but only passes the session frame to the
+// FrameInterceptor if intercept is true.
+func (s *session) doWriteToWire(b []byte, startOfFrame, frameSize int, withPadding bool, intercept bool) (int, error) {
 	startOfPadding := startOfFrame + frameSize
 	if withPadding && startOfPadding < coalesceThreshold {
-		l, err := s.addPadding(b[startOfPadding:])
+		endOfPadding := len(b)
+		if s.maxSessionFrameSize > 0 {
+			endOfPadding = startOfFrame - lenSize + s.maxSessionFrameSize - s.cipherOverhead
+		}
+		if endOfPadding < startOfPadding {
+			endOfPadding = startOfPadding
+		}
+		l, err := s.addPadding(b[startOfPadding:endOfPadding])
 		if err != nil {
 			return 0, err
 		}
@@ -404,6 +856,24 @@ func (s *session) writeToWire(b []byte, startOfFrame, frameSize int, withPadding
 	}
 
 	framesData := b[startOfFrame : startOfFrame+frameSize]
+	if intercept && s.frameInterceptor != nil {
+		intercepted := s.frameInterceptor(true, framesData)
+		if intercepted == nil {
+			// interceptor dropped the frame
+			return 0, nil
+		}
+		if len(intercepted) > len(b)-startOfFrame-s.cipherOverhead {
+			return 0, fmt.Errorf("Intercepted frame of %d bytes is too large", len(intercepted))
+		}
+		frameSize = copy(b[startOfFrame:], intercepted)
+		framesData = b[startOfFrame : startOfFrame+frameSize]
+	}
+	if s.maxSessionFrameSize > 0 && lenSize+frameSize+s.cipherOverhead > s.maxSessionFrameSize {
+		return 0, fmt.Errorf("Session frame of %d bytes exceeds maximum of %d", lenSize+frameSize+s.cipherOverhead, s.maxSessionFrameSize)
+	}
+	if s.checksums {
+		framesData = appendChecksum(framesData)
+	}
 	// Encrypt session frame with MAC appended
 	encryptedFramesData := s.dataEncrypt(framesData, framesData)
 	frameSize = len(encryptedFramesData)
@@ -414,7 +884,107 @@ func (s *session) writeToWire(b []byte, startOfFrame, frameSize int, withPadding
 	binaryEncoding.PutUint16(lenBuf, uint16(frameSize))
 	s.metaEncrypt(lenBuf)
 
-	return s.Write(b[:startOfFrame+frameSize])
+	if s.stallTimer != nil {
+		s.stallTimer.Reset(s.writeStallTimeout)
+	}
+	n, err := s.Write(b[:startOfFrame+frameSize])
+	if s.stallTimer != nil {
+		s.stallTimer.Stop()
+	}
+	if err == nil && n < startOfFrame+frameSize {
+		// misbehaving net.Conn, the peer would get out of sync
+		err = io.ErrShortWrite
+	}
+	if err != nil && atomic.LoadInt32(&s.stalled) == 1 {
+		err = ErrSessionStalled
+	} else if err != nil {
+		s.markConnFailed()
+	}
+	s.addStat(&bytesSent, int64(n))
+	s.bytesSinceRekey += int64(n)
+	if err == nil {
+		s.markActive()
+	}
+	return n, err
+}
+
+// handshakeFailed indicates that streams were opened on this session but the
+// peer closed the connection without ever sending anything back, which is what
+// happens when the server rejects our client init message or something on the
+// network kills the connection. Sessions that we closed ourselves before the
+// peer responded don't count, since the peer may simply not have had anything
+// to say yet.
+func (s *session) handshakeFailed() bool {
+	return atomic.LoadUint32(&s.nextID) > 0 && atomic.LoadInt32(&s.receivedAny) == 0 && atomic.LoadInt32(&s.connFailed) == 1
+}
+
+// markConnFailed records that reading from or writing to the connection failed,
+// unless that's just because we closed the session ourselves.
+func (s *session) markConnFailed() {
+	if !s.isClosed() {
+		atomic.StoreInt32(&s.connFailed, 1)
+	}
+}
+
+// addStat adds delta to the given process-wide statistic, unless this is a
+// probe session.
+func (s *session) addStat(stat *int64, delta int64) {
+	if !s.probe {
+		atomic.AddInt64(stat, delta)
+	}
+}
+
+func (s *session) markActive() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+// windowPolicyValue wraps WindowPolicies so that they can all be stored in
+// the same atomic.Value regardless of their concrete type.
+type windowPolicyValue struct {
+	WindowPolicy
+}
+
+// newSendWindow creates the transmit window for a new stream.
+func (s *session) newSendWindow(windowSize int) *window {
+	return newPolicyWindow(windowSize, s.WindowPolicy)
+}
+
+func (s *session) WindowPolicy() WindowPolicy {
+	return s.windowPolicy.Load().(windowPolicyValue).WindowPolicy
+}
+
+func (s *session) SetWindowPolicy(policy WindowPolicy) {
+	s.windowPolicy.Store(windowPolicyValue{policy})
+	s.mx.RLock()
+	streams := make([]*stream, 0, len(s.streams))
+	for _, c := range s.streams {
+		streams = append(streams, c)
+	}
+	s.mx.RUnlock()
+	for _, c := range streams {
+		c.sb.window.policyChanged()
+	}
+}
+
+func (s *session) LameDuck() bool {
+	return atomic.LoadInt32(&s.lameDuck) == 1
+}
+
+// sendLameDuck tells the client that we're draining, see "Lame Duck" in the
+// package docs.
+func (s *session) sendLameDuck() {
+	select {
+	case s.out <- newHeader(frameTypeLameDuck, 0):
+	case <-s.closeCh:
+	}
+}
+
+func (s *session) CreatedAt() time.Time {
+	return s.createdAt
+}
+
+func (s *session) LastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActivity))
 }
 
 // addPadding adds random sized padding to the byte slice. The size is capped
@@ -455,7 +1025,7 @@ func (snd *sender) send(frame []byte) (open bool) {
 	if snd.pingInterval > 0 {
 		snd.mx.Lock()
 		now := time.Now()
-		if now.Sub(snd.lastPing) > snd.pingInterval {
+		if now.Sub(snd.lastPing) > snd.pingInterval && snd.fits(ping()) {
 			snd.bufferFrame(ping())
 			snd.lastPing = now
 		}
@@ -477,16 +1047,17 @@ func (snd *sender) coalesceAdditionalFrames() bool {
 		select {
 		case <-snd.closeCh:
 			return false
-		case frame := <-snd.out:
-			// pending frame immediately available, add it
-			snd.bufferFrame(frame)
-		case frame := <-snd.echoOut:
-			// pending echo immediately available, add it
-			snd.bufferFrame(frame)
 		default:
+		}
+		// add the pending frame with the highest priority, see FramePriority
+		frame := snd.pollFrames()
+		if frame == nil {
 			// no more frames immediately available
 			return true
 		}
+		if !snd.bufferFrameIfFits(frame) {
+			return true
+		}
 	}
 	return true
 }
@@ -505,6 +1076,9 @@ func (snd *sender) bufferFrame(frame []byte) {
 		// RST frames only contain the header
 		snd.closedStreams = append(snd.closedStreams, streamID)
 		return
+	case frameTypeLameDuck:
+		// lame duck frames only contain the header
+		return
 	case frameTypeACK, frameTypePing, frameTypeEcho:
 		// ACK, ping and echo frames also have additional data
 		snd.coalesce(frame[:dataLen])
@@ -540,24 +1114,85 @@ func (s *session) onSessionError(readErr error, writeErr error) {
 	if readErr == nil {
 		readErr = syscall.EPIPE
 	} else if readErr != io.EOF {
-		log.Errorf("Error on reading from %v: %v", s.RemoteAddr(), readErr)
+		log.Errorf("%vError on reading from %v: %v", s.logPrefix, s.RemoteAddr(), readErr)
 	}
 
 	if writeErr == nil {
 		writeErr = syscall.EPIPE
 	} else {
-		log.Errorf("Error on writing to %v: %v", s.RemoteAddr(), writeErr)
+		log.Errorf("%vError on writing to %v: %v", s.logPrefix, s.RemoteAddr(), writeErr)
+	}
+}
+
+// ping sends a ping to the peer and waits for the echo, returning the round
+// trip time.
+func (s *session) ping(ctx context.Context) (time.Duration, error) {
+	select {
+	case s.echoOut <- ping():
+		// sent
+	case <-s.closeCh:
+		return 0, ErrConnectionClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	select {
+	case rtt := <-s.echoes:
+		return rtt, nil
+	case <-s.closeCh:
+		return 0, ErrConnectionClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
 	}
 }
 
 func (s *session) CreateStream() *stream {
 	nextID := atomic.AddUint32(&s.nextID, 1)
-	stream, _ := s.getOrCreateStream(uint16(nextID - 1))
+	// the client opens streams with even IDs, see "Stream IDs"
+	stream, _ := s.getOrCreateStream(uint16(2 * (nextID - 1)))
 	s.lastDialed = time.Now()
 	return stream
 }
 
 func (s *session) getOrCreateStream(id uint16) (*stream, bool) {
+	return s.getOrCreateStreamWithHeaders(id, nil)
+}
+
+// understands indicates whether the given type of frame with the layout of a
+// data frame is defined in the session's protocol version.
+func (s *session) understands(frameType byte) bool {
+	switch frameType {
+	case frameTypeData, frameTypeOOB:
+		return true
+	case frameTypeFin:
+		return s.version >= halfCloseVersion
+	case frameTypeHeaders:
+		return s.version >= headersVersion
+	default:
+		return false
+	}
+}
+
+// onHeaders opens the stream with the given ID with the given headers. Since
+// headers are always the first frame of a stream, a stream that's already open
+// is reset with ErrLateHeaders.
+func (s *session) onHeaders(id uint16, headers map[string]string) {
+	s.mx.RLock()
+	c := s.streams[id]
+	s.mx.RUnlock()
+	if c == nil {
+		s.getOrCreateStreamWithHeaders(id, headers)
+		return
+	}
+	log.Debugf("%vResetting stream %d because of headers after it was opened", s.logPrefix, id)
+	// resetting waits for the RST to be queued, which would block the recvLoop
+	s.spawn(func() { c.reset(ErrLateHeaders) })
+}
+
+// getOrCreateStreamWithHeaders is like getOrCreateStream but attaches the
+// given headers if it has to create a new stream. Headers are attached before
+// the stream is published on connCh.
+func (s *session) getOrCreateStreamWithHeaders(id uint16, headers map[string]string) (*stream, bool) {
 	s.mx.Lock()
 	c := s.streams[id]
 	if c != nil {
@@ -569,12 +1204,27 @@ func (s *session) getOrCreateStream(id uint16) (*stream, bool) {
 		s.mx.Unlock()
 		return nil, false
 	}
+	pushed := s.isPushed(id)
+	if pushed && !s.pushEnabled {
+		s.closed[id] = true
+		s.mx.Unlock()
+		log.Debugf("%vRejecting stream %d pushed by server", s.logPrefix, id)
+		s.rejectStream(id)
+		return nil, false
+	}
 
-	c = newStream(s, s.pool, s.out, s.windowSize, newHeader(frameTypeData, id))
+	c = newStream(s, s.pool, s.windowSize, id)
+	c.headers = headers
 	s.streams[id] = c
 	s.mx.Unlock()
+	c.onOpened()
 	if s.connCh != nil {
 		s.connCh <- c
+	} else if pushed {
+		select {
+		case s.pushed <- c:
+		case <-s.closeCh:
+		}
 	}
 	return c, true
 }
@@ -582,15 +1232,23 @@ func (s *session) getOrCreateStream(id uint16) (*stream, bool) {
 // AllowNewStream returns true if a new stream is allowed to be created over
 // this session, and false otherwise.
 func (s *session) AllowNewStream(maxStreamPerConn uint16, idleInterval time.Duration) bool {
-	nextID := atomic.LoadUint32(&s.nextID)
-	if nextID > uint32(maxStreamPerConn) {
-		log.Debug("Exhausted maximum allowed IDs on one physical connection, will open new connection")
+	if atomic.LoadInt32(&s.lameDuck) == 1 {
+		return false
+	}
+	return s.allowNewStreamWhileLameDuck(maxStreamPerConn, idleInterval)
+}
+
+// allowNewStreamWhileLameDuck is like AllowNewStream, except that it doesn't
+// hold lame duck mode against the session.
+func (s *session) allowNewStreamWhileLameDuck(maxStreamPerConn uint16, idleInterval time.Duration) bool {
+	if s.streamsExhausted(maxStreamPerConn) {
+		log.Debugf("%vExhausted maximum allowed IDs on one physical connection, will open new connection", s.logPrefix)
 		return false
 	}
 	if idleInterval > 0 {
 		now := time.Now()
 		if now.Sub(s.lastDialed) > idleInterval {
-			log.Debugf("No new connections in %v, will start new session", idleInterval)
+			log.Debugf("%vNo new connections in %v, will start new session", s.logPrefix, idleInterval)
 			return false
 		}
 	}
@@ -600,6 +1258,12 @@ func (s *session) AllowNewStream(maxStreamPerConn uint16, idleInterval time.Dura
 	return true
 }
 
+// streamsExhausted indicates whether maxStreamPerConn streams have already
+// been created on this session.
+func (s *session) streamsExhausted(maxStreamPerConn uint16) bool {
+	return atomic.LoadUint32(&s.nextID) >= uint32(maxStreamPerConn)
+}
+
 // MarkDefunct marks this session as defunct. A defunct session will close once
 // all streams are closed.
 func (s *session) MarkDefunct() {
@@ -611,6 +1275,14 @@ func (s *session) MarkDefunct() {
 	s.mx.Unlock()
 }
 
+// numStreams returns the number of streams that are currently open on this
+// session.
+func (s *session) numStreams() int {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return len(s.streams)
+}
+
 func (s *session) closeStream(id uint16) {
 	delete(s.streams, id)
 	s.closed[id] = true
@@ -619,37 +1291,143 @@ func (s *session) closeStream(id uint16) {
 	}
 }
 
+// rejectStream tells the peer that we don't accept the stream with the given ID
+// by resetting it, for example because it was pushed by a server that we don't
+// accept pushed streams from. The ID must already be marked closed so that the
+// peer's frames for it get dropped.
+func (s *session) rejectStream(id uint16) {
+	select {
+	case s.out <- withFrameType(newHeader(frameTypeData, id), frameTypeRST):
+	case <-s.closeCh:
+	}
+}
+
 var errorAlreadyClosed = errors.New("session already closed")
 
+func (s *session) ResetAll(reason string) error {
+	err := &ResetError{reason}
+	s.mx.RLock()
+	streams := make([]*stream, 0, len(s.streams))
+	for _, c := range s.streams {
+		streams = append(streams, c)
+	}
+	s.mx.RUnlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(streams))
+	for _, c := range streams {
+		go func(c *stream) {
+			defer wg.Done()
+			c.reset(err)
+		}(c)
+	}
+	wg.Wait()
+	return s.Close()
+}
+
 func (s *session) Close() error {
 	err := errorAlreadyClosed
 	s.closeOnce.Do(func() {
 		close(s.closeCh)
-		atomic.AddInt64(&closingSessions, 1)
+		s.addStat(&closingSessions, 1)
 		if s.beforeClose != nil {
 			s.beforeClose(s)
 		}
-		atomic.AddInt64(&closingSessions, -1)
-		atomic.AddInt64(&openSessions, -1)
-		atomic.AddInt64(&closedSessions, 1)
-		go func() {
+		s.onClosed()
+		s.addStat(&closingSessions, -1)
+		s.addStat(&openSessions, -1)
+		s.addStat(&closedSessions, 1)
+		s.spawn(func() {
 			// wait until we're finished sending and receiving and then close any remaining streams
 			<-s.finishedSendingCh
-			<-s.finishedReceivingCh
+			s.stopReceiving()
 
 			s.mx.RLock()
 			for _, c := range s.streams {
+				c := c
 				// Note - we never send an RST because the underlying connection is
 				// considered no good at this point and we won't bother sending anything.
-				go c.close(false, nil, nil)
+				// For the same reason, there's no point in waiting to flush buffered
+				// frames.
+				reason := closeReasonSessionClosed
+				if atomic.LoadInt32(&s.stalled) == 1 {
+					c.resetErr.Store(resetCause{ErrSessionStalled})
+					reason = ErrSessionStalled.Error()
+				}
+				c.sb.setLinger(0)
+				c.sb.abort()
+				s.spawn(func() { c.close(reason, false, nil, nil) })
 			}
 			s.mx.RUnlock()
-		}()
+			if timeout := getLeakCheckTimeout(); timeout > 0 {
+				go s.checkForLeaks(timeout)
+			}
+		})
 		err = nil
 	})
 	return err
 }
 
+// onWriteStalled closes the physical connection when a write made no progress
+// for writeStallTimeout, which makes the write fail and the session close.
+func (s *session) onWriteStalled() {
+	if !atomic.CompareAndSwapInt32(&s.stalled, 0, 1) {
+		return
+	}
+	log.Errorf("%vWriting to %v stalled for %v, closing session", s.logPrefix, s.RemoteAddr(), s.writeStallTimeout)
+	s.Conn.Close()
+}
+
+// stopReceiving waits for recvLoop to exit. Because recvLoop only checks for
+// the session being closed between reads, we expire the current read deadline
+// so that it doesn't sit in a blocked read for up to ReadTimeout. The idletiming
+// reader bumps the deadline before every read, so we keep expiring it until
+// recvLoop notices.
+func (s *session) stopReceiving() {
+	for {
+		s.Conn.SetReadDeadline(time.Now())
+		select {
+		case <-s.finishedReceivingCh:
+			return
+		case <-time.After(leakCheckInterval):
+			// try again
+		}
+	}
+}
+
+// spawn runs fn on a new goroutine that's accounted to this session, so that
+// we can tell whether all of them exit once the session is closed (see
+// SetLeakCheck).
+func (s *session) spawn(fn func()) {
+	atomic.AddInt64(&s.goroutines, 1)
+	atomic.AddInt64(&sessionGoroutines, 1)
+	ops.Go(func() {
+		defer func() {
+			atomic.AddInt64(&s.goroutines, -1)
+			atomic.AddInt64(&sessionGoroutines, -1)
+		}()
+		fn()
+	})
+}
+
+// checkForLeaks waits up to timeout for all of the goroutines of this closed
+// session to exit and logs an error if they don't.
+func (s *session) checkForLeaks(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := atomic.LoadInt64(&s.goroutines)
+		if remaining == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			log.Errorf("%v%d goroutines still running %v after closing session with %v", s.logPrefix, remaining, timeout, s.RemoteAddr())
+			atomic.AddInt64(&leakedSessions, 1)
+			return
+		}
+		time.Sleep(leakCheckInterval)
+	}
+}
+
 func (s *session) isClosed() bool {
 	select {
 	case <-s.closeCh:
@@ -663,4 +1441,24 @@ func (s *session) Wrapped() net.Conn {
 	return s.Conn
 }
 
+func (s *session) TLSConnectionState() (*tls.ConnectionState, bool) {
+	var state *tls.ConnectionState
+	netx.WalkWrapped(s.Conn, func(wrapped net.Conn) bool {
+		tlsConn, ok := wrapped.(*tls.Conn)
+		if ok {
+			cs := tlsConn.ConnectionState()
+			state = &cs
+			return false
+		}
+		return true
+	})
+	return state, state != nil
+}
+
+func (s *session) Stats() SessionStats {
+	return SessionStats{
+		InFlightBytes: atomic.LoadInt64(&s.inFlightBytes),
+	}
+}
+
 // TODO: do we need a way to close a session/physical connection intentionally?
@@ -0,0 +1,84 @@
+package lampshade
+
+import (
+	"net"
+	"time"
+)
+
+// SessionFactory starts a new session using the given DialFN, see
+// DialerOpts.SessionFactory.
+type SessionFactory func(dial DialFN) (DialerSession, error)
+
+// DialerSession is the part of a session that a Dialer needs in order to
+// multiplex streams onto it. It allows plugging custom or mock sessions into a
+// Dialer with DialerOpts.SessionFactory.
+type DialerSession interface {
+	// AllowNewStream indicates whether the Dialer may open another stream on
+	// this session, given the Dialer's MaxStreamsPerConn and IdleInterval. The
+	// Dialer retires sessions that don't.
+	AllowNewStream(maxStreamsPerConn uint16, idleInterval time.Duration) bool
+
+	// MarkDefunct is called when the Dialer retires this session. It should
+	// close the session once its open streams are done.
+	MarkDefunct()
+
+	// NumStreams returns the number of open streams, see FillSessions.
+	NumStreams() int
+
+	// DialStream opens a new stream on this session.
+	DialStream() (net.Conn, error)
+}
+
+// factorySession adapts a DialerSession from a SessionFactory to the interface
+// that the dialer uses internally.
+type factorySession struct {
+	DialerSession
+}
+
+func (s factorySession) dialStream() (net.Conn, error) {
+	return s.DialStream()
+}
+
+func (s factorySession) numStreams() int {
+	return s.NumStreams()
+}
+
+func (s *session) dialStream() (net.Conn, error) {
+	return s.CreateStream(), nil
+}
+
+// newSession starts a new session using the SessionFactory, if there is one,
+// or the built-in session otherwise.
+func (d *dialer) newSession(dial DialFN) (sessionIntf, error) {
+	if d.sessionFactory == nil {
+		s, err := d.startSession(dial)
+		if err != nil {
+			// don't return a typed nil
+			return nil, err
+		}
+		return s, nil
+	}
+	s, err := d.sessionFactory(dial)
+	if err != nil {
+		return nil, err
+	}
+	return factorySession{s}, nil
+}
+
+// withHeaders sends headers on a freshly dialed stream, closing it if that
+// fails. Only the built-in session supports headers.
+func withHeaders(c net.Conn, headers map[string]string) (net.Conn, error) {
+	if len(headers) == 0 {
+		return c, nil
+	}
+	stream, ok := c.(*stream)
+	if !ok {
+		c.Close()
+		return nil, ErrHeadersUnsupported
+	}
+	if err := stream.sendHeaders(headers); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,82 @@
+package lampshade
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSession struct {
+	streams int
+	defunct bool
+	mx      sync.Mutex
+}
+
+func (s *mockSession) AllowNewStream(maxStreamsPerConn uint16, idleInterval time.Duration) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return !s.defunct && (maxStreamsPerConn == 0 || s.streams < int(maxStreamsPerConn))
+}
+
+func (s *mockSession) MarkDefunct() {
+	s.mx.Lock()
+	s.defunct = true
+	s.mx.Unlock()
+}
+
+func (s *mockSession) NumStreams() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.streams
+}
+
+func (s *mockSession) DialStream() (net.Conn, error) {
+	s.mx.Lock()
+	s.streams++
+	s.mx.Unlock()
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, nil
+}
+
+func TestSessionFactory(t *testing.T) {
+	var sessions []*mockSession
+	var mx sync.Mutex
+	d := NewDialer(&DialerOpts{
+		MaxStreamsPerConn: 2,
+		ProtocolVersion:   headersVersion,
+		SessionFactory: func(dial DialFN) (DialerSession, error) {
+			s := &mockSession{}
+			mx.Lock()
+			sessions = append(sessions, s)
+			mx.Unlock()
+			return s, nil
+		},
+	})
+	dial := func() (net.Conn, error) {
+		t.Fatal("the mock sessions shouldn't dial")
+		return nil, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		_, ok := conn.(Stream)
+		assert.False(t, ok, "should have dialed on a mock session")
+		conn.Close()
+	}
+	mx.Lock()
+	require.Len(t, sessions, 2, "first session should have been retired after two streams")
+	assert.Equal(t, 2, sessions[0].NumStreams())
+	assert.False(t, sessions[0].AllowNewStream(0, 0), "retired session should have been marked defunct")
+	assert.Equal(t, 1, sessions[1].NumStreams())
+	mx.Unlock()
+
+	_, err := d.DialWithHeaders(context.Background(), dial, map[string]string{"a": "b"})
+	assert.Equal(t, ErrHeadersUnsupported, err)
+}
@@ -0,0 +1,206 @@
+package lampshade
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SessionParams are the parameters that a Session ended up with once the
+// handshake was done, see Session.Params. They don't include any key material.
+type SessionParams struct {
+	// Version is the protocol version spoken on the Session.
+	Version int
+
+	// Cipher is the cipher that the Session's frames are encrypted with.
+	Cipher Cipher
+
+	// WindowSize is the number of frames that a Stream may send before waiting
+	// for an ack.
+	WindowSize int
+
+	// MaxPadding is the maximum amount of random padding added to session
+	// frames, 0 means that no padding is added.
+	MaxPadding int
+
+	// MaxSessionFrameSize, if > 0, limits the size of session frames on the
+	// wire, see DialerOpts.MaxSessionFrameSize.
+	MaxSessionFrameSize int
+
+	// Checksums indicates whether session frames carry checksums.
+	Checksums bool
+
+	// PushEnabled indicates whether the server may push Streams.
+	PushEnabled bool
+
+	// Client indicates whether this is the dialing end of the Session.
+	Client bool
+}
+
+// String renders the SessionParams as space separated key=value pairs that
+// ParseSessionParams understands, for example to paste them into a bug report.
+func (p SessionParams) String() string {
+	return fmt.Sprintf("version=%d cipher=%v window=%d max_padding=%d max_session_frame_size=%d checksums=%v push=%v client=%v",
+		p.Version, p.Cipher, p.WindowSize, p.MaxPadding, p.MaxSessionFrameSize, p.Checksums, p.PushEnabled, p.Client)
+}
+
+// ParseSessionParams parses SessionParams from the output of
+// SessionParams.String. Missing keys are left at their zero value.
+func ParseSessionParams(str string) (SessionParams, error) {
+	var p SessionParams
+	for _, field := range strings.Fields(str) {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return p, fmt.Errorf("Invalid session param %q", field)
+		}
+		key, value := parts[0], parts[1]
+		var err error
+		switch key {
+		case "version":
+			p.Version, err = strconv.Atoi(value)
+		case "cipher":
+			p.Cipher, err = parseCipher(value)
+		case "window":
+			p.WindowSize, err = strconv.Atoi(value)
+		case "max_padding":
+			p.MaxPadding, err = strconv.Atoi(value)
+		case "max_session_frame_size":
+			p.MaxSessionFrameSize, err = strconv.Atoi(value)
+		case "checksums":
+			p.Checksums, err = strconv.ParseBool(value)
+		case "push":
+			p.PushEnabled, err = strconv.ParseBool(value)
+		case "client":
+			p.Client, err = strconv.ParseBool(value)
+		default:
+			return p, fmt.Errorf("Unknown session param %q", key)
+		}
+		if err != nil {
+			return p, fmt.Errorf("Invalid value for session param %v: %v", key, err)
+		}
+	}
+	return p, nil
+}
+
+func parseCipher(str string) (Cipher, error) {
+	for _, c := range []Cipher{NoEncryption, AES128GCM, ChaCha20Poly1305} {
+		if c.String() == str {
+			return c, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher %q", str)
+}
+
+func (s *session) Params() SessionParams {
+	return SessionParams{
+		Version:             s.version,
+		Cipher:              s.cipherCode,
+		WindowSize:          s.windowSize,
+		MaxPadding:          int(s.maxPadding.Int64()),
+		MaxSessionFrameSize: s.maxSessionFrameSize,
+		Checksums:           s.checksums,
+		PushEnabled:         s.pushEnabled,
+		Client:              s.client,
+	}
+}
+
+// TestSession is a Session started with StartTestSession.
+type TestSession interface {
+	Session
+
+	// OpenStream opens a new Stream to the peer, like a Dialer does on the
+	// client or PushStream does on the server.
+	OpenStream() (Stream, error)
+
+	// AcceptPeerStream waits for the peer to open a Stream and returns it. On
+	// the client, that requires PushEnabled.
+	AcceptPeerStream() (Stream, error)
+}
+
+type testSession struct {
+	*session
+	connCh chan net.Conn
+}
+
+// StartTestSession starts a Session on conn with the given params, skipping the
+// handshake, so that a Session captured with Session.Params can be reproduced
+// in a test. The peer must be another TestSession with the same params except
+// for Client.
+//
+// FOR TESTING ONLY. Both ends use a fixed key that's publicly known, so the
+// traffic isn't confidential no matter which Cipher is used. Dialers and
+// Listeners never start sessions this way.
+func StartTestSession(conn net.Conn, params SessionParams, pool BufferPool) (TestSession, error) {
+	if !params.Cipher.valid() {
+		return nil, fmt.Errorf("Unknown cipher: %d", params.Cipher)
+	}
+	if params.Version < 0 || params.Version > protocolVersion {
+		return nil, ErrUnsupportedVersion
+	}
+	if params.WindowSize <= 0 {
+		return nil, fmt.Errorf("Invalid window size: %d", params.WindowSize)
+	}
+	cs := testCryptoSpec(params.Cipher)
+	var connCh chan net.Conn
+	if !params.Client {
+		cs = cs.reversed()
+		connCh = make(chan net.Conn)
+	}
+	opts := &sessionOpts{
+		version:             params.Version,
+		windowSize:          params.WindowSize,
+		maxPadding:          params.MaxPadding,
+		maxSessionFrameSize: params.MaxSessionFrameSize,
+		checksums:           params.Checksums,
+		pushEnabled:         params.PushEnabled,
+		client:              params.Client,
+	}
+	s, err := startSession(conn, opts, cs, nil, pool, nil, connCh, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &testSession{s, connCh}, nil
+}
+
+// testCryptoSpec returns a cryptoSpec with a fixed, all zero secret. Never use
+// it outside of StartTestSession.
+func testCryptoSpec(cipherCode Cipher) *cryptoSpec {
+	fill := func(size int, b byte) []byte {
+		iv := make([]byte, size)
+		for i := range iv {
+			iv[i] = b
+		}
+		return iv
+	}
+	return &cryptoSpec{
+		cipherCode: cipherCode,
+		secret:     make([]byte, maxSecretSize),
+		metaSendIV: fill(metaIVSize, 1),
+		dataSendIV: fill(cipherCode.ivSize(), 2),
+		metaRecvIV: fill(metaIVSize, 3),
+		dataRecvIV: fill(cipherCode.ivSize(), 4),
+	}
+}
+
+func (s *testSession) OpenStream() (Stream, error) {
+	if !s.client {
+		return s.PushStream(nil)
+	}
+	if s.isClosed() {
+		return nil, ErrConnectionClosed
+	}
+	return s.CreateStream(), nil
+}
+
+func (s *testSession) AcceptPeerStream() (Stream, error) {
+	if s.client {
+		return s.AcceptStream()
+	}
+	select {
+	case conn := <-s.connCh:
+		return conn.(Stream), nil
+	case <-s.closeCh:
+		return nil, ErrConnectionClosed
+	}
+}
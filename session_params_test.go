@@ -0,0 +1,76 @@
+package lampshade
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionParams(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxPadding = 32
+		opts.Checksums = true
+		opts.ProtocolVersion = protocolVersion
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	params := conn.(Stream).Session().Params()
+	assert.Equal(t, SessionParams{
+		Version:     protocolVersion,
+		Cipher:      AES128GCM,
+		WindowSize:  testWindowSize,
+		MaxPadding:  32,
+		Checksums:   true,
+		PushEnabled: false,
+		Client:      true,
+	}, params)
+
+	parsed, err := ParseSessionParams(params.String())
+	require.NoError(t, err)
+	assert.Equal(t, params, parsed)
+
+	_, err = ParseSessionParams("window=10 bogus=1")
+	assert.Error(t, err, "unknown keys should be rejected")
+	_, err = ParseSessionParams("cipher=ROT13")
+	assert.Error(t, err, "unknown ciphers should be rejected")
+}
+
+func TestStartTestSession(t *testing.T) {
+	params, err := ParseSessionParams("version=5 cipher=ChaCha20_Poly1305 window=10 max_padding=16 checksums=true push=true")
+	require.NoError(t, err)
+
+	clientConn, serverConn := net.Pipe()
+	params.Client = true
+	client, err := StartTestSession(clientConn, params, testPool)
+	require.NoError(t, err)
+	defer client.Close()
+	params.Client = false
+	server, err := StartTestSession(serverConn, params, testPool)
+	require.NoError(t, err)
+	defer server.Close()
+	assert.Equal(t, params, server.Params())
+
+	roundTrip := func(from, to TestSession) {
+		sent, err := from.OpenStream()
+		require.NoError(t, err)
+		defer sent.Close()
+		_, err = sent.Write([]byte("hello"))
+		require.NoError(t, err)
+		received, err := to.AcceptPeerStream()
+		require.NoError(t, err)
+		defer received.Close()
+		b := make([]byte, 5)
+		_, err = io.ReadFull(received, b)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(b))
+	}
+	roundTrip(client, server)
+	roundTrip(server, client)
+}
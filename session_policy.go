@@ -0,0 +1,100 @@
+package lampshade
+
+// SessionPolicy decides how a Dialer with MaxLiveConns > 1 assigns new streams
+// to its live sessions, see DialerOpts.SessionPolicy.
+type SessionPolicy int
+
+const (
+	// SpreadSessions hands out the live sessions in round-robin order, so
+	// streams are spread evenly across however many sessions are live.
+	// Additional sessions, up to MaxLiveConns, are started whenever dials
+	// contend for sessions to the point of waiting RedialSessionInterval, and
+	// they're retired again once the contention is over. This maximizes
+	// parallelism for bursts of heavy dialing since no single physical
+	// connection's congestion window or head-of-line blocking holds up all of
+	// the streams, at the cost of churning through physical connections.
+	SpreadSessions SessionPolicy = iota
+
+	// FillSessions packs new streams onto the busiest live session that has
+	// fewer than DialerOpts.SoftStreamsPerConn open streams, and only spills
+	// over onto the next one once it's at that limit. If all live sessions are
+	// at the limit, the least busy one is used while an additional session is
+	// started, up to MaxLiveConns. Sessions stay live for as long as they're
+	// useful, and ones without open streams are retired as soon as another
+	// session has room. Light workloads thereby stick to a single physical
+	// connection and save handshakes, while heavy workloads keep as many
+	// sessions as they fill. The soft limit should be low enough that the
+	// streams on one session don't contend for its physical connection.
+	FillSessions
+)
+
+const defaultSoftStreamsPerConn = 100
+
+func (p SessionPolicy) String() string {
+	switch p {
+	case SpreadSessions:
+		return "spread"
+	case FillSessions:
+		return "fill"
+	default:
+		return "unknown"
+	}
+}
+
+// fillSession picks the live session that FillSessions prefers out of s, which
+// the dial already took and checked, and whatever other live sessions are
+// idle at the moment. The others are returned to liveSessions, except for
+// empty ones that aren't needed. full indicates that the picked session is at
+// softStreamsPerConn, in which case the dial should start spilling over onto
+// a new session.
+func (d *dialer) fillSession(s sessionIntf) (picked sessionIntf, full bool) {
+	candidates := []sessionIntf{s}
+drain:
+	for i := len(d.liveSessions); i > 0; i-- {
+		select {
+		case other := <-d.liveSessions:
+			d.takeLive(other)
+			candidates = append(candidates, other)
+		default:
+			break drain
+		}
+	}
+
+	picked = s
+	for _, c := range candidates[1:] {
+		if d.preferForFill(c, picked) && c.AllowNewStream(d.maxStreamsPerConn, d.idleInterval) && d.sessionValid(c) {
+			picked = c
+		}
+	}
+	full = picked.numStreams() >= d.softStreamsPerConn
+	for _, c := range candidates {
+		switch {
+		case c == picked:
+			// in use
+		case !full && c.numStreams() == 0 && c.AllowNewStream(d.maxStreamsPerConn, d.idleInterval):
+			// picked has room, so this one can go idle
+			d.muNumLivePending.Lock()
+			d.numLive--
+			d.muNumLivePending.Unlock()
+			c.MarkDefunct()
+		default:
+			d.putLive(c)
+		}
+	}
+	return picked, full
+}
+
+// preferForFill indicates whether FillSessions prefers session a over b:
+// sessions below the soft limit come first, the busiest first, followed by
+// the ones at the limit, the least busy first.
+func (d *dialer) preferForFill(a, b sessionIntf) bool {
+	aStreams, bStreams := a.numStreams(), b.numStreams()
+	aFull, bFull := aStreams >= d.softStreamsPerConn, bStreams >= d.softStreamsPerConn
+	if aFull != bFull {
+		return !aFull
+	}
+	if aFull {
+		return aStreams < bStreams
+	}
+	return aStreams > bStreams
+}
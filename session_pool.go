@@ -0,0 +1,57 @@
+package lampshade
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionPool is a set of sessions to a lampshade server that several Dialers
+// share, for programs that use many logical Dialers for the same server and
+// don't want each of them to open physical connections of its own. Dialers
+// created with DialerOpts.SessionPool hand out Streams on the pool's sessions,
+// and the pool applies its limits, like MaxLiveConns, MaxStreamsPerConn and
+// MaxSessions, across all of them. Sessions that the server puts into lame
+// duck mode or that are retired are drained the same way as with a single
+// Dialer.
+//
+// Since the Dialers share everything, including the statistics from Stats
+// and Dump, they're interchangeable. Whichever Dialer needs a new session
+// opens it with the DialFN that it was given, so all of the DialFNs used with
+// a pool need to connect to the same server.
+//
+// Options can't be set per Dialer. Everything in the DialerOpts of a Dialer
+// created with a pool, other than SessionPool itself, is ignored, including
+// Name, and NewDialer logs an error listing any such options that were set.
+type SessionPool struct {
+	dialer *dialer
+}
+
+// NewSessionPool creates a SessionPool whose sessions are configured with the
+// given options, which are the same as for a Dialer of its own. The
+// SessionPool option itself is ignored.
+func NewSessionPool(opts *DialerOpts) *SessionPool {
+	return &SessionPool{dialer: newDialer(opts)}
+}
+
+// ignoredPoolOpts returns the names of the options other than SessionPool that
+// are set in the given DialerOpts, which NewDialer ignores when they come with
+// a SessionPool.
+func ignoredPoolOpts(opts *DialerOpts) []string {
+	var names []string
+	v := reflect.ValueOf(opts).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if name != "SessionPool" && !v.Field(i).IsZero() {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (pool *SessionPool) newDialer(opts *DialerOpts) Dialer {
+	if ignored := ignoredPoolOpts(opts); len(ignored) > 0 {
+		log.Errorf("%v: Ignoring options %v of Dialer that uses the SessionPool, set them on the pool instead", pool.dialer.name, ignored)
+	}
+	return pool.dialer
+}
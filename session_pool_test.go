@@ -0,0 +1,43 @@
+package lampshade
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionPool(t *testing.T) {
+	var pool *SessionPool
+	l, first, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		poolOpts := *opts
+		poolOpts.MaxStreamsPerConn = 3
+		pool = NewSessionPool(&poolOpts)
+		opts.SessionPool = pool
+	})
+	defer l.Close()
+	second := NewDialer(&DialerOpts{SessionPool: pool})
+
+	var sessions []Session
+	for i, d := range []Dialer{first, second, first, second} {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err, "dial %d", i)
+		defer conn.Close()
+		sessions = append(sessions, conn.(Stream).Session())
+	}
+	assert.True(t, sessions[0] == sessions[1] && sessions[1] == sessions[2], "dialers should have shared a session")
+	assert.True(t, sessions[2] != sessions[3], "pool should have applied MaxStreamsPerConn across dialers")
+	assert.Len(t, second.Dump().Sessions, 2, "dialers should share their view of the pool")
+}
+
+func TestSessionPoolIgnoredOpts(t *testing.T) {
+	pool := NewSessionPool(&DialerOpts{})
+	assert.Empty(t, ignoredPoolOpts(&DialerOpts{SessionPool: pool}))
+	assert.Equal(t, []string{"Name", "MaxLiveConns", "FrameInterceptor"}, ignoredPoolOpts(&DialerOpts{
+		Name:             "other",
+		MaxLiveConns:     2,
+		FrameInterceptor: func(outbound bool, frame []byte) []byte { return frame },
+		SessionPool:      pool,
+	}))
+	assert.True(t, NewDialer(&DialerOpts{Name: "other", SessionPool: pool}) == NewDialer(&DialerOpts{SessionPool: pool}), "options shouldn't be applied per dialer")
+}
@@ -0,0 +1,63 @@
+package lampshade
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket limits the rate of new sessions, see DialerOpts.MaxSessionRate.
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	mx     sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill adds the tokens that accrued since the last call. Must be called while
+// holding mx.
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// tryTake takes a token if one is available right away.
+func (tb *tokenBucket) tryTake() bool {
+	tb.mx.Lock()
+	defer tb.mx.Unlock()
+	tb.refill(time.Now())
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// reserve takes a token, going into debt if necessary, and returns how long the
+// caller has to wait before using it. Later callers queue up behind earlier
+// ones.
+func (tb *tokenBucket) reserve() time.Duration {
+	tb.mx.Lock()
+	defer tb.mx.Unlock()
+	tb.refill(time.Now())
+	tb.tokens--
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
@@ -0,0 +1,715 @@
+package lampshade
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// BenchmarkInteractiveLatencyWithBulk measures the round trip latency of small
+// writes on several interactive streams while another stream on the same
+// session is saturated with bulk data.
+func BenchmarkInteractiveLatencyWithBulk(b *testing.B) {
+	const interactiveStreams = 4
+
+	l, d, dial := newTestPair(b, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = headersVersion
+	})
+	defer l.Close()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if conn.(Stream).Headers()["kind"] == "bulk" {
+				go io.Copy(ioutil.Discard, conn)
+			} else {
+				go io.Copy(conn, conn)
+			}
+		}
+	}()
+
+	bulk, err := d.DialWithHeaders(context.Background(), dial, map[string]string{"kind": "bulk"})
+	require.NoError(b, err)
+	defer bulk.Close()
+	stopBulk := make(chan struct{})
+	defer close(stopBulk)
+	go func() {
+		data := make([]byte, 64*1024)
+		for {
+			select {
+			case <-stopBulk:
+				return
+			default:
+				if _, writeErr := bulk.Write(data); writeErr != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	conns := make([]net.Conn, 0, interactiveStreams)
+	for i := 0; i < interactiveStreams; i++ {
+		conn, dialErr := d.Dial(dial)
+		require.NoError(b, dialErr)
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	buf := make([]byte, 1)
+	var total time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn := conns[i%interactiveStreams]
+		start := time.Now()
+		_, err = conn.Write(buf)
+		require.NoError(b, err)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(b, err)
+		total += time.Since(start)
+	}
+	b.ReportMetric(float64(total.Microseconds())/float64(b.N), "µs/roundtrip")
+}
+
+func TestSessionActivity(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	session := conn.(Stream).Session()
+	createdAt := session.CreatedAt()
+	require.False(t, createdAt.IsZero())
+	require.False(t, session.LastActivity().Before(createdAt))
+
+	time.Sleep(10 * time.Millisecond)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	_, err = io.ReadFull(serverConn, make([]byte, 5))
+	require.NoError(t, err)
+
+	require.Equal(t, createdAt, session.CreatedAt())
+	require.True(t, session.LastActivity().After(createdAt.Add(10*time.Millisecond)), "writing should update last activity")
+}
+
+func TestKeepAlive(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	for _, keepAlive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keepAlive=%v", keepAlive), func(t *testing.T) {
+			l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+				if keepAlive {
+					opts.KeepAliveInterval = interval
+				}
+			})
+			defer l.Close()
+			go echoAll(l)
+
+			var recording *sizeRecordingConn
+			recordingDial := func() (net.Conn, error) {
+				conn, dialErr := dial()
+				if dialErr != nil {
+					return nil, dialErr
+				}
+				recording = &sizeRecordingConn{Conn: conn}
+				return recording, nil
+			}
+			conn, err := d.Dial(recordingDial)
+			require.NoError(t, err)
+			defer conn.Close()
+			echo := func() {
+				_, err := conn.Write([]byte("hello"))
+				require.NoError(t, err)
+				_, err = io.ReadFull(conn, make([]byte, 5))
+				require.NoError(t, err)
+			}
+			writes := func() int {
+				recording.mx.Lock()
+				defer recording.mx.Unlock()
+				return recording.writes
+			}
+
+			echo()
+			// give the ack for the echoed data time to go out
+			time.Sleep(interval / 2)
+			before := writes()
+			time.Sleep(10 * interval)
+			idleWrites := writes() - before
+			if keepAlive {
+				assert.True(t, idleWrites >= 3, "should have sent keep-alives while idle, sent %d", idleWrites)
+			} else {
+				assert.Zero(t, idleWrites, "shouldn't send anything while idle")
+			}
+			// peers ignore keep-alives
+			echo()
+		})
+	}
+}
+
+func TestFrameInterceptorSkipsInitFrame(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxPadding = 32
+		opts.FrameInterceptor = func(outbound bool, frame []byte) []byte {
+			if outbound && (len(frame) == 0 || frame[0] == frameTypePadding) {
+				// drop frames that don't carry any stream frames
+				return nil
+			}
+			return frame
+		}
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 5)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err, "client init message should have been sent regardless of the interceptor")
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestRejectOversizedFrame(t *testing.T) {
+	l, d, dial := newTestPair(t, &ListenerOpts{
+		FrameInterceptor: func(outbound bool, frame []byte) []byte {
+			if !outbound && len(frame) >= dataHeaderSize && frame[0] == frameTypeData {
+				// claim more data than can fit in a frame
+				binaryEncoding.PutUint16(frame[headerSize:], MaxDataLen+1)
+			}
+			return frame
+		},
+	}, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// the server resets the session, so we never get a response
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NotEqual(t, ErrTimeout, err, "session should have been closed rather than left hanging")
+}
+
+func TestUnknownFrames(t *testing.T) {
+	// frame type to inject in front of the next data frame from the client
+	var inject int32
+	l, d, dial := newTestPair(t, &ListenerOpts{
+		FrameInterceptor: func(outbound bool, frame []byte) []byte {
+			if outbound || len(frame) < dataHeaderSize || frame[0] != frameTypeData {
+				return frame
+			}
+			frameType := atomic.SwapInt32(&inject, 0)
+			if frameType == 0 {
+				return frame
+			}
+			unknown := make([]byte, dataHeaderSize+3)
+			setFrameTypeAndID(unknown, byte(frameType), binaryEncoding.Uint16(frame[1:]))
+			binaryEncoding.PutUint16(unknown[headerSize:], 3)
+			return append(unknown, frame...)
+		},
+	}, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("a"))
+	require.NoError(t, err)
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1)
+	_, err = io.ReadFull(serverConn, b)
+	require.NoError(t, err)
+
+	atomic.StoreInt32(&inject, 2)
+	_, err = conn.Write([]byte("b"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(serverConn, b)
+	require.NoError(t, err, "frames of unknown types without the must-understand bit should be ignored")
+	assert.Equal(t, "b", string(b))
+
+	atomic.StoreInt32(&inject, frameTypeMustUnderstand|2)
+	_, err = conn.Write([]byte("c"))
+	require.NoError(t, err)
+	// the data frame may still have made it in before the reset
+	for err == nil {
+		_, err = serverConn.Read(b)
+	}
+	assert.Equal(t, ErrUnknownFrame, err, "frames of unknown types with the must-understand bit should reset the stream")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(b)
+	require.Error(t, err)
+	assert.NotEqual(t, ErrTimeout, err, "peer should have been sent an RST")
+}
+
+// replayingConn sends a copy of the Nth write again right after it.
+type replayingConn struct {
+	net.Conn
+	replay int
+	writes int
+}
+
+func (conn *replayingConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b)
+	conn.writes++
+	if err == nil && conn.writes == conn.replay {
+		_, err = conn.Conn.Write(b)
+	}
+	return n, err
+}
+
+func TestReplayedFrameResetsSession(t *testing.T) {
+	// The replayed length decrypts to garbage, so the server may wait for up to
+	// 64KB before it can check the MAC. Use a window that lets us send that
+	// much without acks.
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.WindowSize = 100
+	})
+	defer l.Close()
+	// don't wait long for buffered writes to flush once the session is reset
+	defer setCloseTimeout(getCloseTimeout())
+	setCloseTimeout(250 * time.Millisecond)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	conn, err := d.Dial(func() (net.Conn, error) {
+		conn, dialErr := dial()
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		// the first write is the client init message, replay the one after
+		return &replayingConn{Conn: conn, replay: 2}, nil
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	stopWriting := make(chan struct{})
+	defer close(stopWriting)
+	go func() {
+		data := make([]byte, MaxDataLen)
+		for {
+			select {
+			case <-stopWriting:
+				return
+			default:
+				if _, writeErr := conn.Write(data); writeErr != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.Error(t, err)
+	require.NotEqual(t, ErrTimeout, err, "server should have reset the session")
+}
+
+// stallingConn blocks writes once stall is set, until it's closed.
+type stallingConn struct {
+	net.Conn
+	stall  int32
+	closed chan struct{}
+}
+
+func (conn *stallingConn) Write(b []byte) (int, error) {
+	if atomic.LoadInt32(&conn.stall) == 1 {
+		<-conn.closed
+		return 0, io.ErrClosedPipe
+	}
+	return conn.Conn.Write(b)
+}
+
+func (conn *stallingConn) Close() error {
+	select {
+	case <-conn.closed:
+	default:
+		close(conn.closed)
+	}
+	return conn.Conn.Close()
+}
+
+func TestWriteStallTimeout(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.WriteStallTimeout = 100 * time.Millisecond
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	var stalling *stallingConn
+	conn, err := d.Dial(func() (net.Conn, error) {
+		conn, dialErr := dial()
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		stalling = &stallingConn{Conn: conn, closed: make(chan struct{})}
+		return stalling, nil
+	})
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.NoError(t, err, "writes that complete in time shouldn't be affected")
+
+	atomic.StoreInt32(&stalling.stall, 1)
+	start := time.Now()
+	_, err = conn.Write(make([]byte, 4*testWindowSize*MaxDataLen))
+	assert.Equal(t, ErrSessionStalled, err)
+	assert.True(t, time.Since(start) < 2*time.Second, "should have given up on the stalled write promptly")
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, ErrSessionStalled, err)
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.StreamIdleTimeout = 100 * time.Millisecond
+	})
+	defer l.Close()
+	go echoAll(l)
+
+	idle, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer idle.Close()
+	paused, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer paused.Close()
+	paused.(Stream).Pause()
+	active, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer active.Close()
+
+	b := make([]byte, 5)
+	for i := 0; i < 6; i++ {
+		_, err = active.Write([]byte("hello"))
+		require.NoError(t, err)
+		_, err = io.ReadFull(active, b)
+		require.NoError(t, err, "active streams shouldn't be reset")
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	_, err = idle.Read(b)
+	assert.Equal(t, ErrStreamIdle, err)
+	_, err = idle.Write([]byte("hello"))
+	assert.Equal(t, ErrStreamIdle, err)
+
+	_, err = paused.Write([]byte("hello"))
+	assert.NoError(t, err, "paused streams shouldn't be reset")
+}
+
+func TestOnFrameDropped(t *testing.T) {
+	var mx sync.Mutex
+	drops := make(map[FrameDropReason]int)
+	var droppedID uint16
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.OnFrameDropped = func(streamID uint16, reason FrameDropReason) {
+			mx.Lock()
+			drops[reason]++
+			droppedID = streamID
+			mx.Unlock()
+		}
+	})
+	defer l.Close()
+	defer setCloseTimeout(getCloseTimeout())
+	setCloseTimeout(100 * time.Millisecond)
+	go func() {
+		// accept but never read, so that the window stays closed
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	const unsent = 5
+	data := make([]byte, MaxDataLen)
+	for i := 0; i < testWindowSize+unsent; i++ {
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+	}
+	conn.Close()
+
+	mx.Lock()
+	defer mx.Unlock()
+	assert.Equal(t, map[FrameDropReason]int{FrameDropTimeout: unsent}, drops, "frames that didn't fit into the window should have timed out")
+	_, id := frameTypeAndID(conn.(*stream).sb.defaultHeader)
+	assert.Equal(t, id, droppedID)
+}
+
+func TestTLSConnectionState(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, ok := conn.(Stream).Session().TLSConnectionState()
+	require.False(t, ok, "plain TCP shouldn't report TLS state")
+
+	pk := testPrivateKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "lampshade"},
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &pk.PublicKey, pk)
+	require.NoError(t, err)
+	wrapped, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: pk}},
+	})
+	require.NoError(t, err)
+	tl := WrapListener(wrapped, testPool, pk, &ListenerOpts{})
+	defer tl.Close()
+	go func() {
+		serverConn, acceptErr := tl.Accept()
+		if acceptErr == nil {
+			defer serverConn.Close()
+			io.Copy(ioutil.Discard, serverConn)
+		}
+	}()
+
+	// use a separate dialer so that we don't reuse the plain TCP session
+	unused, td, _ := newTestPair(t, nil, nil)
+	unused.Close()
+	tlsConn, err := td.Dial(func() (net.Conn, error) {
+		return tls.Dial("tcp", wrapped.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	})
+	require.NoError(t, err)
+	defer tlsConn.Close()
+	state, ok := tlsConn.(Stream).Session().TLSConnectionState()
+	require.True(t, ok)
+	require.True(t, state.HandshakeComplete)
+	require.Len(t, state.PeerCertificates, 1)
+	require.Equal(t, "lampshade", state.PeerCertificates[0].Subject.CommonName)
+}
+
+func TestAckShards(t *testing.T) {
+	l, d, dial := newTestPair(t, &ListenerOpts{AckShards: 4}, func(opts *DialerOpts) {
+		opts.AckShards = 4
+	})
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	// more data than fits in the window, so this only completes if acks flow in
+	// both directions
+	data := make([]byte, 4*testWindowSize*MaxDataLen)
+	var conns []net.Conn
+	for i := 0; i < 10; i++ {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		conns = append(conns, conn)
+	}
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn net.Conn) {
+			_, err := conn.Write(data)
+			errs <- err
+		}(conn)
+	}
+	for _, conn := range conns {
+		_, err := io.ReadFull(conn, make([]byte, len(data)))
+		require.NoError(t, err)
+	}
+	for range conns {
+		require.NoError(t, <-errs)
+	}
+}
+
+// BenchmarkAckContention measures the cost of queueing acks from many
+// concurrent streams through the session's single out channel versus sharded
+// channels.
+func BenchmarkAckContention(b *testing.B) {
+	for _, shards := range []int{0, 8} {
+		b.Run(fmt.Sprintf("shards-%d", shards), func(b *testing.B) {
+			benchmarkAckContention(b, shards)
+		})
+	}
+}
+
+func benchmarkAckContention(b *testing.B, shards int) {
+	const numStreams = 256
+
+	acks := newAckShards(shards)
+	out := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+	// drain like the session's sendLoop does
+	go func() {
+		for {
+			select {
+			case <-out:
+			case <-acks.readyCh():
+				for acks.next() != nil {
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	frame := ackWithFrames(newHeader(frameTypeData, 0), 1)
+	var nextID uint32
+	b.SetParallelism(numStreams / runtime.GOMAXPROCS(0))
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		ack, ackQueued := out, func() {}
+		if acks != nil {
+			ack, ackQueued = acks.shardFor(uint16(atomic.AddUint32(&nextID, 1))), acks.signal
+		}
+		for pb.Next() {
+			ack <- frame
+			ackQueued()
+		}
+	})
+}
+
+func TestResetAll(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	reader, err := d.Dial(dial)
+	require.NoError(t, err)
+	_, err = reader.Write([]byte("r"))
+	require.NoError(t, err)
+	writer, err := d.Dial(dial)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("w"))
+	require.NoError(t, err)
+
+	var serverReader, serverWriter net.Conn
+	for i := 0; i < 2; i++ {
+		conn, acceptErr := l.Accept()
+		require.NoError(t, acceptErr)
+		b := make([]byte, 1)
+		_, readErr := io.ReadFull(conn, b)
+		require.NoError(t, readErr)
+		if b[0] == 'r' {
+			serverReader = conn
+		} else {
+			serverWriter = conn
+		}
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := serverReader.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	writeErr := make(chan error, 1)
+	go func() {
+		// nobody reads on the client, so this blocks once the window is full
+		_, err := serverWriter.Write(make([]byte, 10*testWindowSize*MaxDataLen))
+		writeErr <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, serverReader.(Stream).Session().ResetAll("maintenance"))
+	expected := &ResetError{"maintenance"}
+	for _, errs := range []chan error{readErr, writeErr} {
+		select {
+		case err := <-errs:
+			assert.Equal(t, expected, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("blocked call didn't return after reset")
+		}
+	}
+	assert.True(t, time.Since(start) < time.Second, "reset should be prompt")
+	_, err = serverReader.Write([]byte("x"))
+	assert.Equal(t, expected, err)
+
+	// the client sees its streams end
+	reader.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = reader.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.NotEqual(t, ErrTimeout, err)
+}
+
+func TestSessionGoroutinesExitOnClose(t *testing.T) {
+	defer SetLeakCheck(0)
+	SetLeakCheck(2 * time.Second)
+	baseline := ReadGlobalStats().SessionGoroutines
+	baselineLeaked := ReadGlobalStats().LeakedSessions
+	baselineRuntime := runtime.NumGoroutine()
+
+	// Listeners and dialers have goroutines of their own, so share one pair
+	// across all cycles.
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+	for i := 0; i < 5; i++ {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		// leave some data unacked so that the stream has something to flush
+		_, err = conn.Write(make([]byte, 4*testWindowSize*MaxDataLen)[:MaxDataLen])
+		require.NoError(t, err)
+		serverConn, err := l.Accept()
+		require.NoError(t, err)
+		serverConn.Write([]byte("hello"))
+
+		serverConn.(Stream).Session().Close()
+		conn.(Stream).Session().Close()
+		conn.Close()
+		serverConn.Close()
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for ReadGlobalStats().SessionGoroutines > baseline && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.True(t, ReadGlobalStats().SessionGoroutines <= baseline, "session goroutines should have exited, %d still running", ReadGlobalStats().SessionGoroutines-baseline)
+	// give the leak checks a chance to finish
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, baselineLeaked, ReadGlobalStats().LeakedSessions)
+	// allow for a few goroutines that aren't tied to sessions, such as ones
+	// started by the runtime or by the listener
+	require.True(t, runtime.NumGoroutine() <= baselineRuntime+10, "goroutines leaked: %d before, %d after", baselineRuntime, runtime.NumGoroutine())
+}
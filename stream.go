@@ -1,57 +1,194 @@
 package lampshade
 
 import (
+	"context"
+	"errors"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// ErrInvalidWaterMarks indicates that the water marks passed to SetWaterMarks
+// don't satisfy 0 <= low < high.
+var ErrInvalidWaterMarks = errors.New("invalid water marks")
+
+// ResetError is the error with which reads and writes on a Stream fail after
+// it was reset, whether by Stream.Reset or Stream.ResetAfterFlush
+// (ErrStreamReset), by Session.ResetAll, for being idle (ErrStreamIdle), or
+// because of an unknown extension frame (ErrUnknownFrame) or late headers
+// (ErrLateHeaders). See "Closing Streams" in the package doc.
+type ResetError struct {
+	Reason string
+}
+
+func (err *ResetError) Error() string {
+	return "stream reset: " + err.Reason
+}
+
 // a stream is a multiplexed net.Conn operating on top of a physical net.Conn
 // managed by a session.
 type stream struct {
+	// 64 bit fields first so that they're aligned for atomic access
+	bytesWritten int64
+	bytesRead    int64
+	lastActivity int64 // unix nanos, see markActive
 	net.Conn
 	session       *session
 	pool          BufferPool
 	rb            *receiveBuffer
 	sb            *sendBuffer
+	headers       map[string]string
+	userData      interface{}
+	muUserData    sync.RWMutex // not mx, which close holds while flushing
 	readDeadline  time.Time
 	writeDeadline time.Time
+	muDeadlines   sync.RWMutex // not mx, so that the getters don't wait for close
+	openedAt      time.Time
+	closing       int32 // set as soon as close starts, see ErrStreamClosing
 	closed        bool
 	finalReadErr  error
 	finalWriteErr error
+	resetErr      atomic.Value // resetCause, once reset
+	oob           chan []byte
+	oobClosed     bool
+	muOOB         sync.Mutex
 	mx            sync.RWMutex
+	muWrite       sync.Mutex
 }
 
-func newStream(s *session, bp BufferPool, out chan []byte, windowSize int, defaultHeader []byte) *stream {
+func newStream(s *session, bp BufferPool, windowSize int, id uint16) *stream {
 	atomic.AddInt64(&openStreams, 1)
+	defaultHeader := newHeader(frameTypeData, id)
+	ack, ackQueued := s.ackOut, func() {}
+	if s.acks != nil {
+		ack, ackQueued = s.acks.shardFor(id), s.acks.signal
+	}
+	rb := newReceiveBuffer(defaultHeader, ack, bp, windowSize, s.receiveBufferDepth, s.ackJitter)
+	rb.ackQueued = ackQueued
+	rb.spawn = s.spawn
+	rb.onDropped = s.onFrameDroppedFor(id)
+	if s.adaptiveAcks {
+		rb.enableAdaptiveAcks()
+	}
+	if s.maxReceiveBytes > 0 {
+		rb.limitBytes(s.maxReceiveBytes)
+	}
+	now := time.Now()
 	return &stream{
-		Conn:    s,
-		session: s,
-		pool:    bp,
-		sb:      newSendBuffer(defaultHeader, out, windowSize),
-		rb:      newReceiveBuffer(defaultHeader, out, bp, windowSize),
+		lastActivity: now.UnixNano(),
+		Conn:         s,
+		session:      s,
+		pool:         bp,
+		sb:           newSendBuffer(defaultHeader, s.sched, windowSize, s.maxQueuedFrames, s.maxUnackedBytes, s.newSendWindow(windowSize), &s.inFlightBytes, s.closeCh, s.onFrameDroppedFor(id), s.spawn),
+		rb:           rb,
+		openedAt:     now,
+		oob:          make(chan []byte, oobQueueDepth),
 	}
 }
 
 func (c *stream) Read(b []byte) (int, error) {
+	readDeadline := c.ReadDeadline()
+	c.mx.RLock()
+	finalReadErr := c.finalReadErr
+	c.mx.RUnlock()
+	if finalReadErr != nil {
+		return 0, finalReadErr
+	}
+	n, err := c.rb.read(b, readDeadline)
+	atomic.AddInt64(&c.bytesRead, int64(n))
+	return n, c.orResetErr(err)
+}
+
+func (c *stream) ReadFull(b []byte) (int, error) {
+	readDeadline := c.ReadDeadline()
+	c.mx.RLock()
+	finalReadErr := c.finalReadErr
+	c.mx.RUnlock()
+	if finalReadErr != nil {
+		return 0, finalReadErr
+	}
+	n, err := c.rb.readFull(b, readDeadline)
+	atomic.AddInt64(&c.bytesRead, int64(n))
+	return n, c.orResetErr(err)
+}
+
+func (c *stream) ReadContext(ctx context.Context, b []byte) (int, error) {
+	readDeadline := c.ReadDeadline()
+	c.mx.RLock()
+	finalReadErr := c.finalReadErr
+	c.mx.RUnlock()
+	if finalReadErr != nil {
+		return 0, finalReadErr
+	}
+	n, err := c.rb.readCancelable(b, readDeadline, ctx.Done())
+	atomic.AddInt64(&c.bytesRead, int64(n))
+	if err == errReadCanceled {
+		err = ctx.Err()
+	}
+	return n, c.orResetErr(err)
+}
+
+func (c *stream) ReadFrame() ([]byte, func(), error) {
+	readDeadline := c.ReadDeadline()
+	c.mx.RLock()
+	finalReadErr := c.finalReadErr
+	c.mx.RUnlock()
+	if finalReadErr != nil {
+		return nil, nil, finalReadErr
+	}
+	data, release, err := c.rb.readFrame(readDeadline)
+	atomic.AddInt64(&c.bytesRead, int64(len(data)))
+	return data, release, c.orResetErr(err)
+}
+
+func (c *stream) ReadFrames(bufs [][]byte) (int, error) {
+	readDeadline := c.ReadDeadline()
 	c.mx.RLock()
-	readDeadline := c.readDeadline
 	finalReadErr := c.finalReadErr
 	c.mx.RUnlock()
 	if finalReadErr != nil {
 		return 0, finalReadErr
 	}
-	return c.rb.read(b, readDeadline)
+	n, err := c.rb.readFrames(bufs, readDeadline)
+	for _, b := range bufs[:n] {
+		atomic.AddInt64(&c.bytesRead, int64(len(b)))
+	}
+	return n, c.orResetErr(err)
 }
 
+// Write writes the given data to the stream. Concurrent calls to Write are
+// serialized so that the frames of one Write are never interleaved with those
+// of another. If the write deadline expires partway through a Write that spans
+// multiple frames, Write returns the number of bytes that were accepted into
+// the send buffer before the deadline, along with ErrTimeout.
 func (c *stream) Write(b []byte) (int, error) {
-	if len(b) > MaxDataLen {
-		return c.writeChunks(b)
+	c.muWrite.Lock()
+	defer c.muWrite.Unlock()
+	var n int
+	var err error
+	if len(b) > c.session.maxDataLen {
+		n, err = c.writeChunks(b)
+	} else {
+		n, err = c.writeFrame(b)
+	}
+	atomic.AddInt64(&c.bytesWritten, int64(n))
+	return n, c.orResetErr(err)
+}
+
+func (c *stream) writeFrame(b []byte) (int, error) {
+	if atomic.LoadInt32(&c.closing) == 1 {
+		select {
+		case <-c.sb.closed:
+			// finished closing, fail with the final error below
+		default:
+			// don't wait on mx, which close holds while flushing
+			return 0, ErrStreamClosing
+		}
 	}
 
+	writeDeadline := c.WriteDeadline()
 	c.mx.RLock()
-	writeDeadline := c.writeDeadline
 	finalWriteErr := c.finalWriteErr
 	c.mx.RUnlock()
 	if finalWriteErr != nil {
@@ -59,25 +196,35 @@ func (c *stream) Write(b []byte) (int, error) {
 	}
 
 	// copy buffer since we hang on to it past the call to Write but callers
-	// expect that they can reuse the buffer after Write returns
+	// expect that they can reuse the buffer after Write returns. This also
+	// gives the frame a pooled buffer of its own with room for the header.
 	_b := b
 	b = c.pool.getForFrame()[:len(b)]
 	copy(b, _b)
-	return c.sb.send(b, writeDeadline)
+	n, err := c.sb.send(b, writeDeadline)
+	if err != nil {
+		// the frame never got queued
+		c.pool.Put(b[:maxFrameSize])
+	} else {
+		c.markActive()
+	}
+	return n, err
 }
 
-// writeChunks breaks the buffer down into units smaller than MaxDataLen in size
+// writeChunks breaks the buffer down into units no larger than the session's
+// maxDataLen, which is MaxDataLen unless MaxSessionFrameSize calls for less
 func (c *stream) writeChunks(b []byte) (int, error) {
+	maxDataLen := c.session.maxDataLen
 	totalN := 0
 	for {
 		toWrite := b
 		last := true
-		if len(b) > MaxDataLen {
-			toWrite = b[:MaxDataLen]
-			b = b[MaxDataLen:]
+		if len(b) > maxDataLen {
+			toWrite = b[:maxDataLen]
+			b = b[maxDataLen:]
 			last = false
 		}
-		n, err := c.Write(toWrite)
+		n, err := c.writeFrame(toWrite)
 		totalN += n
 		if last || err != nil {
 			return totalN, err
@@ -85,23 +232,129 @@ func (c *stream) writeChunks(b []byte) (int, error) {
 	}
 }
 
+// sendHeaders sends a headers frame for this stream. It must be called before
+// anything is written to the stream.
+func (c *stream) sendHeaders(headers map[string]string) error {
+	if c.session.version < headersVersion {
+		return ErrHeadersUnsupported
+	}
+	if encodedHeadersSize(headers) > c.session.maxDataLen {
+		// doesn't fit into a session frame, see MaxSessionFrameSize
+		return ErrHeadersTooLarge
+	}
+	frame := encodeHeaders(c.pool.getForFrame(), headers)
+	frame = append(frame, withFrameType(c.sb.defaultHeader, frameTypeHeaders)...)
+	select {
+	case c.session.out <- frame:
+		return nil
+	case <-c.session.closeCh:
+		c.pool.Put(frame[:maxFrameSize])
+		return ErrConnectionClosed
+	}
+}
+
+func (c *stream) Headers() map[string]string {
+	return c.headers
+}
+
+func (c *stream) SetUserData(data interface{}) {
+	c.muUserData.Lock()
+	c.userData = data
+	c.muUserData.Unlock()
+}
+
+func (c *stream) UserData() interface{} {
+	c.muUserData.RLock()
+	defer c.muUserData.RUnlock()
+	return c.userData
+}
+
+func (c *stream) Sync() error {
+	if c.session.version < ackRequestVersion {
+		return ErrSyncUnsupported
+	}
+	writeDeadline := c.WriteDeadline()
+	c.mx.RLock()
+	finalWriteErr := c.finalWriteErr
+	c.mx.RUnlock()
+	if finalWriteErr != nil && finalWriteErr != ErrWriteClosed {
+		return finalWriteErr
+	}
+	return c.sb.sync(writeDeadline, c.requestAck)
+}
+
+func (c *stream) CloseWrite() error {
+	if c.session.version < halfCloseVersion {
+		return ErrCloseWriteUnsupported
+	}
+	// hold muWrite so that the fin goes out behind any Write in progress
+	c.muWrite.Lock()
+	defer c.muWrite.Unlock()
+	if atomic.LoadInt32(&c.closing) == 1 {
+		return ErrStreamClosing
+	}
+
+	writeDeadline := c.WriteDeadline()
+	c.mx.RLock()
+	finalWriteErr := c.finalWriteErr
+	c.mx.RUnlock()
+	if finalWriteErr != nil {
+		return finalWriteErr
+	}
+
+	err := c.sb.closeWrite(writeDeadline)
+	if err != nil {
+		return c.orResetErr(err)
+	}
+	c.mx.Lock()
+	if c.finalWriteErr == nil {
+		c.finalWriteErr = ErrWriteClosed
+	}
+	c.mx.Unlock()
+	return nil
+}
+
+func (c *stream) CloseWriteSync() error {
+	if err := c.CloseWrite(); err != nil {
+		return err
+	}
+	return c.Sync()
+}
+
+// requestAck asks the peer to ack whatever it has consumed by sending it an
+// ack with the ack request bit set.
+func (c *stream) requestAck() {
+	select {
+	case c.session.ackOut <- ackRequest(c.sb.defaultHeader):
+	case <-c.session.closeCh:
+	}
+}
+
 func (c *stream) ack(frames int) {
 	c.sb.window.add(frames)
+	if frames > 0 {
+		c.sb.acked(frames, true)
+	}
 }
 
 func (c *stream) Close() error {
-	return c.close(true, ErrConnectionClosed, ErrConnectionClosed)
+	return c.close(closeReasonLocal, true, ErrConnectionClosed, ErrConnectionClosed)
 }
 
-func (c *stream) close(sendRST bool, readErr error, writeErr error) error {
+// close closes the stream for the given reason, which is only used for
+// logging.
+func (c *stream) close(reason string, sendRST bool, readErr error, writeErr error) error {
+	atomic.StoreInt32(&c.closing, 1)
 	c.mx.Lock()
-	if !c.closed {
+	closedNow := !c.closed
+	if closedNow {
 		atomic.AddInt64(&closingStreams, 1)
 		c.closed = true
 		c.finalReadErr = readErr
 		c.finalWriteErr = writeErr
 		atomic.AddInt64(&closingReceiveBuffers, 1)
 		c.rb.close()
+		c.closeOOB()
 		atomic.AddInt64(&closingReceiveBuffers, -1)
 		atomic.AddInt64(&closingSendBuffers, 1)
 		c.sb.close(sendRST)
@@ -109,8 +362,70 @@ func (c *stream) close(sendRST bool, readErr error, writeErr error) error {
 		atomic.AddInt64(&closingStreams, -1)
 		atomic.AddInt64(&openStreams, -1)
 		atomic.AddInt64(&closedStreams, 1)
+		c.logClosed(reason)
 	}
 	c.mx.Unlock()
+	if closedNow {
+		c.onClosed(reason)
+	}
+	return nil
+}
+
+// reset immediately closes the stream with an RST, discarding anything that's
+// still buffered for sending. Reads and writes that are blocked as well as
+// subsequent ones fail with err.
+func (c *stream) reset(err *ResetError) {
+	c.resetErr.Store(resetCause{err})
+	c.sb.setLinger(0)
+	c.sb.abort()
+	c.close(err.Error(), true, err, err)
+}
+
+// resetCause wraps the errors that streams can be reset with so that they can
+// all be stored in the same atomic.Value.
+type resetCause struct {
+	err error
+}
+
+// orResetErr replaces err with the error that the stream was reset with, if
+// any.
+func (c *stream) orResetErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	if cause, ok := c.resetErr.Load().(resetCause); ok {
+		return cause.err
+	}
+	return err
+}
+
+func (c *stream) RTT() time.Duration {
+	return c.sb.rtt.GetDuration()
+}
+
+func (c *stream) Reset() {
+	c.reset(ErrStreamReset)
+}
+
+func (c *stream) ResetAfterFlush() {
+	c.resetErr.Store(resetCause{ErrStreamReset})
+	if c.sb.lingering() && c.sb.flushTimeout() == 0 {
+		// flush for as long as Close would by default
+		c.sb.setLinger(-1)
+	}
+	c.close(ErrStreamReset.Error(), true, ErrStreamReset, ErrStreamReset)
+}
+
+func (c *stream) SetLinger(sec int) error {
+	c.sb.setLinger(sec)
+	return nil
+}
+
+func (c *stream) SetWaterMarks(high, low int, onHigh, onLow func()) error {
+	if high > 0 && (low < 0 || low >= high) {
+		return ErrInvalidWaterMarks
+	}
+	c.sb.setWaterMarks(high, low, onHigh, onLow)
 	return nil
 }
 
@@ -123,27 +438,47 @@ func (c *stream) RemoteAddr() net.Addr {
 }
 
 func (c *stream) SetDeadline(t time.Time) error {
-	c.mx.Lock()
+	c.muDeadlines.Lock()
 	c.readDeadline = t
 	c.writeDeadline = t
-	c.mx.Unlock()
+	c.muDeadlines.Unlock()
 	return nil
 }
 
 func (c *stream) SetReadDeadline(t time.Time) error {
-	c.mx.Lock()
+	c.muDeadlines.Lock()
 	c.readDeadline = t
-	c.mx.Unlock()
+	c.muDeadlines.Unlock()
 	return nil
 }
 
 func (c *stream) SetWriteDeadline(t time.Time) error {
-	c.mx.Lock()
+	c.muDeadlines.Lock()
 	c.writeDeadline = t
-	c.mx.Unlock()
+	c.muDeadlines.Unlock()
 	return nil
 }
 
+func (c *stream) Pause() {
+	c.rb.pause()
+}
+
+func (c *stream) Resume() {
+	c.rb.resume()
+}
+
+func (c *stream) ReadDeadline() time.Time {
+	c.muDeadlines.RLock()
+	defer c.muDeadlines.RUnlock()
+	return c.readDeadline
+}
+
+func (c *stream) WriteDeadline() time.Time {
+	c.muDeadlines.RLock()
+	defer c.muDeadlines.RUnlock()
+	return c.writeDeadline
+}
+
 func (c *stream) Session() Session {
 	return c.session
 }
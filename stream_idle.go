@@ -0,0 +1,49 @@
+package lampshade
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// markActive records that data was sent or received on the stream, see
+// DialerOpts.StreamIdleTimeout.
+func (c *stream) markActive() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// idleSince reports whether the stream has been idle since the given time.
+// Paused streams don't count as idle since it's up to whoever paused them
+// when data flows again.
+func (c *stream) idleSince(t time.Time) bool {
+	return atomic.LoadInt64(&c.lastActivity) < t.UnixNano() && atomic.LoadInt32(&c.rb.paused) == 0
+}
+
+// resetIdleStreams periodically resets the streams that have been idle for
+// longer than streamIdleTimeout, until the session closes.
+func (s *session) resetIdleStreams() {
+	ticker := time.NewTicker(s.streamIdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case now := <-ticker.C:
+			cutoff := now.Add(-s.streamIdleTimeout)
+			var idle []*stream
+			s.mx.RLock()
+			for _, c := range s.streams {
+				if c.idleSince(cutoff) {
+					idle = append(idle, c)
+				}
+			}
+			s.mx.RUnlock()
+			for _, c := range idle {
+				c := c
+				// resetting waits for the RST to be queued, so don't hold up the
+				// check of the remaining streams
+				s.spawn(func() { c.reset(ErrStreamIdle) })
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package lampshade
+
+import (
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Reasons for which streams close, as logged in the close_reason field, see
+// DialerOpts.StreamLogLevel.
+const (
+	closeReasonLocal         = "closed"
+	closeReasonPeer          = "closed by peer"
+	closeReasonSessionClosed = "session closed"
+)
+
+// logStreams indicates whether stream opens and closes get logged.
+func (s *session) logStreams() bool {
+	// PanicLevel is the zero value, which we take to mean disabled
+	return s.streamLogLevel != log.PanicLevel
+}
+
+func (c *stream) logFields() log.Fields {
+	_, id := frameTypeAndID(c.sb.defaultHeader)
+	fields := log.Fields{
+		"session_id":  c.session.id,
+		"stream_id":   id,
+		"remote_addr": c.session.RemoteAddr().String(),
+	}
+	if c.session.name != "" {
+		fields["name"] = c.session.name
+	}
+	return fields
+}
+
+// logOpened logs that the stream was opened, if enabled.
+func (c *stream) logOpened() {
+	if !c.session.logStreams() {
+		return
+	}
+	log.WithFields(c.logFields()).Log(c.session.streamLogLevel, "Stream opened")
+}
+
+// logClosed logs that the stream closed and why, along with how much data it
+// carried, if enabled.
+func (c *stream) logClosed(reason string) {
+	if !c.session.logStreams() {
+		return
+	}
+	fields := c.logFields()
+	fields["bytes_read"] = atomic.LoadInt64(&c.bytesRead)
+	fields["bytes_written"] = atomic.LoadInt64(&c.bytesWritten)
+	fields["duration_seconds"] = time.Since(c.openedAt).Seconds()
+	fields["close_reason"] = reason
+	log.WithFields(fields).Log(c.session.streamLogLevel, "Stream closed")
+}
@@ -0,0 +1,75 @@
+package lampshade
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamLog(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	l, d, dial := newTestPair(t, &ListenerOpts{StreamLogLevel: log.InfoLevel}, func(opts *DialerOpts) {
+		opts.StreamLogLevel = log.InfoLevel
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	_, err = io.ReadFull(serverConn, make([]byte, 5))
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	streamLogs := func() map[string][]*log.Entry {
+		byMsg := make(map[string][]*log.Entry)
+		for _, entry := range hook.AllEntries() {
+			if _, ok := entry.Data["stream_id"]; ok {
+				byMsg[entry.Message] = append(byMsg[entry.Message], entry)
+			}
+		}
+		return byMsg
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(streamLogs()["Stream closed"]) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	byMsg := streamLogs()
+	require.Len(t, byMsg["Stream opened"], 2, "both ends should have logged the stream opening")
+	require.Len(t, byMsg["Stream closed"], 2, "both ends should have logged the stream closing")
+	reasons := make(map[interface{}]log.Fields)
+	for _, entry := range byMsg["Stream closed"] {
+		assert.Equal(t, log.InfoLevel, entry.Level)
+		assert.Equal(t, byMsg["Stream opened"][0].Data["stream_id"], entry.Data["stream_id"])
+		reasons[entry.Data["close_reason"]] = entry.Data
+	}
+	require.Contains(t, reasons, closeReasonLocal)
+	require.Contains(t, reasons, closeReasonPeer)
+	assert.Equal(t, int64(5), reasons[closeReasonLocal]["bytes_written"])
+	assert.Equal(t, int64(5), reasons[closeReasonPeer]["bytes_read"])
+	assert.Equal(t, conn.(Stream).Session().(*session).id, reasons[closeReasonLocal]["session_id"])
+}
+
+func TestStreamLogDisabledByDefault(t *testing.T) {
+	hook := test.NewGlobal()
+	defer log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	for _, entry := range hook.AllEntries() {
+		assert.NotContains(t, entry.Data, "stream_id")
+	}
+}
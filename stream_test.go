@@ -0,0 +1,1078 @@
+package lampshade
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentWritesDontInterleave(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	const (
+		writers    = 5
+		messages   = 20
+		messageLen = 10*MaxDataLen + 7
+	)
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(writers)
+	for i := 0; i < writers; i++ {
+		msg := make([]byte, messageLen)
+		for j := range msg {
+			msg[j] = byte(i)
+		}
+		go func() {
+			defer wg.Done()
+			for j := 0; j < messages; j++ {
+				_, writeErr := conn.Write(msg)
+				assert.NoError(t, writeErr)
+			}
+		}()
+	}
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+
+	received := make([]byte, writers*messages*messageLen)
+	_, err = io.ReadFull(serverConn, received)
+	require.NoError(t, err)
+	wg.Wait()
+
+	for i := 0; i < writers*messages; i++ {
+		msg := received[i*messageLen : (i+1)*messageLen]
+		for j, b := range msg {
+			if !assert.Equal(t, msg[0], b, "message %d interleaved at byte %d", i, j) {
+				return
+			}
+		}
+	}
+}
+
+func TestPartialWriteOnDeadline(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	accepted := make(chan Stream, 1)
+	go func() {
+		serverConn, acceptErr := l.Accept()
+		if acceptErr == nil {
+			accepted <- serverConn.(Stream)
+		}
+	}()
+
+	// Nobody reads on the server yet, so the write stalls once the transmit
+	// window and buffers are full.
+	data := make([]byte, 10*testWindowSize*MaxDataLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
+	n, err := conn.Write(data)
+	assert.Equal(t, ErrTimeout, err)
+	assert.True(t, n > 0 && n < len(data), "should have partially written, but wrote %d", n)
+	assert.Zero(t, n%MaxDataLen, "should have written whole frames")
+
+	serverConn := <-accepted
+	defer serverConn.Close()
+	received := make([]byte, n)
+	_, err = io.ReadFull(serverConn, received)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data[:n], received), "should have received exactly the accepted bytes")
+
+	serverConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	extra, _ := serverConn.Read(make([]byte, 1))
+	assert.Zero(t, extra, "nothing beyond the accepted bytes should have been sent")
+}
+
+func TestSync(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = ackRequestVersion
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	stream := conn.(Stream)
+
+	// a single frame is less than the ack interval, so without a sync the peer
+	// wouldn't ack it
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
+	assert.Equal(t, ErrTimeout, stream.Sync(), "sync should time out while the peer hasn't read anything")
+
+	received := make([]byte, 5)
+	_, err = io.ReadFull(serverConn, received)
+	require.NoError(t, err)
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	assert.NoError(t, stream.Sync(), "sync should succeed once the peer has read everything")
+	assert.Zero(t, stream.Session().Stats().InFlightBytes)
+}
+
+func TestSyncUnsupported(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = ackRequestVersion - 1
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Equal(t, ErrSyncUnsupported, conn.(Stream).Sync(), "older sessions can't request acks")
+}
+
+func TestCloseWrite(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = halfCloseVersion
+	})
+	defer l.Close()
+	respond := make(chan bool)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, err := ioutil.ReadAll(conn)
+		if err != nil {
+			return
+		}
+		<-respond
+		conn.Write(append([]byte("response to "), request...))
+	}()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	stream := conn.(Stream)
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, stream.CloseWriteSync())
+	assert.Zero(t, stream.Session().Stats().InFlightBytes, "fin and data should all have been acked")
+
+	_, err = conn.Write([]byte("more"))
+	assert.Equal(t, ErrWriteClosed, err)
+	assert.Equal(t, ErrWriteClosed, stream.CloseWrite())
+
+	close(respond)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := ioutil.ReadAll(conn)
+	require.NoError(t, err, "reading should carry on after closing the write side")
+	assert.Equal(t, "response to hello", string(response))
+}
+
+func TestCloseWriteUnsupported(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = halfCloseVersion - 1
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, ErrCloseWriteUnsupported, conn.(Stream).CloseWrite(), "older sessions can't send fins")
+	assert.Equal(t, ErrCloseWriteUnsupported, conn.(Stream).CloseWriteSync())
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err, "stream should still be writable")
+}
+
+func TestAckOnFirstIsNotAckRequest(t *testing.T) {
+	l, d, dial := newTestPair(t, &ListenerOpts{AckOnFirst: true}, func(opts *DialerOpts) {
+		opts.ProtocolVersion = ackRequestVersion
+	})
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+	}()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hi"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.NoError(t, err)
+	// the server acked our frame on arrival, which must not make us ack the
+	// frame we just read before the ack interval is up
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&conn.(*stream).rb.unacked), "empty ack from AckOnFirst shouldn't have been taken as an ack request")
+}
+
+func TestReset(t *testing.T) {
+	// more than fits into the window, so that some of it is still buffered
+	data := make([]byte, (testWindowSize+5)*MaxDataLen)
+
+	for _, flush := range []bool{false, true} {
+		t.Run(fmt.Sprintf("flush=%v", flush), func(t *testing.T) {
+			l, d, dial := newTestPair(t, nil, nil)
+			defer l.Close()
+
+			conn, err := d.Dial(dial)
+			require.NoError(t, err)
+			defer conn.Close()
+			stream := conn.(Stream)
+			_, err = conn.Write(data)
+			require.NoError(t, err)
+			serverConn, err := l.Accept()
+			require.NoError(t, err)
+			defer serverConn.Close()
+
+			var received []byte
+			if flush {
+				// the peer has to keep reading for the flush to complete
+				resetDone := make(chan struct{})
+				go func() {
+					stream.ResetAfterFlush()
+					close(resetDone)
+				}()
+				received, err = ioutil.ReadAll(serverConn)
+				require.NoError(t, err, "peer should see the end of the stream after the data")
+				assert.Equal(t, data, received, "all data should have been sent before the RST")
+				select {
+				case <-resetDone:
+				case <-time.After(5 * time.Second):
+					t.Fatal("ResetAfterFlush should return once the data has been sent")
+				}
+			} else {
+				stream.Reset()
+				received, _ = ioutil.ReadAll(serverConn)
+				assert.True(t, len(received) < len(data), "buffered data should have been discarded")
+			}
+
+			_, err = conn.Read(make([]byte, 1))
+			assert.Equal(t, ErrStreamReset, err)
+			_, err = conn.Write([]byte("more"))
+			assert.Equal(t, ErrStreamReset, err)
+		})
+	}
+}
+
+func TestSetLinger(t *testing.T) {
+	// more than fits into the window, so that some of it is still buffered
+	data := make([]byte, (testWindowSize+5)*MaxDataLen)
+
+	for _, linger := range []int{0, 1} {
+		t.Run(fmt.Sprintf("linger=%d", linger), func(t *testing.T) {
+			l, d, dial := newTestPair(t, nil, nil)
+			defer l.Close()
+
+			conn, err := d.Dial(dial)
+			require.NoError(t, err)
+			require.NoError(t, conn.(Stream).SetLinger(linger))
+			_, err = conn.Write(data)
+			require.NoError(t, err)
+			serverConn, err := l.Accept()
+			require.NoError(t, err)
+			defer serverConn.Close()
+
+			closed := make(chan struct{})
+			go func() {
+				conn.Close()
+				close(closed)
+			}()
+			if linger == 0 {
+				select {
+				case <-closed:
+				case <-time.After(500 * time.Millisecond):
+					t.Fatal("close shouldn't wait to flush buffered data")
+				}
+				received, _ := ioutil.ReadAll(serverConn)
+				assert.True(t, len(received) < len(data), "buffered data should have been discarded")
+				return
+			}
+
+			// the peer isn't reading yet, so the flush can't complete
+			time.Sleep(100 * time.Millisecond)
+			select {
+			case <-closed:
+				t.Fatal("close shouldn't have finished flushing yet")
+			default:
+			}
+			received, err := ioutil.ReadAll(serverConn)
+			require.NoError(t, err)
+			assert.Equal(t, data, received, "buffered data should have been flushed")
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("close should return once the data has been flushed")
+			}
+		})
+	}
+}
+
+func TestStreamRTT(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = ackRequestVersion
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	stream := conn.(Stream)
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Zero(t, stream.RTT(), "nothing has been acked yet")
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	// the frame only gets acked once the server reads it
+	time.Sleep(100 * time.Millisecond)
+	_, err = io.ReadFull(serverConn, make([]byte, 5))
+	require.NoError(t, err)
+
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, stream.Sync())
+	rtt := stream.RTT()
+	assert.True(t, rtt >= 100*time.Millisecond && rtt < 5*time.Second, "unexpected rtt %v", rtt)
+}
+
+func TestMessages(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	stream := conn.(Stream)
+
+	messages := [][]byte{
+		[]byte("hello"),
+		{},
+		bytes.Repeat([]byte("x"), 3*MaxDataLen+5),
+		[]byte("world"),
+	}
+	go func() {
+		for _, msg := range messages {
+			assert.NoError(t, stream.WriteMessage(msg))
+		}
+	}()
+	assert.Equal(t, ErrMessageTooLarge, stream.WriteMessage(make([]byte, MaxMessageSize+1)))
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	for i, expected := range messages {
+		msg, readErr := serverConn.(Stream).ReadMessage()
+		require.NoError(t, readErr)
+		assert.Equal(t, expected, msg, "message %d", i)
+	}
+}
+
+func TestUnlimitedWindow(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.UnlimitedWindow = true
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// with a limited window, this would stall since nobody reads or acks on
+	// the server yet
+	data := make([]byte, 4*testWindowSize*MaxDataLen)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Write(data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	_, err = io.ReadFull(serverConn, make([]byte, len(data)))
+	require.NoError(t, err)
+}
+
+func TestSetWindowPolicy(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	session := conn.(Stream).Session()
+	assert.Equal(t, FixedWindowPolicy(), session.WindowPolicy())
+
+	// nobody reads or acks on the server yet, so the write stalls once the
+	// window is used up
+	data := make([]byte, 4*testWindowSize*MaxDataLen)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	written := make(chan error, 1)
+	go func() {
+		_, writeErr := conn.Write(data)
+		written <- writeErr
+	}()
+	select {
+	case <-written:
+		t.Fatal("write shouldn't have completed with a limited window")
+	case <-time.After(250 * time.Millisecond):
+	}
+
+	session.SetWindowPolicy(UnlimitedWindowPolicy())
+	assert.Equal(t, UnlimitedWindowPolicy(), session.WindowPolicy())
+	require.NoError(t, <-written, "write should have completed once the window was unlimited")
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	_, err = io.ReadFull(serverConn, make([]byte, len(data)))
+	require.NoError(t, err)
+}
+
+func TestReadContext(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	stream := conn.(Stream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	b := make([]byte, 5)
+	n, err := stream.ReadContext(ctx, b)
+	assert.Equal(t, context.Canceled, err)
+	assert.Zero(t, n)
+
+	// the stream is still usable after canceling
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	_, err = io.Copy(serverConn, io.LimitReader(serverConn, 5))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b))
+}
+
+func TestDeadlineGetters(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	stream := conn.(Stream)
+	assert.True(t, stream.ReadDeadline().IsZero())
+	assert.True(t, stream.WriteDeadline().IsZero())
+
+	deadline := time.Now().Add(time.Minute)
+	stream.SetDeadline(deadline)
+	assert.Equal(t, deadline, stream.ReadDeadline())
+	assert.Equal(t, deadline, stream.WriteDeadline())
+
+	stream.SetReadDeadline(time.Time{})
+	assert.True(t, stream.ReadDeadline().IsZero())
+	assert.Equal(t, deadline, stream.WriteDeadline(), "clearing the read deadline shouldn't affect the write deadline")
+	stream.SetWriteDeadline(deadline.Add(time.Minute))
+	assert.Equal(t, deadline.Add(time.Minute), stream.WriteDeadline())
+}
+
+func TestDeadlineGettersWhileClosing(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	stream, closed := closeWhileFlushing(t, d, dial)
+	start := time.Now()
+	deadline := time.Now().Add(time.Minute)
+	stream.SetDeadline(deadline)
+	assert.Equal(t, deadline, stream.ReadDeadline())
+	assert.Equal(t, deadline, stream.WriteDeadline())
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "deadlines shouldn't wait for close to finish flushing")
+	<-closed
+}
+
+func TestUserData(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	stream := conn.(Stream)
+	assert.Nil(t, stream.UserData())
+
+	type bookkeeping struct{ upstream string }
+	stream.SetUserData(&bookkeeping{"a"})
+	assert.Equal(t, &bookkeeping{"a"}, stream.UserData())
+	stream.SetUserData("b")
+	assert.Equal(t, "b", stream.UserData(), "should be able to replace user data with a different type")
+
+	conn.Close()
+	assert.Equal(t, "b", stream.UserData(), "user data should survive closing")
+	stream.SetUserData(nil)
+	assert.Nil(t, stream.UserData())
+}
+
+func TestUserDataWhileClosing(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	stream, closed := closeWhileFlushing(t, d, dial)
+	start := time.Now()
+	stream.SetUserData("a")
+	assert.Equal(t, "a", stream.UserData())
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "user data shouldn't wait for close to finish flushing")
+	<-closed
+}
+
+// closeWhileFlushing dials a stream and closes it in the background with
+// unsent data buffered, so that close keeps flushing for a second, the linger
+// time, since nobody reads on the other end. closed is closed once close
+// returns.
+func closeWhileFlushing(t *testing.T, d Dialer, dial DialFN) (stream Stream, closed chan struct{}) {
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	stream = conn.(Stream)
+	stream.SetLinger(1)
+	for i := 0; i < testWindowSize+1; i++ {
+		_, err = conn.Write([]byte("a"))
+		require.NoError(t, err)
+	}
+
+	closed = make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("close shouldn't have finished flushing yet")
+	default:
+	}
+	return stream, closed
+}
+
+func TestWaterMarks(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = ackRequestVersion
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	stream := conn.(Stream)
+
+	assert.Equal(t, ErrInvalidWaterMarks, stream.SetWaterMarks(5, 5, nil, nil))
+	high := make(chan struct{}, 10)
+	low := make(chan struct{}, 10)
+	require.NoError(t, stream.SetWaterMarks(5, 0, func() { high <- struct{}{} }, func() { low <- struct{}{} }))
+
+	for i := 0; i < 4; i++ {
+		_, err = conn.Write([]byte("hello"))
+		require.NoError(t, err)
+	}
+	assert.Empty(t, high, "shouldn't reach high water mark yet")
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Len(t, high, 1, "should have reached high water mark")
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Len(t, high, 1, "should only signal crossing the high water mark once")
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	_, err = io.ReadFull(serverConn, make([]byte, 30))
+	require.NoError(t, err)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, stream.Sync())
+	assert.Len(t, low, 1, "should have signaled low water mark once everything was acked")
+}
+
+func TestSlowStart(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.SlowStartWindow = 1
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	serverConn := make(chan net.Conn, 1)
+	go func() {
+		conn, acceptErr := l.Accept()
+		if acceptErr == nil {
+			serverConn <- conn
+		}
+	}()
+
+	// the window starts out at the ack interval, so nobody reading means that
+	// only a few frames go out
+	conn.SetWriteDeadline(time.Now().Add(250 * time.Millisecond))
+	data := make([]byte, 4*testWindowSize*MaxDataLen)
+	n, err := conn.Write(data)
+	assert.Equal(t, ErrTimeout, err)
+	inFlight := conn.(Stream).Session().Stats().InFlightBytes
+	assert.Equal(t, int64(ackIntervalFor(testWindowSize)*MaxDataLen), inFlight)
+
+	// once acks arrive, the window grows and everything gets through
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	go func() {
+		_, writeErr := conn.Write(data[n:])
+		assert.NoError(t, writeErr)
+	}()
+	sc := <-serverConn
+	defer sc.Close()
+	sc.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(sc, make([]byte, len(data)))
+	require.NoError(t, err)
+}
+
+// BenchmarkWrite measures the steady-state cost of writing a full frame to a
+// stream whose peer keeps up.
+func BenchmarkWrite(b *testing.B) {
+	l, d, dial := newTestPair(b, nil, nil)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	conn, err := d.Dial(dial)
+	require.NoError(b, err)
+	defer conn.Close()
+	data := make([]byte, MaxDataLen)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Write(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestMaxUnackedBytes(t *testing.T) {
+	const maxUnacked = 3 * MaxDataLen
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxUnackedBytes = maxUnacked
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	session := conn.(Stream).Session()
+
+	// with nobody reading, the window would allow testWindowSize frames
+	data := make([]byte, 10*MaxDataLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go conn.Write(data)
+	deadline := time.Now().Add(5 * time.Second)
+	for session.Stats().InFlightBytes < maxUnacked && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.EqualValues(t, maxUnacked, session.Stats().InFlightBytes, "should have stopped sending once maxUnacked bytes were in flight")
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(serverConn, received)
+	require.NoError(t, err)
+	assert.Equal(t, data, received, "should have sent the rest once the reader caught up")
+}
+
+func TestMaxUnackedBytesBelowAckInterval(t *testing.T) {
+	// with the default window, the peer only acks every few dozen frames, so a
+	// cap of a single frame would stall if it weren't raised
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.WindowSize = 0
+		opts.MaxUnackedBytes = MaxDataLen
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	data := make([]byte, 4*defaultWindowSize/10*MaxDataLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go conn.Write(data)
+
+	serverConn, err := l.Accept()
+	require.NoError(t, err)
+	defer serverConn.Close()
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make([]byte, len(data))
+	_, err = io.ReadFull(serverConn, received)
+	require.NoError(t, err, "stream should not stall waiting for an ack")
+	assert.Equal(t, data, received)
+}
+
+func TestMaxQueuedFrames(t *testing.T) {
+	const maxQueued = 2
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.MaxQueuedFrames = maxQueued
+		opts.ProtocolVersion = ackRequestVersion
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// with nobody reading, the window fills up and then frames start to queue
+	frame := make([]byte, MaxDataLen)
+	written := 0
+	for ; written < 2*testWindowSize; written++ {
+		_, err = conn.Write(frame)
+		if err != nil {
+			break
+		}
+	}
+	assert.Equal(t, ErrSendBufferFull, err)
+	assert.True(t, written >= maxQueued, "should have accepted at least a full queue, accepted %d", written)
+	assert.True(t, written <= testWindowSize+maxQueued, "shouldn't have accepted more than the window plus the queue, accepted %d", written)
+
+	// once the reader catches up, writes are accepted again
+	sc, err := l.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(sc, make([]byte, written*MaxDataLen))
+	require.NoError(t, err)
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	require.NoError(t, conn.(Stream).Sync())
+	_, err = conn.Write(frame)
+	assert.NoError(t, err)
+}
+
+func TestWithDataHeaderDoesNotAllocate(t *testing.T) {
+	header := newHeader(frameTypeData, 1)
+	frame := testPool.getForFrame()[:MaxDataLen]
+	allocs := testing.AllocsPerRun(100, func() {
+		withDataHeader(frame, header)
+	})
+	assert.Zero(t, allocs)
+}
+
+func TestWithDataHeaderWithoutCapacity(t *testing.T) {
+	header := newHeader(frameTypeData, 1)
+	data := []byte("hello")
+	frame := withDataHeader(data[:len(data):len(data)], header)
+	assert.Equal(t, append([]byte("hello"), header...), frame)
+	assert.Equal(t, maxFrameSize, cap(frame), "should have been copied into a full sized buffer")
+}
+
+func TestConcurrentStreamsDontCorruptFrames(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	const (
+		streams = 10
+		writes  = 50
+	)
+	// every stream writes frames of varying sizes filled with its own byte, so
+	// any bytes leaking between frames or streams show up on the server
+	expected := func(id byte) []byte {
+		var all []byte
+		for i := 0; i < writes; i++ {
+			all = append(all, bytes.Repeat([]byte{id}, 1+(i*997)%MaxDataLen)...)
+		}
+		return all
+	}
+
+	results := make(chan error, streams)
+	go func() {
+		for i := 0; i < streams; i++ {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				id := []byte{0}
+				if _, err := io.ReadFull(conn, id); err != nil {
+					results <- err
+					return
+				}
+				want := expected(id[0])
+				got := make([]byte, len(want))
+				if _, err := io.ReadFull(conn, got); err != nil {
+					results <- err
+					return
+				}
+				if !bytes.Equal(want, got) {
+					results <- fmt.Errorf("stream %d received corrupted data", id[0])
+					return
+				}
+				results <- nil
+			}(conn)
+		}
+	}()
+
+	for i := 0; i < streams; i++ {
+		conn, err := d.Dial(dial)
+		require.NoError(t, err)
+		defer conn.Close()
+		go func(conn net.Conn, id byte) {
+			conn.Write([]byte{id})
+			data := expected(id)
+			for j := 0; j < writes; j++ {
+				size := 1 + (j*997)%MaxDataLen
+				if _, err := conn.Write(data[:size]); err != nil {
+					return
+				}
+				data = data[size:]
+			}
+		}(conn, byte(i+1))
+	}
+	for i := 0; i < streams; i++ {
+		select {
+		case err := <-results:
+			assert.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("timed out waiting for streams")
+		}
+	}
+}
+
+func TestReadFull(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hel"))
+	require.NoError(t, err)
+	sc, err := l.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	stream := sc.(Stream)
+
+	// the record arrives in pieces, ReadFull waits for all of them
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.Write([]byte("lo"))
+	}()
+	b := make([]byte, 5)
+	n, err := stream.ReadFull(b)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(b[:n]))
+
+	// records larger than the window still complete
+	data := make([]byte, 2*testWindowSize*MaxDataLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go conn.Write(data)
+	b = make([]byte, len(data))
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err = stream.ReadFull(b)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, data, b)
+
+	// the deadline applies to the whole call
+	_, err = conn.Write([]byte("a"))
+	require.NoError(t, err)
+	sc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err = stream.ReadFull(make([]byte, 2))
+	assert.Equal(t, ErrTimeout, err)
+	assert.Equal(t, 1, n, "should return what was read before the deadline")
+
+	// the stream ending partway through a record is unexpected
+	_, err = conn.Write([]byte("b"))
+	require.NoError(t, err)
+	conn.Close()
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err = stream.ReadFull(make([]byte, 2))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestReadFrames(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	// more than a window's worth, so this only completes if the frames that
+	// ReadFrames delivers get acked
+	data := make([]byte, 3*testWindowSize*MaxDataLen)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go func() {
+		conn.Write(data)
+		conn.Close()
+	}()
+	sc, err := l.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	stream := sc.(Stream)
+	sc.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var received []byte
+	multiple := false
+	const slots = 8
+	for {
+		bufs := make([][]byte, slots)
+		for i := range bufs {
+			bufs[i] = make([]byte, 0, MaxDataLen)
+		}
+		n, err := stream.ReadFrames(bufs)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.True(t, n > 0)
+		if n > 1 {
+			multiple = true
+		}
+		for _, b := range bufs[:n] {
+			assert.True(t, len(b) <= MaxDataLen)
+			received = append(received, b...)
+		}
+	}
+	assert.Equal(t, data, received)
+	assert.True(t, multiple, "should have filled several slots at once at least once")
+}
+
+func TestWriteWhileClosing(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	stream := conn.(Stream)
+	// the server never reads, so once the window is used up, close has to wait
+	// for the linger to expire
+	stream.SetLinger(1)
+	for i := 0; i < testWindowSize+1; i++ {
+		_, err = conn.Write([]byte("a"))
+		require.NoError(t, err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-closed:
+		t.Fatal("close shouldn't have finished flushing yet")
+	default:
+	}
+	start := time.Now()
+	_, err = conn.Write([]byte("b"))
+	assert.Equal(t, ErrStreamClosing, err)
+	assert.True(t, time.Since(start) < 500*time.Millisecond, "write during close shouldn't wait for the flush")
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close didn't finish after linger expired")
+	}
+	_, err = conn.Write([]byte("c"))
+	assert.Equal(t, ErrConnectionClosed, err)
+}
+
+func TestOOB(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, func(opts *DialerOpts) {
+		opts.ProtocolVersion = oobVersion
+	})
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	stream := conn.(Stream)
+	// don't wait to flush the data that the server never reads
+	stream.SetLinger(0)
+	assert.Equal(t, ErrOOBTooLarge, stream.WriteOOB(make([]byte, MaxOOBLen+1)))
+
+	// fill up the window and queue some more behind it
+	go conn.Write(make([]byte, 2*testWindowSize*MaxDataLen))
+	sc, err := l.Accept()
+	require.NoError(t, err)
+	defer sc.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	// out-of-band data gets through even though nobody is reading the
+	// regular data
+	require.NoError(t, stream.WriteOOB([]byte("stop")))
+	require.NoError(t, stream.WriteOOB([]byte("now")))
+	oob := sc.(Stream).ReadOOB()
+	for _, expected := range []string{"stop", "now"} {
+		select {
+		case data := <-oob:
+			assert.Equal(t, expected, string(data))
+		case <-time.After(5 * time.Second):
+			t.Fatal("out-of-band data didn't arrive")
+		}
+	}
+
+	sc.Close()
+	_, open := <-oob
+	assert.False(t, open, "channel should be closed along with the stream")
+}
+
+func TestOOBUnsupported(t *testing.T) {
+	l, d, dial := newTestPair(t, nil, nil)
+	defer l.Close()
+
+	conn, err := d.Dial(dial)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Equal(t, ErrOOBUnsupported, conn.(Stream).WriteOOB([]byte("stop")))
+}
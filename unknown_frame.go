@@ -0,0 +1,32 @@
+package lampshade
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// onUnknownFrame handles an extension frame of a type that we don't know, see
+// "Extension Frames" in the package docs. Frames without the must-understand
+// bit are ignored. Otherwise, the frame's stream is reset, or rejected if it
+// isn't open yet.
+func (s *session) onUnknownFrame(frameType byte, id uint16) {
+	if frameType&frameTypeMustUnderstand == 0 {
+		log.Debugf("%vIgnoring frame of unknown type %d on stream %d", s.logPrefix, frameType, id)
+		return
+	}
+	log.Debugf("%vResetting stream %d because of frame of unknown type %d", s.logPrefix, id, frameType)
+	s.mx.Lock()
+	c := s.streams[id]
+	alreadyClosed := s.closed[id]
+	if c == nil && !alreadyClosed {
+		s.closed[id] = true
+	}
+	s.mx.Unlock()
+	switch {
+	case c != nil:
+		// resetting waits for the RST to be queued, which would block the
+		// recvLoop
+		s.spawn(func() { c.reset(ErrUnknownFrame) })
+	case !alreadyClosed:
+		s.rejectStream(id)
+	}
+}
@@ -12,50 +12,241 @@ func init() {
 	close(immediate)
 }
 
-// window models a flow-control window
+// WindowPolicy decides how the transmit windows of a Session's Streams behave,
+// see Session.SetWindowPolicy. A Stream's window starts out at InitialWindow
+// frames and gains a frame back for every frame that the peer acks. On top of
+// that, Grow can open the window further, but never beyond the window size
+// that was agreed with the peer, since that's all the peer buffers.
+//
+// Implementations must be safe for concurrent use.
+type WindowPolicy interface {
+	// Unlimited reports whether Streams send without waiting for acks at all,
+	// see DialerOpts.UnlimitedWindow.
+	Unlimited() bool
+
+	// InitialWindow returns the transmit window for a new Stream given the full
+	// windowSize. The result is capped at windowSize and raised to at least the
+	// peer's ack interval, since a smaller window would stall.
+	InitialWindow(windowSize int) int
+
+	// Grow returns by how many frames to open a window beyond the acked frames
+	// when the peer acks some. room is how far the window still is from the
+	// full window size, results above it are capped. Grow is also called with
+	// acked == 0 for every open Stream when the policy is switched to.
+	Grow(acked int, room int) int
+}
+
+// FixedWindowPolicy returns a WindowPolicy under which each Stream's window is
+// the full window size from the beginning. This is the default.
+func FixedWindowPolicy() WindowPolicy {
+	return fixedWindowPolicy{}
+}
+
+// SlowStartWindowPolicy returns a WindowPolicy under which new Streams start
+// out with a window of initial frames that grows until it reaches the full
+// window size, see DialerOpts.SlowStartWindow. Switching to it from another
+// policy doesn't shrink the windows of Streams that are already open.
+func SlowStartWindowPolicy(initial int) WindowPolicy {
+	return slowStartWindowPolicy{initial}
+}
+
+// InitialBurstWindowPolicy returns a WindowPolicy under which new Streams send
+// up to burst frames before the first ack and then switch to the full window
+// size, see DialerOpts.InitialBurst. Switching to it from another policy opens
+// the windows of Streams that are already open with the next ack.
+func InitialBurstWindowPolicy(burst int) WindowPolicy {
+	return initialBurstWindowPolicy{burst}
+}
+
+// UnlimitedWindowPolicy returns a WindowPolicy under which Streams never wait
+// for acks, see DialerOpts.UnlimitedWindow. When switching away from it, Streams
+// wait until enough of what they sent has been acked to fit into a window
+// again.
+func UnlimitedWindowPolicy() WindowPolicy {
+	return unlimitedWindowPolicy{}
+}
+
+type fixedWindowPolicy struct{}
+
+func (fixedWindowPolicy) Unlimited() bool                  { return false }
+func (fixedWindowPolicy) InitialWindow(windowSize int) int { return windowSize }
+func (fixedWindowPolicy) Grow(acked int, room int) int     { return room }
+
+// slowStartWindowPolicy grows the window like TCP slow start, by one frame for
+// every frame that's acked, which doubles its size with every round trip.
+type slowStartWindowPolicy struct {
+	initial int
+}
+
+func (p slowStartWindowPolicy) Unlimited() bool                  { return false }
+func (p slowStartWindowPolicy) InitialWindow(windowSize int) int { return p.initial }
+func (p slowStartWindowPolicy) Grow(acked int, room int) int     { return acked }
+
+// initialBurstWindowPolicy opens the window all the way with the first ack.
+type initialBurstWindowPolicy struct {
+	burst int
+}
+
+func (p initialBurstWindowPolicy) Unlimited() bool                  { return false }
+func (p initialBurstWindowPolicy) InitialWindow(windowSize int) int { return p.burst }
+func (p initialBurstWindowPolicy) Grow(acked int, room int) int {
+	if acked > 0 {
+		return room
+	}
+	return 0
+}
+
+type unlimitedWindowPolicy struct{}
+
+func (unlimitedWindowPolicy) Unlimited() bool                  { return true }
+func (unlimitedWindowPolicy) InitialWindow(windowSize int) int { return windowSize }
+func (unlimitedWindowPolicy) Grow(acked int, room int) int     { return room }
+
+// windowPolicyFor maps the UnlimitedWindow, SlowStartWindow and InitialBurst
+// options onto a WindowPolicy, unless policy is already set.
+func windowPolicyFor(policy WindowPolicy, unlimited bool, slowStart int, initialBurst int) WindowPolicy {
+	switch {
+	case policy != nil:
+		return policy
+	case unlimited:
+		return UnlimitedWindowPolicy()
+	case slowStart > 0:
+		return SlowStartWindowPolicy(slowStart)
+	case initialBurst > 0:
+		return InitialBurstWindowPolicy(initialBurst)
+	default:
+		return FixedWindowPolicy()
+	}
+}
+
+// window models a flow-control window whose behavior is determined by a
+// WindowPolicy, which may change while the window is in use. The size is
+// tracked even while the policy is unlimited and nothing waits for it, so that
+// switching to a limited policy picks up where things actually are.
 type window struct {
+	policy        func() WindowPolicy
 	size          int
+	growth        int  // how much the window can still grow up to the full window size
+	waiting       bool // whether sub returned positiveAgain and nobody signaled it yet
 	positiveAgain chan bool
 	closeCh       chan bool
 	closed        bool
 	mx            sync.Mutex
 }
 
-func newWindow(initial int) *window {
+// newPolicyWindow creates a window of up to windowSize frames that follows
+// whatever policy returns.
+func newPolicyWindow(windowSize int, policy func() WindowPolicy) *window {
+	initial := policy().InitialWindow(windowSize)
+	// the peer only acks every ackInterval frames, so starting any smaller
+	// would stall
+	if ackInterval := ackIntervalFor(windowSize); initial < ackInterval {
+		initial = ackInterval
+	}
+	if initial > windowSize {
+		initial = windowSize
+	}
 	return &window{
+		policy:        policy,
 		size:          initial,
+		growth:        windowSize - initial,
 		positiveAgain: make(chan bool),
 		closeCh:       make(chan bool),
 	}
 }
 
+// newSlowStartWindow creates a standalone slow start window.
+func newSlowStartWindow(initial int, max int) *window {
+	policy := SlowStartWindowPolicy(initial)
+	return newPolicyWindow(max, func() WindowPolicy { return policy })
+}
+
+// available returns the current size of the window, which is always 0 for
+// unlimited windows.
+func (w *window) available() int {
+	if w.policy().Unlimited() {
+		return 0
+	}
+	w.mx.Lock()
+	defer w.mx.Unlock()
+	return w.size
+}
+
 // add adds to the window
 func (w *window) add(delta int) {
 	w.mx.Lock()
-	wasNegative := w.size < 0
+	if w.growth > 0 && delta > 0 {
+		w.grow(delta)
+	}
 	w.size += delta
-	isNegative := w.size < 0
-	shouldSignal := wasNegative && !isNegative
+	w.signalIfPositive()
+}
+
+// grow applies the policy's growth for acked frames. Must be called with w.mx
+// held.
+func (w *window) grow(acked int) {
+	extra := w.policy().Grow(acked, w.growth)
+	if extra > w.growth {
+		extra = w.growth
+	}
+	if extra > 0 {
+		w.growth -= extra
+		w.size += extra
+	}
+}
+
+// signalIfPositive unlocks w.mx and then wakes up whoever is waiting on sub
+// if the window isn't negative anymore.
+func (w *window) signalIfPositive() {
+	shouldSignal := w.waiting && w.size >= 0
+	if shouldSignal {
+		w.waiting = false
+	}
 	w.mx.Unlock()
 	if shouldSignal {
-		select {
-		case w.positiveAgain <- true:
-			// ok
-		case <-w.closeCh:
-			// nobody waiting anymore
-		}
+		w.signal()
+	}
+}
+
+func (w *window) signal() {
+	select {
+	case w.positiveAgain <- true:
+		// ok
+	case <-w.closeCh:
+		// nobody waiting anymore
 	}
 }
 
+// policyChanged applies a newly set policy to the window. If the window became
+// unlimited, whoever is waiting for it may go ahead.
+func (w *window) policyChanged() {
+	policy := w.policy()
+	w.mx.Lock()
+	if w.growth > 0 {
+		w.grow(0)
+	}
+	if policy.Unlimited() && w.waiting {
+		w.waiting = false
+		w.mx.Unlock()
+		w.signal()
+		return
+	}
+	w.signalIfPositive()
+}
+
 // sub subtracts from the window and returns a channel that blocks until the
 // window is large enough to subtract the given delta while still leaving a
 // non-zero window size.
 func (w *window) sub(delta int) chan bool {
+	unlimited := w.policy().Unlimited()
 	w.mx.Lock()
 	w.size -= delta
 	isNegative := w.size < 0
+	if isNegative && !unlimited {
+		w.waiting = true
+	}
 	w.mx.Unlock()
-	if !isNegative {
+	if !isNegative || unlimited {
 		return immediate
 	}
 	return w.positiveAgain
@@ -0,0 +1,98 @@
+package lampshade
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSlowStartWindow(t *testing.T) {
+	w := newSlowStartWindow(2, 10)
+	assert.Equal(t, immediate, w.sub(2), "should be able to use initial window")
+
+	// each acked frame grows the window by another frame
+	w.add(1)
+	assert.Equal(t, 2, w.size)
+	w.add(4)
+	assert.Equal(t, 10, w.size)
+
+	// until the maximum is reached
+	w.add(5)
+	assert.Equal(t, 18, w.size)
+	assert.Zero(t, w.growth)
+	w.add(2)
+	assert.Equal(t, 20, w.size)
+
+	assert.Equal(t, 10, newSlowStartWindow(20, 10).size, "initial window shouldn't exceed maximum")
+}
+
+func TestInitialBurstWindow(t *testing.T) {
+	policy := InitialBurstWindowPolicy(3)
+	w := newPolicyWindow(10, func() WindowPolicy { return policy })
+	assert.Equal(t, immediate, w.sub(3), "should be able to send the initial burst")
+	waiting := w.sub(1)
+	assert.NotEqual(t, immediate, waiting, "should wait for the first ack after the burst")
+
+	// the first ack opens the window all the way
+	go w.add(1)
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting frame wasn't released")
+	}
+	assert.Equal(t, 7, w.available())
+	assert.Zero(t, w.growth)
+
+	w = newPolicyWindow(100, func() WindowPolicy { return InitialBurstWindowPolicy(1) })
+	assert.Equal(t, 10, w.available(), "burst shouldn't be less than the ack interval")
+	assert.Equal(t, InitialBurstWindowPolicy(5), windowPolicyFor(nil, false, 0, 5))
+	assert.Equal(t, SlowStartWindowPolicy(2), windowPolicyFor(nil, false, 2, 5), "slow start should take precedence")
+}
+
+func TestSwitchWindowPolicy(t *testing.T) {
+	policy := FixedWindowPolicy()
+	w := newPolicyWindow(2, func() WindowPolicy { return policy })
+	assert.Equal(t, immediate, w.sub(2))
+	waiting := w.sub(1)
+	assert.NotEqual(t, immediate, waiting, "window should be exhausted")
+
+	// switching to unlimited lets the waiting frame go
+	policy = UnlimitedWindowPolicy()
+	go w.policyChanged()
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting frame wasn't released")
+	}
+	assert.Equal(t, immediate, w.sub(5))
+	assert.Zero(t, w.available())
+
+	// switching back waits for everything sent in the meantime to be acked
+	policy = FixedWindowPolicy()
+	w.policyChanged()
+	assert.Equal(t, -6, w.available())
+	waiting = w.sub(1)
+	assert.NotEqual(t, immediate, waiting)
+	w.add(6)
+	select {
+	case <-waiting:
+		t.Fatal("window shouldn't have opened yet")
+	default:
+	}
+	go w.add(1)
+	select {
+	case <-waiting:
+	case <-time.After(5 * time.Second):
+		t.Fatal("window didn't open")
+	}
+
+	// switching from slow start to fixed opens the window all the way
+	policy = SlowStartWindowPolicy(2)
+	w = newPolicyWindow(10, func() WindowPolicy { return policy })
+	assert.Equal(t, 2, w.available())
+	policy = FixedWindowPolicy()
+	w.policyChanged()
+	assert.Equal(t, 10, w.available())
+	assert.Zero(t, w.growth)
+}